@@ -19,6 +19,113 @@ func InitSchema(db *sql.DB) error {
 
 	CREATE INDEX IF NOT EXISTS idx_user_tokens_token ON user_tokens(token);
 	CREATE INDEX IF NOT EXISTS idx_user_tokens_email ON user_tokens(email);
+
+	CREATE TABLE IF NOT EXISTS jobs (
+		object_id TEXT PRIMARY KEY,
+		status VARCHAR(32) NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		dimension INTEGER NOT NULL DEFAULT 0,
+		triples JSONB,
+		has_result BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS documents (
+		id TEXT PRIMARY KEY,
+		object_id TEXT NOT NULL REFERENCES jobs(object_id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		content TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_documents_object_id ON documents(object_id);
+
+	CREATE TABLE IF NOT EXISTS embeddings (
+		id BIGSERIAL PRIMARY KEY,
+		object_id TEXT NOT NULL REFERENCES jobs(object_id) ON DELETE CASCADE,
+		document_id TEXT NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		start_offset INTEGER NOT NULL,
+		end_offset INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		vector DOUBLE PRECISION[] NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_embeddings_object_id ON embeddings(object_id);
+
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error_stage TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error_file TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS failures JSONB;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS progress JSONB;
+	ALTER TABLE jobs DROP COLUMN IF EXISTS eta;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS files JSONB;
+
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS result_bytes BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS updating BOOLEAN NOT NULL DEFAULT FALSE;
+
+	CREATE INDEX IF NOT EXISTS idx_jobs_owner_created ON jobs(owner, created_at DESC, object_id DESC);
+
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS callback_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS callback_secret TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		object_id TEXT NOT NULL REFERENCES jobs(object_id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		url TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		delivered BOOLEAN NOT NULL DEFAULT FALSE,
+		attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_object_id ON webhook_deliveries(object_id);
+
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS content_hash TEXT NOT NULL DEFAULT '';
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		owner TEXT NOT NULL,
+		key TEXT NOT NULL,
+		payload_hash TEXT NOT NULL,
+		object_id TEXT NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (owner, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+	ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response JSONB;
+
+	CREATE TABLE IF NOT EXISTS job_checkpoints (
+		object_id TEXT PRIMARY KEY REFERENCES jobs(object_id) ON DELETE CASCADE,
+		spec BYTEA NOT NULL,
+		saved_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+
+	CREATE TABLE IF NOT EXISTS embedding_cache (
+		key TEXT PRIMARY KEY,
+		model TEXT NOT NULL,
+		vector DOUBLE PRECISION[] NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	ALTER TABLE embedding_cache ADD COLUMN IF NOT EXISTS last_used TIMESTAMPTZ NOT NULL DEFAULT NOW();
+	CREATE INDEX IF NOT EXISTS idx_embedding_cache_last_used ON embedding_cache(last_used);
+
+	ALTER TABLE embeddings ADD COLUMN IF NOT EXISTS section TEXT NOT NULL DEFAULT '';
+
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS author TEXT NOT NULL DEFAULT '';
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS created TIMESTAMPTZ;
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS pages INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE embeddings ADD COLUMN IF NOT EXISTS page INTEGER NOT NULL DEFAULT 0;
 	`
 	res, err := db.Exec(schema)
 	if err != nil {
@@ -2,6 +2,7 @@ package chromadb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -136,7 +137,90 @@ func UpdateCollection(req ReqParams, payload Payload) (int, error) {
 	return res.StatusCode, nil
 }
 
-func ListCollections(req ReqParams, query_text []string) (int, error, *ChromaQueryResponse) {
+// UpsertCollection adds records to an existing ChromaDB collection, replacing
+// records that already exist under the same IDs.
+//
+// Endpoint:
+//
+//	POST /api/v2/tenants/{tenant}/databases/{database}/collections/{collection_id}/upsert
+//
+// Parameters:
+//   - req: Contains connection details for ChromaDB
+//   - payload: Records to add or replace
+//
+// Returns:
+//   - 200 OK if operation succeeds
+//   - Error and HTTP status code if marshaling or HTTP request fails
+func UpsertCollection(req ReqParams, payload Payload) (int, error) {
+	url := fmt.Sprintf("http://%s:%d/api/v2/tenants/%s/databases/%s/collections/%s/upsert",
+		req.Host,
+		req.Port,
+		req.Tenant,
+		req.Database,
+		req.Collection_id,
+	)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	res, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("upsert failed: %s", string(respBody))
+	}
+
+	return res.StatusCode, nil
+}
+
+// DeleteRecords removes the records of a ChromaDB collection whose metadata
+// matches where, e.g. {"filename": {"$eq": "a.txt"}}.
+//
+// Endpoint:
+//
+//	POST /api/v2/tenants/{tenant}/databases/{database}/collections/{collection_id}/delete
+//
+// Returns:
+//   - 200 OK if operation succeeds
+//   - Error and HTTP status code if marshaling or HTTP request fails
+func DeleteRecords(req ReqParams, where map[string]any) (int, error) {
+	url := fmt.Sprintf("http://%s:%d/api/v2/tenants/%s/databases/%s/collections/%s/delete",
+		req.Host,
+		req.Port,
+		req.Tenant,
+		req.Database,
+		req.Collection_id,
+	)
+
+	body, err := json.Marshal(map[string]any{"where": where})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to marshal filter: %w", err)
+	}
+
+	res, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("delete failed: %s", string(respBody))
+	}
+
+	return res.StatusCode, nil
+}
+
+// ListCollections queries a ChromaDB collection with the embeddings of
+// query_text. embedder should be the one the collection was built with; nil
+// uses pipeline.DefaultEmbedder.
+func ListCollections(req ReqParams, embedder pipeline.Embedder, query_text []string) (int, error, *ChromaQueryResponse) {
 	url := fmt.Sprintf("http://%s:%d/api/v2/tenants/%s/databases/%s/collections/%s/query",
 		req.Host,
 		req.Port,
@@ -145,12 +229,12 @@ func ListCollections(req ReqParams, query_text []string) (int, error, *ChromaQue
 		req.Collection_id,
 	)
 
-	//for test
-	query_embeddings, err := pipeline.EmbeddingFn(query_text)
+	if embedder == nil {
+		embedder = pipeline.DefaultEmbedder
+	}
+	query_embeddings, err := embedder.Embed(context.Background(), query_text)
 	slog.Debug("query embeddings", slog.Any("query_text", query_text), slog.Any("embedding_dim", len(query_embeddings)))
 
-	//for production
-	// query_embeddings, err := pipeline.EmbeddingsAPI(query_text)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("embedding failed: %s", err), nil
 	}
@@ -1,11 +1,13 @@
 package chromadb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	"github.com/abdulahshoaib/quirk/pipeline"
@@ -192,15 +194,23 @@ func TestUpdateCollection(t *testing.T) {
 	}
 }
 
+type stubEmbedder func(texts []string) ([][]float64, error)
+
+func (s stubEmbedder) Model() string  { return "stub" }
+func (s stubEmbedder) Dimension() int { return 0 }
+func (s stubEmbedder) Embed(_ context.Context, texts []string) ([][]float64, error) {
+	return s(texts)
+}
+
 func TestListCollections(t *testing.T) {
-	// Backup and restore EmbeddingFn
-	original := pipeline.EmbeddingFn
-	defer func() { pipeline.EmbeddingFn = original }()
+	// Backup and restore DefaultEmbedder
+	original := pipeline.DefaultEmbedder
+	defer func() { pipeline.DefaultEmbedder = original }()
 
 	t.Run("success", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(texts []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(texts []string) ([][]float64, error) {
 			return [][]float64{{0.1, 0.2, 0.3}}, nil
-		}
+		})
 
 		mockResponse := ChromaQueryResponse{
 			Documents: [][]string{{"doc1"}},
@@ -223,40 +233,67 @@ func TestListCollections(t *testing.T) {
 			Collection_id: "c",
 		}
 
-		code, err, parsed := ListCollections(req, []string{"test query"})
+		code, err, parsed := ListCollections(req, nil, []string{"test query"})
 		if err != nil || code != http.StatusOK || parsed == nil || len(parsed.Documents) != 1 {
 			t.Errorf("expected success, got code=%d, err=%v", code, err)
 		}
 	})
 
+	t.Run("given embedder", func(t *testing.T) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
+			return nil, fmt.Errorf("default embedder used")
+		})
+
+		var received map[string]any
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&received)
+			json.NewEncoder(w).Encode(ChromaQueryResponse{})
+		}))
+		defer server.Close()
+
+		addr := server.Listener.Addr().(*net.TCPAddr)
+		req := ReqParams{Host: addr.IP.String(), Port: addr.Port, Tenant: "t", Database: "d", Collection_id: "c"}
+		embedder := stubEmbedder(func(_ []string) ([][]float64, error) {
+			return [][]float64{{0.4, 0.5}}, nil
+		})
+
+		code, err, _ := ListCollections(req, embedder, []string{"test query"})
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("expected success, got code=%d, err=%v", code, err)
+		}
+		if !reflect.DeepEqual(received["query_embeddings"], []any{[]any{0.4, 0.5}}) {
+			t.Errorf("expected the given embedder's vectors, got %v", received["query_embeddings"])
+		}
+	})
+
 	t.Run("embedding API fails", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(_ []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
 			return nil, fmt.Errorf("embedding error")
-		}
+		})
 
 		req := ReqParams{}
-		code, err, parsed := ListCollections(req, []string{"fail"})
+		code, err, parsed := ListCollections(req, nil, []string{"fail"})
 		if err == nil || code != http.StatusInternalServerError || parsed != nil {
 			t.Errorf("expected embedding failure, got code=%d, err=%v", code, err)
 		}
 	})
 
 	t.Run("empty embeddings", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(_ []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
 			return [][]float64{}, nil
-		}
+		})
 
 		req := ReqParams{}
-		code, err, parsed := ListCollections(req, []string{"empty"})
+		code, err, parsed := ListCollections(req, nil, []string{"empty"})
 		if err == nil || code != http.StatusBadRequest || parsed != nil {
 			t.Errorf("expected empty embedding error, got code=%d, err=%v", code, err)
 		}
 	})
 
 	t.Run("http post fails", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(_ []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
 			return [][]float64{{0.1}}, nil
-		}
+		})
 
 		req := ReqParams{
 			Host:          "127.0.0.1",
@@ -266,16 +303,16 @@ func TestListCollections(t *testing.T) {
 			Collection_id: "c",
 		}
 
-		code, err, parsed := ListCollections(req, []string{"fail"})
+		code, err, parsed := ListCollections(req, nil, []string{"fail"})
 		if err == nil || code != http.StatusInternalServerError || parsed != nil {
 			t.Errorf("expected http post failure, got code=%d, err=%v", code, err)
 		}
 	})
 
 	t.Run("http returns error status", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(_ []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
 			return [][]float64{{0.1}}, nil
-		}
+		})
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "server error", http.StatusInternalServerError)
@@ -291,16 +328,16 @@ func TestListCollections(t *testing.T) {
 			Collection_id: "c",
 		}
 
-		code, err, parsed := ListCollections(req, []string{"fail"})
+		code, err, parsed := ListCollections(req, nil, []string{"fail"})
 		if err == nil || code != http.StatusInternalServerError || parsed != nil {
 			t.Errorf("expected server error, got code=%d, err=%v", code, err)
 		}
 	})
 
 	t.Run("invalid JSON response", func(t *testing.T) {
-		pipeline.EmbeddingFn = func(_ []string) ([][]float64, error) {
+		pipeline.DefaultEmbedder = stubEmbedder(func(_ []string) ([][]float64, error) {
 			return [][]float64{{0.1}}, nil
-		}
+		})
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "not a json")
@@ -316,9 +353,64 @@ func TestListCollections(t *testing.T) {
 			Collection_id: "c",
 		}
 
-		code, err, parsed := ListCollections(req, []string{"fail"})
+		code, err, parsed := ListCollections(req, nil, []string{"fail"})
 		if err == nil || code != http.StatusInternalServerError || parsed != nil {
 			t.Errorf("expected JSON unmarshal error, got code=%d, err=%v", code, err)
 		}
 	})
 }
+
+func TestUpsertCollection(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	req := ReqParams{
+		Host:          server.Listener.Addr().(*net.TCPAddr).IP.String(),
+		Port:          server.Listener.Addr().(*net.TCPAddr).Port,
+		Tenant:        "t",
+		Database:      "d",
+		Collection_id: "c",
+	}
+
+	code, err := UpsertCollection(req, Payload{IDs: []string{"id1"}, Documents: []string{"text"}})
+	if err != nil || code != http.StatusOK {
+		t.Errorf("UpsertCollection failed: code=%d, err=%v", code, err)
+	}
+	if path != "/api/v2/tenants/t/databases/d/collections/c/upsert" {
+		t.Errorf("unexpected path %s", path)
+	}
+}
+
+func TestDeleteRecords(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		if r.URL.Path != "/api/v2/tenants/t/databases/d/collections/c/delete" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	req := ReqParams{
+		Host:          server.Listener.Addr().(*net.TCPAddr).IP.String(),
+		Port:          server.Listener.Addr().(*net.TCPAddr).Port,
+		Tenant:        "t",
+		Database:      "d",
+		Collection_id: "c",
+	}
+
+	code, err := DeleteRecords(req, map[string]any{"filename": map[string]any{"$eq": "a.txt"}})
+	if err != nil || code != http.StatusOK {
+		t.Errorf("DeleteRecords failed: code=%d, err=%v", code, err)
+	}
+	want := map[string]any{"where": map[string]any{"filename": map[string]any{"$eq": "a.txt"}}}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("unexpected body %v", received)
+	}
+}
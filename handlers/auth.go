@@ -110,3 +110,18 @@ func AuthenticateJWT(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
+
+// AuthenticateStream is AuthenticateJWT for event stream routes. EventSource
+// cannot set headers, so an event stream request may pass the token as the
+// access_token query parameter instead; other routes only take the header.
+func AuthenticateStream(next http.HandlerFunc) http.HandlerFunc {
+	authenticate := AuthenticateJWT(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+		if r.Header.Get("Authorization") == "" && token != "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		authenticate(w, r)
+	}
+}
@@ -111,3 +111,35 @@ func TestAuthenticateJWT_TokenNotInDB(t *testing.T) {
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.Contains(t, w.Body.String(), "Invalid token")
 }
+
+func TestAuthenticateStream_QueryToken(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer mockDB.Close()
+	Db = mockDB
+
+	tokenStr, err := generateValidToken("test@example.com")
+	assert.NoError(t, err)
+
+	mock.ExpectQuery(`SELECT token FROM user_tokens WHERE email = \$1`).
+		WithArgs("test@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"token"}).AddRow(tokenStr))
+
+	req := httptest.NewRequest(http.MethodGet, "/status/stream?access_token="+tokenStr, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+
+	AuthenticateStream(dummyHandler).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Authenticated: test@example.com")
+
+	// other routes need the header, even when asking for an event stream
+	req = httptest.NewRequest(http.MethodGet, "/status?access_token="+tokenStr, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+
+	AuthenticateJWT(dummyHandler).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
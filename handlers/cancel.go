@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// HandleCancelJob cancels a queued or running job.
+//
+// DELETE /jobs/{object_id}
+//
+// Parameters:
+//   - object_id (required): The unique identifier of the job
+//
+// Returns:
+//   - 200: The job was cancelled before it finished
+//   - 202: The job is running; it stops at the next file or embedding batch
+//     and /status reports cancelled once it has
+//   - 404: Job not found or owned by another user
+//   - 405: Method is not DELETE
+//   - 409: The job already finished, or a worker on another instance started
+//     it before the cancel took effect
+//   - 500: The job store could not be read or updated
+//
+// Whatever a cancelled job produced is discarded; /result answers 410.
+//
+// Example response:
+//
+//	{"object_id": "4c1d...", "status": "cancelled"}
+func HandleCancelJob(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if r.Method != http.MethodDelete {
+		slog.Error("invalid method", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.PathValue("object_id")
+	status, ok := authorizeJob(w, r, id)
+	if !ok {
+		return
+	}
+
+	if finished(status.Status) {
+		slog.Warn("cancel requested for finished job", slog.String("object_id", id), slog.String("status", status.Status))
+		http.Error(w, "Job already "+status.Status, http.StatusConflict)
+		return
+	}
+
+	waiting, running := Queue.Cancel(id)
+	if running {
+		// the worker marks the job cancelled once the pipeline has stopped
+		slog.Info("cancelling running job", slog.String("object_id", id))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"object_id": id, "status": "cancelling"})
+		return
+	}
+
+	if !waiting {
+		// not held by this instance: another one may start it at any moment,
+		// and only that one can stop it then. A job still queued there is
+		// skipped once it is dequeued.
+		current, ok, err := Jobs.GetStatus(id)
+		if err != nil {
+			slog.Error("failed to load job status", slog.String("object_id", id), slog.Any("error", err))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			status = current
+		}
+	}
+
+	// an update that is cancelled leaves the job with its previous result
+	update := status.Updating
+	if update {
+		status = restoredStatus(status)
+	} else {
+		status.Status = StatusCancelled
+	}
+	// only wins if no worker has picked the job up in the meantime
+	cancelled, err := Jobs.TransitionStatus(id, StatusQueued, status)
+	if err != nil {
+		slog.Error("failed to update job status", slog.String("object_id", id), slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		current, _, _ := Jobs.GetStatus(id)
+		slog.Warn("cancel requested for job started elsewhere", slog.String("object_id", id), slog.String("status", current.Status))
+		http.Error(w, "Job is "+current.Status+" and can no longer be cancelled here", http.StatusConflict)
+		return
+	}
+	slog.Info("job cancelled", slog.String("object_id", id), slog.Bool("update", update))
+	if !update {
+		notifyFinished(id, ResultSummary{})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"object_id": id, "status": status.Status})
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// jobSpec is everything needed to run a queued job. It is stored as a
+// checkpoint when a shutdown interrupts the job, so that ResumeJobs can
+// queue it again on the next start. Provider and Triples are the names given
+// to /process; empty means the defaults. Skipped are the files of uploaded
+// archives that no converter claims; they are reported among the job's
+// failures.
+type jobSpec struct {
+	Owner    string                `json:"owner"`
+	Sources  []pipeline.Source     `json:"sources"`
+	Chunking pipeline.ChunkOptions `json:"chunking"`
+	Select   []string              `json:"select,omitempty"`
+	Provider string                `json:"provider,omitempty"`
+	Triples  string                `json:"triples,omitempty"`
+	TTL      time.Duration         `json:"ttl,omitempty"`
+	Update   *jobUpdate            `json:"update,omitempty"`
+	Skipped  []pipeline.StageError `json:"skipped,omitempty"`
+}
+
+// options builds the pipeline options the job was submitted with.
+func (spec jobSpec) options() (pipeline.ProcessOptions, error) {
+	opts := pipeline.ProcessOptions{
+		Chunking:  spec.Chunking,
+		Select:    spec.Select,
+		Embedder:  pipeline.DefaultEmbedder,
+		Extractor: pipeline.DefaultExtractor,
+		Progress:  reportProgress,
+	}
+	var err error
+	if spec.Provider != "" {
+		if opts.Embedder, err = pipeline.NewEmbedder(spec.Provider); err != nil {
+			return opts, fmt.Errorf("provider: %w", err)
+		}
+	}
+	if spec.Triples != "" {
+		if opts.Extractor, err = pipeline.NewExtractor(spec.Triples); err != nil {
+			return opts, fmt.Errorf("triples: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// checkpointJob saves an interrupted job and puts it back in the queued
+// state; an interrupted update shows its previous result meanwhile.
+func checkpointJob(id string, spec jobSpec) {
+	data, err := json.Marshal(spec)
+	if err == nil {
+		err = Jobs.SaveCheckpoint(id, data)
+	}
+	if err != nil {
+		slog.Error("failed to checkpoint job", slog.String("object_id", id), slog.Any("error", err))
+		Jobs.SetStatus(id, JobStatus{
+			Status: StatusFailed,
+			Error:  &pipeline.StageError{Stage: StageQueue, Message: "interrupted by shutdown"},
+		})
+		return
+	}
+
+	status := JobStatus{Status: StatusQueued}
+	if spec.Update != nil {
+		status = spec.Update.Previous
+		status.Status = StatusQueued
+		status.Files = spec.Update.files()
+		status.StartedAt = time.Time{}
+		status.Progress = pipeline.Progress{}
+		status.Updating = true
+	}
+	if err := Jobs.SetStatus(id, status); err != nil {
+		slog.Error("failed to update job status", slog.String("object_id", id), slog.Any("error", err))
+	}
+	slog.Info("job checkpointed", slog.String("object_id", id))
+}
+
+// ResumeJobs queues again the jobs checkpointed by the last shutdown, oldest
+// first. A job that can no longer be queued fails. It returns how many jobs
+// were resumed.
+func ResumeJobs(store JobStore, queue *JobQueue) (int, error) {
+	checkpoints, err := store.TakeCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+
+	resumed := 0
+	for _, c := range checkpoints {
+		var spec jobSpec
+		err := json.Unmarshal(c.Spec, &spec)
+		var opts pipeline.ProcessOptions
+		if err == nil {
+			opts, err = spec.options()
+		}
+		if err == nil {
+			id := c.ID
+			err = queue.Enqueue(id, spec.Owner, spec.Sources, func(ctx context.Context) {
+				runJob(ctx, id, spec, opts)
+			})
+		}
+		if err != nil {
+			slog.Error("failed to resume job", slog.String("object_id", c.ID), slog.Any("error", err))
+			failed := JobStatus{
+				Status: StatusFailed,
+				Error:  &pipeline.StageError{Stage: StageQueue, Message: "could not be resumed: " + err.Error()},
+			}
+			if spec.Update != nil {
+				failed = restoredStatus(spec.Update.Previous)
+			}
+			store.SetStatus(c.ID, failed)
+			removeSources(spec.Sources)
+			continue
+		}
+		resumed++
+	}
+	return resumed, nil
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown_CheckpointsAndResumes(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+
+	sources := []pipeline.Source{{Filename: "a.txt", ContentType: "text/plain", Content: []byte("Some text.")}}
+	spec := jobSpec{Owner: "alice", Sources: sources, Chunking: pipeline.DefaultChunkOptions}
+
+	// one job is interrupted while embedding, the other never starts
+	embedder := blockingEmbedder{started: make(chan struct{})}
+	opts := pipeline.ProcessOptions{Chunking: pipeline.DefaultChunkOptions, Embedder: embedder}
+	for _, id := range []string{"checkpoint-running", "checkpoint-waiting"} {
+		Jobs.SetStatus(id, JobStatus{Status: StatusQueued, Owner: "alice"})
+		require.NoError(t, Queue.Enqueue(id, "alice", nil, func(ctx context.Context) {
+			runJob(ctx, id, spec, opts)
+		}))
+	}
+	<-embedder.started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	Queue.Shutdown(ctx)
+
+	for _, id := range []string{"checkpoint-running", "checkpoint-waiting"} {
+		status, _, _ := Jobs.GetStatus(id)
+		assert.Equal(t, StatusQueued, status.Status, id)
+		assert.Equal(t, "alice", status.Owner)
+	}
+
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+	resumed, err := ResumeJobs(Jobs, Queue)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resumed)
+
+	for _, id := range []string{"checkpoint-running", "checkpoint-waiting"} {
+		assert.Equal(t, StatusCompleted, waitFinished(t, id).Status, id)
+	}
+	// checkpoints are only resumed once
+	resumed, err = ResumeJobs(Jobs, Queue)
+	require.NoError(t, err)
+	assert.Zero(t, resumed)
+}
+
+func TestResumeJobs_Update(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+
+	id := submit(t, processRequest(t, "/process", [][2]string{{"a.txt", "Alpha text."}}, nil))["object_id"].(string)
+	require.Equal(t, StatusCompleted, waitFinished(t, id).Status)
+	previous, _, _ := Jobs.GetStatus(id)
+	base, _, _ := Jobs.GetResult(id)
+
+	plan, changed, err := planUpdate(base, []pipeline.Source{
+		{ID: "b", Filename: "b.txt", ContentType: "text/plain", Content: []byte("Beta text."), Hash: "hb"},
+	}, nil)
+	require.NoError(t, err)
+	plan.Previous = previous
+	checkpointJob(id, jobSpec{Sources: changed, Chunking: pipeline.DefaultChunkOptions, Update: &plan})
+
+	// the previous result is served until the update is resumed
+	status, _, _ := Jobs.GetStatus(id)
+	assert.Equal(t, StatusQueued, status.Status)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, status.Files)
+	assert.Equal(t, previous.ResultBytes, status.ResultBytes)
+
+	resumed, err := ResumeJobs(Jobs, Queue)
+	require.NoError(t, err)
+	assert.Equal(t, 1, resumed)
+	assert.Equal(t, StatusCompleted, waitFinished(t, id).Status)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, resultFiles(t, id))
+}
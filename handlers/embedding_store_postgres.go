@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresEmbeddingStore is the shared tier of the embedding cache, kept in
+// the embedding_cache table created by InitSchema. Reads mark vectors as
+// used, to the hour; PurgeEmbeddings drops those that have not been used
+// for a while.
+type PostgresEmbeddingStore struct {
+	db *sql.DB
+}
+
+func NewPostgresEmbeddingStore(db *sql.DB) *PostgresEmbeddingStore {
+	return &PostgresEmbeddingStore{db: db}
+}
+
+// rows per INSERT, well below the 65535 parameters Postgres allows
+const cacheInsertRows = 1000
+
+func (s *PostgresEmbeddingStore) GetEmbeddings(keys []string) (map[string][]float64, error) {
+	// last_used only needs to be as precise as the cache TTL, so hot vectors
+	// are rewritten once an hour rather than on every read
+	rows, err := s.db.Query(`
+		WITH touched AS (
+			UPDATE embedding_cache SET last_used = NOW()
+			WHERE key = ANY($1) AND last_used < NOW() - INTERVAL '1 hour'
+		)
+		SELECT key, vector FROM embedding_cache
+		WHERE key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cached embeddings: %w", err)
+	}
+	defer rows.Close()
+
+	vectors := make(map[string][]float64, len(keys))
+	for rows.Next() {
+		var (
+			key    string
+			vector []float64
+		)
+		if err := rows.Scan(&key, pq.Array(&vector)); err != nil {
+			return nil, fmt.Errorf("failed to scan cached embedding: %w", err)
+		}
+		vectors[key] = vector
+	}
+	return vectors, rows.Err()
+}
+
+func (s *PostgresEmbeddingStore) PutEmbeddings(model string, vectors map[string][]float64) error {
+	keys := slices.Sorted(maps.Keys(vectors))
+	for batch := range slices.Chunk(keys, cacheInsertRows) {
+		var values strings.Builder
+		args := []any{model}
+		for i, key := range batch {
+			if i > 0 {
+				values.WriteString(", ")
+			}
+			fmt.Fprintf(&values, "($%d, $1, $%d)", len(args)+1, len(args)+2)
+			args = append(args, key, pq.Array(vectors[key]))
+		}
+		_, err := s.db.Exec(`
+			INSERT INTO embedding_cache (key, model, vector)
+			VALUES `+values.String()+`
+			ON CONFLICT (key) DO NOTHING`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to cache embeddings: %w", err)
+		}
+	}
+	return nil
+}
+
+// PurgeEmbeddings drops the vectors last used before unusedSince, then the
+// least recently used beyond maxRows. Zero values do not purge.
+func (s *PostgresEmbeddingStore) PurgeEmbeddings(unusedSince time.Time, maxRows int) (int, error) {
+	purged := int64(0)
+	if !unusedSince.IsZero() {
+		res, err := s.db.Exec(`DELETE FROM embedding_cache WHERE last_used < $1`, unusedSince)
+		if err != nil {
+			return 0, fmt.Errorf("failed to purge unused embeddings: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+	if maxRows > 0 {
+		res, err := s.db.Exec(`
+			DELETE FROM embedding_cache WHERE key IN (
+				SELECT key FROM embedding_cache
+				ORDER BY last_used DESC
+				OFFSET $1)`, maxRows)
+		if err != nil {
+			return int(purged), fmt.Errorf("failed to purge embeddings over the cap: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+	return int(purged), nil
+}
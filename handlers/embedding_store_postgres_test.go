@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresEmbeddingStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// one statement for all vectors
+	mock.ExpectExec(`INSERT INTO embedding_cache \(key, model, vector\)\s+VALUES \(\$2, \$1, \$3\), \(\$4, \$1, \$5\)`).
+		WithArgs("model", "k1", pq.Array([]float64{0.1, 0.2}), "k2", pq.Array([]float64{0.3, 0.4})).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("UPDATE embedding_cache SET last_used = NOW\\(\\)\\s+WHERE key = ANY\\(\\$1\\) AND last_used < NOW\\(\\) - INTERVAL '1 hour'\\s+\\)\\s+SELECT key, vector FROM embedding_cache").
+		WithArgs(pq.Array([]string{"k1", "k3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "vector"}).AddRow("k1", "{0.1,0.2}"))
+
+	store := NewPostgresEmbeddingStore(db)
+	require.NoError(t, store.PutEmbeddings("model", map[string][]float64{"k2": {0.3, 0.4}, "k1": {0.1, 0.2}}))
+
+	vectors, err := store.GetEmbeddings([]string{"k1", "k3"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]float64{"k1": {0.1, 0.2}}, vectors)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresEmbeddingStore_Purge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	cutoff := time.Now().Add(-time.Hour)
+	mock.ExpectExec("DELETE FROM embedding_cache WHERE last_used < \\$1").
+		WithArgs(cutoff).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM embedding_cache WHERE key IN \\(\\s+SELECT key FROM embedding_cache\\s+ORDER BY last_used DESC\\s+OFFSET \\$1\\)").
+		WithArgs(100).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	store := NewPostgresEmbeddingStore(db)
+	n, err := store.PurgeEmbeddings(cutoff, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// zero values purge nothing
+	n, err = store.PurgeEmbeddings(time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+const (
+	// events kept per job for clients resuming with Last-Event-ID
+	eventHistory = 64
+	// events buffered per subscriber before it is dropped as too slow
+	subscriberBuffer = 64
+)
+
+// how long a finished job's events stay available for replay. For testing.
+var eventRetention = 5 * time.Minute
+
+// JobEvent is a status or progress change of a job. IDs increase across all
+// jobs, so a single Last-Event-ID can resume a stream over several jobs.
+type JobEvent struct {
+	ID   int64
+	Job  string
+	Type string
+	Data []byte
+}
+
+// EventBroker fans job events out to /status/stream subscribers and keeps
+// the last few events of each job so reconnecting clients can catch up.
+// Events only reach subscribers on the instance that published them.
+type EventBroker struct {
+	mu      sync.Mutex
+	seq     int64
+	history map[string]*jobHistory
+	subs    map[string]map[chan JobEvent]struct{}
+	closed  bool
+}
+
+type jobHistory struct {
+	events  []JobEvent
+	trimmed int64       // ID of the newest event dropped from events
+	expiry  *time.Timer // set by Finish, stopped when the job runs again
+}
+
+// Events is the broker fed by Jobs.
+var Events = NewEventBroker()
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		history: map[string]*jobHistory{},
+		subs:    map[string]map[chan JobEvent]struct{}{},
+	}
+}
+
+// Publish records an event for job and sends it to the job's subscribers. A
+// subscriber that has fallen behind is closed; it can reconnect and replay.
+func (b *EventBroker) Publish(job, typ string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to encode job event", slog.String("object_id", job), slog.Any("error", err))
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := JobEvent{ID: b.seq, Job: job, Type: typ, Data: raw}
+
+	h := b.history[job]
+	if h == nil {
+		h = &jobHistory{}
+		b.history[job] = h
+	}
+	if h.expiry != nil {
+		// the job was updated after it finished; its history is live again
+		h.expiry.Stop()
+		h.expiry = nil
+	}
+	h.events = append(h.events, event)
+	if len(h.events) > eventHistory {
+		h.trimmed = h.events[0].ID
+		h.events = slices.Delete(h.events, 0, 1)
+	}
+
+	for ch := range b.subs[job] {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("dropping slow event subscriber", slog.String("object_id", job))
+			b.unsubscribe(ch)
+		}
+	}
+}
+
+// Finish forgets a finished job's events once clients have had time to
+// replay them, unless the job publishes again before then.
+func (b *EventBroker) Finish(job string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := b.history[job]
+	if h == nil {
+		return
+	}
+	if h.expiry != nil {
+		h.expiry.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(eventRetention, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// a timer that fired while Publish or Finish replaced it is stale
+		if b.history[job] == h && h.expiry == timer {
+			delete(b.history, job)
+		}
+	})
+	h.expiry = timer
+}
+
+// Subscribe delivers future events of jobs on the returned channel until
+// cancel is called or the broker is closed. seq is the ID of the last event
+// published before the subscription; earlier events are only available
+// through Since.
+func (b *EventBroker) Subscribe(jobs []string) (events <-chan JobEvent, seq int64, cancel func()) {
+	ch := make(chan JobEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, b.seq, func() {}
+	}
+	for _, job := range jobs {
+		if b.subs[job] == nil {
+			b.subs[job] = map[chan JobEvent]struct{}{}
+		}
+		b.subs[job][ch] = struct{}{}
+	}
+
+	return ch, b.seq, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(ch)
+	}
+}
+
+// Close ends every subscription, now and in future, so that streaming
+// clients reconnect to another instance while this one shuts down.
+func (b *EventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, subs := range b.subs {
+		for ch := range subs {
+			b.unsubscribe(ch)
+		}
+	}
+}
+
+// unsubscribe removes and closes ch. Callers hold b.mu.
+func (b *EventBroker) unsubscribe(ch chan JobEvent) {
+	found := false
+	for job, subs := range b.subs {
+		if _, ok := subs[ch]; !ok {
+			continue
+		}
+		found = true
+		delete(subs, ch)
+		if len(subs) == 0 {
+			delete(b.subs, job)
+		}
+	}
+	if found {
+		close(ch)
+	}
+}
+
+// Since returns the job's events after last, up to and including until. It
+// reports false if the history no longer reaches back to last, in which case
+// the caller should send the current status instead.
+func (b *EventBroker) Since(job string, last, until int64) ([]JobEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := b.history[job]
+	if h == nil || h.trimmed > last || last > b.seq {
+		// never seen here, trimmed, or an ID from before a restart
+		return nil, false
+	}
+
+	var events []JobEvent
+	for _, e := range h.events {
+		if e.ID > last && e.ID <= until {
+			events = append(events, e)
+		}
+	}
+	return events, true
+}
+
+// publishingJobStore publishes every status and progress change to Events,
+// whichever code path made it.
+type publishingJobStore struct {
+	JobStore
+}
+
+func (s publishingJobStore) SetStatus(id string, status JobStatus) error {
+	if err := s.JobStore.SetStatus(id, status); err != nil {
+		return err
+	}
+	Events.Publish(id, "status", statusEvent(id, status, time.Now()))
+	if finished(status.Status) {
+		Events.Finish(id)
+	}
+	return nil
+}
+
+func (s publishingJobStore) TransitionStatus(id, from string, status JobStatus) (bool, error) {
+	ok, err := s.JobStore.TransitionStatus(id, from, status)
+	if err != nil || !ok {
+		return ok, err
+	}
+	Events.Publish(id, "status", statusEvent(id, status, time.Now()))
+	if finished(status.Status) {
+		Events.Finish(id)
+	}
+	return true, nil
+}
+
+func (s publishingJobStore) ExpireResult(id string, listed JobStatus) (bool, error) {
+	ok, err := s.JobStore.ExpireResult(id, listed)
+	if err != nil || !ok {
+		return ok, err
+	}
+	status := listed
+	status.Status = StatusExpired
+	status.ResultBytes = 0
+	Events.Publish(id, "status", statusEvent(id, status, time.Now()))
+	Events.Finish(id)
+	return true, nil
+}
+
+func (s publishingJobStore) SetProgress(id string, progress pipeline.Progress) error {
+	if err := s.JobStore.SetProgress(id, progress); err != nil {
+		return err
+	}
+	Events.Publish(id, "progress", map[string]any{
+		"object_id": id,
+		"stage":     progress.Stage,
+		"percent":   int(progress.Fraction() * 100),
+		"progress":  progress,
+	})
+	return nil
+}
+
+// statusEvent is the data of a status event: the /status fields plus the
+// job's ID, which multi-job streams need.
+func statusEvent(id string, status JobStatus, now time.Time) map[string]any {
+	fields := statusFields(id, status, now)
+	fields["object_id"] = id
+	return fields
+}
+
+// finished reports whether a job in this state will not change any more,
+// apart from its result expiring.
+func finished(status string) bool {
+	switch status {
+	case StatusCompleted, StatusPartial, StatusFailed, StatusCancelled, StatusExpired:
+		return true
+	}
+	return false
+}
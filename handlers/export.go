@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
 )
 
 // HandleExport returns the embeddings and triples in CSV or JSON format
@@ -17,10 +19,17 @@ import (
 //   - object_id (required): The unique identifier of the processed job
 //   - format (required): Either "csv" or "json"
 //
+// The CSV export has one row per chunk: document id, filename, chunk index,
+// character offsets, the section it came from (a heading, slide or sheet,
+// empty for formats without sections), the PDF page it starts on (empty for
+// other formats), the embedding vector spread across columns, then the
+// chunk's triples as "subject | predicate | object" joined by "; ".
+//
 // Returns:
 //   - 200: File content in requested format
 //   - 400: Missing object_id or invalid format
-//   - 404: If object_id is not found or job not completed
+//   - 404: If object_id is not found, owned by another user or job not completed
+//   - 500: If the job store could not be read
 //
 // Content-Type:
 //   - text/csv for CSV exports
@@ -36,10 +45,16 @@ func HandleExport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutex.RLock()
-	result, ok := jobResults[id]
-	mutex.RUnlock()
+	if _, ok := authorizeJob(w, r, id); !ok {
+		return
+	}
 
+	result, ok, err := Jobs.GetResult(id)
+	if err != nil {
+		slog.Error("failed to load job result", slog.String("object_id", id), slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 	if !ok {
 		slog.Error("result not found", slog.String("object_id", id))
 		http.Error(w, "Result not found", http.StatusNotFound)
@@ -52,13 +67,12 @@ func HandleExport(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/csv")
 		w.Header().Set("Content-Disposition", "attachment; filename=result.csv")
 		writer := csv.NewWriter(w)
-		writer.Write([]string{"Embeddings", "Triple"})
-		for i := range result.Embeddings {
-			triple := ""
-			if i < len(result.Triples) {
-				triple = result.Triples[i]
-			}
-			row := append(embeddingsToString(result.Embeddings[i]), triple)
+		writer.Write([]string{"Document", "Filename", "Chunk", "Start", "End", "Section", "Page", "Embeddings", "Triple"})
+		triples := triplesByChunk(result.Triples)
+		for _, emb := range result.Embeddings {
+			row := chunkToString(emb.Chunk)
+			row = append(row, embeddingsToString(emb.Vector)...)
+			row = append(row, triples[chunkKey{emb.DocumentID, emb.Index}])
 			writer.Write(row)
 		}
 		writer.Flush()
@@ -77,6 +91,34 @@ func HandleExport(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// chunkToString returns the provenance columns of a chunk
+func chunkToString(c pipeline.Chunk) []string {
+	page := ""
+	if c.Page > 0 {
+		page = strconv.Itoa(c.Page)
+	}
+	return []string{c.DocumentID, c.Filename, strconv.Itoa(c.Index), strconv.Itoa(c.Start), strconv.Itoa(c.End), c.Section, page}
+}
+
+type chunkKey struct {
+	documentID string
+	index      int
+}
+
+// triplesByChunk renders the triples of every chunk into a single CSV cell
+func triplesByChunk(triples []pipeline.Triple) map[chunkKey]string {
+	out := map[chunkKey]string{}
+	for _, t := range triples {
+		k := chunkKey{t.DocumentID, t.ChunkIndex}
+		cell := t.Subject + " | " + t.Predicate + " | " + t.Object
+		if out[k] != "" {
+			cell = out[k] + "; " + cell
+		}
+		out[k] = cell
+	}
+	return out
+}
+
 func embeddingsToString(floats []float64) []string {
 	out := make([]string, len(floats))
 	for i, f := range floats {
@@ -2,20 +2,24 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
 
 	chromadb "github.com/abdulahshoaib/quirk/chromaDB"
 )
 
 // HandleExportToChroma handles exporting embeddings to a ChromaDB collection,
-// either by adding a new collection or updating an existing one.
+// either by adding a new collection, updating an existing one or syncing a
+// collection with a job that has since been updated.
 //
-// POST /export?object_id={id}&operation={add|update}
+// POST /export?object_id={id}&operation={add|update|sync}
 //
 // Query Parameters:
 //   - object_id (required): Unique identifier corresponding to pre-computed embeddings
-//   - operation (required): Operation type; must be either "add" or "update"
+//   - operation (required): Operation type; one of "add", "update" or "sync"
 //
 // Request Body (JSON):
 //
@@ -27,14 +31,23 @@ import (
 // Response Codes:
 //   - 200 OK: Operation completed successfully
 //   - 400 Bad Request: Missing or invalid parameters, or malformed JSON body
-//   - 404 Not Found: No embeddings found for the given object_id
+//   - 404 Not Found: No embeddings found for the given object_id, or the job
+//     is owned by another user
 //   - 5xx Error: Internal error during Chroma operation
 //
 // Behavior:
 //   - Reads the object_id and operation from query parameters
 //   - Validates presence and correctness of inputs
-//   - Extracts precomputed embeddings from in-memory jobResults map
-//   - Injects embeddings into the payload and calls ChromaDB API (add/update)
+//   - Extracts precomputed embeddings from the job store
+//   - Injects one record per embedding into the payload: the id is
+//     "<document_id>#<chunk_index>", the document is the chunk text, and the metadata
+//     carries object_id, document_id, filename, content_hash, chunk_index, start,
+//     end and, when known, the document's title and author and the chunk's
+//     section and page, merged over any metadata the caller supplied for that document
+//   - Calls ChromaDB API (add/update). sync upserts every record, then deletes
+//     the job's records whose content_hash is no longer part of the job: those
+//     of removed files and left-over chunks of replaced ones. Records exported
+//     before content hashes were recorded are not deleted.
 func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 
@@ -57,7 +70,7 @@ func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if operation != "update" && operation != "add" {
+	if operation != "update" && operation != "add" && operation != "sync" {
 		slog.Error("invalid operation param", slog.String("operation", operation), slog.String("object_id", id))
 		http.Error(w, "invalid operation param", http.StatusBadRequest)
 		return
@@ -79,7 +92,16 @@ func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, ok := jobResults[id]
+	if _, ok := authorizeJob(w, r, id); !ok {
+		return
+	}
+
+	results, ok, err := Jobs.GetResult(id)
+	if err != nil {
+		slog.Error("failed to load job result", slog.String("object_id", id), slog.Any("error", err), slog.String("handler", "HandleExportToChroma"))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 	if !ok {
 		slog.Error("embedding not found", slog.String("object_id", id), slog.String("handler", "HandleExportToChroma"))
 		http.Error(w, "embedding not found for object_id", http.StatusNotFound)
@@ -88,9 +110,15 @@ func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 
 	req = body.Req
 	payload = body.Payload
-	payload.Embeddings = results.Embeddings
-	payload.IDs = results.Filenames
-	payload.Documents = results.Filecontent
+	payload.Embeddings = make([][]float64, len(results.Embeddings))
+	payload.IDs = make([]string, len(results.Embeddings))
+	payload.Documents = make([]string, len(results.Embeddings))
+	payload.Metadatas = chunkMetadatas(id, results, body.Payload.Metadatas)
+	for i, e := range results.Embeddings {
+		payload.Embeddings[i] = e.Vector
+		payload.IDs[i] = fmt.Sprintf("%s#%d", e.DocumentID, e.Index)
+		payload.Documents[i] = e.Text
+	}
 
 	slog.Info("embedding export payload size",
 		slog.Int("ids", len(payload.IDs)),
@@ -99,16 +127,18 @@ func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 		slog.Int("metas", len(payload.Metadatas)),
 	)
 
-	var (
-		status int
-		err    error
-	)
+	var status int
 
 	switch operation {
 	case "update":
 		status, err = chromadb.UpdateCollection(req, payload)
 	case "add":
 		status, err = chromadb.CreateNewCollection(req, payload)
+	case "sync":
+		status, err = chromadb.UpsertCollection(req, payload)
+		if err == nil {
+			status, err = chromadb.DeleteRecords(req, staleRecords(id, results))
+		}
 	}
 
 	if err != nil {
@@ -120,3 +150,67 @@ func HandleExportToChroma(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Chroma operation succeeded"))
 }
+
+// chunkMetadatas builds the per-chunk Chroma metadata. Caller-supplied
+// metadatas are matched to documents by upload position; a single entry
+// applies to every chunk.
+func chunkMetadatas(id string, results Result, user []map[string]chromadb.MetadataVal) []map[string]chromadb.MetadataVal {
+	docIdx := make(map[string]int, len(results.Documents))
+	for i, d := range results.Documents {
+		docIdx[d.ID] = i
+	}
+
+	metas := make([]map[string]chromadb.MetadataVal, len(results.Embeddings))
+	for i, c := range results.Embeddings {
+		meta := map[string]chromadb.MetadataVal{}
+		switch {
+		case len(user) == 1:
+			maps.Copy(meta, user[0])
+		case len(user) > 1:
+			if j, ok := docIdx[c.DocumentID]; ok && j < len(user) {
+				maps.Copy(meta, user[j])
+			}
+		}
+		meta["object_id"] = id
+		meta["document_id"] = c.DocumentID
+		meta["filename"] = c.Filename
+		if j, ok := docIdx[c.DocumentID]; ok {
+			d := results.Documents[j]
+			if d.Hash != "" {
+				meta["content_hash"] = d.Hash
+			}
+			if d.Title != "" {
+				meta["title"] = d.Title
+			}
+			if d.Author != "" {
+				meta["author"] = d.Author
+			}
+		}
+		meta["chunk_index"] = c.Index
+		meta["start"] = c.Start
+		meta["end"] = c.End
+		if c.Section != "" {
+			meta["section"] = c.Section
+		}
+		if c.Page > 0 {
+			meta["page"] = c.Page
+		}
+		metas[i] = meta
+	}
+	return metas
+}
+
+// staleRecords is the Chroma filter matching a job's exported records that
+// are no longer part of its result.
+func staleRecords(id string, results Result) map[string]any {
+	hashes := []string{}
+	for _, d := range results.Documents {
+		if d.Hash != "" && !slices.Contains(hashes, d.Hash) {
+			hashes = append(hashes, d.Hash)
+		}
+	}
+	return map[string]any{"$and": []map[string]any{
+		{"object_id": map[string]any{"$eq": id}},
+		{"content_hash": map[string]any{"$nin": hashes}},
+	}}
+}
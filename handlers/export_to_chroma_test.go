@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	chromadb "github.com/abdulahshoaib/quirk/chromaDB"
+	"github.com/abdulahshoaib/quirk/pipeline"
 	"github.com/jarcoal/httpmock"
 )
 
@@ -16,21 +18,29 @@ func TestHandleExportToChroma_AddSuccess(t *testing.T) {
 	defer httpmock.DeactivateAndReset()
 
 	// Mock the outgoing ChromaDB POST request
+	var sent chromadb.Payload
 	httpmock.RegisterResponder("POST", "http://localhost:8001/api/v2/tenants/quirk/databases/quirk/collections/afaa5b03-e179-4afd-bc7a-6948daf7056b/add",
-		httpmock.NewStringResponder(200, `{"message": "success"}`))
+		func(r *http.Request) (*http.Response, error) {
+			json.NewDecoder(r.Body).Decode(&sent)
+			return httpmock.NewStringResponse(200, `{"message": "success"}`), nil
+		})
 
-	// Prepare mock jobResults
+	// Prepare mock job result
 	id := "test_id"
 	embedding := make([]float64, 1024)
 	for i := range embedding {
 		embedding[i] = float64(i) * 0.01
 	}
-	jobResults[id] = Result{
-		Embeddings:  [][]float64{embedding},
-		Filenames:   []string{"file1"},
-		Filecontent: []string{"This is the file content"},
-	}
-	defer delete(jobResults, id)
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+	Jobs.SaveResult(id, Result{
+		Documents: []pipeline.Document{
+			{ID: "doc1", Filename: "file1", Text: "This is the file content"},
+		},
+		Embeddings: []pipeline.Embedding{
+			{Chunk: pipeline.Chunk{DocumentID: "doc1", Filename: "file1", Index: 0, Start: 0, End: 8, Text: "This is "}, Vector: embedding},
+			{Chunk: pipeline.Chunk{DocumentID: "doc1", Filename: "file1", Index: 1, Start: 8, End: 24, Text: "the file content"}, Vector: embedding},
+		},
+	})
 
 	// Prepare request
 	body := struct {
@@ -44,7 +54,9 @@ func TestHandleExportToChroma_AddSuccess(t *testing.T) {
 			Database:      "quirk",
 			Collection_id: "afaa5b03-e179-4afd-bc7a-6948daf7056b",
 		},
-		Payload: chromadb.Payload{},
+		Payload: chromadb.Payload{
+			Metadatas: []map[string]chromadb.MetadataVal{{"source": "upload"}},
+		},
 	}
 	bodyBytes, _ := json.Marshal(body)
 	req := httptest.NewRequest(http.MethodPost, "/export?object_id="+id+"&operation=add", bytes.NewReader(bodyBytes))
@@ -58,8 +70,68 @@ func TestHandleExportToChroma_AddSuccess(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("expected 200 OK, got %d", resp.StatusCode)
 	}
+
+	if len(sent.IDs) != 2 || sent.IDs[1] != "doc1#1" {
+		t.Errorf("expected one id per chunk, got %v", sent.IDs)
+	}
+	if len(sent.Documents) != 2 || sent.Documents[1] != "the file content" {
+		t.Errorf("expected chunk text as documents, got %v", sent.Documents)
+	}
+	if len(sent.Metadatas) != 2 || sent.Metadatas[1]["source"] != "upload" || sent.Metadatas[1]["chunk_index"] != float64(1) {
+		t.Errorf("expected merged chunk metadata, got %v", sent.Metadatas)
+	}
+	if sent.Metadatas[1]["document_id"] != "doc1" || sent.Metadatas[1]["filename"] != "file1" {
+		t.Errorf("expected document provenance in metadata, got %v", sent.Metadatas[1])
+	}
 }
 
+func TestHandleExportToChroma_Sync(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	base := "http://localhost:8001/api/v2/tenants/quirk/databases/quirk/collections/c1"
+	var upserted chromadb.Payload
+	var deleted map[string]any
+	httpmock.RegisterResponder("POST", base+"/upsert",
+		func(r *http.Request) (*http.Response, error) {
+			json.NewDecoder(r.Body).Decode(&upserted)
+			return httpmock.NewStringResponse(200, `{}`), nil
+		})
+	httpmock.RegisterResponder("POST", base+"/delete",
+		func(r *http.Request) (*http.Response, error) {
+			json.NewDecoder(r.Body).Decode(&deleted)
+			return httpmock.NewStringResponse(200, `[]`), nil
+		})
+
+	id := "sync_id"
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+	Jobs.SaveResult(id, Result{
+		Documents: []pipeline.Document{{ID: "doc1", Filename: "file1", Hash: "h1", Text: "content"}},
+		Embeddings: []pipeline.Embedding{
+			{Chunk: pipeline.Chunk{DocumentID: "doc1", Filename: "file1", Text: "content"}, Vector: []float64{1}},
+		},
+	})
+
+	body := `{"req": {"Host": "localhost", "Port": 8001, "Tenant": "quirk", "Database": "quirk", "Collection_id": "c1"}, "payload": {}}`
+	req := httptest.NewRequest(http.MethodPost, "/export?object_id="+id+"&operation=sync", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	HandleExportToChroma(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(upserted.IDs) != 1 || upserted.Metadatas[0]["content_hash"] != "h1" || upserted.Metadatas[0]["object_id"] != id {
+		t.Errorf("expected records tagged with job and content hash, got %v", upserted.Metadatas)
+	}
+	want := map[string]any{"where": map[string]any{"$and": []any{
+		map[string]any{"object_id": map[string]any{"$eq": id}},
+		map[string]any{"content_hash": map[string]any{"$nin": []any{"h1"}}},
+	}}}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("unexpected delete filter %v", deleted)
+	}
+}
 func TestHandleExportToChroma_MissingID(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/export?operation=add", nil)
 	w := httptest.NewRecorder()
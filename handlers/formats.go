@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// HandleFormats lists the file formats /process accepts.
+//
+// GET /formats
+//
+// Returns:
+//   - 200: JSON with every registered converter, highest priority first
+//   - 405: Method other than GET
+//
+// Example response:
+//
+//	{
+//	  "formats": [
+//	    {"name": "pdf", "extensions": [".pdf"], "mime_types": ["application/pdf"], "priority": 10},
+//	    {"name": "text", "extensions": [".txt", ".log"], "mime_types": ["text/plain", "text/x-log"], "priority": 0}
+//	  ]
+//	}
+func HandleFormats(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if r.Method != http.MethodGet {
+		slog.Warn("non-GET method", slog.String("method", r.Method))
+		http.Error(w, "[GET] allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"formats": pipeline.Converters()})
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleFormats(t *testing.T) {
+	w := httptest.NewRecorder()
+	HandleFormats(w, httptest.NewRequest(http.MethodGet, "/formats", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Formats []struct {
+			Name       string   `json:"name"`
+			Extensions []string `json:"extensions"`
+			MIMETypes  []string `json:"mime_types"`
+		} `json:"formats"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+
+	names := map[string][]string{}
+	for _, f := range body.Formats {
+		names[f.Name] = f.Extensions
+	}
+	assert.Equal(t, []string{".pdf"}, names["pdf"])
+	assert.Contains(t, names["text"], ".txt")
+	assert.Equal(t, "text", body.Formats[len(body.Formats)-1].Name, "plain text has the lowest priority")
+
+	w = httptest.NewRecorder()
+	HandleFormats(w, httptest.NewRequest(http.MethodPost, "/formats", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandleProcess_DetectsFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		code     int
+	}{
+		{"csv by extension", "data.csv", "a,b\n1,2\n", http.StatusOK},
+		{"pdf by magic bytes", "scan", "%PDF-1.4 ...", http.StatusOK},
+		{"pdf that is not", "fake.pdf", "just text", http.StatusBadRequest},
+		{"unknown extension", "image.png", "fake image content", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleProcess(w, processRequest(t, "/process", [][2]string{{tt.filename, tt.content}}, nil))
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code != http.StatusOK {
+				return
+			}
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			status, _, _ := Jobs.GetStatus(body["object_id"])
+			assert.Equal(t, []string{tt.filename}, status.Files)
+		})
+	}
+}
+
+func zipOf(t *testing.T, files ...[2]string) string {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range files {
+		w, err := zw.Create(f[0])
+		require.NoError(t, err)
+		w.Write([]byte(f[1]))
+	}
+	require.NoError(t, zw.Close())
+	return b.String()
+}
+
+func TestHandleProcess_Archive(t *testing.T) {
+	dump := zipOf(t, [2]string{"notes/a.txt", "Alpha"}, [2]string{"data.csv", "a,b\n1,2\n"})
+	body := submit(t, processRequest(t, "/process", [][2]string{{"dump.zip", dump}, {"c.md", "# C"}}, nil))
+
+	status, _, _ := Jobs.GetStatus(body["object_id"].(string))
+	assert.Equal(t, []string{"notes/a.txt", "data.csv", "c.md"}, status.Files)
+
+	tests := []struct {
+		name    string
+		archive string
+	}{
+		{"only unsupported files inside", zipOf(t, [2]string{"tool.exe", "MZ\x90\x00"})},
+		{"empty", zipOf(t)},
+		{"not an archive", "plain text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleProcess(w, processRequest(t, "/process", [][2]string{{"dump.zip", tt.archive}}, nil))
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestHandleProcess_ArchiveSkipsUnsupported(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+
+	dump := zipOf(t, [2]string{"notes/a.txt", "Alpha"}, [2]string{"tool.exe", "MZ\x90\x00"})
+	body := submit(t, processRequest(t, "/process", [][2]string{{"dump.zip", dump}}, nil))
+	id := body["object_id"].(string)
+	require.Len(t, body["skipped"], 1)
+	assert.Equal(t, "tool.exe", body["skipped"].([]any)[0].(map[string]any)["file"])
+
+	status := waitFinished(t, id)
+	assert.Equal(t, StatusPartial, status.Status)
+	assert.Equal(t, []string{"notes/a.txt"}, status.Files)
+	require.Len(t, status.Failures, 1)
+	assert.Equal(t, pipeline.StageError{Stage: pipeline.StageExtract, File: "tool.exe", Message: "unsupported file extension .exe"}, status.Failures[0])
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,13 +12,14 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/abdulahshoaib/quirk/pipeline"
 )
 
 func TestHandleResult_Completed(t *testing.T) {
 	// Mock state
 	id := "job1"
-	jobStatuses[id] = JobStatus{Status: "completed", ETA: time.Now()}
-	jobResults[id] = Result{Triples: []string{"a"}, Embeddings: [][]float64{{0.1, 0.2}}}
+	Jobs.SetStatus(id, JobStatus{Status: "completed", StartedAt: time.Now()})
+	Jobs.SaveResult(id, Result{Triples: []pipeline.Triple{{Subject: "a", Predicate: "is", Object: "b"}}, Embeddings: []pipeline.Embedding{{Vector: []float64{0.1, 0.2}}}})
 
 	req := httptest.NewRequest("GET", "/result?object_id="+id, nil)
 	w := httptest.NewRecorder()
@@ -40,7 +42,8 @@ func TestHandleResult_Completed(t *testing.T) {
 
 func TestHandleExport_JSON(t *testing.T) {
 	id := "job2"
-	jobResults[id] = Result{Triples: []string{"a"}, Embeddings: [][]float64{{0.1, 0.2}}}
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+	Jobs.SaveResult(id, Result{Triples: []pipeline.Triple{{Subject: "a", Predicate: "is", Object: "b"}}, Embeddings: []pipeline.Embedding{{Vector: []float64{0.1, 0.2}}}})
 
 	req := httptest.NewRequest("GET", "/export?object_id="+id+"&format=json", nil)
 	w := httptest.NewRecorder()
@@ -57,7 +60,14 @@ func TestHandleExport_JSON(t *testing.T) {
 
 func TestHandleExport_CSV(t *testing.T) {
 	id := "job3"
-	jobResults[id] = Result{Triples: []string{"hello"}, Embeddings: [][]float64{{1.1, 2.2}}}
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+	Jobs.SaveResult(id, Result{Triples: []pipeline.Triple{
+		{Subject: "hello", Predicate: "is", Object: "greeting", DocumentID: "doc1", ChunkIndex: 0},
+		{Subject: "hello", Predicate: "has", Object: "five letters", DocumentID: "doc1", ChunkIndex: 0},
+	}, Embeddings: []pipeline.Embedding{{
+		Chunk:  pipeline.Chunk{DocumentID: "doc1", Filename: "a.txt", Index: 0, Start: 0, End: 5, Section: "Intro", Page: 2, Text: "hello"},
+		Vector: []float64{1.1, 2.2},
+	}}})
 
 	req := httptest.NewRequest("GET", "/export?object_id="+id+"&format=csv", nil)
 	w := httptest.NewRecorder()
@@ -71,11 +81,14 @@ func TestHandleExport_CSV(t *testing.T) {
 	if !strings.Contains(body, "hello") {
 		t.Error("Expected triple in CSV export")
 	}
+	if !strings.Contains(body, "doc1,a.txt,0,0,5,Intro,2,1.1,2.2,hello | is | greeting; hello | has | five letters") {
+		t.Errorf("Expected provenance columns before the vector, got %q", body)
+	}
 }
 
 func TestHandleStatus(t *testing.T) {
 	id := "job4"
-	jobStatuses[id] = JobStatus{Status: "processing", ETA: time.Now().Add(10 * time.Second)}
+	Jobs.SetStatus(id, JobStatus{Status: "processing", StartedAt: time.Now()})
 
 	req := httptest.NewRequest("GET", "/status?object_id="+id, nil)
 	w := httptest.NewRecorder()
@@ -90,6 +103,124 @@ func TestHandleStatus(t *testing.T) {
 	}
 }
 
+func TestHandleStatus_Progress(t *testing.T) {
+	id := "job7"
+	Jobs.SetStatus(id, JobStatus{Status: StatusProcessing, StartedAt: time.Now().Add(-30 * time.Second)})
+	Jobs.SetProgress(id, pipeline.Progress{
+		Stage:          pipeline.StageEmbed,
+		FilesTotal:     2,
+		FilesExtracted: 2,
+		FilesChunked:   2,
+		BytesTotal:     100,
+		BytesExtracted: 100,
+		ChunksCreated:  10,
+		ChunksEmbedded: 5,
+	})
+
+	req := httptest.NewRequest("GET", "/status?object_id="+id, nil)
+	w := httptest.NewRecorder()
+
+	HandleStatus(w, req)
+
+	var body struct {
+		Stage      string            `json:"stage"`
+		Percent    int               `json:"percent"`
+		ETASeconds *int              `json:"eta_seconds"`
+		Progress   pipeline.Progress `json:"progress"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	if body.Stage != pipeline.StageEmbed || body.Percent != 70 {
+		t.Errorf("Expected embed stage at 70%%, got %q at %d%%", body.Stage, body.Percent)
+	}
+	// 70% done in 30s leaves roughly 13s at the same throughput
+	if body.ETASeconds == nil || *body.ETASeconds < 12 || *body.ETASeconds > 14 {
+		t.Errorf("Expected ETA of about 13s, got %v", body.ETASeconds)
+	}
+	if body.Progress.ChunksEmbedded != 5 {
+		t.Errorf("Expected raw progress counters, got %+v", body.Progress)
+	}
+}
+
+func TestEstimateETA_NoProgress(t *testing.T) {
+	if _, ok := estimateETA(JobStatus{Status: StatusProcessing, StartedAt: time.Now()}, time.Now()); ok {
+		t.Error("Expected no ETA before any progress")
+	}
+}
+
+func TestHandleStatus_Failed(t *testing.T) {
+	id := "job5"
+	failure := pipeline.StageError{Stage: pipeline.StageEmbed, File: "a.txt", Message: "service unavailable"}
+	Jobs.SetStatus(id, JobStatus{Status: StatusFailed, Error: &failure, Failures: []pipeline.StageError{failure}})
+
+	req := httptest.NewRequest("GET", "/status?object_id="+id, nil)
+	w := httptest.NewRecorder()
+
+	HandleStatus(w, req)
+
+	var body struct {
+		Status       string                `json:"status"`
+		ErrorMessage *pipeline.StageError  `json:"error_message"`
+		Failures     []pipeline.StageError `json:"failures"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	if body.Status != StatusFailed {
+		t.Errorf("Expected failed status, got %q", body.Status)
+	}
+	if body.ErrorMessage == nil || *body.ErrorMessage != failure {
+		t.Errorf("Expected structured error_message, got %+v", body.ErrorMessage)
+	}
+	if len(body.Failures) != 1 {
+		t.Errorf("Expected one failure, got %+v", body.Failures)
+	}
+}
+
+func TestHandleResult_Failed(t *testing.T) {
+	id := "job6"
+	Jobs.SetStatus(id, JobStatus{Status: StatusFailed, Error: &pipeline.StageError{Stage: pipeline.StageChunk, File: "a.txt", Message: "no text to embed"}})
+
+	req := httptest.NewRequest("GET", "/result?object_id="+id, nil)
+	w := httptest.NewRecorder()
+
+	HandleResult(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for failed job, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "no text to embed") {
+		t.Errorf("Expected failure reason in body, got %q", w.Body.String())
+	}
+}
+
+func TestFinishedStatus(t *testing.T) {
+	failure := pipeline.StageError{Stage: pipeline.StageEmbed, File: "b.txt", Message: "boom"}
+
+	tests := []struct {
+		name   string
+		res    pipeline.ProcessResult
+		status string
+	}{
+		{"completed", pipeline.ProcessResult{Embeddings: []pipeline.Embedding{{}}}, StatusCompleted},
+		{"partial", pipeline.ProcessResult{Embeddings: []pipeline.Embedding{{}}, Failures: []pipeline.StageError{failure}}, StatusPartial},
+		{"failed", pipeline.ProcessResult{Failures: []pipeline.StageError{failure}, Err: &failure}, StatusFailed},
+		{"failed without stage", pipeline.ProcessResult{Err: fmt.Errorf("boom")}, StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := finishedStatus(tt.res)
+			if got.Status != tt.status {
+				t.Errorf("Expected %s, got %s", tt.status, got.Status)
+			}
+			if (tt.status == StatusCompleted) != (got.Error == nil) {
+				t.Errorf("Unexpected error for %s job: %+v", tt.status, got.Error)
+			}
+		})
+	}
+}
+
 func TestHandleResult_MissingID(t *testing.T) {
 	req := httptest.NewRequest("GET", "/result", nil)
 	w := httptest.NewRecorder()
@@ -172,13 +303,10 @@ func TestHandleSignup_InvalidJSON(t *testing.T) {
 	}
 }
 
-// Optional: Reset shared maps between tests
+// Optional: Reset the shared job store between tests
 func TestMain(m *testing.M) {
 	// clean state before tests
-	mutex.Lock()
-	jobStatuses = make(map[string]JobStatus)
-	jobResults = make(map[string]Result)
-	mutex.Unlock()
+	Jobs = NewMemoryJobStore()
 
 	m.Run()
 }
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// DefaultIdempotencyTTL is how long an Idempotency-Key is remembered.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// longest Idempotency-Key accepted
+const maxIdempotencyKey = 255
+
+// how long a claimed Idempotency-Key is held for a request that has not been
+// accepted yet; a retry takes over the key of one that never finished
+const idempotencyLease = time.Minute
+
+// IdempotencyTTL is how long /process remembers an Idempotency-Key. RunApp
+// sets it from IDEMPOTENCY_TTL.
+var IdempotencyTTL = DefaultIdempotencyTTL
+
+func InitIdempotency(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	IdempotencyTTL = ttl
+}
+
+// idempotencyKey reads the optional Idempotency-Key header. Keys are up to
+// 255 printable ASCII characters.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKey {
+		return "", fmt.Errorf("longer than %d characters", maxIdempotencyKey)
+	}
+	for _, c := range []byte(key) {
+		if c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("must be printable ASCII")
+		}
+	}
+	return key, nil
+}
+
+// payloadHash identifies a /process request by what it asks for: the job it
+// updates, its form fields and the name and content of every upload.
+func payloadHash(r *http.Request, sources []pipeline.Source) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "object_id=%q\n", r.URL.Query().Get("object_id"))
+	for _, name := range slices.Sorted(maps.Keys(r.MultipartForm.Value)) {
+		fmt.Fprintf(h, "%q=%q\n", name, r.MultipartForm.Value[name])
+	}
+	for _, src := range sources {
+		fmt.Fprintf(h, "file %q %s\n", src.Filename, src.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// acceptIdempotencyKey stores the response to the request that claimed key,
+// so that retries are answered with it rather than just the object_id.
+func acceptIdempotencyKey(key IdempotencyKey, response map[string]any) {
+	data, err := json.Marshal(response)
+	if err == nil {
+		key.Response = data
+		err = Jobs.AcceptIdempotencyKey(key)
+	}
+	if err != nil {
+		slog.Warn("failed to store idempotent response", slog.String("object_id", key.ObjectID), slog.Any("error", err))
+	}
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func idempotentRequest(t *testing.T, key, user, content string) *http.Request {
+	req := processRequest(t, "/process", [][2]string{{"a.txt", content}}, map[string]string{"chunk_size": "500"})
+	req.Header.Set("Idempotency-Key", key)
+	return asUser(req, user)
+}
+
+func objectID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	return body["object_id"]
+}
+
+func TestHandleProcess_IdempotencyKey(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+	// room for exactly one job, so a retry that queued again would be refused
+	Queue = NewJobQueue(1, 1)
+	release := blockWorker(t, Queue)
+	defer release()
+
+	w := httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-1", "alice@example.com", "Hello world!"))
+	require.Equal(t, http.StatusOK, w.Code)
+	first := objectID(t, w)
+	require.True(t, Queue.Full())
+
+	// a retry gets the same job
+	w = httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-1", "alice@example.com", "Hello world!"))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first, objectID(t, w))
+
+	// the same key with another payload is refused
+	w = httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-1", "alice@example.com", "Something else"))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// keys are scoped per user: bob's request is a new job, for which there
+	// is no room
+	w = httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-1", "bob@example.com", "Hello world!"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestHandleProcess_IdempotencyKeyReleasedOnRejection(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+	Queue = NewJobQueue(1, 1)
+	release := blockWorker(t, Queue)
+	defer release()
+	require.NoError(t, Queue.Enqueue("waiting", "", nil, func(context.Context) {}))
+
+	w := httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-2", "alice@example.com", "Hello world!"))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// once there is room the retry creates the job
+	Queue.Cancel("waiting")
+	w = httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-2", "alice@example.com", "Hello world!"))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+}
+
+func TestHandleProcess_IdempotencyKeyReleasedOnFailure(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+
+	id := "idempotent-update"
+	storeFinishedJob(t, Jobs, id, "", time.Now(), time.Time{}, 10)
+	status, _, _ := Jobs.GetStatus(id)
+	status.Status = StatusProcessing
+	Jobs.SetStatus(id, status)
+
+	update := func() *http.Request {
+		req := processRequest(t, "/process?object_id="+id, [][2]string{{"b.txt", "Beta text."}}, nil)
+		req.Header.Set("Idempotency-Key", "update-2")
+		return req
+	}
+
+	// the first attempt fails after the key was claimed
+	w := httptest.NewRecorder()
+	HandleProcess(w, update())
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	// the retry is processed rather than pointed at a job that never came
+	status.Status = StatusCompleted
+	Jobs.SetStatus(id, status)
+	w = httptest.NewRecorder()
+	HandleProcess(w, update())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	assert.Contains(t, w.Body.String(), `"added":["b.txt"]`)
+	waitFinished(t, id)
+}
+
+func TestHandleProcess_IdempotencyKeyInProgress(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+	Queue = NewJobQueue(1, 5)
+	release := blockWorker(t, Queue)
+	defer release()
+
+	// another request claimed the key for this payload but has not been
+	// accepted yet
+	req := idempotentRequest(t, "upload-3", "alice@example.com", "Hello world!")
+	uploads, err := readUploads(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	pending := IdempotencyKey{
+		Owner:       "alice@example.com",
+		Key:         "upload-3",
+		PayloadHash: payloadHash(req, []pipeline.Source{uploads[0].source("text/plain")}),
+		ObjectID:    "never-created",
+		ExpiresAt:   time.Now().Add(idempotencyLease),
+	}
+	_, claimed, err := Jobs.ClaimIdempotencyKey(pending)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	w := httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-3", "alice@example.com", "Hello world!"))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// once its lease runs out, a retry takes the key over
+	pending.ExpiresAt = time.Now().Add(-time.Second)
+	require.NoError(t, Jobs.AcceptIdempotencyKey(pending))
+	w = httptest.NewRecorder()
+	HandleProcess(w, idempotentRequest(t, "upload-3", "alice@example.com", "Hello world!"))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	assert.NotEqual(t, "never-created", objectID(t, w))
+}
+
+func TestHandleProcess_IdempotentUpdateReplay(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+
+	body := submit(t, processRequest(t, "/process", [][2]string{{"a.txt", "Alpha text."}}, nil))
+	id := body["object_id"].(string)
+	waitFinished(t, id)
+
+	update := func() *http.Request {
+		req := processRequest(t, "/process?object_id="+id, [][2]string{{"b.txt", "Beta text."}}, nil)
+		req.Header.Set("Idempotency-Key", "update-1")
+		return req
+	}
+	first := submit(t, update())
+	assert.Equal(t, []any{"b.txt"}, first["added"])
+	waitFinished(t, id)
+
+	// the retry is answered like the request it repeats, even though the
+	// job has moved on since
+	w := httptest.NewRecorder()
+	HandleProcess(w, update())
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	var replayed map[string]any
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&replayed))
+	assert.Equal(t, first, replayed)
+}
+
+func TestHandleProcess_InvalidIdempotencyKey(t *testing.T) {
+	for _, key := range []string{strings.Repeat("k", maxIdempotencyKey+1), "tab\tkey", "ключ"} {
+		w := httptest.NewRecorder()
+		HandleProcess(w, idempotentRequest(t, key, "alice@example.com", "Hello world!"))
+		assert.Equal(t, http.StatusBadRequest, w.Code, key)
+	}
+}
+
+func TestMemoryJobStore_IdempotencyKeys(t *testing.T) {
+	store := NewMemoryJobStore()
+	now := time.Now()
+
+	key := IdempotencyKey{Owner: "alice", Key: "k", PayloadHash: "h1", ObjectID: "job1", ExpiresAt: now.Add(time.Hour)}
+	_, claimed, err := store.ClaimIdempotencyKey(key)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	retry := key
+	retry.ObjectID = "job2"
+	stored, claimed, _ := store.ClaimIdempotencyKey(retry)
+	assert.False(t, claimed)
+	assert.Equal(t, "job1", stored.ObjectID)
+
+	n, err := store.PurgeIdempotencyKeys(now.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, claimed, _ = store.ClaimIdempotencyKey(retry)
+	assert.True(t, claimed)
+
+	require.NoError(t, store.ReleaseIdempotencyKey("alice", "k"))
+	_, claimed, _ = store.ClaimIdempotencyKey(key)
+	assert.True(t, claimed)
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+var (
+	ErrQueueFull = errors.New("job queue is full")
+	// ErrShuttingDown is returned by Enqueue once Shutdown has begun, and is
+	// the cause of the contexts of jobs interrupted by it.
+	ErrShuttingDown = errors.New("server is shutting down")
+)
+
+const (
+	DefaultQueueWorkers = 4
+	DefaultQueueDepth   = 100
+
+	// Retry-After suggested before any job has finished
+	defaultRetryAfter = 5 * time.Second
+)
+
+// JobQueue runs processing jobs on a fixed pool of workers. Waiting jobs are
+// kept in one FIFO per user and workers serve users round-robin, so a user
+// submitting a large batch cannot starve everybody else.
+type JobQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	workers  int
+	maxDepth int
+
+	users   []string // users with waiting jobs, in round-robin order
+	next    int      // index into users of the next user to serve
+	waiting map[string][]queuedJob
+	depth   int
+	running map[string]context.CancelCauseFunc
+	closed  bool
+	done    sync.WaitGroup // workers
+
+	// moving average of job run time, used to suggest Retry-After
+	avgRun time.Duration
+}
+
+type queuedJob struct {
+	id      string
+	sources []pipeline.Source // removed if the job is cancelled while waiting
+	run     func(ctx context.Context)
+}
+
+// Queue is the queue used by HandleProcess. RunApp replaces it according to
+// JOB_WORKERS and JOB_QUEUE_DEPTH.
+var Queue = NewJobQueue(DefaultQueueWorkers, DefaultQueueDepth)
+
+func InitJobQueue(queue *JobQueue) {
+	Queue = queue
+}
+
+// NewJobQueue starts workers goroutines that run queued jobs. At most
+// maxDepth jobs may wait at once; non-positive values use the defaults.
+func NewJobQueue(workers, maxDepth int) *JobQueue {
+	if workers <= 0 {
+		workers = DefaultQueueWorkers
+	}
+	if maxDepth <= 0 {
+		maxDepth = DefaultQueueDepth
+	}
+
+	q := &JobQueue{
+		workers:  workers,
+		maxDepth: maxDepth,
+		waiting:  map[string][]queuedJob{},
+		running:  map[string]context.CancelCauseFunc{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	q.done.Add(workers)
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+// Full reports whether Enqueue would currently reject a job.
+func (q *JobQueue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth >= q.maxDepth
+}
+
+// Enqueue adds a job for user to the queue. It returns ErrQueueFull when
+// maxDepth jobs are already waiting, and ErrShuttingDown after Shutdown. run
+// receives a context that is cancelled when the job is cancelled, or with
+// the cause ErrShuttingDown when the queue shuts down before it finishes.
+// run is responsible for the spooled files of sources, unless the job is
+// cancelled before it starts; the queue removes them then.
+func (q *JobQueue) Enqueue(id, user string, sources []pipeline.Source, run func(ctx context.Context)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrShuttingDown
+	}
+	if q.depth >= q.maxDepth {
+		return ErrQueueFull
+	}
+	if len(q.waiting[user]) == 0 {
+		q.users = append(q.users, user)
+	}
+	q.waiting[user] = append(q.waiting[user], queuedJob{id: id, sources: sources, run: run})
+	q.depth++
+
+	q.cond.Signal()
+	return nil
+}
+
+// Cancel stops a job. A waiting job is dropped from the queue before it
+// starts and its spooled files are removed; a running job has its context
+// cancelled and winds down on its own. Both are false if the job is unknown
+// to this queue.
+func (q *JobQueue) Cancel(id string) (waiting, running bool) {
+	q.mu.Lock()
+	if cancel, ok := q.running[id]; ok {
+		cancel(nil)
+		q.mu.Unlock()
+		return false, true
+	}
+	job, waiting := q.remove(id)
+	q.mu.Unlock()
+
+	if waiting {
+		removeSources(job.sources)
+	}
+	return waiting, false
+}
+
+// remove takes the waiting job id out of the queue. Callers hold q.mu.
+func (q *JobQueue) remove(id string) (queuedJob, bool) {
+	for u, user := range q.users {
+		jobs := q.waiting[user]
+		for j, job := range jobs {
+			if job.id != id {
+				continue
+			}
+			q.waiting[user] = append(jobs[:j:j], jobs[j+1:]...)
+			q.depth--
+			if len(q.waiting[user]) == 0 {
+				delete(q.waiting, user)
+				q.users = append(q.users[:u], q.users[u+1:]...)
+				if u < q.next {
+					q.next--
+				}
+			}
+			return job, true
+		}
+	}
+	return queuedJob{}, false
+}
+
+// Position returns the 1-based place of a waiting job in the order workers
+// will pick jobs up, or false if the job is not waiting.
+func (q *JobQueue) Position(id string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// replay the round-robin without taking anything out
+	taken := make(map[string]int, len(q.users))
+	pos := 0
+	for remaining := q.depth; remaining > 0; {
+		for k := range q.users {
+			user := q.users[(q.next+k)%len(q.users)]
+			jobs := q.waiting[user]
+			if taken[user] >= len(jobs) {
+				continue
+			}
+			pos++
+			remaining--
+			if jobs[taken[user]].id == id {
+				return pos, true
+			}
+			taken[user]++
+		}
+	}
+	return 0, false
+}
+
+// RetryAfter suggests how long a rejected client should wait before trying
+// again: roughly the time until a worker frees up.
+func (q *JobQueue) RetryAfter() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.avgRun == 0 {
+		return defaultRetryAfter
+	}
+	return max(q.avgRun/time.Duration(q.workers), time.Second)
+}
+
+// Shutdown stops the queue: Enqueue fails and workers take no new jobs.
+// Waiting jobs are run at once with a context already cancelled with
+// ErrShuttingDown, so they can save themselves for later. Running jobs may
+// finish until ctx is done; those still running then are cancelled the same
+// way. Shutdown returns once every job has returned.
+func (q *JobQueue) Shutdown(ctx context.Context) {
+	q.mu.Lock()
+	q.closed = true
+	var waiting []queuedJob
+	for q.depth > 0 {
+		waiting = append(waiting, q.pop())
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	stopped, stop := context.WithCancelCause(context.Background())
+	stop(ErrShuttingDown)
+	for _, job := range waiting {
+		job.run(stopped)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	slog.Warn("interrupting running jobs", slog.Int("jobs", len(q.running)))
+	for _, cancel := range q.running {
+		cancel(ErrShuttingDown)
+	}
+	q.mu.Unlock()
+	<-done
+}
+
+func (q *JobQueue) work() {
+	defer q.done.Done()
+	for {
+		job, ctx, cancel, ok := q.take()
+		if !ok {
+			return
+		}
+
+		start := time.Now()
+		job.run(ctx)
+		elapsed := time.Since(start)
+		cancel(nil)
+
+		q.mu.Lock()
+		delete(q.running, job.id)
+		if q.avgRun == 0 {
+			q.avgRun = elapsed
+		} else {
+			q.avgRun = (q.avgRun*4 + elapsed) / 5
+		}
+		q.mu.Unlock()
+
+		slog.Debug("job finished", slog.String("object_id", job.id), slog.Duration("elapsed", elapsed))
+	}
+}
+
+// take blocks until a job is waiting, removes the next one in round-robin
+// order and registers it as running. It reports false once the queue is
+// shut down.
+func (q *JobQueue) take() (queuedJob, context.Context, context.CancelCauseFunc, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.depth == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return queuedJob{}, nil, nil, false
+	}
+
+	job := q.pop()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	q.running[job.id] = cancel
+	return job, ctx, cancel, true
+}
+
+// pop removes the next waiting job in round-robin order. Callers hold q.mu
+// and make sure a job is waiting.
+func (q *JobQueue) pop() queuedJob {
+	q.next %= len(q.users)
+	user := q.users[q.next]
+	job := q.waiting[user][0]
+	q.waiting[user] = q.waiting[user][1:]
+	q.depth--
+
+	if len(q.waiting[user]) == 0 {
+		// drop the user from the rotation; next now points at whoever followed
+		delete(q.waiting, user)
+		q.users = append(q.users[:q.next], q.users[q.next+1:]...)
+	} else {
+		q.next++
+	}
+	return job
+}
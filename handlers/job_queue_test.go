@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockWorker occupies the queue's only worker until the returned func is called
+func blockWorker(t *testing.T, q *JobQueue) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	require.NoError(t, q.Enqueue("blocker", "", nil, func(context.Context) {
+		close(started)
+		<-release
+	}))
+	<-started
+	return func() { close(release) }
+}
+
+func TestJobQueue_RoundRobin(t *testing.T) {
+	q := NewJobQueue(1, 10)
+	release := blockWorker(t, q)
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(id, user string) {
+		wg.Add(1)
+		require.NoError(t, q.Enqueue(id, user, nil, func(context.Context) {
+			mu.Lock()
+			order = append(order, id)
+			mu.Unlock()
+			wg.Done()
+		}))
+	}
+
+	// alice floods the queue before bob and carol submit anything
+	enqueue("a1", "alice")
+	enqueue("a2", "alice")
+	enqueue("a3", "alice")
+	enqueue("b1", "bob")
+	enqueue("c1", "carol")
+	enqueue("b2", "bob")
+
+	pos, ok := q.Position("b1")
+	assert.True(t, ok)
+	assert.Equal(t, 2, pos)
+	pos, ok = q.Position("a3")
+	assert.True(t, ok)
+	assert.Equal(t, 6, pos)
+	_, ok = q.Position("blocker")
+	assert.False(t, ok, "running jobs are not waiting")
+
+	release()
+	wg.Wait()
+
+	assert.Equal(t, []string{"a1", "b1", "c1", "a2", "b2", "a3"}, order)
+}
+
+func TestJobQueue_Full(t *testing.T) {
+	q := NewJobQueue(1, 2)
+	release := blockWorker(t, q)
+	defer release()
+
+	require.NoError(t, q.Enqueue("j1", "alice", nil, func(context.Context) {}))
+	assert.False(t, q.Full())
+	require.NoError(t, q.Enqueue("j2", "bob", nil, func(context.Context) {}))
+	assert.True(t, q.Full())
+
+	assert.ErrorIs(t, q.Enqueue("j3", "carol", nil, func(context.Context) {}), ErrQueueFull)
+}
+
+func TestJobQueue_RetryAfter(t *testing.T) {
+	q := NewJobQueue(2, 1)
+	assert.Equal(t, defaultRetryAfter, q.RetryAfter())
+
+	done := make(chan struct{})
+	require.NoError(t, q.Enqueue("j1", "", nil, func(context.Context) { close(done) }))
+	<-done
+
+	// a near-instant job still suggests at least a second
+	assert.Eventually(t, func() bool { return q.RetryAfter() == time.Second }, time.Second, time.Millisecond)
+}
+
+func TestHandleProcess_QueueFull(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+
+	Queue = NewJobQueue(1, 1)
+	release := blockWorker(t, Queue)
+	defer release()
+	require.NoError(t, Queue.Enqueue("waiting", "", nil, func(context.Context) {}))
+
+	req := createMultipartRequest(t, "files", "example.txt", "text/plain", "Hello world!")
+	w := httptest.NewRecorder()
+
+	HandleProcess(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+}
+
+func TestHandleStatus_Queued(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+
+	Queue = NewJobQueue(1, 5)
+	release := blockWorker(t, Queue)
+	defer release()
+
+	id := "queued-job"
+	Jobs.SetStatus(id, JobStatus{Status: StatusQueued})
+	require.NoError(t, Queue.Enqueue("other", "alice", nil, func(context.Context) {}))
+	require.NoError(t, Queue.Enqueue(id, "alice", nil, func(context.Context) {}))
+
+	req := httptest.NewRequest("GET", "/status?object_id="+id, nil)
+	w := httptest.NewRecorder()
+
+	HandleStatus(w, req)
+
+	assert.Contains(t, w.Body.String(), `"queue_position":2`)
+	assert.Contains(t, w.Body.String(), `"status":"queued"`)
+}
+
+func TestJobQueue_CancelWaiting(t *testing.T) {
+	q := NewJobQueue(1, 10)
+	release := blockWorker(t, q)
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(id, user string) {
+		wg.Add(1)
+		require.NoError(t, q.Enqueue(id, user, nil, func(context.Context) {
+			mu.Lock()
+			order = append(order, id)
+			mu.Unlock()
+			wg.Done()
+		}))
+	}
+	enqueue("a1", "alice")
+	enqueue("b1", "bob")
+	enqueue("c1", "carol")
+
+	waiting, running := q.Cancel("b1")
+	assert.True(t, waiting)
+	assert.False(t, running)
+	wg.Done()
+
+	pos, ok := q.Position("c1")
+	assert.True(t, ok)
+	assert.Equal(t, 2, pos)
+
+	release()
+	wg.Wait()
+	assert.Equal(t, []string{"a1", "c1"}, order)
+}
+
+func TestJobQueue_CancelRunning(t *testing.T) {
+	q := NewJobQueue(1, 10)
+
+	started := make(chan struct{})
+	stopped := make(chan error)
+	require.NoError(t, q.Enqueue("j1", "", nil, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+	}))
+	<-started
+
+	waiting, running := q.Cancel("j1")
+	assert.False(t, waiting)
+	assert.True(t, running)
+	assert.ErrorIs(t, <-stopped, context.Canceled)
+
+	waiting, running = q.Cancel("unknown")
+	assert.False(t, waiting || running)
+}
+
+func TestHandleCancelJob_Queued(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+
+	Queue = NewJobQueue(1, 5)
+	release := blockWorker(t, Queue)
+	defer release()
+
+	id := "cancel-queued"
+	Jobs.SetStatus(id, JobStatus{Status: StatusQueued})
+	require.NoError(t, Queue.Enqueue(id, "alice", nil, func(context.Context) {
+		t.Error("cancelled job ran")
+	}))
+
+	req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+
+	HandleCancelJob(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"cancelled"`)
+	status, _, _ := Jobs.GetStatus(id)
+	assert.Equal(t, StatusCancelled, status.Status)
+	_, ok := Queue.Position(id)
+	assert.False(t, ok)
+}
+
+// blockingEmbedder holds a job in the embed stage until it is cancelled
+type blockingEmbedder struct{ started chan struct{} }
+
+func (blockingEmbedder) Model() string  { return "mock" }
+func (blockingEmbedder) Dimension() int { return 1 }
+func (e blockingEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	close(e.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestHandleCancelJob_Running(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+
+	Queue = NewJobQueue(1, 5)
+
+	id := "cancel-running"
+	Jobs.SetStatus(id, JobStatus{Status: StatusQueued})
+	sources := []pipeline.Source{{Filename: "a.txt", ContentType: "text/plain", Content: []byte("Some text.")}}
+	embedder := blockingEmbedder{started: make(chan struct{})}
+	opts := pipeline.ProcessOptions{Chunking: pipeline.DefaultChunkOptions, Embedder: embedder}
+	require.NoError(t, Queue.Enqueue(id, "", nil, func(ctx context.Context) {
+		runJob(ctx, id, jobSpec{Sources: sources}, opts)
+	}))
+	<-embedder.started
+
+	req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+
+	HandleCancelJob(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Eventually(t, func() bool {
+		status, _, _ := Jobs.GetStatus(id)
+		return status.Status == StatusCancelled
+	}, time.Second, time.Millisecond)
+	_, hasResult, _ := Jobs.GetResult(id)
+	assert.False(t, hasResult)
+}
+
+func TestHandleCancelJob_Finished(t *testing.T) {
+	id := "cancel-finished"
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+
+	req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+
+	HandleCancelJob(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	status, _, _ := Jobs.GetStatus(id)
+	assert.Equal(t, StatusCompleted, status.Status)
+}
+
+func TestHandleCancelJob_OtherInstance(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+	Queue = NewJobQueue(1, 5)
+
+	// neither job is held by this instance's queue
+	Jobs.SetStatus("elsewhere-running", JobStatus{Status: StatusProcessing})
+	Jobs.SetStatus("elsewhere-queued", JobStatus{Status: StatusQueued})
+
+	cancelJob := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+		req.SetPathValue("object_id", id)
+		w := httptest.NewRecorder()
+		HandleCancelJob(w, req)
+		return w
+	}
+
+	w := cancelJob("elsewhere-running")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	status, _, _ := Jobs.GetStatus("elsewhere-running")
+	assert.Equal(t, StatusProcessing, status.Status)
+
+	w = cancelJob("elsewhere-queued")
+	assert.Equal(t, http.StatusOK, w.Code)
+	status, _, _ = Jobs.GetStatus("elsewhere-queued")
+	assert.Equal(t, StatusCancelled, status.Status)
+
+	// the instance holding the job skips it once it is dequeued
+	sources := []pipeline.Source{{Filename: "a.txt", ContentType: "text/plain", Content: []byte("Some text.")}}
+	opts := pipeline.ProcessOptions{Chunking: pipeline.DefaultChunkOptions, Embedder: &recordingEmbedder{}}
+	runJob(context.Background(), "elsewhere-queued", jobSpec{Sources: sources}, opts)
+	status, _, _ = Jobs.GetStatus("elsewhere-queued")
+	assert.Equal(t, StatusCancelled, status.Status)
+	_, hasResult, _ := Jobs.GetResult("elsewhere-queued")
+	assert.False(t, hasResult)
+}
+
+func TestJobQueue_Shutdown(t *testing.T) {
+	q := NewJobQueue(1, 5)
+	release := blockWorker(t, q)
+
+	causes := make(chan error, 1)
+	require.NoError(t, q.Enqueue("waiting", "", nil, func(ctx context.Context) {
+		causes <- context.Cause(ctx)
+	}))
+
+	shutdown := make(chan struct{})
+	go func() {
+		q.Shutdown(context.Background())
+		close(shutdown)
+	}()
+
+	// waiting jobs are handed back at once
+	assert.ErrorIs(t, <-causes, ErrShuttingDown)
+	assert.ErrorIs(t, q.Enqueue("late", "", nil, func(context.Context) {}), ErrShuttingDown)
+
+	// running jobs are waited for
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned while a job was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	<-shutdown
+}
+
+func TestJobQueue_ShutdownDeadline(t *testing.T) {
+	q := NewJobQueue(1, 5)
+
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	require.NoError(t, q.Enqueue("running", "", nil, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		causes <- context.Cause(ctx)
+	}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.Shutdown(ctx)
+
+	assert.ErrorIs(t, <-causes, ErrShuttingDown)
+}
+
+func TestHandleProcess_ShuttingDown(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+
+	Queue = NewJobQueue(1, 5)
+	Queue.Shutdown(context.Background())
+
+	req := createMultipartRequest(t, "files", "example.txt", "text/plain", "Hello world!")
+	w := httptest.NewRecorder()
+
+	HandleProcess(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// JobStore persists job status and results so they survive restarts and can
+// be shared between replicas. Get methods report whether the job exists.
+type JobStore interface {
+	SetStatus(id string, status JobStatus) error
+	// TransitionStatus is SetStatus for a job whose status is still from; it
+	// reports false, storing nothing, when the job has moved on or is
+	// unknown. Instances racing to change a job use it so only one wins.
+	TransitionStatus(id, from string, status JobStatus) (bool, error)
+	// SetProgress updates only the progress of an existing job.
+	SetProgress(id string, progress pipeline.Progress) error
+	GetStatus(id string) (JobStatus, bool, error)
+	// ListJobs returns up to filter.Limit of the owner's jobs, newest first.
+	ListJobs(filter JobFilter) ([]JobSummary, error)
+	SaveResult(id string, result Result) error
+	GetResult(id string) (Result, bool, error)
+	// ExpireResult drops a job's result and marks it expired, but only while
+	// its status and expiry are still those of listed; it reports false,
+	// changing nothing, when the job was updated or given a new expiry since.
+	ExpireResult(id string, listed JobStatus) (bool, error)
+	// ListRetained returns every job that still holds a result.
+	ListRetained() ([]JobSummary, error)
+	// AddDelivery logs a webhook delivery attempt for a job.
+	AddDelivery(id string, delivery WebhookDelivery) error
+	// ListDeliveries returns a job's delivery attempts, oldest first.
+	ListDeliveries(id string) ([]WebhookDelivery, error)
+	// ClaimIdempotencyKey stores key unless its owner already holds an
+	// unexpired key of that name; then it returns the stored key and false.
+	ClaimIdempotencyKey(key IdempotencyKey) (IdempotencyKey, bool, error)
+	// AcceptIdempotencyKey stores the response and expiry of a claimed key
+	// once its request was accepted.
+	AcceptIdempotencyKey(key IdempotencyKey) error
+	// ReleaseIdempotencyKey forgets a key whose request was not accepted.
+	ReleaseIdempotencyKey(owner, key string) error
+	// PurgeIdempotencyKeys drops keys that expired by now.
+	PurgeIdempotencyKeys(now time.Time) (int, error)
+	// SaveCheckpoint stores an interrupted job, replacing an earlier
+	// checkpoint of it.
+	SaveCheckpoint(id string, spec []byte) error
+	// TakeCheckpoints removes and returns every checkpoint, oldest first.
+	TakeCheckpoints() ([]Checkpoint, error)
+}
+
+// Jobs is the store used by all job handlers. It defaults to an in-memory
+// store; RunApp swaps in the Postgres store via InitJobStore. Status and
+// progress changes made through it are published to Events.
+var Jobs JobStore = publishingJobStore{NewMemoryJobStore()}
+
+func InitJobStore(store JobStore) {
+	Jobs = publishingJobStore{store}
+}
+
+// MemoryJobStore keeps jobs in process memory. Everything is lost on
+// restart, so it is meant for tests and single-instance development.
+type MemoryJobStore struct {
+	mu          sync.RWMutex
+	statuses    map[string]JobStatus
+	results     map[string]Result
+	deliveries  map[string][]WebhookDelivery
+	keys        map[[2]string]IdempotencyKey // by owner and key
+	checkpoints map[string]Checkpoint
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		statuses:    map[string]JobStatus{},
+		results:     map[string]Result{},
+		deliveries:  map[string][]WebhookDelivery{},
+		keys:        map[[2]string]IdempotencyKey{},
+		checkpoints: map[string]Checkpoint{},
+	}
+}
+
+func (s *MemoryJobStore) SetStatus(id string, status JobStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setStatus(id, status)
+	return nil
+}
+
+func (s *MemoryJobStore) TransitionStatus(id, from string, status JobStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.statuses[id]; !ok || prev.Status != from {
+		return false, nil
+	}
+	s.setStatus(id, status)
+	return true, nil
+}
+
+// setStatus stores status, keeping what is only recorded when the job is
+// created. Callers hold s.mu.
+func (s *MemoryJobStore) setStatus(id string, status JobStatus) {
+	if prev, ok := s.statuses[id]; ok {
+		status.Owner, status.CreatedAt = prev.Owner, prev.CreatedAt
+		if status.Files == nil {
+			status.Files = prev.Files
+		}
+		status.CallbackURL, status.CallbackSecret = prev.CallbackURL, prev.CallbackSecret
+	} else if status.CreatedAt.IsZero() {
+		status.CreatedAt = time.Now()
+	}
+	s.statuses[id] = status
+}
+
+func (s *MemoryJobStore) SetProgress(id string, progress pipeline.Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[id]; ok {
+		status.Progress = progress
+		s.statuses[id] = status
+	}
+	return nil
+}
+
+func (s *MemoryJobStore) GetStatus(id string) (JobStatus, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.statuses[id]
+	return status, ok, nil
+}
+
+func (s *MemoryJobStore) ListJobs(filter JobFilter) ([]JobSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var jobs []JobSummary
+	for id, status := range s.statuses {
+		switch {
+		case status.Owner != filter.Owner,
+			filter.Status != "" && status.Status != filter.Status,
+			!filter.Since.IsZero() && status.CreatedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !status.CreatedAt.Before(filter.Until),
+			filter.After != nil && !jobBefore(status.CreatedAt, id, *filter.After):
+			continue
+		}
+		jobs = append(jobs, JobSummary{ID: id, JobStatus: status})
+	}
+
+	slices.SortFunc(jobs, func(a, b JobSummary) int {
+		if jobBefore(a.CreatedAt, a.ID, JobCursor{b.CreatedAt, b.ID}) {
+			return 1
+		}
+		return -1
+	})
+	if filter.Limit > 0 && len(jobs) > filter.Limit {
+		jobs = jobs[:filter.Limit]
+	}
+	return jobs, nil
+}
+
+// jobBefore reports whether a job sorts after the cursor in newest-first
+// order, i.e. it was created earlier or at the same time with a lower id.
+func jobBefore(created time.Time, id string, c JobCursor) bool {
+	if !created.Equal(c.CreatedAt) {
+		return created.Before(c.CreatedAt)
+	}
+	return id < c.ID
+}
+
+func (s *MemoryJobStore) SaveResult(id string, result Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = result
+	return nil
+}
+
+func (s *MemoryJobStore) GetResult(id string) (Result, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result, ok := s.results[id]
+	return result, ok, nil
+}
+
+func (s *MemoryJobStore) ExpireResult(id string, listed JobStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok || status.Status != listed.Status || !status.ExpiresAt.Equal(listed.ExpiresAt) {
+		return false, nil
+	}
+	delete(s.results, id)
+	status.Status = StatusExpired
+	status.ResultBytes = 0
+	s.statuses[id] = status
+	return true, nil
+}
+
+func (s *MemoryJobStore) ListRetained() ([]JobSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var jobs []JobSummary
+	for id := range s.results {
+		jobs = append(jobs, JobSummary{ID: id, JobStatus: s.statuses[id]})
+	}
+	return jobs, nil
+}
+
+func (s *MemoryJobStore) AddDelivery(id string, delivery WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[id] = append(s.deliveries[id], delivery)
+	return nil
+}
+
+func (s *MemoryJobStore) ListDeliveries(id string) ([]WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.deliveries[id]), nil
+}
+
+func (s *MemoryJobStore) ClaimIdempotencyKey(key IdempotencyKey) (IdempotencyKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope := [2]string{key.Owner, key.Key}
+	if stored, ok := s.keys[scope]; ok && time.Now().Before(stored.ExpiresAt) {
+		return stored, false, nil
+	}
+	s.keys[scope] = key
+	return key, true, nil
+}
+
+func (s *MemoryJobStore) AcceptIdempotencyKey(key IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scope := [2]string{key.Owner, key.Key}
+	if stored, ok := s.keys[scope]; ok && stored.ObjectID == key.ObjectID {
+		stored.Response, stored.ExpiresAt = key.Response, key.ExpiresAt
+		s.keys[scope] = stored
+	}
+	return nil
+}
+
+func (s *MemoryJobStore) ReleaseIdempotencyKey(owner, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, [2]string{owner, key})
+	return nil
+}
+
+func (s *MemoryJobStore) PurgeIdempotencyKeys(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for scope, key := range s.keys {
+		if !now.Before(key.ExpiresAt) {
+			delete(s.keys, scope)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryJobStore) SaveCheckpoint(id string, spec []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[id] = Checkpoint{ID: id, Spec: spec, SavedAt: time.Now()}
+	return nil
+}
+
+func (s *MemoryJobStore) TakeCheckpoints() ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkpoints := slices.Collect(maps.Values(s.checkpoints))
+	slices.SortFunc(checkpoints, func(a, b Checkpoint) int {
+		return a.SavedAt.Compare(b.SavedAt)
+	})
+	clear(s.checkpoints)
+	return checkpoints, nil
+}
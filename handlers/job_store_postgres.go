@@ -0,0 +1,551 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/lib/pq"
+)
+
+// PostgresJobStore keeps jobs in the jobs, documents and embeddings tables
+// created by InitSchema.
+type PostgresJobStore struct {
+	db *sql.DB
+}
+
+func NewPostgresJobStore(db *sql.DB) *PostgresJobStore {
+	return &PostgresJobStore{db: db}
+}
+
+// encodedStatus holds the columns of a job status that are stored as JSON
+// or split up.
+type encodedStatus struct {
+	progress, failures, files []byte
+	err                       pipeline.StageError
+}
+
+func encodeStatus(status JobStatus) (encodedStatus, error) {
+	var e encodedStatus
+	var err error
+	if e.progress, err = json.Marshal(status.Progress); err != nil {
+		return e, fmt.Errorf("failed to encode progress: %w", err)
+	}
+	if e.failures, err = json.Marshal(status.Failures); err != nil {
+		return e, fmt.Errorf("failed to encode failures: %w", err)
+	}
+	if e.files, err = json.Marshal(status.Files); err != nil {
+		return e, fmt.Errorf("failed to encode files: %w", err)
+	}
+	if status.Error != nil {
+		e.err = *status.Error
+	}
+	return e, nil
+}
+
+func (s *PostgresJobStore) SetStatus(id string, status JobStatus) error {
+	e, err := encodeStatus(status)
+	if err != nil {
+		return err
+	}
+	secret, err := sealSecret(status.CallbackSecret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt callback secret: %w", err)
+	}
+
+	// owner, callback and created_at are only written when the job is created,
+	// files also when an update changes them
+	_, err = s.db.Exec(`
+		INSERT INTO jobs (object_id, status, started_at, progress, error, error_stage, error_file, failures,
+			expires_at, result_bytes, owner, files, callback_url, callback_secret, created_at, updating)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, COALESCE($15, NOW()), $16)
+		ON CONFLICT (object_id) DO UPDATE
+		SET status = EXCLUDED.status, started_at = EXCLUDED.started_at, progress = EXCLUDED.progress,
+			error = EXCLUDED.error, error_stage = EXCLUDED.error_stage, error_file = EXCLUDED.error_file,
+			failures = EXCLUDED.failures, expires_at = EXCLUDED.expires_at, result_bytes = EXCLUDED.result_bytes,
+			updating = EXCLUDED.updating, files = COALESCE(NULLIF(EXCLUDED.files, 'null'::jsonb), jobs.files), updated_at = NOW()`,
+		id, status.Status, nullTime(status.StartedAt), e.progress, e.err.Message, e.err.Stage, e.err.File, e.failures,
+		nullTime(status.ExpiresAt), status.ResultBytes, status.Owner, e.files, status.CallbackURL, secret,
+		nullTime(status.CreatedAt), status.Updating)
+	if err != nil {
+		return fmt.Errorf("failed to store job status: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) TransitionStatus(id, from string, status JobStatus) (bool, error) {
+	e, err := encodeStatus(status)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = $3, started_at = $4, progress = $5, error = $6, error_stage = $7, error_file = $8,
+			failures = $9, expires_at = $10, result_bytes = $11, updating = $12,
+			files = COALESCE(NULLIF($13::jsonb, 'null'::jsonb), files), updated_at = NOW()
+		WHERE object_id = $1 AND status = $2`,
+		id, from, status.Status, nullTime(status.StartedAt), e.progress, e.err.Message, e.err.Stage, e.err.File,
+		e.failures, nullTime(status.ExpiresAt), status.ResultBytes, status.Updating, e.files)
+	if err != nil {
+		return false, fmt.Errorf("failed to store job status: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to store job status: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *PostgresJobStore) SetProgress(id string, progress pipeline.Progress) error {
+	raw, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to encode progress: %w", err)
+	}
+	_, err = s.db.Exec(`
+		UPDATE jobs SET progress = $2, updated_at = NOW()
+		WHERE object_id = $1`, id, raw)
+	if err != nil {
+		return fmt.Errorf("failed to store job progress: %w", err)
+	}
+	return nil
+}
+
+const jobStatusColumns = `status, owner, files, callback_url, callback_secret, created_at, started_at, expires_at, result_bytes, progress, error, error_stage, error_file, failures, updating`
+
+func (s *PostgresJobStore) GetStatus(id string) (JobStatus, bool, error) {
+	status, err := scanJobStatus(s.db.QueryRow(`
+		SELECT `+jobStatusColumns+` FROM jobs
+		WHERE object_id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return JobStatus{}, false, nil
+	}
+	if err != nil {
+		return JobStatus{}, false, fmt.Errorf("failed to load job status: %w", err)
+	}
+	return status, true, nil
+}
+
+func (s *PostgresJobStore) ListJobs(filter JobFilter) ([]JobSummary, error) {
+	var afterTime sql.NullTime
+	var afterID string
+	if filter.After != nil {
+		afterTime, afterID = nullTime(filter.After.CreatedAt), filter.After.ID
+	}
+	limit := sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+
+	rows, err := s.db.Query(`
+		SELECT object_id, `+jobStatusColumns+` FROM jobs
+		WHERE owner = $1
+			AND ($2::text = '' OR status = $2)
+			AND ($3::timestamptz IS NULL OR created_at >= $3)
+			AND ($4::timestamptz IS NULL OR created_at < $4)
+			AND ($5::timestamptz IS NULL OR (created_at, object_id) < ($5, $6))
+		ORDER BY created_at DESC, object_id DESC
+		LIMIT $7`,
+		filter.Owner, filter.Status, nullTime(filter.Since), nullTime(filter.Until), afterTime, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []JobSummary
+	for rows.Next() {
+		var job JobSummary
+		job.JobStatus, err = scanJobStatus(rows, &job.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+func (s *PostgresJobStore) ListRetained() ([]JobSummary, error) {
+	rows, err := s.db.Query(`
+		SELECT object_id, ` + jobStatusColumns + ` FROM jobs
+		WHERE has_result`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list retained jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []JobSummary
+	for rows.Next() {
+		var job JobSummary
+		job.JobStatus, err = scanJobStatus(rows, &job.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// scanJobStatus reads jobStatusColumns, after any leading columns given in
+// dest.
+func scanJobStatus(row interface{ Scan(...any) error }, dest ...any) (JobStatus, error) {
+	var (
+		status    JobStatus
+		files     []byte
+		startedAt sql.NullTime
+		expiresAt sql.NullTime
+		progress  []byte
+		jobErr    pipeline.StageError
+		failures  []byte
+		secret    string
+	)
+	dest = append(dest, &status.Status, &status.Owner, &files, &status.CallbackURL, &secret, &status.CreatedAt, &startedAt, &expiresAt,
+		&status.ResultBytes, &progress, &jobErr.Message, &jobErr.Stage, &jobErr.File, &failures, &status.Updating)
+	if err := row.Scan(dest...); err != nil {
+		return JobStatus{}, err
+	}
+	status.StartedAt = startedAt.Time
+	status.ExpiresAt = expiresAt.Time
+	var err error
+	// a job whose secret was stored unsealed stays readable; it is left
+	// without a secret and notifyFinished refuses to deliver its events
+	if status.CallbackSecret, err = openSecret(secret); err != nil && !errors.Is(err, errUnsealedSecret) {
+		return JobStatus{}, fmt.Errorf("failed to decrypt callback secret: %w", err)
+	}
+	if len(files) > 0 {
+		if err := json.Unmarshal(files, &status.Files); err != nil {
+			return JobStatus{}, fmt.Errorf("failed to decode files: %w", err)
+		}
+	}
+	if len(progress) > 0 {
+		if err := json.Unmarshal(progress, &status.Progress); err != nil {
+			return JobStatus{}, fmt.Errorf("failed to decode progress: %w", err)
+		}
+	}
+	if jobErr.Message != "" || jobErr.Stage != "" {
+		status.Error = &jobErr
+	}
+	if len(failures) > 0 {
+		if err := json.Unmarshal(failures, &status.Failures); err != nil {
+			return JobStatus{}, fmt.Errorf("failed to decode failures: %w", err)
+		}
+	}
+	return status, nil
+}
+
+// SaveResult replaces any stored result for the job in a single transaction.
+// The job row must already exist.
+func (s *PostgresJobStore) SaveResult(id string, result Result) error {
+	triples, err := json.Marshal(result.Triples)
+	if err != nil {
+		return fmt.Errorf("failed to encode triples: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE jobs SET model = $2, dimension = $3, triples = $4, has_result = TRUE, updated_at = NOW()
+		WHERE object_id = $1`, id, result.Model, result.Dimension, triples)
+	if err != nil {
+		return fmt.Errorf("failed to store job result: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("job %s does not exist", id)
+	}
+
+	// embeddings cascade with their documents
+	if _, err := tx.Exec(`DELETE FROM documents WHERE object_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to clear previous result: %w", err)
+	}
+
+	documents := make([][]any, len(result.Documents))
+	for i, d := range result.Documents {
+		documents[i] = []any{d.ID, i, d.Filename, d.Hash, d.Title, d.Description, d.Author, nullTime(d.Created), d.Pages, d.Text}
+	}
+	err = insertRows(tx, `INSERT INTO documents (object_id, id, position, filename, content_hash, title, description, author, created, pages, content)`, id, documents)
+	if err != nil {
+		return fmt.Errorf("failed to store documents: %w", err)
+	}
+
+	embeddings := make([][]any, len(result.Embeddings))
+	for i, e := range result.Embeddings {
+		embeddings[i] = []any{e.DocumentID, i, e.Index, e.Start, e.End, e.Section, e.Page, e.Text, pq.Array(e.Vector)}
+	}
+	err = insertRows(tx, `INSERT INTO embeddings (object_id, document_id, position, chunk_index, start_offset, end_offset, section, page, content, vector)`, id, embeddings)
+	if err != nil {
+		return fmt.Errorf("failed to store embeddings: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit job result: %w", err)
+	}
+	return nil
+}
+
+// rows per INSERT of a result; vectors make embedding rows large
+const resultInsertRows = 500
+
+// insertRows runs insert, whose first column is the job's object_id, for
+// rows in multi-row batches, so a result of thousands of chunks takes a
+// handful of round trips rather than one per row.
+func insertRows(tx *sql.Tx, insert, id string, rows [][]any) error {
+	for batch := range slices.Chunk(rows, resultInsertRows) {
+		var values strings.Builder
+		args := []any{id}
+		for i, row := range batch {
+			if i > 0 {
+				values.WriteString(", ")
+			}
+			values.WriteString("($1")
+			for _, v := range row {
+				args = append(args, v)
+				fmt.Fprintf(&values, ", $%d", len(args))
+			}
+			values.WriteString(")")
+		}
+		if _, err := tx.Exec(insert+`
+			VALUES `+values.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) ExpireResult(id string, listed JobStatus) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the row stays locked until commit, so an update cannot start on the job
+	// while its result is being deleted
+	res, err := tx.Exec(`
+		UPDATE jobs SET status = $4, triples = NULL, has_result = FALSE, result_bytes = 0, updated_at = NOW()
+		WHERE object_id = $1 AND status = $2 AND expires_at IS NOT DISTINCT FROM $3`,
+		id, listed.Status, nullTime(listed.ExpiresAt), StatusExpired)
+	if err != nil {
+		return false, fmt.Errorf("failed to expire job result: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to expire job result: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM documents WHERE object_id = $1`, id); err != nil {
+		return false, fmt.Errorf("failed to expire job result: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit result expiry: %w", err)
+	}
+	return true, nil
+}
+
+func (s *PostgresJobStore) GetResult(id string) (Result, bool, error) {
+	var (
+		result    Result
+		triples   []byte
+		hasResult bool
+	)
+	err := s.db.QueryRow(`
+		SELECT model, dimension, triples, has_result FROM jobs
+		WHERE object_id = $1`, id).Scan(&result.Model, &result.Dimension, &triples, &hasResult)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hasResult) {
+		return Result{}, false, nil
+	}
+	if err != nil {
+		return Result{}, false, fmt.Errorf("failed to load job result: %w", err)
+	}
+	if len(triples) > 0 {
+		if err := json.Unmarshal(triples, &result.Triples); err != nil {
+			return Result{}, false, fmt.Errorf("failed to decode triples: %w", err)
+		}
+	}
+
+	docs, err := s.db.Query(`
+		SELECT id, filename, content_hash, title, description, author, created, pages, content FROM documents
+		WHERE object_id = $1 ORDER BY position`, id)
+	if err != nil {
+		return Result{}, false, fmt.Errorf("failed to load documents: %w", err)
+	}
+	defer docs.Close()
+	for docs.Next() {
+		var d pipeline.Document
+		var created sql.NullTime
+		if err := docs.Scan(&d.ID, &d.Filename, &d.Hash, &d.Title, &d.Description, &d.Author, &created, &d.Pages, &d.Text); err != nil {
+			return Result{}, false, fmt.Errorf("failed to read document: %w", err)
+		}
+		d.Created = created.Time
+		result.Documents = append(result.Documents, d)
+	}
+	if err := docs.Err(); err != nil {
+		return Result{}, false, fmt.Errorf("failed to read documents: %w", err)
+	}
+
+	embs, err := s.db.Query(`
+		SELECT e.document_id, d.filename, e.chunk_index, e.start_offset, e.end_offset, e.section, e.page, e.content, e.vector
+		FROM embeddings e JOIN documents d ON d.id = e.document_id
+		WHERE e.object_id = $1 ORDER BY e.position`, id)
+	if err != nil {
+		return Result{}, false, fmt.Errorf("failed to load embeddings: %w", err)
+	}
+	defer embs.Close()
+	for embs.Next() {
+		var e pipeline.Embedding
+		if err := embs.Scan(&e.DocumentID, &e.Filename, &e.Index, &e.Start, &e.End, &e.Section, &e.Page, &e.Text, pq.Array(&e.Vector)); err != nil {
+			return Result{}, false, fmt.Errorf("failed to read embedding: %w", err)
+		}
+		result.Embeddings = append(result.Embeddings, e)
+	}
+	if err := embs.Err(); err != nil {
+		return Result{}, false, fmt.Errorf("failed to read embeddings: %w", err)
+	}
+
+	return result, true, nil
+}
+
+func (s *PostgresJobStore) AddDelivery(id string, d WebhookDelivery) error {
+	_, err := s.db.Exec(`
+		INSERT INTO webhook_deliveries (object_id, event, url, attempt, status_code, error, delivered, attempted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		id, d.Event, d.URL, d.Attempt, d.StatusCode, d.Error, d.Delivered, d.At)
+	if err != nil {
+		return fmt.Errorf("failed to log webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) ListDeliveries(id string) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(`
+		SELECT event, url, attempt, status_code, error, delivered, attempted_at FROM webhook_deliveries
+		WHERE object_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.Event, &d.URL, &d.Attempt, &d.StatusCode, &d.Error, &d.Delivered, &d.At); err != nil {
+			return nil, fmt.Errorf("failed to read webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (s *PostgresJobStore) ClaimIdempotencyKey(key IdempotencyKey) (IdempotencyKey, bool, error) {
+	// an expired key is taken over as if it did not exist
+	var id string
+	err := s.db.QueryRow(`
+		INSERT INTO idempotency_keys (owner, key, payload_hash, object_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (owner, key) DO UPDATE
+		SET payload_hash = EXCLUDED.payload_hash, object_id = EXCLUDED.object_id, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= NOW()
+		RETURNING object_id`,
+		key.Owner, key.Key, key.PayloadHash, key.ObjectID, key.ExpiresAt).Scan(&id)
+	if err == nil {
+		return key, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	stored := IdempotencyKey{Owner: key.Owner, Key: key.Key}
+	err = s.db.QueryRow(`
+		SELECT payload_hash, object_id, expires_at, response FROM idempotency_keys
+		WHERE owner = $1 AND key = $2`, key.Owner, key.Key).Scan(&stored.PayloadHash, &stored.ObjectID, &stored.ExpiresAt, &stored.Response)
+	if err != nil {
+		return IdempotencyKey{}, false, fmt.Errorf("failed to load idempotency key: %w", err)
+	}
+	return stored, false, nil
+}
+
+func (s *PostgresJobStore) AcceptIdempotencyKey(key IdempotencyKey) error {
+	_, err := s.db.Exec(`
+		UPDATE idempotency_keys SET response = $4, expires_at = $5
+		WHERE owner = $1 AND key = $2 AND object_id = $3`,
+		key.Owner, key.Key, key.ObjectID, key.Response, key.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to accept idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) ReleaseIdempotencyKey(owner, key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE owner = $1 AND key = $2`, owner, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) PurgeIdempotencyKeys(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func (s *PostgresJobStore) SaveCheckpoint(id string, spec []byte) error {
+	_, err := s.db.Exec(`
+		INSERT INTO job_checkpoints (object_id, spec)
+		VALUES ($1, $2)
+		ON CONFLICT (object_id) DO UPDATE
+		SET spec = EXCLUDED.spec, saved_at = NOW()`,
+		id, spec,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) TakeCheckpoints() ([]Checkpoint, error) {
+	rows, err := s.db.Query(`DELETE FROM job_checkpoints RETURNING object_id, spec, saved_at`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take checkpoints: %w", err)
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var c Checkpoint
+		if err := rows.Scan(&c.ID, &c.Spec, &c.SavedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan checkpoint: %w", err)
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to take checkpoints: %w", err)
+	}
+	// DELETE ... RETURNING has no ORDER BY
+	slices.SortFunc(checkpoints, func(a, b Checkpoint) int {
+		return a.SavedAt.Compare(b.SavedAt)
+	})
+	return checkpoints, nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sealedAs matches a callback secret stored encrypted.
+type sealedAs string
+
+func (s sealedAs) Match(v driver.Value) bool {
+	stored, ok := v.(string)
+	if !ok || stored == string(s) {
+		return false
+	}
+	secret, err := openSecret(stored)
+	return err == nil && secret == string(s)
+}
+
+func TestPostgresJobStore_SetStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	started := time.Now()
+	expires := started.Add(time.Hour)
+	mock.ExpectExec("INSERT INTO jobs").
+		WithArgs("job1", "partial", started, sqlmock.AnyArg(), "no text to embed", "chunk", "a.txt",
+			[]byte(`[{"stage":"chunk","file":"a.txt","message":"no text to embed"}]`),
+			expires, int64(1024), "alice@example.com", []byte(`["a.txt"]`), "https://example.com/hook", sealedAs("s3cret"), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	failure := pipeline.StageError{Stage: pipeline.StageChunk, File: "a.txt", Message: "no text to embed"}
+	store := NewPostgresJobStore(db)
+	require.NoError(t, store.SetStatus("job1", JobStatus{
+		Status:         StatusPartial,
+		Owner:          "alice@example.com",
+		Files:          []string{"a.txt"},
+		CallbackURL:    "https://example.com/hook",
+		CallbackSecret: "s3cret",
+		StartedAt:      started,
+		ExpiresAt:      expires,
+		ResultBytes:    1024,
+		Progress:       pipeline.Progress{Stage: pipeline.StageEmbed, FilesTotal: 1},
+		Error:          &failure,
+		Failures:       []pipeline.StageError{failure},
+	}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_SetProgress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE jobs SET progress").
+		WithArgs("job1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store := NewPostgresJobStore(db)
+	require.NoError(t, store.SetProgress("job1", pipeline.Progress{Stage: pipeline.StageExtract, FilesTotal: 3}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_TransitionStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, rows := range []int64{1, 0} {
+		mock.ExpectExec(`UPDATE jobs\s+SET status = \$3(.|\s)+WHERE object_id = \$1 AND status = \$2`).
+			WithArgs("job1", "queued", "cancelled", nil, sqlmock.AnyArg(), "", "", "", []byte("null"), nil, int64(0), false, []byte("null")).
+			WillReturnResult(sqlmock.NewResult(0, rows))
+	}
+
+	store := NewPostgresJobStore(db)
+	ok, err := store.TransitionStatus("job1", StatusQueued, JobStatus{Status: StatusCancelled})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	// the job was no longer queued
+	ok, err = store.TransitionStatus("job1", StatusQueued, JobStatus{Status: StatusCancelled})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_GetStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	started := time.Now()
+	created := started.Add(-time.Minute)
+	sealed, err := sealSecret("s3cret")
+	require.NoError(t, err)
+	columns := []string{"status", "owner", "files", "callback_url", "callback_secret", "created_at", "started_at", "expires_at", "result_bytes", "progress", "error", "error_stage", "error_file", "failures", "updating"}
+	mock.ExpectQuery("SELECT status, owner, files, callback_url, callback_secret, created_at, started_at, expires_at, result_bytes, progress, error, error_stage, error_file, failures, updating FROM jobs").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("completed", "alice@example.com", []byte(`["a.txt","b.txt"]`), "https://example.com/hook", sealed, created, started, nil, 2048,
+			[]byte(`{"stage":"embed","files_total":2}`), "", "", "", []byte("null"), false))
+	mock.ExpectQuery("SELECT status, owner, files, callback_url, callback_secret, created_at, started_at, expires_at, result_bytes, progress, error, error_stage, error_file, failures, updating FROM jobs").
+		WithArgs("job2").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("failed", "", nil, "", "", created, nil, nil, 0, nil, "service unavailable", "embed", "a.txt",
+			[]byte(`[{"stage":"embed","file":"a.txt","message":"service unavailable"}]`), true))
+	mock.ExpectQuery("SELECT status, owner, files, callback_url, callback_secret, created_at, started_at, expires_at, result_bytes, progress, error, error_stage, error_file, failures, updating FROM jobs").
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	store := NewPostgresJobStore(db)
+
+	status, ok, err := store.GetStatus("job1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "completed", status.Status)
+	assert.Equal(t, "alice@example.com", status.Owner)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, status.Files)
+	assert.True(t, status.CreatedAt.Equal(created))
+	assert.True(t, status.StartedAt.Equal(started))
+	assert.Equal(t, int64(2048), status.ResultBytes)
+	assert.Equal(t, "https://example.com/hook", status.CallbackURL)
+	assert.Equal(t, "s3cret", status.CallbackSecret)
+	assert.Equal(t, pipeline.Progress{Stage: pipeline.StageEmbed, FilesTotal: 2}, status.Progress)
+	assert.Nil(t, status.Error)
+
+	status, ok, err = store.GetStatus("job2")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	failure := pipeline.StageError{Stage: pipeline.StageEmbed, File: "a.txt", Message: "service unavailable"}
+	assert.Equal(t, &failure, status.Error)
+	assert.Equal(t, []pipeline.StageError{failure}, status.Failures)
+	assert.True(t, status.Updating)
+
+	_, ok, err = store.GetStatus("missing")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_ListJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	since := time.Now().Add(-time.Hour)
+	after := JobCursor{CreatedAt: time.Now(), ID: "job9"}
+	created := since.Add(time.Minute)
+	columns := []string{"object_id", "status", "owner", "files", "callback_url", "callback_secret", "created_at", "started_at", "expires_at", "result_bytes", "progress", "error", "error_stage", "error_file", "failures", "updating"}
+	mock.ExpectQuery("SELECT object_id, status, owner, .* FROM jobs\\s+WHERE owner").
+		WithArgs("alice@example.com", "completed", since, nil, after.CreatedAt, "job9", int64(3)).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("job2", "completed", "alice@example.com", []byte(`["b.txt"]`), "", "", created.Add(time.Second), nil, nil, 0, nil, "", "", "", nil, false).
+			AddRow("job1", "completed", "alice@example.com", []byte(`["a.txt"]`), "", "", created, nil, nil, 0, nil, "", "", "", nil, false))
+
+	store := NewPostgresJobStore(db)
+	jobs, err := store.ListJobs(JobFilter{Owner: "alice@example.com", Status: StatusCompleted, Since: since, After: &after, Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "job2", jobs[0].ID)
+	assert.Equal(t, []string{"a.txt"}, jobs[1].Files)
+	assert.True(t, jobs[1].CreatedAt.Equal(created))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_SaveResult(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	result := Result{
+		Model:     "mock",
+		Dimension: 2,
+		Documents: []pipeline.Document{
+			{ID: "doc1", Filename: "a.txt", Hash: "abc", Text: "hello"},
+			{ID: "doc2", Filename: "b.txt", Hash: "def", Text: "world"},
+		},
+	}
+	// more embeddings than fit in one INSERT
+	for i := range resultInsertRows + 1 {
+		result.Embeddings = append(result.Embeddings, pipeline.Embedding{
+			Chunk:  pipeline.Chunk{DocumentID: "doc1", Filename: "a.txt", Index: i, Start: 0, End: 5, Text: "hello"},
+			Vector: []float64{0.1, 0.2},
+		})
+	}
+	embeddingArgs := func(from, to int) []driver.Value {
+		args := []driver.Value{"job1"}
+		for i := from; i < to; i++ {
+			args = append(args, "doc1", i, i, 0, 5, "", 0, "hello", sqlmock.AnyArg())
+		}
+		return args
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE jobs SET model").
+		WithArgs("job1", "mock", 2, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM documents").
+		WithArgs("job1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO documents .+ VALUES \(\$1, \$2, .+, \$11\), \(\$1, \$12, .+, \$21\)$`).
+		WithArgs("job1", "doc1", 0, "a.txt", "abc", "", "", "", nil, 0, "hello",
+			"doc2", 1, "b.txt", "def", "", "", "", nil, 0, "world").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO embeddings").
+		WithArgs(embeddingArgs(0, resultInsertRows)...).
+		WillReturnResult(sqlmock.NewResult(0, resultInsertRows))
+	mock.ExpectExec("INSERT INTO embeddings").
+		WithArgs(embeddingArgs(resultInsertRows, resultInsertRows+1)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	store := NewPostgresJobStore(db)
+	require.NoError(t, store.SaveResult("job1", result))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_SaveResult_UnknownJob(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE jobs SET model").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	store := NewPostgresJobStore(db)
+	assert.Error(t, store.SaveResult("missing", Result{}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_GetResult(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT model, dimension, triples, has_result FROM jobs").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows([]string{"model", "dimension", "triples", "has_result"}).
+			AddRow("mock", 2, []byte(`[{"subject":"a","predicate":"is","object":"b","document_id":"doc1"}]`), true))
+	created := time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, filename, content_hash, title, description, author, created, pages, content FROM documents").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "filename", "content_hash", "title", "description", "author", "created", "pages", "content"}).
+			AddRow("doc1", "a.pdf", "abc", "A", "About a", "Ada", created, 3, "hello"))
+	mock.ExpectQuery("FROM embeddings e JOIN documents d").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows([]string{"document_id", "filename", "chunk_index", "start_offset", "end_offset", "section", "page", "content", "vector"}).
+			AddRow("doc1", "a.pdf", 0, 0, 5, "Intro", 2, "hello", "{0.1,0.2}"))
+
+	store := NewPostgresJobStore(db)
+	result, ok, err := store.GetResult("job1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, "mock", result.Model)
+	assert.Equal(t, 2, result.Dimension)
+	assert.Equal(t, []pipeline.Document{{
+		ID: "doc1", Filename: "a.pdf", Hash: "abc", Title: "A", Description: "About a", Author: "Ada", Created: created, Pages: 3, Text: "hello",
+	}}, result.Documents)
+	require.Len(t, result.Embeddings, 1)
+	assert.Equal(t, []float64{0.1, 0.2}, result.Embeddings[0].Vector)
+	assert.Equal(t, 5, result.Embeddings[0].End)
+	assert.Equal(t, "Intro", result.Embeddings[0].Section)
+	assert.Equal(t, 2, result.Embeddings[0].Page)
+	require.Len(t, result.Triples, 1)
+	assert.Equal(t, "doc1", result.Triples[0].DocumentID)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_GetResult_NotReady(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT model, dimension, triples, has_result FROM jobs").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows([]string{"model", "dimension", "triples", "has_result"}).
+			AddRow("", 0, nil, false))
+
+	store := NewPostgresJobStore(db)
+	_, ok, err := store.GetResult("job1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_ExpireResult(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	expires := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE jobs SET status = \$4(.|\s)+WHERE object_id = \$1 AND status = \$2 AND expires_at IS NOT DISTINCT FROM \$3`).
+		WithArgs("job1", "completed", expires, "expired").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM documents").
+		WithArgs("job1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	// updated since it was listed: nothing is deleted
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE jobs SET status = \\$4").
+		WithArgs("job2", "completed", expires, "expired").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	store := NewPostgresJobStore(db)
+	ok, err := store.ExpireResult("job1", JobStatus{Status: StatusCompleted, ExpiresAt: expires})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.ExpireResult("job2", JobStatus{Status: StatusCompleted, ExpiresAt: expires})
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_ListRetained(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	expires := time.Now()
+	columns := []string{"object_id", "status", "owner", "files", "callback_url", "callback_secret", "created_at", "started_at", "expires_at", "result_bytes", "progress", "error", "error_stage", "error_file", "failures", "updating"}
+	mock.ExpectQuery("FROM jobs\\s+WHERE has_result").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("job1", "completed", "alice@example.com", nil, "", "", expires.Add(-time.Hour), nil, expires, 4096, nil, "", "", "", nil, false))
+
+	store := NewPostgresJobStore(db)
+	jobs, err := store.ListRetained()
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "job1", jobs[0].ID)
+	assert.True(t, jobs[0].ExpiresAt.Equal(expires))
+	assert.Equal(t, int64(4096), jobs[0].ResultBytes)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_Deliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	at := time.Now()
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs("job1", "job.completed", "https://example.com/hook", 1, 503, "503 Service Unavailable", false, at).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT event, url, attempt, status_code, error, delivered, attempted_at FROM webhook_deliveries").
+		WithArgs("job1").
+		WillReturnRows(sqlmock.NewRows([]string{"event", "url", "attempt", "status_code", "error", "delivered", "attempted_at"}).
+			AddRow("job.completed", "https://example.com/hook", 1, 503, "503 Service Unavailable", false, at))
+
+	store := NewPostgresJobStore(db)
+	delivery := WebhookDelivery{Event: "job.completed", URL: "https://example.com/hook", Attempt: 1, StatusCode: 503, Error: "503 Service Unavailable", At: at}
+	require.NoError(t, store.AddDelivery("job1", delivery))
+
+	deliveries, err := store.ListDeliveries("job1")
+	require.NoError(t, err)
+	assert.Equal(t, []WebhookDelivery{delivery}, deliveries)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_ClaimIdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	expires := time.Now().Add(time.Hour)
+	key := IdempotencyKey{Owner: "alice", Key: "k1", PayloadHash: "h1", ObjectID: "job1", ExpiresAt: expires}
+
+	mock.ExpectQuery("INSERT INTO idempotency_keys").
+		WithArgs("alice", "k1", "h1", "job1", expires).
+		WillReturnRows(sqlmock.NewRows([]string{"object_id"}).AddRow("job1"))
+	// held by an earlier request
+	mock.ExpectQuery("INSERT INTO idempotency_keys").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT payload_hash, object_id, expires_at, response FROM idempotency_keys").
+		WithArgs("alice", "k1").
+		WillReturnRows(sqlmock.NewRows([]string{"payload_hash", "object_id", "expires_at", "response"}).AddRow("h0", "job0", expires, []byte(`{"object_id":"job0"}`)))
+	mock.ExpectExec("UPDATE idempotency_keys SET response").
+		WithArgs("alice", "k1", "job1", []byte(`{"object_id":"job1"}`), expires).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	store := NewPostgresJobStore(db)
+	stored, claimed, err := store.ClaimIdempotencyKey(key)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, key, stored)
+
+	stored, claimed, err = store.ClaimIdempotencyKey(key)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "job0", stored.ObjectID)
+	assert.Equal(t, "h0", stored.PayloadHash)
+	assert.JSONEq(t, `{"object_id":"job0"}`, string(stored.Response))
+
+	key.Response = []byte(`{"object_id":"job1"}`)
+	require.NoError(t, store.AcceptIdempotencyKey(key))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresJobStore_Checkpoints(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectExec("INSERT INTO job_checkpoints").
+		WithArgs("job2", []byte(`{"owner":"alice"}`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("DELETE FROM job_checkpoints RETURNING object_id, spec, saved_at").
+		WillReturnRows(sqlmock.NewRows([]string{"object_id", "spec", "saved_at"}).
+			AddRow("job2", []byte(`{"owner":"alice"}`), now).
+			AddRow("job1", []byte(`{}`), now.Add(-time.Minute)))
+
+	store := NewPostgresJobStore(db)
+	require.NoError(t, store.SaveCheckpoint("job2", []byte(`{"owner":"alice"}`)))
+
+	checkpoints, err := store.TakeCheckpoints()
+	require.NoError(t, err)
+	require.Len(t, checkpoints, 2)
+	assert.Equal(t, "job1", checkpoints[0].ID, "oldest first")
+	assert.Equal(t, []byte(`{"owner":"alice"}`), checkpoints[1].Spec)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
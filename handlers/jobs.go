@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultJobsLimit = 20
+	maxJobsLimit     = 100
+)
+
+// HandleListJobs lists the caller's jobs, newest first.
+//
+// GET /jobs?status={status}&since={time}&until={time}&limit={n}&cursor={cursor}
+//
+// Parameters:
+//   - status (optional): Only jobs in this state (queued, processing,
+//     completed, partial, failed, cancelled or expired)
+//   - since, until (optional): RFC 3339 times; only jobs created at or after
+//     since and before until
+//   - limit (optional): Page size, 1 to 100 (default 20)
+//   - cursor (optional): next_cursor from the previous page
+//
+// Returns:
+//   - 200: JSON with jobs and next_cursor, which is null on the last page
+//   - 400: Invalid status, time, limit or cursor
+//   - 405: Method is not GET
+//   - 500: The job store could not be read
+//
+// Example response:
+//
+//	{
+//	  "jobs": [
+//	    {"object_id": "4c1d...", "status": "completed", "files": ["a.pdf"], "created_at": "2025-07-01T10:00:00Z", "error_message": null}
+//	  ],
+//	  "next_cursor": "MTc1MTM2NDAwMDAwMDAwMDAwMDo0YzFk..."
+//	}
+func HandleListJobs(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if r.Method != http.MethodGet {
+		slog.Error("invalid method", slog.String("method", r.Method))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := jobFilter(r)
+	if err != nil {
+		slog.Error("invalid job filter", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := filter.Limit
+	filter.Limit++ // one extra to tell whether there is another page
+
+	jobs, err := Jobs.ListJobs(filter)
+	if err != nil {
+		slog.Error("failed to list jobs", slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var next *string
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		last := jobs[limit-1]
+		cursor := encodeJobCursor(JobCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+		next = &cursor
+	}
+
+	list := make([]map[string]any, 0, len(jobs))
+	for _, job := range jobs {
+		files := job.Files
+		if files == nil {
+			files = []string{}
+		}
+		list = append(list, map[string]any{
+			"object_id":     job.ID,
+			"status":        job.Status,
+			"files":         files,
+			"created_at":    job.CreatedAt,
+			"error_message": job.Error,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"jobs":        list,
+		"next_cursor": next,
+	})
+}
+
+// jobFilter parses the query parameters of GET /jobs.
+func jobFilter(r *http.Request) (JobFilter, error) {
+	q := r.URL.Query()
+	filter := JobFilter{Owner: requestOwner(r), Status: q.Get("status"), Limit: defaultJobsLimit}
+
+	switch filter.Status {
+	case "", StatusQueued, StatusProcessing, StatusCompleted, StatusPartial, StatusFailed, StatusCancelled, StatusExpired:
+	default:
+		return JobFilter{}, fmt.Errorf("invalid status: %s", filter.Status)
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return JobFilter{}, fmt.Errorf("invalid %s: expected an RFC 3339 time", name)
+			}
+			*dst = t
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxJobsLimit {
+			return JobFilter{}, fmt.Errorf("invalid limit: must be between 1 and %d", maxJobsLimit)
+		}
+		filter.Limit = n
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := decodeJobCursor(v)
+		if err != nil {
+			return JobFilter{}, fmt.Errorf("invalid cursor")
+		}
+		filter.After = &cursor
+	}
+	return filter, nil
+}
+
+// encodeJobCursor makes an opaque page token from the last job of a page.
+func encodeJobCursor(c JobCursor) string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeJobCursor(s string) (JobCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return JobCursor{}, err
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return JobCursor{}, fmt.Errorf("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return JobCursor{}, err
+	}
+	return JobCursor{CreatedAt: time.Unix(0, n), ID: id}, nil
+}
+
+// authorizeJob loads a job for a job-scoped handler and checks that the
+// caller owns it. Jobs owned by someone else are reported as not found so
+// object IDs cannot be probed. When it returns false the response has
+// already been written.
+func authorizeJob(w http.ResponseWriter, r *http.Request, id string) (JobStatus, bool) {
+	status, exists, err := Jobs.GetStatus(id)
+	if err != nil {
+		slog.Error("failed to load job status", slog.String("object_id", id), slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return JobStatus{}, false
+	}
+	if !exists {
+		slog.Warn("job not found", slog.String("object_id", id))
+		http.Error(w, "Not found", http.StatusNotFound)
+		return JobStatus{}, false
+	}
+	if status.Owner != requestOwner(r) {
+		slog.Warn("job requested by another user", slog.String("object_id", id), slog.String("user", requestOwner(r)))
+		http.Error(w, "Not found", http.StatusNotFound)
+		return JobStatus{}, false
+	}
+	return status, true
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// asUser returns req as if AuthenticateJWT had accepted a token for email
+func asUser(req *http.Request, email string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), "email", email))
+}
+
+type jobsPage struct {
+	Jobs []struct {
+		ObjectID string   `json:"object_id"`
+		Status   string   `json:"status"`
+		Files    []string `json:"files"`
+	} `json:"jobs"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+func listJobs(t *testing.T, query, email string) jobsPage {
+	req := asUser(httptest.NewRequest("GET", "/jobs?"+query, nil), email)
+	w := httptest.NewRecorder()
+
+	HandleListJobs(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var page jobsPage
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	return page
+}
+
+func TestMemoryJobStore_TransitionStatus(t *testing.T) {
+	store := NewMemoryJobStore()
+	require.NoError(t, store.SetStatus("job1", JobStatus{Status: StatusQueued, Owner: "alice"}))
+
+	ok, err := store.TransitionStatus("job1", StatusQueued, JobStatus{Status: StatusProcessing})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	// a cancel arriving after the worker took the job loses
+	ok, err = store.TransitionStatus("job1", StatusQueued, JobStatus{Status: StatusCancelled})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	status, _, _ := store.GetStatus("job1")
+	assert.Equal(t, StatusProcessing, status.Status)
+	assert.Equal(t, "alice", status.Owner)
+
+	ok, _ = store.TransitionStatus("unknown", StatusQueued, JobStatus{Status: StatusCancelled})
+	assert.False(t, ok)
+}
+
+func TestJobOwnership(t *testing.T) {
+	original := Jobs
+	defer func() { Jobs = original }()
+	Jobs = NewMemoryJobStore()
+
+	id := "alice-job"
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted, Owner: "alice@example.com"})
+	Jobs.SaveResult(id, Result{Model: "mock"})
+
+	// later updates keep the owner
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+
+	handlers := map[string]http.HandlerFunc{
+		"/status?object_id=" + id:                  HandleStatus,
+		"/result?object_id=" + id:                  HandleResult,
+		"/export?object_id=" + id + "&format=json": HandleExport,
+	}
+	for target, handler := range handlers {
+		w := httptest.NewRecorder()
+		handler(w, asUser(httptest.NewRequest("GET", target, nil), "mallory@example.com"))
+		assert.Equal(t, http.StatusNotFound, w.Code, target)
+
+		w = httptest.NewRecorder()
+		handler(w, asUser(httptest.NewRequest("GET", target, nil), "alice@example.com"))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+	}
+
+	req := asUser(httptest.NewRequest("DELETE", "/jobs/"+id, nil), "mallory@example.com")
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+	HandleCancelJob(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHandleListJobs(t *testing.T) {
+	original := Jobs
+	defer func() { Jobs = original }()
+	Jobs = NewMemoryJobStore()
+
+	start := time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"j1", "j2", "j3", "j4", "j5"} {
+		status := StatusCompleted
+		if i%2 == 1 {
+			status = StatusFailed
+		}
+		Jobs.SetStatus(id, JobStatus{
+			Status:    status,
+			Owner:     "alice@example.com",
+			Files:     []string{id + ".txt"},
+			CreatedAt: start.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	Jobs.SetStatus("other", JobStatus{Status: StatusCompleted, Owner: "bob@example.com", CreatedAt: start})
+
+	page := listJobs(t, "limit=2", "alice@example.com")
+	require.Len(t, page.Jobs, 2)
+	assert.Equal(t, "j5", page.Jobs[0].ObjectID)
+	assert.Equal(t, []string{"j5.txt"}, page.Jobs[0].Files)
+	assert.Equal(t, "j4", page.Jobs[1].ObjectID)
+	require.NotNil(t, page.NextCursor)
+
+	page = listJobs(t, "limit=2&cursor="+*page.NextCursor, "alice@example.com")
+	require.Len(t, page.Jobs, 2)
+	assert.Equal(t, "j3", page.Jobs[0].ObjectID)
+	require.NotNil(t, page.NextCursor)
+
+	page = listJobs(t, "limit=2&cursor="+*page.NextCursor, "alice@example.com")
+	require.Len(t, page.Jobs, 1)
+	assert.Equal(t, "j1", page.Jobs[0].ObjectID)
+	assert.Nil(t, page.NextCursor)
+
+	page = listJobs(t, "status=failed", "alice@example.com")
+	require.Len(t, page.Jobs, 2)
+	assert.Equal(t, "j4", page.Jobs[0].ObjectID)
+	assert.Equal(t, "j2", page.Jobs[1].ObjectID)
+
+	page = listJobs(t, "since=2025-07-01T11:00:00Z&until=2025-07-01T13:00:00Z", "alice@example.com")
+	require.Len(t, page.Jobs, 2)
+	assert.Equal(t, "j3", page.Jobs[0].ObjectID)
+	assert.Equal(t, "j2", page.Jobs[1].ObjectID)
+
+	page = listJobs(t, "", "bob@example.com")
+	require.Len(t, page.Jobs, 1)
+	assert.Equal(t, "other", page.Jobs[0].ObjectID)
+}
+
+func TestHandleListJobs_BadRequest(t *testing.T) {
+	for _, query := range []string{"status=done", "since=yesterday", "limit=0", "limit=101", "cursor=bm90LWEtY3Vyc29y"} {
+		req := asUser(httptest.NewRequest("GET", "/jobs?"+query, nil), "alice@example.com")
+		w := httptest.NewRecorder()
+
+		HandleListJobs(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
-	"path/filepath"
-	"strings"
+	"os"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/abdulahshoaib/quirk/pipeline"
@@ -27,21 +31,76 @@ func enableCors(w *http.ResponseWriter) {
 // processing using the embedding model, and returns a unique object ID.
 //
 // POST /process
+// POST /process?object_id={id}
 //
 // Description:
 //   - Accepts multipart form uploads under the field "files".
-//   - Reads all uploaded files into memory.
-//   - Triggers asynchronous processing for embeddings and triples.
-//   - Tracks job status using an internal job ID.
+//   - Streams the upload: files up to Uploads.Memory bytes are read into
+//     memory, larger ones are spooled to Uploads.Dir and read from there by
+//     the job, which removes them once it finishes. Checks their types.
+//   - Expands .zip, .tar, .tar.gz and .tgz uploads, and archives nested in
+//     them, into one document per file, named by its path in the archive.
+//     The archives of a request may expand to at most
+//     pipeline.DefaultArchiveLimits together. Files in them that no
+//     converter claims are skipped and reported among the job's failures.
+//   - Queues the job; a worker then runs text extraction, embedding and triple
+//     extraction in the background. Workers serve users round-robin.
+//   - Tracks job status using an internal job ID; the job is owned by the
+//     authenticated user and only visible to them.
+//   - With object_id, updates that completed or partial job instead: uploads
+//     with a new name are added, uploads that differ from the stored file of
+//     the same name replace it and files named in "remove" are dropped. Only
+//     added and replaced files are processed; the job is queued again and its
+//     result, exports and status reflect the merged corpus once it finishes.
+//     Cancelling the update leaves the job as it was.
 //
 // Request:
 //   - Content-Type: multipart/form-data
-//   - Form Field: files (one or more files)
+//   - Query Parameter: object_id (optional): the job to update
+//   - Header: Idempotency-Key (optional): a key of up to 255 printable ASCII
+//     characters, scoped to the user. Repeating a request with the same key
+//     and the same payload returns the original object_id instead of
+//     creating another job; keys are remembered for IDEMPOTENCY_TTL
+//   - Form Field: files (one or more files; optional when updating)
+//   - Form Field: remove (optional, updates only): names of files to drop,
+//     repeated or comma separated
+//   - Form Field: chunk_strategy (optional): fixed, overlap or sentence (default)
+//   - Form Field: chunk_size (optional): maximum characters per chunk
+//   - Form Field: chunk_overlap (optional): characters shared by consecutive chunks
+//   - Form Field: select (optional): element and key paths to keep from XML
+//     and YAML files, e.g. "description" or "item.@id", repeated or comma
+//     separated; everything else in those files is left out
+//   - Form Field: provider (optional): embedding provider, one of cloudflare, openai
+//     or ollama; defaults to the deployment's EMBEDDING_PROVIDER
+//   - Form Field: triples (optional): triple extractor, one of rules, llm or none;
+//     defaults to the deployment's TRIPLE_EXTRACTOR
+//   - Form Field: ttl (optional): how long to keep the result once the job
+//     finishes, e.g. "2h"; at most the deployment's RESULT_TTL
+//   - Form Field: callback_url, callback_secret (optional, together): URL that
+//     receives a job.<status> event signed with the secret when the job
+//     completes, fails or is cancelled; it must not point to a loopback,
+//     private or link-local address
 //
 // Returns:
-//   - 200: JSON object with { "object_id": string }
-//   - 400: If no files are uploaded or request is malformed
+//   - 200: JSON object with { "object_id": string }; updates also list the
+//     added, replaced, removed and unchanged files. An update that changes
+//     nothing is not queued. Archive files that were skipped are listed
+//     under "skipped" with the reason.
+//   - 400: If no files are uploaded, a file outside an archive or every file
+//     in the archives is unsupported, an archive is malformed or the archives
+//     exceed their limits, chunk options, select, provider,
+//     extractor, ttl or callback are invalid, an update names unknown files or
+//     uses another embedding model than the job, the Idempotency-Key is
+//     invalid, or request is malformed
+//   - 404: If the job to update does not exist or is owned by another user
 //   - 405: If method is not POST
+//   - 409: If the job to update is not completed or partial or another
+//     request changes it at the same time, or the
+//     Idempotency-Key was used for a different payload or by a request that
+//     is still in progress
+//   - 413: If the request is larger than MAX_UPLOAD_SIZE or a file larger
+//     than MAX_FILE_SIZE
+//   - 429: If the job queue is full; Retry-After suggests when to try again
 //
 // Example:
 //
@@ -64,116 +123,547 @@ func HandleProcess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(50 << 20) // 50MB
+	key, err := idempotencyKey(r)
 	if err != nil {
+		slog.Error("invalid idempotency key", slog.Any("error", err))
+		http.Error(w, "Invalid Idempotency-Key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// refuse before reading the upload when there is no room for the job; a
+	// retry with a key may only be asking for the job it already created
+	if key == "" && Queue.Full() {
+		slog.Warn("job queue full")
+		rejectQueueFull(w)
+		return
+	}
+
+	object_id := r.URL.Query().Get("object_id")
+	var previous JobStatus
+	if object_id != "" {
+		var ok bool
+		if previous, ok = authorizeJob(w, r, object_id); !ok {
+			return
+		}
+	}
+
+	// a large upload may outlast the server's timeouts if it keeps arriving
+	r.Body = uploadBody(w, r)
+	uploads, err := readUploads(w, r)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+	case errors.As(err, &tooLarge):
+		slog.Error("request too large", slog.Int64("limit", tooLarge.Limit))
+		http.Error(w, "Request larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errUploadTooLarge):
+		slog.Error("file too large", slog.Any("error", err))
+		http.Error(w, "File too large: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errReadUpload):
+		slog.Error("failed to read uploaded file", slog.Any("error", err))
+		http.Error(w, "Read error: "+err.Error(), http.StatusInternalServerError)
+		return
+	default:
 		slog.Error("failed to parse multipart form", slog.Any("error", err))
 		http.Error(w, "Failed to parse:"+err.Error(), http.StatusBadRequest)
 		return
 	}
+	// spooled files are removed unless a queued job still needs them
+	var queued []pipeline.Source
+	var expanded []upload
+	defer func() { discardUploads(slices.Concat(uploads, expanded), queued) }()
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
+	remove := removedFiles(r.MultipartForm.Value["remove"])
+	if object_id == "" && len(remove) > 0 {
+		slog.Error("remove given for new job")
+		http.Error(w, "remove is only valid when updating a job", http.StatusBadRequest)
+		return
+	}
+	if len(uploads) == 0 && len(remove) == 0 {
 		slog.Error("no files uploaded")
 		http.Error(w, "No files uploaded", http.StatusBadRequest)
 		return
 	}
 
-	object_id := uuid.NewString()
-	memFiles := map[string][]byte{}
-	filenames := []string{}
-	filecontent := []string{}
+	chunkOpts, err := pipeline.ParseChunkOptions(
+		r.FormValue("chunk_strategy"),
+		r.FormValue("chunk_size"),
+		r.FormValue("chunk_overlap"),
+	)
+	if err != nil {
+		slog.Error("invalid chunk options", slog.Any("error", err))
+		http.Error(w, "Invalid chunk options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	selectors, err := pipeline.ParseSelectors(r.MultipartForm.Value["select"])
+	if err != nil {
+		slog.Error("invalid select", slog.Any("error", err))
+		http.Error(w, "Invalid select: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	for _, fh := range files {
-		file, err := fh.Open()
+	embedder := pipeline.DefaultEmbedder
+	if provider := r.FormValue("provider"); provider != "" {
+		embedder, err = pipeline.NewEmbedder(provider)
 		if err != nil {
-			slog.Error("failed to open uploaded file", slog.String("filename", fh.Filename), slog.Any("error", err))
-			http.Error(w, "File open error: "+err.Error(), http.StatusInternalServerError)
+			slog.Error("invalid embedding provider", slog.String("provider", provider), slog.Any("error", err))
+			http.Error(w, "Invalid provider: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
+	}
 
-		contentBytes, err := ReadAll(file)
+	extractor := pipeline.DefaultExtractor
+	if name := r.FormValue("triples"); name != "" {
+		extractor, err = pipeline.NewExtractor(name)
 		if err != nil {
-			slog.Error("failed to read uploaded file", slog.String("filename", fh.Filename), slog.Any("error", err))
-			http.Error(w, "Read error: "+err.Error(), http.StatusInternalServerError)
+			slog.Error("invalid triple extractor", slog.String("triples", name), slog.Any("error", err))
+			http.Error(w, "Invalid triples: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
+
+	ttl, err := parseTTL(r.FormValue("ttl"))
+	if err != nil {
+		slog.Error("invalid ttl", slog.String("ttl", r.FormValue("ttl")), slog.Any("error", err))
+		http.Error(w, "Invalid ttl: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	callbackURL, callbackSecret := r.FormValue("callback_url"), r.FormValue("callback_secret")
+	if err := validateCallback(callbackURL, callbackSecret); err != nil {
+		slog.Error("invalid callback", slog.String("callback_url", callbackURL), slog.Any("error", err))
+		http.Error(w, "Invalid callback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sources := []pipeline.Source{}
+	var skipped []pipeline.StageError
+
+	// archives are expanded into the spool dir, within limits shared by all
+	// the archives of the request
+	expander := pipeline.NewExpander(pipeline.DefaultArchiveLimits, Uploads.Dir)
+	for _, u := range uploads {
+		if !pipeline.IsArchive(u.name) {
+			converter, err := pipeline.DetectConverterAt(u.name, u.r, u.size)
+			if err != nil {
+				slog.Error("unsupported file", slog.String("filename", u.name), slog.Any("error", err))
+				http.Error(w, "Unsupported file "+u.name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			src := u.source(converter.MIMETypes[0])
+			src.ID = uuid.NewString()
+			sources = append(sources, src)
+			continue
+		}
 
-		fileExt := strings.ToLower(filepath.Ext(fh.Filename))
-		if fileExt != ".pdf" &&
-			fileExt != ".csv" &&
-			fileExt != ".txt" &&
-			fileExt != ".json" &&
-			fileExt != ".md" &&
-			fileExt != ".yml" &&
-			fileExt != ".xml" {
-			slog.Error("unsupported file extension", slog.String("filename", fh.Filename), slog.String("ext", fileExt))
-			http.Error(w, "Unsupported file extension: "+fileExt, http.StatusBadRequest)
+		entries, err := expander.Expand(u.name, u.r, u.size)
+		if err != nil {
+			slog.Error("invalid archive", slog.String("filename", u.name), slog.Any("error", err))
+			http.Error(w, "Invalid archive "+u.name+": "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		slog.Info("expanded archive", slog.String("filename", u.name), slog.Int("files", len(entries)))
+
+		first := len(expanded)
+		for _, entry := range entries {
+			expanded = append(expanded, upload{name: entry.Name, path: entry.Path, size: entry.Size, hash: entry.Hash})
+		}
+		for i := first; i < len(expanded); i++ {
+			e := &expanded[i]
+			f, err := os.Open(e.path)
+			if err != nil {
+				slog.Error("failed to open expanded file", slog.String("filename", e.name), slog.Any("error", err))
+				http.Error(w, "Read error: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			e.r = f
 
-		contentType := http.DetectContentType(contentBytes)
-		if idx := strings.Index(contentType, ";"); idx != -1 {
-			contentType = strings.TrimSpace(contentType[:idx])
+			// an archive may hold anything, so unsupported files in it are
+			// left out rather than failing the request
+			converter, err := pipeline.DetectConverterAt(e.name, e.r, e.size)
+			if err != nil {
+				slog.Warn("skipping unsupported file", slog.String("filename", e.name), slog.Any("error", err))
+				skipped = append(skipped, pipeline.StageError{Stage: pipeline.StageExtract, File: e.name, Message: err.Error()})
+				continue
+			}
+			src := e.source(converter.MIMETypes[0])
+			src.ID = uuid.NewString()
+			sources = append(sources, src)
 		}
+	}
 
-		var textBytes []byte
+	if len(sources) == 0 && len(remove) == 0 {
+		slog.Error("no supported files uploaded")
+		http.Error(w, "Unsupported file "+skipped[0].File+": "+skipped[0].Message, http.StatusBadRequest)
+		return
+	}
 
-		switch contentType {
-		case "application/pdf":
-			textBytes, err = pipeline.PdfToText(contentBytes)
-		case "text/csv":
-			textBytes, err = pipeline.CsvToText(contentBytes)
-		case "application/json":
-			textBytes, err = pipeline.JsonToText(contentBytes)
-		case "text/plain", "text/markdown", "text/x-log", "text/x-yaml", "text/x-markdown":
-			textBytes = contentBytes
-		case "application/xml", "text/xml":
-			textBytes = contentBytes
-		default:
-			slog.Error("unsupported content type", slog.String("filename", fh.Filename), slog.String("type", contentType))
-			http.Error(w, "Unsupported file type: "+contentType, http.StatusBadRequest)
+	target := object_id
+	if target == "" {
+		target = uuid.NewString()
+	}
+	// a claimed key is pending until the request is accepted and released
+	// again if it is not; a retry can take over a key whose request never
+	// finished once the lease runs out
+	accepted := false
+	var claim IdempotencyKey
+	if key != "" {
+		claim = IdempotencyKey{
+			Owner:       requestOwner(r),
+			Key:         key,
+			PayloadHash: payloadHash(r, sources),
+			ObjectID:    target,
+			ExpiresAt:   time.Now().Add(idempotencyLease),
+		}
+		stored, claimed, err := Jobs.ClaimIdempotencyKey(claim)
+		if err != nil {
+			slog.Error("failed to claim idempotency key", slog.Any("error", err))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			if stored.PayloadHash != claim.PayloadHash {
+				slog.Warn("idempotency key reused for another request", slog.String("object_id", stored.ObjectID))
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusConflict)
+				return
+			}
+			if len(stored.Response) == 0 {
+				slog.Warn("idempotent request still in progress", slog.String("object_id", stored.ObjectID))
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			slog.Info("replaying idempotent request", slog.String("object_id", stored.ObjectID))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Write(append(stored.Response, '\n'))
 			return
 		}
+		defer func() {
+			if accepted {
+				return
+			}
+			if err := Jobs.ReleaseIdempotencyKey(claim.Owner, claim.Key); err != nil {
+				slog.Error("failed to release idempotency key", slog.Any("error", err))
+			}
+		}()
+	}
+
+	// respond accepts the request; retries with its key are answered the same
+	respond := func(body map[string]any) {
+		if len(skipped) > 0 {
+			body["skipped"] = skipped
+		}
+		accepted = true
+		if key != "" {
+			claim.ExpiresAt = time.Now().Add(IdempotencyTTL)
+			acceptIdempotencyKey(claim, body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if object_id != "" && previous.Status != StatusCompleted && previous.Status != StatusPartial {
+		slog.Warn("update requested for unfinished job", slog.String("object_id", object_id), slog.String("status", previous.Status))
+		http.Error(w, "Only completed or partial jobs can be updated; job is "+previous.Status, http.StatusConflict)
+		return
+	}
 
+	var update *jobUpdate
+	status := JobStatus{
+		Status:         StatusQueued,
+		Owner:          requestOwner(r),
+		Files:          jobFiles(sources),
+		CallbackURL:    callbackURL,
+		CallbackSecret: callbackSecret,
+		CreatedAt:      time.Now(),
+	}
+	if object_id == "" {
+		object_id = target
+	} else {
+		base, _, err := Jobs.GetResult(object_id)
 		if err != nil {
-			slog.Error("file processing error", slog.String("filename", fh.Filename), slog.Any("error", err))
-			http.Error(w, "Failed to process file: "+err.Error(), http.StatusInternalServerError)
+			slog.Error("failed to load job result", slog.String("object_id", object_id), slog.Any("error", err))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if base.Model != "" && base.Model != embedder.Model() {
+			slog.Error("update uses another embedding model", slog.String("object_id", object_id),
+				slog.String("job_model", base.Model), slog.String("model", embedder.Model()))
+			http.Error(w, "Job was embedded with "+base.Model+"; updates must use the same model", http.StatusBadRequest)
 			return
 		}
 
-		memFiles[fh.Filename] = textBytes
-		filenames = append(filenames, fh.Filename)
-		filecontent = append(filecontent, string(textBytes))
+		plan, changed, err := planUpdate(base, sources, remove)
+		if err != nil {
+			slog.Error("invalid job update", slog.String("object_id", object_id), slog.Any("error", err))
+			http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		plan.Previous = previous
+		if plan.empty() {
+			slog.Info("job update changes nothing", slog.String("object_id", object_id))
+			respond(updateResponse(object_id, plan))
+			return
+		}
+		update, sources = &plan, changed
 
-		slog.Info("processed file", slog.String("filename", fh.Filename), slog.Int("bytes", len(contentBytes)))
+		// the previous result stays in place until the update finishes
+		status = previous
+		status.Status = StatusQueued
+		status.Files = plan.files()
+		status.StartedAt = time.Time{}
+		status.Progress = pipeline.Progress{}
+		status.Updating = true
 	}
 
-	mutex.Lock()
-	jobStatuses[object_id] = JobStatus{
-		Status: "processing",
-		ETA:    time.Now().Add(5 * time.Second),
-		Error:  "",
+	if update == nil {
+		err = Jobs.SetStatus(object_id, status)
+	} else {
+		// of concurrent updates of the job, only the first to move it on
+		// from its finished status goes ahead
+		var queuedUpdate bool
+		queuedUpdate, err = Jobs.TransitionStatus(object_id, previous.Status, status)
+		if err == nil && !queuedUpdate {
+			slog.Warn("job changed while its update was read", slog.String("object_id", object_id))
+			http.Error(w, "Job is already being changed by another request", http.StatusConflict)
+			return
+		}
+	}
+	if err != nil {
+		slog.Error("failed to create job", slog.String("object_id", object_id), slog.Any("error", err))
+		http.Error(w, "Failed to create job", http.StatusInternalServerError)
+		return
 	}
-	mutex.Unlock()
 
-	// asynchronusly writes back whenever the embeddings are created
-	go pipeline.ProcessFiles(object_id, memFiles, func(id string, embs [][]float64, trips []string) {
-		mutex.Lock()
-		jobResults[id] = Result{
-			Embeddings:  embs,
-			Triples:     trips,
-			Filenames:   filenames,
-			Filecontent: filecontent,
+	spec := jobSpec{
+		Owner:    requestOwner(r),
+		Sources:  sources,
+		Chunking: chunkOpts,
+		Select:   selectors,
+		Provider: r.FormValue("provider"),
+		Triples:  r.FormValue("triples"),
+		TTL:      ttl,
+		Update:   update,
+		Skipped:  skipped,
+	}
+	opts := pipeline.ProcessOptions{
+		Chunking:  chunkOpts,
+		Select:    selectors,
+		Embedder:  embedder,
+		Extractor: extractor,
+		Progress:  reportProgress,
+	}
+	err = Queue.Enqueue(object_id, spec.Owner, spec.Sources, func(ctx context.Context) {
+		runJob(ctx, object_id, spec, opts)
+	})
+	if err != nil {
+		// the queue filled up or began shutting down while the upload was
+		// being read
+		slog.Warn("job not queued", slog.String("object_id", object_id), slog.Any("error", err))
+		failed := JobStatus{
+			Status: StatusFailed,
+			Error:  &pipeline.StageError{Stage: StageQueue, Message: err.Error()},
 		}
-		jobStatuses[id] = JobStatus{
-			Status: "completed",
-			ETA:    time.Time{},
-			Error:  "",
+		if update != nil {
+			failed = update.Previous
 		}
-		mutex.Unlock()
-	})
+		Jobs.SetStatus(object_id, failed)
+		if errors.Is(err, ErrShuttingDown) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server is shutting down, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		rejectQueueFull(w)
+		return
+	}
+
+	queued = spec.Sources
+	if update != nil {
+		respond(updateResponse(object_id, *update))
+		return
+	}
+	respond(map[string]any{"object_id": object_id})
+}
+
+// updateResponse answers an update request with the files it changes.
+func updateResponse(object_id string, u jobUpdate) map[string]any {
+	return map[string]any{
+		"object_id": object_id,
+		"added":     nonNil(u.Added),
+		"replaced":  nonNil(u.Replaced),
+		"removed":   nonNil(u.Removed),
+		"unchanged": nonNil(u.Unchanged),
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// runJob processes a dequeued job and stores its outcome. A job whose ctx is
+// cancelled is marked cancelled and whatever it produced so far is dropped.
+// The result is kept for ttl, or the retention default when ttl is zero.
+//
+// For an update, sources are only the changed files and their outcome is
+// merged into the job's current result; a cancelled update restores the job.
+//
+// A job that is no longer queued when it is dequeued was cancelled through
+// another instance and is skipped. A job interrupted by Queue.Shutdown is
+// not cancelled but checkpointed, to be resumed by ResumeJobs. Otherwise the spooled uploads of the job are
+// removed once it finishes.
+func runJob(ctx context.Context, object_id string, spec jobSpec, opts pipeline.ProcessOptions) {
+	if errors.Is(context.Cause(ctx), ErrShuttingDown) {
+		// never started
+		checkpointJob(object_id, spec)
+		return
+	}
+
+	sources, ttl, update := spec.Sources, spec.TTL, spec.Update
+	checkpointed := false
+	defer func() {
+		if !checkpointed {
+			removeSources(sources)
+		}
+	}()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"object_id": object_id})
+	started := time.Now()
+	processing := JobStatus{Status: StatusProcessing, StartedAt: started}
+	if update != nil {
+		processing = update.Previous
+		processing.Status = StatusProcessing
+		processing.StartedAt = started
+		processing.Progress = pipeline.Progress{}
+		processing.Updating = true
+	}
+	// another instance may have cancelled the job while it waited here
+	dequeued, err := Jobs.TransitionStatus(object_id, StatusQueued, processing)
+	if err != nil {
+		slog.Error("failed to update job status", slog.String("object_id", object_id), slog.Any("error", err))
+	} else if !dequeued {
+		slog.Info("skipping job that is no longer queued", slog.String("object_id", object_id))
+		return
+	}
+
+	writeBack := func(id string, res pipeline.ProcessResult) {
+		var summary ResultSummary
+		cancelled := ctx.Err() != nil || errors.Is(res.Err, context.Canceled)
+		if cancelled && errors.Is(context.Cause(ctx), ErrShuttingDown) {
+			checkpointJob(id, spec)
+			checkpointed = true
+			return
+		}
+		if cancelled && update != nil {
+			slog.Info("job update cancelled", slog.String("object_id", id))
+			if err := Jobs.SetStatus(id, update.Previous); err != nil {
+				slog.Error("failed to update job status", slog.String("object_id", id), slog.Any("error", err))
+			}
+			return
+		}
+		if !cancelled && update != nil {
+			base, _, err := Jobs.GetResult(id)
+			if err != nil {
+				slog.Error("failed to load job result", slog.String("object_id", id), slog.Any("error", err))
+				res = pipeline.ProcessResult{Progress: res.Progress, Err: &pipeline.StageError{Stage: StageStore, Message: "failed to load result"}}
+			} else {
+				res = update.merge(base, res)
+			}
+		}
+		if !cancelled && len(spec.Skipped) > 0 {
+			res.Failures = append(slices.Clone(spec.Skipped), res.Failures...)
+		}
+
+		status := finishedStatus(res)
+		if cancelled {
+			status = JobStatus{Status: StatusCancelled, Progress: res.Progress}
+		} else if res.Err == nil {
+			result := Result{
+				Model:      opts.Embedder.Model(),
+				Dimension:  opts.Embedder.Dimension(),
+				Documents:  res.Documents,
+				Embeddings: res.Embeddings,
+				Triples:    res.Triples,
+			}
+			if err := Jobs.SaveResult(id, result); err != nil {
+				slog.Error("failed to save job result", slog.String("object_id", id), slog.Any("error", err))
+				status.Status = StatusFailed
+				status.Error = &pipeline.StageError{Stage: StageStore, Message: "failed to save result"}
+			} else {
+				status.ResultBytes = result.Size()
+				status.ExpiresAt = jobExpiry(time.Now(), ttl)
+				summary = ResultSummary{Documents: len(result.Documents), Embeddings: len(result.Embeddings), Triples: len(result.Triples)}
+			}
+		}
+		status.StartedAt = started
+		if update != nil {
+			status.Files = update.files()
+		}
+		if err := Jobs.SetStatus(id, status); err != nil {
+			slog.Error("failed to update job status", slog.String("object_id", id), slog.Any("error", err))
+			return
+		}
+		notifyFinished(id, summary)
+	}
+
+	if update != nil && len(sources) == 0 {
+		// only removals: nothing to process
+		writeBack(object_id, pipeline.ProcessResult{})
+		return
+	}
+	pipeline.ProcessFiles(ctx, object_id, sources, opts, writeBack)
+}
+
+// requestOwner identifies the user a request was authenticated as. Jobs are
+// owned by it and the queue is shared fairly between owners.
+// Unauthenticated requests share one slot.
+func requestOwner(r *http.Request) string {
+	email, _ := r.Context().Value("email").(string)
+	return email
+}
+
+// jobFiles lists the file names of a job's sources.
+func jobFiles(sources []pipeline.Source) []string {
+	files := make([]string, len(sources))
+	for i, src := range sources {
+		files[i] = src.Filename
+	}
+	return files
+}
+
+func rejectQueueFull(w http.ResponseWriter) {
+	retry := int(math.Ceil(Queue.RetryAfter().Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(w, "Too many jobs queued, retry later", http.StatusTooManyRequests)
+}
+
+// reportProgress stores pipeline progress so /status can report it.
+func reportProgress(id string, p pipeline.Progress) {
+	if err := Jobs.SetProgress(id, p); err != nil {
+		slog.Warn("failed to update job progress", slog.String("object_id", id), slog.Any("error", err))
+	}
+}
+
+// finishedStatus maps the outcome of a pipeline run to the job's final status.
+func finishedStatus(res pipeline.ProcessResult) JobStatus {
+	status := JobStatus{Status: StatusCompleted, Progress: res.Progress, Failures: res.Failures}
+
+	switch {
+	case res.Err != nil:
+		status.Status = StatusFailed
+		var stageErr *pipeline.StageError
+		if !errors.As(res.Err, &stageErr) {
+			stageErr = &pipeline.StageError{Message: res.Err.Error()}
+		}
+		status.Error = stageErr
+	case len(res.Failures) > 0:
+		status.Status = StatusPartial
+		status.Error = &res.Failures[0]
+	}
+	return status
 }
@@ -90,6 +90,25 @@ func TestHandleProcess_UnsupportedFile(t *testing.T) {
 	}
 }
 
+func TestHandleProcess_InvalidSelect(t *testing.T) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "feed.xml")
+	part.Write([]byte("<feed><title>News</title></feed>"))
+	writer.WriteField("select", "feed title")
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/process", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	HandleProcess(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 Bad Request for an invalid select, got %d", w.Code)
+	}
+}
+
 func TestHandleProcess_ReadError(t *testing.T) {
 	req := createMultipartRequest(t, "files", "test.txt", "text/plain", "")
 
@@ -7,13 +7,32 @@ import (
 	"net/http"
 
 	chromadb "github.com/abdulahshoaib/quirk/chromaDB"
+	"github.com/abdulahshoaib/quirk/pipeline"
 )
 
+// HandleQuery searches a ChromaDB collection for the chunks closest to the
+// given texts.
+//
+// POST /query
+//
+// Request Body (JSON):
+//
+//	{
+//	  "req": { ... },       // chromadb.ReqParams object for Chroma configuration
+//	  "text": ["..."],      // query texts
+//	  "provider": "openai"  // optional; the embedding provider the collection was built with
+//	}
+//
+// Response Codes:
+//   - 200 OK: Documents and distances of the closest chunks
+//   - 400 Bad Request: Malformed JSON body or unknown provider
+//   - 5xx Error: Embedding or Chroma query failed
 func HandleQuery(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	var input struct {
-		Req  chromadb.ReqParams `json:"req"`
-		Text []string           `json:"text"`
+		Req      chromadb.ReqParams `json:"req"`
+		Text     []string           `json:"text"`
+		Provider string             `json:"provider"`
 	}
 
 	// Parse and decode JSON
@@ -23,8 +42,20 @@ func HandleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// queries must be embedded with the model the collection was built with
+	embedder := pipeline.DefaultEmbedder
+	if input.Provider != "" {
+		var err error
+		embedder, err = pipeline.NewEmbedder(input.Provider)
+		if err != nil {
+			slog.Error("invalid embedding provider", slog.String("provider", input.Provider), slog.Any("error", err), slog.String("handler", "HandleQuery"))
+			http.Error(w, "Invalid provider: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Call ListCollections with extracted data
-	status, err, res := chromadb.ListCollections(input.Req, input.Text)
+	status, err, res := chromadb.ListCollections(input.Req, embedder, input.Text)
 	if err != nil {
 		slog.Error("chroma query failed", slog.Any("error", err), slog.Int("status", status), slog.String("handler", "HandleQuery"))
 		http.Error(w, fmt.Sprintf("query failed: %v", err), status)
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -14,13 +15,19 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func mockEmbeddingsAPI(texts []string) ([][]float64, error) {
+type mockEmbedder struct{}
+
+func (mockEmbedder) Model() string  { return "mock" }
+func (mockEmbedder) Dimension() int { return 3 }
+func (mockEmbedder) Embed(_ context.Context, texts []string) ([][]float64, error) {
 	return [][]float64{{1.1, 2.2, 3.3}}, nil
 }
 
 func TestHandleQuery_Success(t *testing.T) {
-	// Override embedding function
-	pipeline.EmbeddingFn = mockEmbeddingsAPI
+	// Override embedding provider
+	original := pipeline.DefaultEmbedder
+	defer func() { pipeline.DefaultEmbedder = original }()
+	pipeline.DefaultEmbedder = mockEmbedder{}
 
 	// Activate HTTP mocking
 	httpmock.Activate()
@@ -67,3 +74,14 @@ func TestHandleQuery_Success(t *testing.T) {
 	assert.Contains(t, parsed, "documents")
 	assert.Contains(t, parsed, "distances")
 }
+
+func TestHandleQuery_InvalidProvider(t *testing.T) {
+	body := `{"req": {"Host": "localhost", "Port": 8000}, "text": ["what is ai"], "provider": "nope"}`
+	req := httptest.NewRequest("POST", "/query", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	HandleQuery(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid provider")
+}
@@ -7,7 +7,7 @@ import (
 )
 
 // HandleResult returns the processed embeddings and knowledge triples
-// for a given object ID, if the job has been completed.
+// for a given object ID, once the job has completed or partially completed.
 //
 // GET /result?object_id={id}
 //
@@ -15,10 +15,14 @@ import (
 //   - object_id (required): Unique identifier for the processing job
 //
 // Response Codes:
-//   - 200 OK: Job completed; returns JSON with embeddings and triples
+//   - 200 OK: Job completed or partial; returns JSON with embeddings and triples
+//     (see /status for the files a partial job left out)
 //   - 202 Accepted: Job is still in progress or incomplete
 //   - 400 Bad Request: Missing object_id
-//   - 404 Not Found: Unknown or invalid object_id
+//   - 404 Not Found: Unknown or invalid object_id, or a job owned by another user
+//   - 410 Gone: Job was cancelled, or its result expired or was deleted
+//   - 422 Unprocessable Entity: Job failed and has no result
+//   - 500 Internal Server Error: The job store could not be read
 //
 // Example JSON Response:
 //
@@ -39,20 +43,103 @@ func HandleResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutex.RLock()
-	status, exists := jobStatuses[id]
-	result, hasResult := jobResults[id]
-	mutex.RUnlock()
+	status, ok := authorizeJob(w, r, id)
+	if !ok {
+		return
+	}
+	if status.Status == StatusFailed {
+		slog.Error("result requested for failed job", slog.String("object_id", id))
+		msg := "Job failed"
+		if status.Error != nil {
+			msg += ": " + status.Error.Error()
+		}
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if status.Status == StatusCancelled {
+		slog.Error("result requested for cancelled job", slog.String("object_id", id))
+		http.Error(w, "Job was cancelled", http.StatusGone)
+		return
+	}
+	if status.Status == StatusExpired {
+		slog.Error("result requested for expired job", slog.String("object_id", id))
+		http.Error(w, "Result expired", http.StatusGone)
+		return
+	}
+	if status.Status != StatusCompleted && status.Status != StatusPartial {
+		slog.Error("result not ready", slog.String("object_id", id))
+		http.Error(w, "Result not ready", http.StatusAccepted)
+		return
+	}
 
-	if !exists {
-		slog.Error("result not found", slog.String("object_id", id))
-		http.Error(w, "Not found", http.StatusNotFound)
+	result, hasResult, err := Jobs.GetResult(id)
+	if err != nil {
+		slog.Error("failed to load job result", slog.String("object_id", id), slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if status.Status != "completed" || !hasResult {
+	if !hasResult {
 		slog.Error("result not ready", slog.String("object_id", id))
 		http.Error(w, "Result not ready", http.StatusAccepted)
 		return
 	}
 	json.NewEncoder(w).Encode(result)
 }
+
+// HandleDeleteResult deletes a finished job's result to free storage before
+// the retention policy would. The job stays listed with status expired.
+//
+// DELETE /result?object_id={id}
+//
+// Query Parameters:
+//   - object_id (required): Unique identifier for the processing job
+//
+// Response Codes:
+//   - 200 OK: The result was deleted, or the job has none left to delete;
+//     status is the job's status afterwards
+//   - 400 Bad Request: Missing object_id
+//   - 404 Not Found: Unknown object_id, or a job owned by another user
+//   - 409 Conflict: Job is still queued or processing; cancel it with
+//     DELETE /jobs/{object_id} instead. Also returned when an update of the
+//     job started while the result was being deleted
+//   - 500 Internal Server Error: The job store could not be read or updated
+//
+// Example JSON Response:
+//
+//	{ "object_id": "4c1d...", "status": "expired" }
+func HandleDeleteResult(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	id := r.URL.Query().Get("object_id")
+	if id == "" {
+		slog.Error("missing object_id", slog.String("handler", "HandleDeleteResult"))
+		http.Error(w, "Missing object_id parameter", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := authorizeJob(w, r, id)
+	if !ok {
+		return
+	}
+
+	switch status.Status {
+	case StatusQueued, StatusProcessing:
+		slog.Warn("result deletion requested for unfinished job", slog.String("object_id", id))
+		http.Error(w, "Job is still "+status.Status, http.StatusConflict)
+		return
+	case StatusCompleted, StatusPartial:
+		expired, err := expireJob(Jobs, JobSummary{ID: id, JobStatus: status})
+		if err != nil {
+			slog.Error("failed to delete job result", slog.String("object_id", id), slog.Any("error", err))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !expired {
+			http.Error(w, "Job is already being changed by another request", http.StatusConflict)
+			return
+		}
+		status.Status = StatusExpired
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"object_id": id, "status": status.Status})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+const (
+	DefaultResultTTL     = 72 * time.Hour
+	DefaultSweepInterval = time.Minute
+	DefaultCacheTTL      = 30 * 24 * time.Hour
+	DefaultCacheRows     = 1_000_000
+)
+
+// RetentionPolicy bounds how much result data is kept. Finished jobs keep
+// their result for TTL, or for the shorter ttl requested with the job; zero
+// keeps results until they are deleted. UserCap limits the bytes of results
+// each user may keep, evicting their oldest results first; zero means no cap.
+// The shared embedding cache drops vectors unused for CacheTTL and keeps at
+// most CacheRows of them; zero means no limit.
+type RetentionPolicy struct {
+	TTL       time.Duration
+	UserCap   int64
+	Interval  time.Duration
+	CacheTTL  time.Duration
+	CacheRows int
+}
+
+// Retention is the policy applied to new jobs and by the sweeper. RunApp
+// replaces it according to RESULT_TTL, USER_STORAGE_CAP, SWEEP_INTERVAL,
+// EMBEDDING_CACHE_TTL and EMBEDDING_CACHE_ROWS.
+var Retention = RetentionPolicy{
+	TTL:       DefaultResultTTL,
+	Interval:  DefaultSweepInterval,
+	CacheTTL:  DefaultCacheTTL,
+	CacheRows: DefaultCacheRows,
+}
+
+func InitRetention(policy RetentionPolicy) {
+	Retention = policy
+}
+
+// CachePurger is the shared tier of the embedding cache, as bounded by the
+// sweeper.
+type CachePurger interface {
+	// PurgeEmbeddings drops the vectors last used before unusedSince, then
+	// the least recently used beyond maxRows. Zero values do not purge.
+	PurgeEmbeddings(unusedSince time.Time, maxRows int) (int, error)
+}
+
+// RunSweeper evicts results according to policy, and drops expired
+// idempotency keys and, unless cache is nil, unused cached embeddings, every
+// policy.Interval until ctx is done.
+func RunSweeper(ctx context.Context, store JobStore, cache CachePurger, policy RetentionPolicy) {
+	ticker := time.NewTicker(cmp.Or(policy.Interval, DefaultSweepInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := Sweep(store, policy, now)
+			if err != nil {
+				slog.Error("result sweep failed", slog.Any("error", err))
+			}
+			if n > 0 {
+				slog.Info("evicted expired results", slog.Int("count", n))
+			}
+			n, err = store.PurgeIdempotencyKeys(now)
+			if err != nil {
+				slog.Error("idempotency key purge failed", slog.Any("error", err))
+			}
+			if n > 0 {
+				slog.Info("purged expired idempotency keys", slog.Int("count", n))
+			}
+			if cache == nil {
+				continue
+			}
+			var unusedSince time.Time
+			if policy.CacheTTL > 0 {
+				unusedSince = now.Add(-policy.CacheTTL)
+			}
+			n, err = cache.PurgeEmbeddings(unusedSince, policy.CacheRows)
+			if err != nil {
+				slog.Error("embedding cache purge failed", slog.Any("error", err))
+			}
+			if n > 0 {
+				slog.Info("purged cached embeddings", slog.Int("count", n))
+			}
+		}
+	}
+}
+
+// Sweep evicts every result past its expiry, then the oldest results of any
+// user over policy.UserCap. It returns how many results were evicted.
+func Sweep(store JobStore, policy RetentionPolicy, now time.Time) (int, error) {
+	jobs, err := store.ListRetained()
+	if err != nil {
+		return 0, err
+	}
+
+	evicted := 0
+	usage := map[string]int64{}
+	var kept []JobSummary
+	for _, job := range jobs {
+		if !finished(job.Status) {
+			// being updated; the update sets a new expiry
+			usage[job.Owner] += job.ResultBytes
+			continue
+		}
+		if !job.ExpiresAt.IsZero() && !now.Before(job.ExpiresAt) {
+			expired, err := expireJob(store, job)
+			if err != nil {
+				return evicted, err
+			}
+			if expired {
+				evicted++
+			}
+			continue
+		}
+		usage[job.Owner] += job.ResultBytes
+		kept = append(kept, job)
+	}
+
+	if policy.UserCap <= 0 {
+		return evicted, nil
+	}
+	slices.SortFunc(kept, func(a, b JobSummary) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for _, job := range kept {
+		if usage[job.Owner] <= policy.UserCap {
+			continue
+		}
+		expired, err := expireJob(store, job)
+		if err != nil {
+			return evicted, err
+		}
+		if expired {
+			usage[job.Owner] -= job.ResultBytes
+			evicted++
+		}
+	}
+	return evicted, nil
+}
+
+// expireJob drops a job's result and marks it expired, unless the job was
+// updated or given a new expiry since it was listed.
+func expireJob(store JobStore, job JobSummary) (bool, error) {
+	expired, err := store.ExpireResult(job.ID, job.JobStatus)
+	if err != nil {
+		return false, err
+	}
+	if !expired {
+		slog.Info("job changed during sweep, result kept", slog.String("object_id", job.ID))
+		return false, nil
+	}
+	slog.Info("job result evicted", slog.String("object_id", job.ID), slog.String("owner", job.Owner))
+	return true, nil
+}
+
+// parseTTL reads the ttl form field of /process. Jobs may ask to be kept for
+// less than the policy allows, not more.
+func parseTTL(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	if Retention.TTL > 0 && ttl > Retention.TTL {
+		return 0, fmt.Errorf("may not exceed %s", Retention.TTL)
+	}
+	return ttl, nil
+}
+
+// jobExpiry is when a job finishing now loses its result. ttl is the
+// lifetime requested with the job, zero for the policy default.
+func jobExpiry(now time.Time, ttl time.Duration) time.Time {
+	ttl = cmp.Or(ttl, Retention.TTL)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
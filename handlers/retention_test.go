@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeFinishedJob stores a completed job with a result of size bytes
+func storeFinishedJob(t *testing.T, store JobStore, id, owner string, created, expires time.Time, size int64) {
+	require.NoError(t, store.SetStatus(id, JobStatus{
+		Status:      StatusCompleted,
+		Owner:       owner,
+		CreatedAt:   created,
+		ExpiresAt:   expires,
+		ResultBytes: size,
+	}))
+	require.NoError(t, store.SaveResult(id, Result{Documents: []pipeline.Document{{ID: "d", Text: "text"}}}))
+}
+
+func TestSweep_TTL(t *testing.T) {
+	store := NewMemoryJobStore()
+	now := time.Now()
+	storeFinishedJob(t, store, "old", "alice", now.Add(-2*time.Hour), now.Add(-time.Minute), 10)
+	storeFinishedJob(t, store, "fresh", "alice", now.Add(-time.Hour), now.Add(time.Hour), 10)
+	storeFinishedJob(t, store, "forever", "alice", now.Add(-time.Hour), time.Time{}, 10)
+
+	n, err := Sweep(store, RetentionPolicy{TTL: time.Hour}, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	status, _, _ := store.GetStatus("old")
+	assert.Equal(t, StatusExpired, status.Status)
+	assert.Equal(t, "alice", status.Owner)
+	_, hasResult, _ := store.GetResult("old")
+	assert.False(t, hasResult)
+
+	for _, id := range []string{"fresh", "forever"} {
+		status, _, _ := store.GetStatus(id)
+		assert.Equal(t, StatusCompleted, status.Status, id)
+		_, hasResult, _ := store.GetResult(id)
+		assert.True(t, hasResult, id)
+	}
+}
+
+// racingStore updates a job between the sweep listing it and expiring it
+type racingStore struct {
+	*MemoryJobStore
+	update func()
+}
+
+func (s racingStore) ExpireResult(id string, listed JobStatus) (bool, error) {
+	s.update()
+	return s.MemoryJobStore.ExpireResult(id, listed)
+}
+
+func TestSweep_JobChangedDuringSweep(t *testing.T) {
+	now := time.Now()
+	for name, update := range map[string]JobStatus{
+		"new ttl":     {Status: StatusCompleted, ExpiresAt: now.Add(time.Hour), ResultBytes: 10},
+		"resubmitted": {Status: StatusQueued, Updating: true},
+	} {
+		store := NewMemoryJobStore()
+		storeFinishedJob(t, store, "old", "alice", now.Add(-2*time.Hour), now.Add(-time.Minute), 10)
+		racing := racingStore{store, func() { store.SetStatus("old", update) }}
+
+		n, err := Sweep(racing, RetentionPolicy{TTL: time.Hour}, now)
+		require.NoError(t, err)
+		assert.Zero(t, n, name)
+
+		status, _, _ := store.GetStatus("old")
+		assert.Equal(t, update.Status, status.Status, name)
+		_, hasResult, _ := store.GetResult("old")
+		assert.True(t, hasResult, name)
+	}
+}
+
+func TestSweep_UserCap(t *testing.T) {
+	store := NewMemoryJobStore()
+	now := time.Now()
+	storeFinishedJob(t, store, "a1", "alice", now.Add(-3*time.Hour), time.Time{}, 40)
+	storeFinishedJob(t, store, "a2", "alice", now.Add(-2*time.Hour), time.Time{}, 40)
+	storeFinishedJob(t, store, "a3", "alice", now.Add(-time.Hour), time.Time{}, 40)
+	storeFinishedJob(t, store, "b1", "bob", now.Add(-3*time.Hour), time.Time{}, 90)
+
+	n, err := Sweep(store, RetentionPolicy{UserCap: 100}, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// alice's oldest result goes; bob is under the cap
+	for id, want := range map[string]string{"a1": StatusExpired, "a2": StatusCompleted, "a3": StatusCompleted, "b1": StatusCompleted} {
+		status, _, _ := store.GetStatus(id)
+		assert.Equal(t, want, status.Status, id)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	original := Retention
+	defer func() { Retention = original }()
+	Retention = RetentionPolicy{TTL: 24 * time.Hour}
+
+	ttl, err := parseTTL("")
+	require.NoError(t, err)
+	assert.Zero(t, ttl)
+
+	ttl, err = parseTTL("2h")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, ttl)
+
+	for _, v := range []string{"soon", "-1h", "0s", "48h"} {
+		_, err := parseTTL(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestHandleDeleteResult(t *testing.T) {
+	id := "delete-me"
+	storeFinishedJob(t, Jobs, id, "", time.Now(), time.Now().Add(time.Hour), 10)
+
+	w := httptest.NewRecorder()
+	HandleDeleteResult(w, httptest.NewRequest("DELETE", "/result?object_id="+id, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"expired"`)
+	_, hasResult, _ := Jobs.GetResult(id)
+	assert.False(t, hasResult)
+
+	w = httptest.NewRecorder()
+	HandleResult(w, httptest.NewRequest("GET", "/result?object_id="+id, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+}
+
+func TestHandleDeleteResult_Processing(t *testing.T) {
+	id := "delete-running"
+	Jobs.SetStatus(id, JobStatus{Status: StatusProcessing})
+
+	w := httptest.NewRecorder()
+	HandleDeleteResult(w, httptest.NewRequest("DELETE", "/result?object_id="+id, nil))
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// callbackKey encrypts the callback secrets the Postgres job store keeps.
+// RunApp sets it from CALLBACK_SECRET_KEY; otherwise it is derived from the
+// token signing key.
+var callbackKey = deriveKey(jwtKey)
+
+func InitCallbackKey(key string) {
+	if key != "" {
+		callbackKey = deriveKey([]byte(key))
+	}
+}
+
+// deriveKey turns a secret of any length into an AES-256 key.
+func deriveKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("quirk callback secrets"))
+	return mac.Sum(nil)
+}
+
+// sealed secrets are marked so that those stored before encryption was
+// introduced can be told apart and refused
+const sealedPrefix = "v1:"
+
+// errUnsealedSecret is returned by openSecret for a secret stored in plain
+// text. Such a secret may have been written by anyone with access to the
+// database, so events are not signed with it.
+var errUnsealedSecret = errors.New("callback secret is not sealed")
+
+// sealSecret encrypts a callback secret with AES-GCM for storage.
+func sealSecret(secret string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	gcm, err := callbackCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a secret stored by sealSecret. Secrets stored in
+// plain text are refused with errUnsealedSecret.
+func openSecret(stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	encoded, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return "", errUnsealedSecret
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := callbackCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("sealed secret is too short")
+	}
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func callbackCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(callbackKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
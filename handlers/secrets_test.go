@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealSecret(t *testing.T) {
+	sealed, err := sealSecret("s3cret")
+	require.NoError(t, err)
+	assert.NotContains(t, sealed, "s3cret")
+
+	secret, err := openSecret(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+
+	// a secret stored in plain text is not trusted
+	_, err = openSecret("s3cret")
+	assert.ErrorIs(t, err, errUnsealedSecret)
+
+	original := callbackKey
+	defer func() { callbackKey = original }()
+	InitCallbackKey("another key")
+	_, err = openSecret(sealed)
+	assert.Error(t, err)
+}
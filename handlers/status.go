@@ -3,8 +3,11 @@ package handlers
 import (
 	"encoding/json"
 	"log/slog"
+	"math"
 	"net/http"
 	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
 )
 
 // HandleStatus retrieves the current status of a job by its object ID.
@@ -15,14 +18,29 @@ import (
 //   - object_id (required): The unique identifier of the job
 //
 // Returns:
-//   - 200: JSON with status, eta_seconds, and error_message
+//   - 200: JSON with status, queue_position, stage, percent, eta_seconds,
+//     expires_at, progress, error_message and failures
 //   - 400: Missing object_id parameter
-//   - 404: Job not found
+//   - 404: Job not found or owned by another user
+//   - 500: The job store could not be read
+//
+// Status is one of queued, processing, completed, partial (some files were
+// left out of the result), failed (no result), cancelled or expired (the
+// result was evicted or deleted). expires_at is when a finished job's result
+// will be evicted, null if it is kept indefinitely. While queued, queue_position
+// is the job's 1-based place in line. While processing, stage is the pipeline
+// stage the job is in (extract, chunk or embed), percent is the estimated
+// share of work done and eta_seconds is extrapolated from the throughput
+// observed so far; it is null until there is progress to go on. progress
+// holds the raw counters. error_message names the failing stage (queue,
+// extract, chunk, triples, embed or store) and file; failures lists every
+// file that failed.
 //
 // Example response:
 //
-//	- {"status": "running", "eta_seconds": 120, "error_message": null}
-//  - {"status": "failed", eta_seconds": 0, "error_message": Failed...}
+//   - {"status": "queued", "queue_position": 3, "stage": "", "percent": 0, "eta_seconds": null, ...}
+//   - {"status": "processing", "stage": "embed", "percent": 62, "eta_seconds": 48, "progress": {...}, "error_message": null, "failures": []}
+//   - {"status": "failed", "stage": "", "percent": 40, "eta_seconds": 0, "progress": {...}, "error_message": {"stage": "embed", "file": "a.pdf", "message": "..."}, "failures": [...]}
 func HandleStatus(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	id := r.URL.Query().Get("object_id")
@@ -32,22 +50,69 @@ func HandleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutex.RLock()
-	status, exists := jobStatuses[id]
-	mutex.RUnlock()
-
-	if !exists {
-		slog.Warn("job status not found", slog.String("object_id", id))
-		http.Error(w, "Not Found", http.StatusNotFound)
+	status, ok := authorizeJob(w, r, id)
+	if !ok {
 		return
 	}
 
-	eta := int(time.Until(status.ETA).Seconds())
-	eta = max(eta, 0)
+	json.NewEncoder(w).Encode(statusFields(id, status, time.Now()))
+}
+
+// statusFields builds the body of a /status response. Webhook events carry
+// the same fields.
+func statusFields(id string, status JobStatus, now time.Time) map[string]any {
+	fraction := status.Progress.Fraction()
+	stage := ""
+	var eta, position *int
+	switch status.Status {
+	case StatusQueued:
+		// only known to the instance holding the job in its queue
+		if pos, ok := Queue.Position(id); ok {
+			position = &pos
+		}
+	case StatusProcessing:
+		stage = status.Progress.Stage
+		if remaining, ok := estimateETA(status, now); ok {
+			secs := int(math.Ceil(remaining.Seconds()))
+			eta = &secs
+		}
+	case StatusCompleted, StatusPartial, StatusExpired:
+		fraction = 1
+		eta = new(int)
+	default:
+		eta = new(int)
+	}
+
+	var expires *time.Time
+	if !status.ExpiresAt.IsZero() {
+		expires = &status.ExpiresAt
+	}
+
+	failures := status.Failures
+	if failures == nil {
+		failures = []pipeline.StageError{}
+	}
 
-	json.NewEncoder(w).Encode(map[string]any{
-		"status":        status.Status,
-		"eta_seconds":   eta,
-		"error_message": status.Error,
-	})
+	return map[string]any{
+		"status":         status.Status,
+		"queue_position": position,
+		"stage":          stage,
+		"percent":        int(fraction * 100),
+		"eta_seconds":    eta,
+		"expires_at":     expires,
+		"progress":       status.Progress,
+		"error_message":  status.Error,
+		"failures":       failures,
+	}
+}
+
+// estimateETA extrapolates the time left from the throughput observed since
+// the job started. It reports false until the job has made some progress.
+func estimateETA(status JobStatus, now time.Time) (time.Duration, bool) {
+	fraction := status.Progress.Fraction()
+	if fraction <= 0 || status.StartedAt.IsZero() {
+		return 0, false
+	}
+	elapsed := now.Sub(status.StartedAt)
+	return time.Duration(float64(elapsed) * (1 - fraction) / fraction), true
 }
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// most jobs one stream may follow
+	maxStreamJobs = 50
+	// how often an idle stream sends a comment, so proxies keep it open, and
+	// rechecks the store for changes made by other instances
+	streamHeartbeat = 10 * time.Second
+)
+
+// HandleStatusStream streams status and progress events of one or more jobs
+// as Server-Sent Events until every job has finished.
+//
+// GET /status/stream?object_id={id}[&object_id={id}...]
+//
+// Parameters:
+//   - object_id (required): The job to follow; repeat it, or separate IDs
+//     with commas, to follow up to 50 jobs on one stream
+//   - Last-Event-ID header (optional): The id of the last event received;
+//     events since then are replayed when still available, otherwise the
+//     stream starts with each job's current status
+//
+// EventSource cannot set headers, so the stream also accepts the JWT as the
+// access_token query parameter; it is served through AuthenticateStream.
+//
+// Events:
+//   - status: The /status fields plus object_id, sent first for every job and
+//     on each state change
+//   - progress: object_id, stage, percent and progress while a job runs
+//
+// Returns:
+//   - 200: text/event-stream, closed once every job is completed, partial,
+//     failed, cancelled or expired
+//   - 400: Missing object_id, too many jobs or a malformed Last-Event-ID
+//   - 404: A job was not found or is owned by another user
+//   - 500: Streaming is not supported or the job store could not be read
+//
+// Example stream:
+//
+//	id: 41
+//	event: status
+//	data: {"object_id": "4c1d...", "status": "processing", "stage": "extract", "percent": 0, ...}
+//
+//	id: 42
+//	event: progress
+//	data: {"object_id": "4c1d...", "stage": "embed", "percent": 55, "progress": {...}}
+func HandleStatusStream(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	var ids []string
+	for _, v := range r.URL.Query()["object_id"] {
+		for id := range strings.SplitSeq(v, ",") {
+			if id = strings.TrimSpace(id); id != "" && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		slog.Error("missing object_id", slog.String("handler", "HandleStatusStream"))
+		http.Error(w, "Missing object_id", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxStreamJobs {
+		slog.Error("too many jobs to stream", slog.Int("jobs", len(ids)))
+		http.Error(w, fmt.Sprintf("At most %d jobs per stream", maxStreamJobs), http.StatusBadRequest)
+		return
+	}
+
+	var last int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		var err error
+		if last, err = strconv.ParseInt(v, 10, 64); err != nil {
+			slog.Error("invalid Last-Event-ID", slog.String("last_event_id", v))
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, id := range ids {
+		if _, ok := authorizeJob(w, r, id); !ok {
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.Error("streaming unsupported", slog.String("handler", "HandleStatusStream"))
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before reading current state so no change is missed
+	events, seq, cancel := Events.Subscribe(ids)
+	defer cancel()
+
+	var replay []JobEvent
+	replayed := map[string]bool{}
+	for _, id := range ids {
+		if missed, ok := Events.Since(id, last, seq); last > 0 && ok {
+			replay = append(replay, missed...)
+			replayed[id] = true
+		}
+	}
+	slices.SortFunc(replay, func(a, b JobEvent) int { return cmp.Compare(a.ID, b.ID) })
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	// streams outlive the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+
+	s := &statusStream{w: w, states: map[string]string{}}
+	for _, e := range replay {
+		s.send(e)
+	}
+
+	// jobs that could not be replayed start from their current status. Its
+	// event shares the ID of the last event before the subscription, so a
+	// reconnect resumes from there.
+	for _, id := range ids {
+		status, _, err := Jobs.GetStatus(id)
+		if err != nil {
+			slog.Error("failed to load job status", slog.String("object_id", id), slog.Any("error", err))
+			return
+		}
+		if replayed[id] {
+			// the client has seen everything up to the current state
+			s.states[id] = status.Status
+			continue
+		}
+		s.sendStatus(seq, id, status)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for !s.finished(ids) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// catch state changes published by another instance
+			for _, id := range ids {
+				status, _, err := Jobs.GetStatus(id)
+				if err == nil && status.Status != s.states[id] {
+					s.sendStatus(seq, id, status)
+				}
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				// dropped for falling behind, or shutting down; the client
+				// reconnects and replays
+				return
+			}
+			seq = e.ID
+			s.send(e)
+			flusher.Flush()
+		}
+	}
+}
+
+// statusStream writes events to one client and tracks the last status it
+// sent for each job.
+type statusStream struct {
+	w      http.ResponseWriter
+	states map[string]string
+}
+
+func (s *statusStream) send(e JobEvent) {
+	fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	if e.Type != "status" {
+		return
+	}
+	var data struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(e.Data, &data) == nil {
+		s.states[e.Job] = data.Status
+	}
+}
+
+func (s *statusStream) sendStatus(id int64, job string, status JobStatus) {
+	data, err := json.Marshal(statusEvent(job, status, time.Now()))
+	if err != nil {
+		slog.Error("failed to encode job event", slog.String("object_id", job), slog.Any("error", err))
+		return
+	}
+	s.send(JobEvent{ID: id, Job: job, Type: "status", Data: data})
+}
+
+func (s *statusStream) finished(ids []string) bool {
+	for _, id := range ids {
+		if !finished(s.states[id]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// openStream starts HandleStatusStream for query and returns its events as
+// they arrive. The channel is closed when the stream ends.
+func openStream(t *testing.T, query, lastEventID string) <-chan sseEvent {
+	server := httptest.NewServer(http.HandlerFunc(HandleStatusStream))
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest("GET", server.URL+"/status/stream?"+query, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan sseEvent, 64)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.event != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		require.True(t, ok, "stream closed")
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return sseEvent{}
+	}
+}
+
+func assertClosed(t *testing.T, events <-chan sseEvent) {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		assert.False(t, ok, "unexpected event %+v", e)
+	case <-time.After(time.Second):
+		t.Fatal("stream still open")
+	}
+}
+
+func usePublishingStore(t *testing.T) {
+	original := Jobs
+	t.Cleanup(func() { Jobs = original })
+	InitJobStore(NewMemoryJobStore())
+}
+
+func TestHandleStatusStream(t *testing.T) {
+	usePublishingStore(t)
+	id := "stream-job"
+	Jobs.SetStatus(id, JobStatus{Status: StatusProcessing})
+
+	events := openStream(t, "object_id="+id, "")
+
+	e := nextEvent(t, events)
+	assert.Equal(t, "status", e.event)
+	assert.Contains(t, e.data, `"status":"processing"`)
+	assert.Contains(t, e.data, `"object_id":"stream-job"`)
+
+	Jobs.SetProgress(id, pipeline.Progress{Stage: pipeline.StageEmbed, FilesTotal: 2})
+	e = nextEvent(t, events)
+	assert.Equal(t, "progress", e.event)
+	assert.Contains(t, e.data, `"stage":"embed"`)
+
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+	e = nextEvent(t, events)
+	assert.Equal(t, "status", e.event)
+	assert.Contains(t, e.data, `"status":"completed"`)
+
+	assertClosed(t, events)
+}
+
+func TestHandleStatusStream_LastEventID(t *testing.T) {
+	usePublishingStore(t)
+	id := "stream-resume"
+	Jobs.SetStatus(id, JobStatus{Status: StatusProcessing})
+
+	events := openStream(t, "object_id="+id, "")
+	first := nextEvent(t, events)
+
+	// events published while the client was away are replayed in order
+	Jobs.SetProgress(id, pipeline.Progress{Stage: pipeline.StageEmbed, FilesTotal: 1})
+	Jobs.SetStatus(id, JobStatus{Status: StatusFailed})
+
+	resumed := openStream(t, "object_id="+id, first.id)
+	assert.Equal(t, "progress", nextEvent(t, resumed).event)
+	e := nextEvent(t, resumed)
+	assert.Equal(t, "status", e.event)
+	assert.Contains(t, e.data, `"status":"failed"`)
+	assertClosed(t, resumed)
+
+	// a client that already saw the last event is done straight away
+	resumed = openStream(t, "object_id="+id, e.id)
+	assertClosed(t, resumed)
+}
+
+func TestHandleStatusStream_MultipleJobs(t *testing.T) {
+	usePublishingStore(t)
+	Jobs.SetStatus("stream-a", JobStatus{Status: StatusQueued})
+	Jobs.SetStatus("stream-b", JobStatus{Status: StatusCompleted})
+
+	events := openStream(t, "object_id=stream-a,stream-b&object_id=stream-a", "")
+	seen := map[string]bool{}
+	for range 2 {
+		e := nextEvent(t, events)
+		for _, id := range []string{"stream-a", "stream-b"} {
+			if strings.Contains(e.data, `"object_id":"`+id+`"`) {
+				seen[id] = true
+			}
+		}
+	}
+	assert.Equal(t, map[string]bool{"stream-a": true, "stream-b": true}, seen)
+
+	// still open while stream-a runs
+	Jobs.SetStatus("stream-a", JobStatus{Status: StatusCancelled})
+	assert.Contains(t, nextEvent(t, events).data, `"status":"cancelled"`)
+	assertClosed(t, events)
+}
+
+func TestHandleStatusStream_Errors(t *testing.T) {
+	Jobs.SetStatus("stream-owned", JobStatus{Status: StatusQueued, Owner: "alice@example.com"})
+	var tooMany []string
+	for i := 0; i <= maxStreamJobs; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("job-%d", i))
+	}
+
+	tests := []struct {
+		name, query, lastEventID, user string
+		code                           int
+	}{
+		{"missing object_id", "", "", "", http.StatusBadRequest},
+		{"bad Last-Event-ID", "object_id=stream-owned", "abc", "alice@example.com", http.StatusBadRequest},
+		{"unknown job", "object_id=nope", "", "", http.StatusNotFound},
+		{"other user's job", "object_id=stream-owned", "", "bob@example.com", http.StatusNotFound},
+		{"too many jobs", "object_id=" + strings.Join(tooMany, ","), "", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/status/stream?"+tt.query, nil)
+			if tt.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			if tt.user != "" {
+				req = asUser(req, tt.user)
+			}
+			w := httptest.NewRecorder()
+			HandleStatusStream(w, req)
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestEventBroker_DropsSlowSubscriber(t *testing.T) {
+	b := NewEventBroker()
+	events, _, cancel := b.Subscribe([]string{"job"})
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish("job", "progress", i)
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	assert.Equal(t, subscriberBuffer, n)
+
+	// the history still lets the client catch up, as far as it reaches
+	missed, ok := b.Since("job", 1, b.seq)
+	assert.True(t, ok)
+	assert.Len(t, missed, eventHistory)
+	_, ok = b.Since("job", 0, b.seq)
+	assert.False(t, ok)
+}
+
+func TestEventBroker_Close(t *testing.T) {
+	b := NewEventBroker()
+	events, _, cancel := b.Subscribe([]string{"job"})
+	defer cancel()
+
+	b.Close()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// later subscriptions end at once
+	events, _, cancel = b.Subscribe([]string{"job"})
+	defer cancel()
+	_, ok = <-events
+	assert.False(t, ok)
+}
+
+func TestEventBroker_Finish(t *testing.T) {
+	original := eventRetention
+	defer func() { eventRetention = original }()
+	eventRetention = 20 * time.Millisecond
+
+	b := NewEventBroker()
+	b.Publish("job", "status", "completed")
+	b.Finish("job")
+	// an update re-queues the job before its history expires
+	b.Publish("job", "status", "queued")
+
+	time.Sleep(3 * eventRetention)
+	events, ok := b.Since("job", 0, b.seq)
+	assert.True(t, ok)
+	assert.Len(t, events, 2)
+
+	b.Finish("job")
+	assert.Eventually(t, func() bool {
+		_, ok := b.Since("job", 0, b.seq)
+		return !ok
+	}, time.Second, time.Millisecond)
+}
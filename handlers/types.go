@@ -4,21 +4,148 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/abdulahshoaib/quirk/pipeline"
 	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/lib/pq"
 )
 
+// Job states. A queued job is waiting for a worker. A partial job finished
+// with some files missing from its result; a failed job has no result at all.
+// A cancelled job was stopped on request and its result discarded. An
+// expired job's result was evicted by the retention policy or deleted by its
+// owner.
+const (
+	StatusQueued     = "queued"
+	StatusProcessing = "processing"
+	StatusCompleted  = "completed"
+	StatusPartial    = "partial"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+)
+
+// Stages reported outside the pipeline: StageQueue when a job could not be
+// queued, StageStore when the pipeline succeeded but its result could not be
+// saved.
+const (
+	StageQueue = "queue"
+	StageStore = "store"
+)
+
+// JobStatus tracks a job. Owner is the email of the user who submitted it and
+// Files the uploaded file names; they and CreatedAt are recorded when the job
+// is first stored and kept by later updates, except that an update with
+// non-nil Files replaces them. Progress is the last snapshot
+// reported by the pipeline. Error explains why a job failed or, for partial
+// jobs, the first file that was left out; Failures lists every file-level
+// failure. A finished job's result is evicted at ExpiresAt; ResultBytes is
+// its approximate size. When the job finishes an event signed with
+// CallbackSecret is posted to CallbackURL, if set; both are kept like Owner.
+// The Postgres store keeps CallbackSecret encrypted with callbackKey.
+// Updating is set while an update of a finished job is queued or running;
+// the job still holds its previous result meanwhile.
 type JobStatus struct {
+	Status         string
+	Owner          string
+	Files          []string
+	CallbackURL    string
+	CallbackSecret string
+	CreatedAt      time.Time
+	StartedAt      time.Time
+	ExpiresAt      time.Time
+	ResultBytes    int64
+	Progress       pipeline.Progress
+	Error          *pipeline.StageError
+	Failures       []pipeline.StageError
+	Updating       bool
+}
+
+// JobSummary is a job as returned by JobStore.ListJobs.
+type JobSummary struct {
+	ID string
+	JobStatus
+}
+
+// JobFilter selects an owner's jobs for JobStore.ListJobs. Jobs are listed
+// newest first; zero fields do not filter.
+type JobFilter struct {
+	Owner  string
 	Status string
-	ETA    time.Time
-	Error  string
+	Since  time.Time // created at or after
+	Until  time.Time // created before
+	After  *JobCursor
+	Limit  int
+}
+
+// JobCursor marks the last job of a page; the next page starts after it.
+type JobCursor struct {
+	CreatedAt time.Time
+	ID        string
 }
 
+// Result holds the output of a processing job. Documents are in upload order;
+// every embedding and triple names the document and chunk it came from.
 type Result struct {
-	Embeddings  [][]float64
-	Triples     []string
-	Filenames   []string
-	Filecontent []string
+	Model      string
+	Dimension  int
+	Documents  []pipeline.Document
+	Embeddings []pipeline.Embedding
+	Triples    []pipeline.Triple
+}
+
+// Size approximates the memory a result holds: its text and vectors.
+func (r Result) Size() int64 {
+	var n int64
+	for _, d := range r.Documents {
+		n += int64(len(d.Text))
+	}
+	for _, e := range r.Embeddings {
+		n += int64(len(e.Text)) + 8*int64(len(e.Vector))
+	}
+	for _, t := range r.Triples {
+		n += int64(len(t.Subject) + len(t.Predicate) + len(t.Object))
+	}
+	return n
+}
+
+// ResultSummary counts what a finished job produced.
+type ResultSummary struct {
+	Documents  int `json:"documents"`
+	Embeddings int `json:"embeddings"`
+	Triples    int `json:"triples"`
+}
+
+// WebhookDelivery records one attempt to deliver a webhook event.
+type WebhookDelivery struct {
+	Event      string    `json:"event"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+	Delivered  bool      `json:"delivered"`
+	At         time.Time `json:"at"`
+}
+
+// IdempotencyKey remembers the job a client-chosen Idempotency-Key created,
+// so a retried /process request gets that job instead of a new one. Keys are
+// scoped to their Owner; PayloadHash identifies the request that first used
+// the key. Response is the JSON body that request was answered with, stored
+// once it was accepted and replayed to retries.
+type IdempotencyKey struct {
+	Owner       string
+	Key         string
+	PayloadHash string
+	ObjectID    string
+	ExpiresAt   time.Time
+	Response    []byte
+}
+
+// Checkpoint is a job interrupted by a shutdown, saved to run again on the
+// next start. Spec is the encoded job.
+type Checkpoint struct {
+	ID      string
+	Spec    []byte
+	SavedAt time.Time
 }
 
 type Name struct {
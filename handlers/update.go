@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// jobUpdate is a change to the corpus of a finished job, submitted through
+// POST /process?object_id=. Files are matched by name: an upload whose name
+// is new is added, one whose content differs from the stored document
+// replaces it and an identical one is left alone. Only added and replaced
+// files go through the pipeline; the rest of the result is reused.
+type jobUpdate struct {
+	Added     []string `json:"added"`
+	Replaced  []string `json:"replaced"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+
+	// the job before the update, restored if the update is cancelled
+	Previous JobStatus `json:"previous"`
+}
+
+// planUpdate compares the uploaded sources and the names to remove with the
+// job's current result. It returns the sources that need processing; a
+// replacement keeps the ID of the document it replaces, so exported records
+// are overwritten rather than duplicated.
+func planUpdate(base Result, sources []pipeline.Source, remove []string) (jobUpdate, []pipeline.Source, error) {
+	docs := make(map[string]pipeline.Document, len(base.Documents))
+	for _, d := range base.Documents {
+		docs[d.Filename] = d
+	}
+
+	var u jobUpdate
+	for _, name := range remove {
+		if _, ok := docs[name]; !ok {
+			return u, nil, fmt.Errorf("%s is not part of the job", name)
+		}
+		if !slices.Contains(u.Removed, name) {
+			u.Removed = append(u.Removed, name)
+		}
+	}
+
+	var changed []pipeline.Source
+	seen := map[string]bool{}
+	for _, src := range sources {
+		if seen[src.Filename] {
+			return u, nil, fmt.Errorf("%s was uploaded more than once", src.Filename)
+		}
+		seen[src.Filename] = true
+		if slices.Contains(u.Removed, src.Filename) {
+			return u, nil, fmt.Errorf("%s is both uploaded and removed", src.Filename)
+		}
+
+		doc, ok := docs[src.Filename]
+		switch {
+		case !ok:
+			u.Added = append(u.Added, src.Filename)
+		case doc.Hash != "" && doc.Hash == src.Hash:
+			u.Unchanged = append(u.Unchanged, src.Filename)
+			continue
+		default:
+			src.ID = doc.ID
+			u.Replaced = append(u.Replaced, src.Filename)
+		}
+		changed = append(changed, src)
+	}
+	return u, changed, nil
+}
+
+// empty reports whether the update would not change anything.
+func (u jobUpdate) empty() bool {
+	return len(u.Added) == 0 && len(u.Replaced) == 0 && len(u.Removed) == 0
+}
+
+// files lists the job's file names once the update is applied.
+func (u jobUpdate) files() []string {
+	files := []string{}
+	for _, name := range u.Previous.Files {
+		if !slices.Contains(u.Removed, name) {
+			files = append(files, name)
+		}
+	}
+	for _, name := range u.Added {
+		if !slices.Contains(files, name) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// touches reports whether the update uploads or removes the named file.
+func (u jobUpdate) touches(name string) bool {
+	return slices.Contains(u.Added, name) || slices.Contains(u.Replaced, name) || slices.Contains(u.Removed, name)
+}
+
+// merge folds the outcome of processing the changed files into the job's
+// current result. Removed documents are dropped; a replaced document takes
+// the place of the old one unless its new version could not be extracted or
+// produced no embeddings, in which case the old version and its embeddings
+// stay and the failure is reported. Added documents go last. Failures of
+// files the update did not touch are carried over.
+func (u jobUpdate) merge(base Result, res pipeline.ProcessResult) pipeline.ProcessResult {
+	fresh := make(map[string]pipeline.Document, len(res.Documents))
+	for _, d := range res.Documents {
+		fresh[d.Filename] = d
+	}
+	embedded := map[string]bool{}
+	for _, e := range res.Embeddings {
+		embedded[e.DocumentID] = true
+	}
+
+	var docs []pipeline.Document
+	isNew := map[string]bool{}
+	for _, d := range base.Documents {
+		if slices.Contains(u.Removed, d.Filename) {
+			continue
+		}
+		if nd, ok := fresh[d.Filename]; ok {
+			if embedded[nd.ID] {
+				d = nd
+				isNew[d.ID] = true
+			}
+			delete(fresh, d.Filename)
+		}
+		docs = append(docs, d)
+	}
+	for _, d := range res.Documents {
+		if _, ok := fresh[d.Filename]; ok {
+			docs = append(docs, d)
+			isNew[d.ID] = true
+		}
+	}
+
+	merged := pipeline.ProcessResult{Documents: docs, Progress: res.Progress}
+	for _, d := range docs {
+		embeddings, triples := base.Embeddings, base.Triples
+		if isNew[d.ID] {
+			embeddings, triples = res.Embeddings, res.Triples
+		}
+		for _, e := range embeddings {
+			if e.DocumentID == d.ID {
+				merged.Embeddings = append(merged.Embeddings, e)
+			}
+		}
+		for _, t := range triples {
+			if t.DocumentID == d.ID {
+				merged.Triples = append(merged.Triples, t)
+			}
+		}
+	}
+
+	for _, f := range u.Previous.Failures {
+		if f.File != "" && !u.touches(f.File) {
+			merged.Failures = append(merged.Failures, f)
+		}
+	}
+	merged.Failures = append(merged.Failures, res.Failures...)
+	if res.Err != nil && len(res.Failures) == 0 {
+		// a failure of the whole run, e.g. nothing left to embed
+		merged.Failures = append(merged.Failures, *finishedStatus(res).Error)
+	}
+
+	if len(merged.Embeddings) == 0 {
+		if len(merged.Failures) > 0 {
+			first := merged.Failures[0]
+			merged.Err = &first
+		} else {
+			merged.Err = &pipeline.StageError{Stage: pipeline.StageEmbed, Message: "no embeddings produced"}
+		}
+	}
+	return merged
+}
+
+// restoredStatus is the status of a job whose update was cancelled: it goes
+// back to being completed, or partial if it had failures, with its previous
+// result.
+func restoredStatus(status JobStatus) JobStatus {
+	status.Status = StatusCompleted
+	status.Error = nil
+	status.Updating = false
+	if len(status.Failures) > 0 {
+		status.Status = StatusPartial
+		status.Error = &status.Failures[0]
+	}
+	return status
+}
+
+// removedFiles reads the remove form field of /process: file names,
+// repeated or comma separated.
+func removedFiles(values []string) []string {
+	var names []string
+	for _, v := range values {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
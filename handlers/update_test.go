@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingEmbedder returns one vector per text and remembers what it embedded
+type recordingEmbedder struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func (e *recordingEmbedder) Model() string  { return "recording" }
+func (e *recordingEmbedder) Dimension() int { return 2 }
+func (e *recordingEmbedder) Embed(_ context.Context, texts []string) ([][]float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.texts = append(e.texts, texts...)
+	vectors := make([][]float64, len(texts))
+	for i := range texts {
+		vectors[i] = []float64{float64(len(texts[i])), 1}
+	}
+	return vectors, nil
+}
+
+func (e *recordingEmbedder) embedded() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	texts := e.texts
+	e.texts = nil
+	return texts
+}
+
+// processRequest builds a /process request uploading files (name to
+// content), with extra form fields.
+func processRequest(t *testing.T, target string, files [][2]string, fields map[string]string) *http.Request {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, f := range files {
+		part, err := writer.CreateFormFile("files", f[0])
+		require.NoError(t, err)
+		part.Write([]byte(f[1]))
+	}
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, target, &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func submit(t *testing.T, req *http.Request) map[string]any {
+	t.Helper()
+	w := httptest.NewRecorder()
+	HandleProcess(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+	return body
+}
+
+func waitFinished(t *testing.T, id string) JobStatus {
+	t.Helper()
+	var status JobStatus
+	require.Eventually(t, func() bool {
+		status, _, _ = Jobs.GetStatus(id)
+		return finished(status.Status)
+	}, 2*time.Second, time.Millisecond)
+	return status
+}
+
+func resultFiles(t *testing.T, id string) []string {
+	t.Helper()
+	result, ok, err := Jobs.GetResult(id)
+	require.NoError(t, err)
+	require.True(t, ok)
+	var files []string
+	for _, d := range result.Documents {
+		files = append(files, d.Filename)
+	}
+	return files
+}
+
+func TestHandleProcess_Update(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	embedder := &recordingEmbedder{}
+	pipeline.DefaultEmbedder = embedder
+
+	body := submit(t, processRequest(t, "/process", [][2]string{
+		{"a.txt", "Alpha text."},
+		{"b.txt", "Beta text."},
+	}, nil))
+	id := body["object_id"].(string)
+	assert.Equal(t, StatusCompleted, waitFinished(t, id).Status)
+	assert.Len(t, embedder.embedded(), 2)
+	before, _, _ := Jobs.GetResult(id)
+
+	// a.txt is unchanged, b.txt replaced and c.txt added
+	body = submit(t, processRequest(t, "/process?object_id="+id, [][2]string{
+		{"a.txt", "Alpha text."},
+		{"b.txt", "Beta text, revised."},
+		{"c.txt", "Gamma text."},
+	}, nil))
+	assert.Equal(t, []any{"c.txt"}, body["added"])
+	assert.Equal(t, []any{"b.txt"}, body["replaced"])
+	assert.Equal(t, []any{"a.txt"}, body["unchanged"])
+
+	status := waitFinished(t, id)
+	assert.Equal(t, StatusCompleted, status.Status)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, status.Files)
+	// only the chunks of b.txt and c.txt are embedded again
+	embedded := embedder.embedded()
+	assert.Len(t, embedded, 2)
+	assert.NotContains(t, embedded, before.Embeddings[0].Text)
+
+	after, _, _ := Jobs.GetResult(id)
+	require.Len(t, after.Documents, 3)
+	assert.Equal(t, before.Documents[0], after.Documents[0])
+	assert.Equal(t, before.Documents[1].ID, after.Documents[1].ID, "a replacement keeps its document ID")
+	assert.Equal(t, "Beta text, revised.", after.Documents[1].Text)
+	assert.Len(t, after.Embeddings, 3)
+	assert.Equal(t, before.Embeddings[0], after.Embeddings[0])
+
+	// removing needs no processing
+	body = submit(t, processRequest(t, "/process?object_id="+id, nil, map[string]string{"remove": "a.txt"}))
+	assert.Equal(t, []any{"a.txt"}, body["removed"])
+	status = waitFinished(t, id)
+	assert.Equal(t, []string{"b.txt", "c.txt"}, status.Files)
+	assert.Equal(t, []string{"b.txt", "c.txt"}, resultFiles(t, id))
+	assert.Empty(t, embedder.embedded())
+
+	// an identical upload is not queued at all
+	body = submit(t, processRequest(t, "/process?object_id="+id, [][2]string{{"c.txt", "Gamma text."}}, nil))
+	assert.Equal(t, []any{"c.txt"}, body["unchanged"])
+	assert.Equal(t, status, waitFinished(t, id))
+}
+
+// poisonEmbedder fails every request containing "poison"
+type poisonEmbedder struct{ recordingEmbedder }
+
+func (e *poisonEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	for _, text := range texts {
+		if strings.Contains(strings.ToLower(text), "poison") {
+			return nil, errors.New("model rejected the input")
+		}
+	}
+	return e.recordingEmbedder.Embed(ctx, texts)
+}
+
+func TestHandleProcess_UpdateKeepsDocumentWithoutEmbeddings(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &poisonEmbedder{}
+
+	body := submit(t, processRequest(t, "/process", [][2]string{
+		{"a.txt", "Alpha text."},
+		{"b.txt", "Beta text."},
+	}, nil))
+	id := body["object_id"].(string)
+	assert.Equal(t, StatusCompleted, waitFinished(t, id).Status)
+	before, _, _ := Jobs.GetResult(id)
+
+	// b.txt's new version extracts but cannot be embedded
+	body = submit(t, processRequest(t, "/process?object_id="+id, [][2]string{
+		{"b.txt", "Poison text."},
+	}, nil))
+	assert.Equal(t, []any{"b.txt"}, body["replaced"])
+
+	status := waitFinished(t, id)
+	assert.Equal(t, StatusPartial, status.Status)
+	require.Len(t, status.Failures, 1)
+	assert.Equal(t, "b.txt", status.Failures[0].File)
+
+	after, _, _ := Jobs.GetResult(id)
+	assert.Equal(t, before.Documents, after.Documents)
+	assert.Equal(t, before.Embeddings, after.Embeddings)
+}
+
+func TestHandleProcess_UpdateErrors(t *testing.T) {
+	storeFinishedJob(t, Jobs, "update-done", "", time.Now(), time.Time{}, 10)
+	Jobs.SetStatus("update-running", JobStatus{Status: StatusProcessing})
+
+	tests := []struct {
+		name   string
+		target string
+		files  [][2]string
+		fields map[string]string
+		code   int
+	}{
+		{"unknown job", "/process?object_id=nope", [][2]string{{"a.txt", "text"}}, nil, http.StatusNotFound},
+		{"unfinished job", "/process?object_id=update-running", [][2]string{{"a.txt", "text"}}, nil, http.StatusConflict},
+		{"remove unknown file", "/process?object_id=update-done", nil, map[string]string{"remove": "missing.txt"}, http.StatusBadRequest},
+		{"remove without job", "/process", [][2]string{{"a.txt", "text"}}, map[string]string{"remove": "a.txt"}, http.StatusBadRequest},
+		{"duplicate upload", "/process?object_id=update-done", [][2]string{{"a.txt", "one"}, {"a.txt", "two"}}, nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleProcess(w, processRequest(t, tt.target, tt.files, tt.fields))
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestJobUpdate_Merge(t *testing.T) {
+	base := Result{
+		Documents: []pipeline.Document{
+			{ID: "a", Filename: "a.txt", Hash: "ha"},
+			{ID: "b", Filename: "b.txt", Hash: "hb"},
+			{ID: "c", Filename: "c.txt", Hash: "hc"},
+		},
+		Embeddings: []pipeline.Embedding{
+			{Chunk: pipeline.Chunk{DocumentID: "a", Index: 0}},
+			{Chunk: pipeline.Chunk{DocumentID: "b", Index: 0}},
+			{Chunk: pipeline.Chunk{DocumentID: "b", Index: 1}},
+			{Chunk: pipeline.Chunk{DocumentID: "c", Index: 0}},
+		},
+		Triples: []pipeline.Triple{{Subject: "old b", DocumentID: "b"}},
+	}
+	sources := []pipeline.Source{
+		{ID: "new-b", Filename: "b.txt", Hash: "hb2"},
+		{ID: "d", Filename: "d.txt", Hash: "hd"},
+		{ID: "new-c", Filename: "c.txt", Hash: "hc"},
+	}
+
+	u, changed, err := planUpdate(base, sources, []string{"a.txt"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d.txt"}, u.Added)
+	assert.Equal(t, []string{"b.txt"}, u.Replaced)
+	assert.Equal(t, []string{"a.txt"}, u.Removed)
+	assert.Equal(t, []string{"c.txt"}, u.Unchanged)
+	require.Len(t, changed, 2)
+	assert.Equal(t, "b", changed[0].ID)
+
+	u.Previous = JobStatus{Failures: []pipeline.StageError{
+		{Stage: pipeline.StageEmbed, File: "b.txt", Message: "old failure"},
+		{Stage: pipeline.StageEmbed, File: "c.txt", Message: "kept"},
+	}}
+	merged := u.merge(base, pipeline.ProcessResult{
+		Documents: []pipeline.Document{{ID: "b", Filename: "b.txt", Hash: "hb2"}, {ID: "d", Filename: "d.txt", Hash: "hd"}},
+		Embeddings: []pipeline.Embedding{
+			{Chunk: pipeline.Chunk{DocumentID: "b", Index: 0}},
+			{Chunk: pipeline.Chunk{DocumentID: "d", Index: 0}},
+		},
+	})
+
+	require.NoError(t, merged.Err)
+	var ids []string
+	for _, d := range merged.Documents {
+		ids = append(ids, d.ID+":"+d.Hash)
+	}
+	assert.Equal(t, []string{"b:hb2", "c:hc", "d:hd"}, ids)
+	// b's second chunk and its old triple are gone with the old version
+	assert.Len(t, merged.Embeddings, 3)
+	assert.Empty(t, merged.Triples)
+	assert.Equal(t, []pipeline.StageError{{Stage: pipeline.StageEmbed, File: "c.txt", Message: "kept"}}, merged.Failures)
+}
+
+func TestHandleCancelJob_QueuedUpdate(t *testing.T) {
+	original := Queue
+	defer func() { Queue = original }()
+	Queue = NewJobQueue(1, 5)
+	release := blockWorker(t, Queue)
+	defer release()
+
+	id := "cancel-update"
+	storeFinishedJob(t, Jobs, id, "", time.Now(), time.Time{}, 10)
+	status, _, _ := Jobs.GetStatus(id)
+	status.Status = StatusQueued
+	status.Updating = true
+	Jobs.SetStatus(id, status)
+	require.NoError(t, Queue.Enqueue(id, "", nil, func(context.Context) {}))
+
+	req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+	HandleCancelJob(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"completed"`)
+	_, hasResult, _ := Jobs.GetResult(id)
+	assert.True(t, hasResult)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+)
+
+// UploadLimits bound the uploads /process accepts. Files up to Memory bytes
+// are kept in memory; larger ones are spooled to Dir until their job
+// finishes, so a large upload does not have to fit in the heap.
+type UploadLimits struct {
+	MaxRequest int64  // bytes of a whole request
+	MaxFile    int64  // bytes of one file
+	Memory     int64  // largest file kept in memory
+	Dir        string // where larger files are spooled; "" for the temp dir
+}
+
+// DefaultUploadLimits are the upload limits unless RunApp sets them from
+// MAX_UPLOAD_SIZE, MAX_FILE_SIZE and UPLOAD_DIR.
+var DefaultUploadLimits = UploadLimits{
+	MaxRequest: 2 << 30, // 2GB
+	MaxFile:    1 << 30, // 1GB
+	Memory:     10 << 20,
+}
+
+// Uploads are the limits /process reads uploads with.
+var Uploads = DefaultUploadLimits
+
+// form values are small; this bounds what a request can make us buffer
+const maxFormValues = 1 << 20
+
+// minUploadRate is the slowest upload, in bytes per second, that is let
+// past the server's read timeout.
+const minUploadRate = 256 << 10
+
+// uploadBody lets the body of r be read for longer than the server's
+// ReadTimeout as long as it arrives at minUploadRate or faster: each read
+// moves the deadline to ReadTimeout plus the time the bytes so far take at
+// that rate, counted from now. A client trickling a body is still cut off
+// as before. The write deadline moves along, WriteTimeout after the read
+// one, so the response can be written once the upload is in.
+func uploadBody(w http.ResponseWriter, r *http.Request) io.ReadCloser {
+	srv, _ := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if srv == nil || srv.ReadTimeout <= 0 {
+		return r.Body
+	}
+	b := &rateLimitedBody{
+		ReadCloser: r.Body,
+		rc:         http.NewResponseController(w),
+		start:      time.Now(),
+		read:       srv.ReadTimeout,
+		write:      srv.WriteTimeout,
+	}
+	b.extend()
+	return b
+}
+
+type rateLimitedBody struct {
+	io.ReadCloser
+	rc          *http.ResponseController
+	start       time.Time
+	read, write time.Duration
+	n           int64
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.n += int64(n)
+		b.extend()
+	}
+	return n, err
+}
+
+func (b *rateLimitedBody) extend() {
+	deadline := b.start.Add(b.read + time.Duration(b.n)*time.Second/minUploadRate)
+	b.rc.SetReadDeadline(deadline)
+	if b.write > 0 {
+		b.rc.SetWriteDeadline(deadline.Add(b.write))
+	}
+}
+
+var (
+	errReadUpload      = errors.New("read error")
+	errUploadTooLarge  = errors.New("upload too large")
+	errFormValuesLarge = errors.New("form values too large")
+)
+
+func InitUploads(limits UploadLimits) error {
+	if limits.MaxRequest <= 0 {
+		limits.MaxRequest = DefaultUploadLimits.MaxRequest
+	}
+	if limits.MaxFile <= 0 {
+		limits.MaxFile = DefaultUploadLimits.MaxFile
+	}
+	if limits.Memory <= 0 {
+		limits.Memory = DefaultUploadLimits.Memory
+	}
+	if limits.Dir != "" {
+		if err := os.MkdirAll(limits.Dir, 0o700); err != nil {
+			return fmt.Errorf("failed to create upload dir: %v", err)
+		}
+	}
+	Uploads = limits
+	return nil
+}
+
+// upload is a file read from a /process request, held in content or spooled
+// to path.
+type upload struct {
+	name    string
+	content []byte
+	path    string
+	size    int64
+	hash    string
+	r       io.ReaderAt
+}
+
+// source is the pipeline source for the upload.
+func (u upload) source(contentType string) pipeline.Source {
+	return pipeline.Source{
+		Filename:    u.name,
+		ContentType: contentType,
+		Content:     u.content,
+		Path:        u.path,
+		Size:        u.size,
+		Hash:        u.hash,
+	}
+}
+
+// readUploads streams a multipart request, reading the files of the "files"
+// field into memory or spooling them to disk as they arrive. Afterwards the
+// form values can be read from r as if r.ParseMultipartForm had been called.
+// On error, whatever was spooled is removed again.
+func readUploads(w http.ResponseWriter, r *http.Request) (uploads []upload, err error) {
+	defer func() {
+		if err != nil {
+			discardUploads(uploads, nil)
+			uploads = nil
+		}
+	}()
+
+	r.Body = http.MaxBytesReader(w, r.Body, Uploads.MaxRequest)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string][]string{}
+	valueBytes := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploads, err
+		}
+
+		switch {
+		case part.FileName() == "":
+			v, err := io.ReadAll(io.LimitReader(part, maxFormValues-valueBytes+1))
+			if err != nil {
+				return uploads, err
+			}
+			if valueBytes += int64(len(v)); valueBytes > maxFormValues {
+				return uploads, errFormValuesLarge
+			}
+			values[part.FormName()] = append(values[part.FormName()], string(v))
+		case part.FormName() == "files":
+			u, err := spoolUpload(part)
+			if err != nil {
+				return uploads, err
+			}
+			uploads = append(uploads, u)
+		default:
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return uploads, err
+			}
+		}
+	}
+
+	form := url.Values{}
+	for k, v := range values {
+		form[k] = append(form[k], v...)
+	}
+	for k, v := range r.URL.Query() {
+		form[k] = append(form[k], v...)
+	}
+	r.MultipartForm = &multipart.Form{Value: values}
+	r.PostForm = values
+	r.Form = form
+	return uploads, nil
+}
+
+// spoolUpload reads one file, keeping it in memory when it is at most
+// Uploads.Memory bytes and writing it to a spool file otherwise.
+func spoolUpload(part *multipart.Part) (upload, error) {
+	u := upload{name: part.FileName()}
+	h := sha256.New()
+	src := io.TeeReader(io.LimitReader(part, Uploads.MaxFile+1), h)
+
+	content, err := ReadAll(io.LimitReader(src, Uploads.Memory+1))
+	if err != nil {
+		return u, fmt.Errorf("%w: %w", errReadUpload, err)
+	}
+	if int64(len(content)) <= Uploads.Memory {
+		u.content, u.size, u.r = content, int64(len(content)), bytes.NewReader(content)
+	} else {
+		f, err := os.CreateTemp(Uploads.Dir, "upload-*")
+		if err != nil {
+			return u, fmt.Errorf("failed to spool %s: %v", u.name, err)
+		}
+		u.path, u.r = f.Name(), f
+		_, err = f.Write(content)
+		if err == nil {
+			var n int64
+			n, err = io.Copy(f, src)
+			u.size = int64(len(content)) + n
+		}
+		if err != nil {
+			discardUploads([]upload{u}, nil)
+			return upload{}, fmt.Errorf("%w: %w", errReadUpload, err)
+		}
+	}
+
+	if u.size > Uploads.MaxFile {
+		discardUploads([]upload{u}, nil)
+		return upload{}, fmt.Errorf("%w: %s is larger than %d bytes", errUploadTooLarge, u.name, Uploads.MaxFile)
+	}
+	u.hash = hex.EncodeToString(h.Sum(nil))
+	return u, nil
+}
+
+// discardUploads closes the spool files of uploads and removes those that
+// are not the content of one of the queued sources.
+func discardUploads(uploads []upload, queued []pipeline.Source) {
+	kept := map[string]bool{}
+	for _, src := range queued {
+		kept[src.Path] = true
+	}
+	for _, u := range uploads {
+		if u.path == "" {
+			continue
+		}
+		if f, ok := u.r.(*os.File); ok {
+			f.Close()
+		}
+		if !kept[u.path] {
+			removeSpooled(u.path)
+		}
+	}
+}
+
+// removeSources removes the spool files of a job's sources once it no
+// longer needs them.
+func removeSources(sources []pipeline.Source) {
+	for _, src := range sources {
+		if src.Path != "" {
+			removeSpooled(src.Path)
+		}
+	}
+}
+
+func removeSpooled(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove spooled upload", slog.String("path", path), slog.Any("error", err))
+	}
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abdulahshoaib/quirk/pipeline"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spoolFiles lists what is left in the spool dir.
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestHandleProcess_SpooledUpload(t *testing.T) {
+	originalQueue, originalEmbedder, originalUploads := Queue, pipeline.DefaultEmbedder, Uploads
+	defer func() { Queue, pipeline.DefaultEmbedder, Uploads = originalQueue, originalEmbedder, originalUploads }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+	dir := t.TempDir()
+	require.NoError(t, InitUploads(UploadLimits{MaxRequest: 1 << 20, MaxFile: 1 << 16, Memory: 16, Dir: dir}))
+
+	body := submit(t, processRequest(t, "/process", [][2]string{
+		{"big.txt", strings.Repeat("Spooled words. ", 100)},
+		{"small.txt", "In memory."},
+		{"dump.zip", zipOf(t, [2]string{"inner.txt", "From a spooled archive."})},
+	}, map[string]string{"chunk_size": "500"}))
+	id := body["object_id"].(string)
+
+	assert.Equal(t, StatusCompleted, waitFinished(t, id).Status)
+	assert.Equal(t, []string{"big.txt", "small.txt", "inner.txt"}, resultFiles(t, id))
+
+	result, _, err := Jobs.GetResult(id)
+	require.NoError(t, err)
+	// hashed while spooled, identical to hashing the whole content
+	sum := sha256.Sum256([]byte(strings.Repeat("Spooled words. ", 100)))
+	assert.Equal(t, hex.EncodeToString(sum[:]), result.Documents[0].Hash)
+	assert.Empty(t, spoolFiles(t, dir), "spooled files are removed once the job finishes")
+}
+
+func TestHandleProcess_UploadLimits(t *testing.T) {
+	originalUploads, originalLimits := Uploads, pipeline.DefaultArchiveLimits
+	defer func() { Uploads, pipeline.DefaultArchiveLimits = originalUploads, originalLimits }()
+	dir := t.TempDir()
+	require.NoError(t, InitUploads(UploadLimits{MaxRequest: 4 << 10, MaxFile: 1 << 10, Memory: 16, Dir: dir}))
+	pipeline.DefaultArchiveLimits = pipeline.ArchiveLimits{MaxSize: 1500, MaxEntries: 10, MaxDepth: 1}
+	archive := zipOf(t, [2]string{"a.txt", strings.Repeat("a", 1000)})
+
+	tests := []struct {
+		name  string
+		files [][2]string
+		code  int
+	}{
+		{"file too large", [][2]string{{"a.txt", strings.Repeat("a", 2<<10)}}, http.StatusRequestEntityTooLarge},
+		{"request too large", [][2]string{
+			{"a.txt", strings.Repeat("a", 1000)},
+			{"b.txt", strings.Repeat("b", 1000)},
+			{"c.txt", strings.Repeat("c", 1000)},
+			{"d.txt", strings.Repeat("d", 1000)},
+			{"e.txt", strings.Repeat("e", 1000)},
+		}, http.StatusRequestEntityTooLarge},
+		{"unsupported spooled file", [][2]string{{"image.png", "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100)}}, http.StatusBadRequest},
+		{"archives over the limits together", [][2]string{{"a.zip", archive}, {"b.zip", archive}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			HandleProcess(w, processRequest(t, "/process", tt.files, nil))
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			assert.Empty(t, spoolFiles(t, dir), "rejected uploads are not left behind")
+		})
+	}
+}
+
+// slowUpload posts a file to server in chunks, pausing between them.
+func slowUpload(server *httptest.Server, chunk string, chunks int, pause time.Duration) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, _ := mw.CreateFormFile("files", "slow.txt")
+		for range chunks {
+			if _, err := part.Write([]byte(chunk)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			time.Sleep(pause)
+		}
+		mw.Close()
+		pw.Close()
+	}()
+	return http.Post(server.URL+"/process", mw.FormDataContentType(), pr)
+}
+
+func TestHandleProcess_SlowUpload(t *testing.T) {
+	originalQueue, originalEmbedder := Queue, pipeline.DefaultEmbedder
+	defer func() { Queue, pipeline.DefaultEmbedder = originalQueue, originalEmbedder }()
+	Queue = NewJobQueue(1, 5)
+	pipeline.DefaultEmbedder = &recordingEmbedder{}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(HandleProcess))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// the body arrives over longer than the server's timeouts, but faster
+	// than minUploadRate
+	res, err := slowUpload(server, strings.Repeat("Steadily uploaded words. ", 2500), 5, 50*time.Millisecond)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, string(body))
+
+	// a body trickling in is cut off at the read timeout
+	res, err = slowUpload(server, "Trickle. ", 6, 50*time.Millisecond)
+	if err == nil {
+		res.Body.Close()
+		assert.NotEqual(t, http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestHandleCancelJob_SpooledUpload(t *testing.T) {
+	originalQueue, originalUploads := Queue, Uploads
+	defer func() { Queue, Uploads = originalQueue, originalUploads }()
+	Queue = NewJobQueue(1, 5)
+	release := blockWorker(t, Queue)
+	defer release()
+	dir := t.TempDir()
+	require.NoError(t, InitUploads(UploadLimits{MaxRequest: 1 << 20, MaxFile: 1 << 16, Memory: 16, Dir: dir}))
+
+	body := submit(t, processRequest(t, "/process", [][2]string{{"big.txt", strings.Repeat("Spooled words. ", 100)}}, nil))
+	id := body["object_id"].(string)
+	require.Len(t, spoolFiles(t, dir), 1)
+
+	req := httptest.NewRequest("DELETE", "/jobs/"+id, nil)
+	req.SetPathValue("object_id", id)
+	w := httptest.NewRecorder()
+	HandleCancelJob(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, spoolFiles(t, dir), "the spooled files of a job cancelled while queued are removed")
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = 2 * time.Second
+)
+
+// WebhookNotifier posts job events to the callback URL given with a job.
+// Each event is signed with the job's secret; failed deliveries are retried
+// with exponential backoff and every attempt is logged in the job store.
+// Callbacks only reach public addresses and redirects are not followed, so a
+// callback URL cannot be used to make requests into the deployment's network.
+// Events are sent in the background; Shutdown waits for them.
+type WebhookNotifier struct {
+	client      *http.Client
+	store       JobStore
+	maxAttempts int
+	backoff     time.Duration
+
+	ctx    context.Context // cancelled when Shutdown gives up on deliveries
+	stop   context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Webhooks is the notifier used when jobs finish. RunApp replaces it
+// according to WEBHOOK_MAX_ATTEMPTS and WEBHOOK_BACKOFF.
+var Webhooks = NewWebhookNotifier(nil, DefaultWebhookAttempts, DefaultWebhookBackoff)
+
+func InitWebhooks(notifier *WebhookNotifier) {
+	Webhooks = notifier
+}
+
+// NewWebhookNotifier delivers events, making up to maxAttempts attempts with
+// backoff doubling after each failure. A nil store logs to Jobs; non-positive
+// values use the defaults.
+func NewWebhookNotifier(store JobStore, maxAttempts int, backoff time.Duration) *WebhookNotifier {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookAttempts
+	}
+	if backoff <= 0 {
+		backoff = DefaultWebhookBackoff
+	}
+	// the address is checked when it is dialled, after DNS resolution, so a
+	// name that resolves to an internal address is refused as well
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	return &WebhookNotifier{
+		client:      client,
+		store:       store,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		ctx:         ctx,
+		stop:        stop,
+	}
+}
+
+// Send delivers an event in the background. Events sent after Shutdown are
+// dropped.
+func (n *WebhookNotifier) Send(id, callbackURL, secret, event string, body []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		slog.Warn("webhook dropped during shutdown", slog.String("object_id", id), slog.String("event", event))
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.Deliver(id, callbackURL, secret, event, body)
+	}()
+}
+
+// Shutdown waits for the events being sent, retries included, until ctx is
+// done. Then it cancels the deliveries left and waits for them to stop.
+func (n *WebhookNotifier) Shutdown(ctx context.Context) {
+	n.mu.Lock()
+	n.closed = true
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("cancelling webhook deliveries still in progress")
+		n.stop()
+		<-done
+	}
+}
+
+// Deliver posts body to callbackURL until it is accepted, the attempts run
+// out or Shutdown cancels it. It blocks for the whole retry schedule; Send
+// runs it in the background. It reports whether the event was delivered.
+func (n *WebhookNotifier) Deliver(id, callbackURL, secret, event string, body []byte) bool {
+	store := n.store
+	if store == nil {
+		store = Jobs
+	}
+
+	wait := n.backoff
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		delivery := WebhookDelivery{Event: event, URL: callbackURL, Attempt: attempt, At: time.Now()}
+		retry := n.post(callbackURL, secret, event, id, body, &delivery)
+
+		if err := store.AddDelivery(id, delivery); err != nil {
+			slog.Warn("failed to log webhook delivery", slog.String("object_id", id), slog.Any("error", err))
+		}
+		if delivery.Delivered {
+			slog.Info("webhook delivered", slog.String("object_id", id), slog.String("event", event), slog.Int("attempt", attempt))
+			return true
+		}
+		slog.Warn("webhook delivery failed", slog.String("object_id", id), slog.String("event", event),
+			slog.Int("attempt", attempt), slog.Int("status_code", delivery.StatusCode), slog.String("error", delivery.Error))
+		if !retry || attempt == n.maxAttempts {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-n.ctx.Done():
+			slog.Warn("webhook retries cancelled by shutdown", slog.String("object_id", id), slog.String("event", event))
+			return false
+		}
+		wait *= 2
+	}
+	return false
+}
+
+// post makes a single delivery attempt and fills in its outcome. It reports
+// whether a failed attempt is worth retrying.
+func (n *WebhookNotifier) post(callbackURL, secret, event, id string, body []byte, d *WebhookDelivery) bool {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		d.Error = err.Error()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Quirk-Event", event)
+	req.Header.Set("X-Quirk-Object-Id", id)
+	req.Header.Set("X-Quirk-Signature", "sha256="+signPayload(secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		d.Error = err.Error()
+		return true
+	}
+	defer resp.Body.Close()
+
+	d.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d.Delivered = true
+		return false
+	}
+	d.Error = resp.Status
+	return resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// signPayload is the hex HMAC-SHA256 of body under secret, sent as
+// X-Quirk-Signature so receivers can verify the event came from us.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyFinished sends the job.<status> event for a job that just reached a
+// final state, if the job was submitted with a callback.
+func notifyFinished(id string, summary ResultSummary) {
+	status, ok, err := Jobs.GetStatus(id)
+	if err != nil || !ok {
+		slog.Error("failed to load job for webhook", slog.String("object_id", id), slog.Any("error", err))
+		return
+	}
+	if status.CallbackURL == "" {
+		return
+	}
+
+	now := time.Now()
+	event := "job." + status.Status
+	if status.CallbackSecret == "" {
+		// validateCallback requires a secret, so the stored one was refused
+		// by openSecret; an unsigned event must not be sent
+		slog.Error("webhook not sent: callback secret is unavailable", slog.String("object_id", id), slog.String("event", event))
+		delivery := WebhookDelivery{Event: event, URL: status.CallbackURL, Attempt: 1, Error: errUnsealedSecret.Error(), At: now}
+		if err := Jobs.AddDelivery(id, delivery); err != nil {
+			slog.Warn("failed to log webhook delivery", slog.String("object_id", id), slog.Any("error", err))
+		}
+		return
+	}
+	fields := statusEvent(id, status, now)
+	fields["event"] = event
+	fields["occurred_at"] = now
+	fields["result"] = summary
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		slog.Error("failed to encode webhook event", slog.String("object_id", id), slog.Any("error", err))
+		return
+	}
+	Webhooks.Send(id, status.CallbackURL, status.CallbackSecret, event, body)
+}
+
+// validateCallback checks the callback_url and callback_secret form fields
+// of /process. Both are optional but must be given together.
+func validateCallback(callbackURL, secret string) error {
+	if callbackURL == "" && secret == "" {
+		return nil
+	}
+	if callbackURL == "" || secret == "" {
+		return fmt.Errorf("callback_url and callback_secret must be given together")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http or https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errInternalCallback
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !callbackAllowed(ip) {
+		return errInternalCallback
+	}
+	return nil
+}
+
+var errInternalCallback = errors.New("callback_url must not point to a loopback, private, shared or link-local address")
+
+// For testing
+var callbackAllowed = publicAddr
+
+// internalPrefixes are IPv4 ranges that netip has no predicate for: "this
+// network", which Linux routes to the local host, and the carrier-grade NAT
+// space that cloud providers use for internal services.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr reports whether ip may receive callbacks. Loopback, private,
+// shared (CGNAT), link-local, multicast and unspecified addresses are
+// refused.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic is the Control of the delivery client's dialer: it refuses to
+// connect to an address that may not receive callbacks.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !callbackAllowed(addr.Addr()) {
+		return fmt.Errorf("callback address %s is not public", addr.Addr())
+	}
+	return nil
+}
+
+// HandleDeliveries lists the webhook deliveries attempted for a job.
+//
+// GET /deliveries?object_id={id}
+//
+// Parameters:
+//   - object_id (required): The unique identifier of the job
+//
+// Returns:
+//   - 200: JSON with object_id and deliveries, oldest first
+//   - 400: Missing object_id parameter
+//   - 404: Job not found or owned by another user
+//   - 500: The job store could not be read
+//
+// Example response:
+//
+//	{
+//	  "object_id": "4c1d...",
+//	  "deliveries": [
+//	    {"event": "job.completed", "url": "https://...", "attempt": 1, "status_code": 503, "error": "503 Service Unavailable", "delivered": false, "at": "..."},
+//	    {"event": "job.completed", "url": "https://...", "attempt": 2, "status_code": 200, "error": "", "delivered": true, "at": "..."}
+//	  ]
+//	}
+func HandleDeliveries(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	id := r.URL.Query().Get("object_id")
+	if id == "" {
+		slog.Error("missing object_id", slog.String("handler", "HandleDeliveries"))
+		http.Error(w, "Missing object_id", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := authorizeJob(w, r, id); !ok {
+		return
+	}
+
+	deliveries, err := Jobs.ListDeliveries(id)
+	if err != nil {
+		slog.Error("failed to load webhook deliveries", slog.String("object_id", id), slog.Any("error", err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"object_id":  id,
+		"deliveries": deliveries,
+	})
+}
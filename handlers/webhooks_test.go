@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// allowLoopbackCallbacks lets the notifier deliver to httptest servers.
+func allowLoopbackCallbacks(t *testing.T) {
+	original := callbackAllowed
+	callbackAllowed = func(netip.Addr) bool { return true }
+	t.Cleanup(func() { callbackAllowed = original })
+}
+
+func TestWebhookNotifier_RetriesAndSigns(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "sha256="+signPayload("s3cret", body), r.Header.Get("X-Quirk-Signature"))
+		assert.Equal(t, "job.completed", r.Header.Get("X-Quirk-Event"))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	store := NewMemoryJobStore()
+	n := NewWebhookNotifier(store, 5, time.Millisecond)
+
+	assert.True(t, n.Deliver("job1", server.URL, "s3cret", "job.completed", []byte(`{"status":"completed"}`)))
+	assert.Equal(t, int32(3), calls.Load())
+
+	deliveries, err := store.ListDeliveries("job1")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[0].StatusCode)
+	assert.False(t, deliveries[0].Delivered)
+	assert.Equal(t, 3, deliveries[2].Attempt)
+	assert.True(t, deliveries[2].Delivered)
+}
+
+func TestWebhookNotifier_GivesUp(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	store := NewMemoryJobStore()
+	n := NewWebhookNotifier(store, 5, time.Millisecond)
+
+	// a client error will not go away by retrying
+	assert.False(t, n.Deliver("job1", server.URL, "s3cret", "job.failed", []byte(`{}`)))
+	assert.Equal(t, int32(1), calls.Load())
+
+	deliveries, _ := store.ListDeliveries("job1")
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "400 Bad Request", deliveries[0].Error)
+}
+
+func TestWebhookNotifier_Shutdown(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	store := NewMemoryJobStore()
+	n := NewWebhookNotifier(store, 5, time.Hour)
+	n.Send("job1", server.URL, "s3cret", "job.completed", []byte(`{}`))
+	require.Eventually(t, func() bool {
+		deliveries, _ := store.ListDeliveries("job1")
+		return len(deliveries) == 1
+	}, time.Second, time.Millisecond)
+
+	// the retry waiting on its backoff is cancelled once the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		n.Shutdown(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not cancel the pending retry")
+	}
+
+	n.Send("job2", server.URL, "s3cret", "job.completed", []byte(`{}`))
+	assert.Equal(t, int32(1), calls.Load())
+	deliveries, _ := store.ListDeliveries("job2")
+	assert.Empty(t, deliveries)
+}
+
+func TestWebhookNotifier_RefusesInternalAddresses(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	store := NewMemoryJobStore()
+	n := NewWebhookNotifier(store, 1, time.Millisecond)
+
+	// the server listens on loopback, which is refused when dialled
+	assert.False(t, n.Deliver("job1", server.URL, "s3cret", "job.completed", []byte(`{}`)))
+	assert.Equal(t, int32(0), calls.Load())
+	deliveries, _ := store.ListDeliveries("job1")
+	require.Len(t, deliveries, 1)
+	assert.Contains(t, deliveries[0].Error, "is not public")
+}
+
+func TestWebhookNotifier_DoesNotFollowRedirects(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	var followed atomic.Bool
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.Store(true)
+	}))
+	defer internal.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	store := NewMemoryJobStore()
+	n := NewWebhookNotifier(store, 3, time.Millisecond)
+
+	assert.False(t, n.Deliver("job1", server.URL, "s3cret", "job.completed", []byte(`{}`)))
+	assert.False(t, followed.Load())
+	deliveries, _ := store.ListDeliveries("job1")
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, http.StatusTemporaryRedirect, deliveries[0].StatusCode)
+}
+
+func TestNotifyFinished(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	original := Webhooks
+	defer func() { Webhooks = original }()
+	Webhooks = NewWebhookNotifier(nil, 1, time.Millisecond)
+
+	events := make(chan map[string]any, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+
+	id := "webhook-job"
+	Jobs.SetStatus(id, JobStatus{Status: StatusQueued, CallbackURL: server.URL, CallbackSecret: "s3cret"})
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted})
+
+	notifyFinished(id, ResultSummary{Documents: 2, Embeddings: 5, Triples: 3})
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "job.completed", event["event"])
+		assert.Equal(t, id, event["object_id"])
+		assert.Equal(t, "completed", event["status"])
+		assert.Equal(t, float64(100), event["percent"])
+		assert.Equal(t, map[string]any{"documents": float64(2), "embeddings": float64(5), "triples": float64(3)}, event["result"])
+	case <-time.After(time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	assert.Eventually(t, func() bool {
+		deliveries, _ := Jobs.ListDeliveries(id)
+		return len(deliveries) == 1 && deliveries[0].Delivered
+	}, time.Second, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	HandleDeliveries(w, httptest.NewRequest("GET", "/deliveries?object_id="+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"event":"job.completed"`)
+}
+
+func TestNotifyFinished_UnsealedSecret(t *testing.T) {
+	allowLoopbackCallbacks(t)
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	// as read back from Postgres when the stored secret was not sealed
+	id := "unsealed-webhook-job"
+	Jobs.SetStatus(id, JobStatus{Status: StatusCompleted, CallbackURL: server.URL})
+
+	notifyFinished(id, ResultSummary{})
+
+	deliveries, err := Jobs.ListDeliveries(id)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.False(t, deliveries[0].Delivered)
+	assert.Equal(t, errUnsealedSecret.Error(), deliveries[0].Error)
+	select {
+	case <-received:
+		t.Fatal("unsigned webhook delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestValidateCallback(t *testing.T) {
+	assert.NoError(t, validateCallback("", ""))
+	assert.NoError(t, validateCallback("https://example.com/hook", "s3cret"))
+
+	assert.Error(t, validateCallback("https://example.com/hook", ""))
+	assert.Error(t, validateCallback("", "s3cret"))
+	assert.Error(t, validateCallback("ftp://example.com/hook", "s3cret"))
+	assert.Error(t, validateCallback("/hook", "s3cret"))
+
+	for _, internal := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://0.1.2.3/hook",
+		"http://100.64.0.1/hook",
+		"http://100.127.255.254/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		assert.ErrorIs(t, validateCallback(internal, "s3cret"), errInternalCallback, internal)
+	}
+}
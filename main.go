@@ -1,14 +1,22 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/abdulahshoaib/quirk/handlers"
 	"github.com/abdulahshoaib/quirk/middleware"
+	"github.com/abdulahshoaib/quirk/pipeline"
 	_ "github.com/joho/godotenv/autoload"
 	_ "github.com/lib/pq"
 )
@@ -63,17 +71,127 @@ func RunApp() error {
 	if err := InitSchema(db); err != nil {
 		return fmt.Errorf("failed to sync db: %v", err)
 	}
+	handlers.InitJobStore(handlers.NewPostgresJobStore(db))
+
+	cacheSize, err := envInt("EMBEDDING_CACHE_SIZE")
+	if err != nil {
+		return err
+	}
+	embeddingStore := handlers.NewPostgresEmbeddingStore(db)
+	pipeline.DefaultEmbeddingCache = pipeline.NewEmbeddingCache(cacheSize, embeddingStore)
+
+	embedder, err := pipeline.NewEmbedder(os.Getenv("EMBEDDING_PROVIDER"))
+	if err != nil {
+		return fmt.Errorf("failed to configure embeddings: %v", err)
+	}
+	pipeline.DefaultEmbedder = embedder
+	slog.Info("embedding provider configured", slog.String("model", embedder.Model()))
+
+	extractor, err := pipeline.NewExtractor(os.Getenv("TRIPLE_EXTRACTOR"))
+	if err != nil {
+		return fmt.Errorf("failed to configure triple extraction: %v", err)
+	}
+	pipeline.DefaultExtractor = extractor
+
+	workers, err := envInt("JOB_WORKERS")
+	if err != nil {
+		return err
+	}
+	depth, err := envInt("JOB_QUEUE_DEPTH")
+	if err != nil {
+		return err
+	}
+	handlers.InitJobQueue(handlers.NewJobQueue(workers, depth))
+
+	retention := handlers.Retention
+	if os.Getenv("RESULT_TTL") != "" {
+		if retention.TTL, err = envDuration("RESULT_TTL"); err != nil {
+			return err
+		}
+	}
+	if retention.Interval, err = envDuration("SWEEP_INTERVAL"); err != nil {
+		return err
+	}
+	userCap, err := envInt("USER_STORAGE_CAP")
+	if err != nil {
+		return err
+	}
+	retention.UserCap = int64(userCap)
+	if os.Getenv("EMBEDDING_CACHE_TTL") != "" {
+		if retention.CacheTTL, err = envDuration("EMBEDDING_CACHE_TTL"); err != nil {
+			return err
+		}
+	}
+	if os.Getenv("EMBEDDING_CACHE_ROWS") != "" {
+		if retention.CacheRows, err = envInt("EMBEDDING_CACHE_ROWS"); err != nil {
+			return err
+		}
+	}
+	handlers.InitRetention(retention)
+
+	attempts, err := envInt("WEBHOOK_MAX_ATTEMPTS")
+	if err != nil {
+		return err
+	}
+	backoff, err := envDuration("WEBHOOK_BACKOFF")
+	if err != nil {
+		return err
+	}
+	handlers.InitWebhooks(handlers.NewWebhookNotifier(handlers.Jobs, attempts, backoff))
+	handlers.InitCallbackKey(os.Getenv("CALLBACK_SECRET_KEY"))
+
+	idempotencyTTL, err := envDuration("IDEMPOTENCY_TTL")
+	if err != nil {
+		return err
+	}
+	handlers.InitIdempotency(idempotencyTTL)
+
+	maxUpload, err := envInt("MAX_UPLOAD_SIZE")
+	if err != nil {
+		return err
+	}
+	maxFile, err := envInt("MAX_FILE_SIZE")
+	if err != nil {
+		return err
+	}
+	err = handlers.InitUploads(handlers.UploadLimits{
+		MaxRequest: int64(maxUpload),
+		MaxFile:    int64(maxFile),
+		Dir:        os.Getenv("UPLOAD_DIR"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// SIGTERM (a deploy) and SIGINT stop the server gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go handlers.RunSweeper(ctx, handlers.Jobs, embeddingStore, retention)
+
+	resumed, err := handlers.ResumeJobs(handlers.Jobs, handlers.Queue)
+	if err != nil {
+		return fmt.Errorf("failed to resume jobs: %v", err)
+	}
+	if resumed > 0 {
+		slog.Info("resumed interrupted jobs", slog.Int("jobs", resumed))
+	}
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/signup", middleware.Logging(handlers.HandleSignup))
+	mux.HandleFunc("/formats", middleware.Logging(handlers.HandleFormats))
 
 	mux.HandleFunc("/process", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleProcess)))
 	mux.HandleFunc("/status", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleStatus)))
+	mux.HandleFunc("/status/stream", middleware.Logging(handlers.AuthenticateStream(handlers.HandleStatusStream)))
 	mux.HandleFunc("/result", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleResult)))
+	mux.HandleFunc("DELETE /result", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleDeleteResult)))
 	mux.HandleFunc("/export", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleExport)))
 	mux.HandleFunc("/export-chroma", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleExportToChroma)))
 	mux.HandleFunc("/query", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleQuery)))
+	mux.HandleFunc("/deliveries", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleDeliveries)))
+	mux.HandleFunc("/jobs", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleListJobs)))
+	mux.HandleFunc("/jobs/{object_id}", middleware.Logging(handlers.AuthenticateJWT(handlers.HandleCancelJob)))
 	// following command was used to check authentication
 	// mux.HandleFunc("/protected", handlers.AuthenticateJWT(handleProtectedRoute))
 	//
@@ -83,8 +201,83 @@ func RunApp() error {
 	//	mux.HandleFunc("/result", middleware.Logging(middleware.Auth(handlers.HandleResult)))
 	//	mux.HandleFunc("/export", middleware.Logging(middleware.Auth(handlers.HandleExport)))
 
-	slog.Info("server started", slog.String("port", "8080"))
-	return http.ListenAndServe(":8080", mux)
+	readTimeout, err := envDuration("SERVER_READ_TIMEOUT")
+	if err != nil {
+		return err
+	}
+	writeTimeout, err := envDuration("SERVER_WRITE_TIMEOUT")
+	if err != nil {
+		return err
+	}
+	idleTimeout, err := envDuration("SERVER_IDLE_TIMEOUT")
+	if err != nil {
+		return err
+	}
+	shutdownTimeout, err := envDuration("SHUTDOWN_TIMEOUT")
+	if err != nil {
+		return err
+	}
+	shutdownTimeout = cmp.Or(shutdownTimeout, 30*time.Second)
+
+	srv := &http.Server{
+		Addr:              ":8080",
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       cmp.Or(readTimeout, 2*time.Minute),
+		WriteTimeout:      cmp.Or(writeTimeout, 5*time.Minute),
+		IdleTimeout:       cmp.Or(idleTimeout, 2*time.Minute),
+	}
+	// end status streams so their clients reconnect elsewhere
+	srv.RegisterOnShutdown(handlers.Events.Close)
+
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("server started", slog.String("port", "8080"))
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// stop accepting uploads and give running jobs until the deadline to
+	// finish; the rest are checkpointed and resumed on the next start
+	slog.Info("shutting down", slog.Duration("timeout", shutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		handlers.Queue.Shutdown(shutdownCtx)
+		close(drained)
+	}()
+	err = srv.Shutdown(shutdownCtx)
+	<-drained
+	// events of the jobs that just finished, and retries still waiting
+	handlers.Webhooks.Shutdown(shutdownCtx)
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to shut down server: %v", err)
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// envInt reads an optional integer setting; unset means zero.
+func envInt(key string) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
 }
 
 func main() {
@@ -92,3 +285,15 @@ func main() {
 		slog.Error("server", slog.Any("error", err))
 	}
 }
+
+func envDuration(key string) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return d, nil
+}
@@ -37,23 +37,26 @@ func TestInitSchema(t *testing.T) {
 		t.Fatalf("InitSchema failed: %v", err)
 	}
 
-	// Check if table exists
+	// Check if tables exist
 	var exists bool
-	err = db.QueryRow(`
-		SELECT EXISTS (
-			SELECT FROM information_schema.tables
-			WHERE table_name = 'user_tokens'
-		)
-	`).Scan(&exists)
-	if err != nil {
-		t.Fatalf("Failed to check if table exists: %v", err)
-	}
-	if !exists {
-		t.Errorf("Expected table 'user_tokens' to exist, but it doesn't")
+	tables := []string{"user_tokens", "jobs", "documents", "embeddings"}
+	for _, table := range tables {
+		err = db.QueryRow(`
+			SELECT EXISTS (
+				SELECT FROM information_schema.tables
+				WHERE table_name = $1
+			)
+		`, table).Scan(&exists)
+		if err != nil {
+			t.Fatalf("Failed to check if table exists: %v", err)
+		}
+		if !exists {
+			t.Errorf("Expected table '%s' to exist, but it doesn't", table)
+		}
 	}
 
 	// Check if index exists
-	indexes := []string{"idx_user_tokens_token", "idx_user_tokens_email"}
+	indexes := []string{"idx_user_tokens_token", "idx_user_tokens_email", "idx_documents_object_id", "idx_embeddings_object_id"}
 	for _, index := range indexes {
 		err = db.QueryRow(`
 			SELECT EXISTS (
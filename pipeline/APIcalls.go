@@ -2,18 +2,74 @@ package pipeline
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	// "log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var EmbeddingsAPIURL = "https://api.cloudflare.com/client/v4/accounts/%s/ai/run/@cf/baai/bge-large-en-v1.5"
 
-func EmbeddingsAPI(texts []string) ([][]float64, error) {
-	account_id := os.Getenv("CLOUDFLARE_ACCOUNT_ID")
-	apiToken := os.Getenv("CLOUDFLARE_API_TOKEN")
+const (
+	defaultCloudflareBatchSize   = 100 // Workers AI limit for bge models
+	defaultCloudflareConcurrency = 4
+	defaultCloudflareMaxRetries  = 3
+)
+
+// base delay for exponential backoff between retries, doubled per attempt,
+// and the longest wait between retries, whatever Retry-After asks for
+var (
+	retryBaseDelay = 500 * time.Millisecond
+	maxRetryDelay  = 30 * time.Second
+)
+
+// errNetwork marks requests that failed before a whole response arrived;
+// sending them again may succeed.
+var errNetwork = errors.New("network error")
+
+// shared by all providers so a stuck upstream can't hang a job forever
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
+// CloudflareEmbedder calls the Workers AI bge-large-en-v1.5 model.
+// Credentials left empty are read from CLOUDFLARE_ACCOUNT_ID and
+// CLOUDFLARE_API_TOKEN on every call.
+//
+// Inputs are split into batches of BatchSize texts, at most Concurrency
+// batches are in flight at once, and each batch is retried up to MaxRetries
+// times on network errors, 429 and 5xx responses. Pooling is how the model
+// pools token vectors, "mean" or "cls". Zero values use defaults.
+type CloudflareEmbedder struct {
+	AccountID   string
+	APIToken    string
+	BatchSize   int
+	Concurrency int
+	MaxRetries  int
+	Pooling     string
+}
+
+func (e *CloudflareEmbedder) Model() string  { return "@cf/baai/bge-large-en-v1.5" }
+func (e *CloudflareEmbedder) Dimension() int { return 1024 }
+
+func (e *CloudflareEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	account_id := e.AccountID
+	if account_id == "" {
+		account_id = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	}
+	apiToken := e.APIToken
+	if apiToken == "" {
+		apiToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+	}
 
 	if account_id == "" || apiToken == "" {
 		return nil, fmt.Errorf("missing CLOUDFLARE_ACC or CLOUDFLARE_TOKEN")
@@ -21,28 +77,313 @@ func EmbeddingsAPI(texts []string) ([][]float64, error) {
 
 	url := fmt.Sprintf(EmbeddingsAPIURL, account_id)
 
-	body, err := json.Marshal(BGEReq{Text: texts})
+	batchSize := cmp.Or(e.BatchSize, defaultCloudflareBatchSize)
+	concurrency := cmp.Or(e.Concurrency, defaultCloudflareConcurrency)
+
+	var batches [][]string
+	for i := 0; i < len(texts); i += batchSize {
+		batches = append(batches, texts[i:min(i+batchSize, len(texts))])
+	}
+
+	results := make([][][]float64, len(batches))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for i, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			mu.Unlock()
+			break
+		}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			data, err := e.embedBatch(ctx, url, apiToken, batch)
+			if err == nil && len(data) != len(batch) {
+				err = fmt.Errorf("cloudflare returned %d embeddings for %d texts", len(data), len(batch))
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("batch %d of %d: %w", i+1, len(batches), err)
+				}
+				mu.Unlock()
+				return
+			}
+			results[i] = data
+		}(i, batch)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	embeddings := make([][]float64, 0, len(texts))
+	for _, r := range results {
+		embeddings = append(embeddings, r...)
+	}
+	return embeddings, nil
+}
+
+// embedBatch posts a single batch, retrying network errors and 429 and 5xx
+// responses with exponential backoff. A Retry-After header longer than the
+// backoff wins, up to maxRetryDelay.
+// Cancelling ctx aborts the request in flight and any wait between retries.
+func (e *CloudflareEmbedder) embedBatch(ctx context.Context, url, apiToken string, texts []string) ([][]float64, error) {
+	body, err := json.Marshal(BGEReq{Text: texts, Pooling: e.Pooling})
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	maxRetries := cmp.Or(e.MaxRetries, defaultCloudflareMaxRetries)
+
+	for attempt := 0; ; attempt++ {
+		data, retryAfter, err := e.post(ctx, url, apiToken, body)
+		if err == nil {
+			return data, nil
+		}
+
+		var cfErr *CloudflareError
+		retryable := errors.Is(err, errNetwork) || errors.As(err, &cfErr) && cfErr.Retryable()
+		if !retryable || attempt >= maxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := min(max(retryBaseDelay<<attempt, retryAfter), maxRetryDelay)
+		slog.Warn("cloudflare embedding request failed, retrying",
+			slog.Int("attempt", attempt+1),
+			slog.Duration("delay", delay),
+			slog.Any("error", err),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// post performs one request. The returned duration is the server's
+// Retry-After hint, zero if absent.
+func (e *CloudflareEmbedder) post(ctx context.Context, url, apiToken string, body []byte) ([][]float64, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	req.Header.Set("Authorization", "Bearer "+apiToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, fmt.Errorf("%w: %w", errNetwork, err)
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errNetwork, err)
 	}
 
 	var result BGERes
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+	decodeErr := json.Unmarshal(raw, &result)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 || len(result.Errors) > 0 {
+		cfErr := &CloudflareError{StatusCode: res.StatusCode, Errors: result.Errors}
+		if decodeErr != nil {
+			cfErr.Body = strings.TrimSpace(string(raw[:min(len(raw), 1024)]))
+		}
+		return nil, parseRetryAfter(res.Header.Get("Retry-After")), cfErr
+	}
+	if decodeErr != nil {
+		return nil, 0, decodeErr
+	}
+
+	return result.Result.Data, 0, nil
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay seconds and
+// an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// OpenAIEmbedder calls any server implementing the OpenAI /v1/embeddings API.
+// Dim may be left zero, in which case it is learned from the first response.
+type OpenAIEmbedder struct {
+	BaseURL   string
+	APIKey    string
+	ModelName string
+	Dim       int
+
+	seenDim atomic.Int64
+}
+
+func (e *OpenAIEmbedder) Model() string { return e.ModelName }
+func (e *OpenAIEmbedder) Dimension() int {
+	if e.Dim > 0 {
+		return e.Dim
+	}
+	return int(e.seenDim.Load())
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	url := strings.TrimRight(e.BaseURL, "/") + "/v1/embeddings"
+
+	var result OpenAIEmbeddingRes
+	if err := postJSON(ctx, url, e.APIKey, OpenAIEmbeddingReq{Model: e.ModelName, Input: texts}, &result); err != nil {
+		return nil, err
+	}
+
+	// the API does not promise response order, only that index matches input
+	sort.Slice(result.Data, func(i, j int) bool { return result.Data[i].Index < result.Data[j].Index })
+
+	embeddings := make([][]float64, len(result.Data))
+	for i, d := range result.Data {
+		embeddings[i] = d.Embedding
+	}
+	if len(embeddings) > 0 {
+		e.seenDim.Store(int64(len(embeddings[0])))
+	}
+
+	return embeddings, nil
+}
+
+// OllamaEmbedder calls the /api/embed endpoint of an Ollama server.
+// Dim may be left zero, in which case it is learned from the first response.
+type OllamaEmbedder struct {
+	BaseURL   string
+	ModelName string
+	Dim       int
+
+	seenDim atomic.Int64
+}
+
+func (e *OllamaEmbedder) Model() string { return e.ModelName }
+func (e *OllamaEmbedder) Dimension() int {
+	if e.Dim > 0 {
+		return e.Dim
+	}
+	return int(e.seenDim.Load())
+}
+
+func (e *OllamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	url := strings.TrimRight(e.BaseURL, "/") + "/api/embed"
+
+	var result OllamaEmbedRes
+	if err := postJSON(ctx, url, "", OllamaEmbedReq{Model: e.ModelName, Input: texts}, &result); err != nil {
 		return nil, err
 	}
+	if len(result.Embeddings) > 0 {
+		e.seenDim.Store(int64(len(result.Embeddings[0])))
+	}
+
+	return result.Embeddings, nil
+}
+
+var LLMAPIURL = "https://api.cloudflare.com/client/v4/accounts/%s/ai/run/%s"
+
+// CloudflareLLM runs a Workers AI text generation model.
+type CloudflareLLM struct {
+	AccountID string
+	APIToken  string
+	ModelName string
+}
+
+func (l *CloudflareLLM) Complete(ctx context.Context, prompt string) (string, error) {
+	if l.AccountID == "" || l.APIToken == "" {
+		return "", fmt.Errorf("missing CLOUDFLARE_ACC or CLOUDFLARE_TOKEN")
+	}
+
+	url := fmt.Sprintf(LLMAPIURL, l.AccountID, l.ModelName)
+
+	var result CloudflareLLMRes
+	req := CloudflareLLMReq{Messages: []LLMMessage{{Role: "user", Content: prompt}}}
+	if err := postJSON(ctx, url, l.APIToken, req, &result); err != nil {
+		return "", err
+	}
+	return result.Result.Response, nil
+}
+
+// OpenAIChat calls any server implementing the OpenAI /v1/chat/completions API.
+type OpenAIChat struct {
+	BaseURL   string
+	APIKey    string
+	ModelName string
+}
+
+func (l *OpenAIChat) Complete(ctx context.Context, prompt string) (string, error) {
+	url := strings.TrimRight(l.BaseURL, "/") + "/v1/chat/completions"
+
+	var result OpenAIChatRes
+	req := OpenAIChatReq{Model: l.ModelName, Messages: []LLMMessage{{Role: "user", Content: prompt}}}
+	if err := postJSON(ctx, url, l.APIKey, req, &result); err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("chat completion returned no choices")
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+// postJSON sends body as JSON to url and decodes the response into out.
+// The bearer token is only set when non-empty.
+func postJSON(ctx context.Context, url, bearer string, body any, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("request to %s failed: status %d: %s", url, res.StatusCode, strings.TrimSpace(string(msg)))
+	}
 
-	return result.Result.Data, nil
+	return json.NewDecoder(res.Body).Decode(out)
 }
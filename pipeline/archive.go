@@ -0,0 +1,262 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ArchiveLimits bound what an uploaded archive may expand to, so a small
+// upload cannot turn into gigabytes of documents.
+type ArchiveLimits struct {
+	MaxSize    int64 // uncompressed bytes of all files, nested archives included
+	MaxEntries int   // files, nested archives included
+	MaxDepth   int   // archives inside the uploaded one, and inside those
+}
+
+// DefaultArchiveLimits are the limits /process expands the archives of a
+// request with.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxSize:    256 << 20, // 256MB
+	MaxEntries: 1000,
+	MaxDepth:   2,
+}
+
+// ArchiveFile is a file unpacked from an archive and spooled to Path. Name
+// is its path in the archive, after the path of the archive itself when it
+// was nested in another. Hash is the hex SHA-256 of its content.
+type ArchiveFile struct {
+	Name string
+	Path string
+	Size int64
+	Hash string
+}
+
+// archiveKind names the kind of archive filename is by its extension, or ""
+// for files that are not archives. Office documents are zip files too, but
+// are converted rather than expanded.
+func archiveKind(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// IsArchive reports whether filename is a .zip, .tar, .tar.gz or .tgz
+// archive that an Expander unpacks.
+func IsArchive(filename string) bool {
+	return archiveKind(filename) != ""
+}
+
+var errArchiveTooLarge = errors.New("archive expands to too many bytes")
+
+// Expander unpacks the archives uploaded with one request, spooling their
+// files to a directory rather than holding them in memory. Its limits apply
+// to all the archives it expands together, so splitting a bomb over several
+// archives does not get it past them.
+type Expander struct {
+	limits    ArchiveLimits
+	dir       string
+	remaining int64
+	entries   int
+	files     []ArchiveFile // spooled by the current Expand
+}
+
+// NewExpander expands archives within limits, spooling their files to dir,
+// or the temp dir when dir is "".
+func NewExpander(limits ArchiveLimits, dir string) *Expander {
+	return &Expander{limits: limits, dir: dir, remaining: limits.MaxSize}
+}
+
+// Expand unpacks the files of an archive of size bytes read from r,
+// expanding the archives found inside it too. Directories, links, hidden
+// files and macOS resource forks (__MACOSX) are left out. It fails when the
+// archive is malformed, has no files or exceeds what is left of the limits.
+// The caller removes the spooled files; on error none are left behind.
+func (e *Expander) Expand(filename string, r io.ReaderAt, size int64) ([]ArchiveFile, error) {
+	e.files = nil
+	err := e.expand("", filename, r, size, 0)
+	files := e.files
+	e.files = nil
+	if err == nil && len(files) == 0 {
+		err = errors.New("archive has no files")
+	}
+	if err != nil {
+		for _, f := range files {
+			os.Remove(f.Path)
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// expand unpacks the archive at prefix, which is depth archives deep.
+func (e *Expander) expand(prefix, filename string, r io.ReaderAt, size int64, depth int) error {
+	switch archiveKind(filename) {
+	case "zip":
+		return e.zip(prefix, r, size, depth)
+	case "tar":
+		return e.tar(prefix, io.NewSectionReader(r, 0, size), depth)
+	case "tar.gz":
+		gz, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return malformed(prefix, err)
+		}
+		defer gz.Close()
+		// besides the files, a tar holds a header and padding for each
+		// entry; anything beyond that is a decompression bomb
+		overhead := int64(e.limits.MaxEntries+2) * 2 * 512
+		return e.tar(prefix, &budgetReader{r: gz, n: e.remaining + overhead}, depth)
+	}
+	return fmt.Errorf("%s is not an archive", filename)
+}
+
+func (e *Expander) zip(prefix string, r io.ReaderAt, size int64, depth int) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return malformed(prefix, err)
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err := e.open(prefix, f.Name, depth, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Expander) tar(prefix string, r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errArchiveTooLarge) {
+			return fmt.Errorf("archive expands to more than %d bytes", e.limits.MaxSize)
+		}
+		if err != nil {
+			return malformed(prefix, err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := e.open(prefix, h.Name, depth, open); err != nil {
+			return err
+		}
+	}
+}
+
+// open spools the entry called name and adds it to the files, or expands it
+// when it is an archive itself.
+func (e *Expander) open(prefix, name string, depth int, open func() (io.ReadCloser, error)) error {
+	name = entryName(name)
+	if name == "" {
+		return nil
+	}
+	if e.entries++; e.entries > e.limits.MaxEntries {
+		return fmt.Errorf("archive has more than %d files", e.limits.MaxEntries)
+	}
+	name = entryPath(prefix, name)
+
+	rc, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp(e.dir, "archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool %s: %v", name, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(rc, e.remaining+1))
+	if err == nil && n > e.remaining {
+		err = errArchiveTooLarge
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		if errors.Is(err, errArchiveTooLarge) {
+			return fmt.Errorf("archive expands to more than %d bytes", e.limits.MaxSize)
+		}
+		return fmt.Errorf("failed to unpack %s: %v", name, err)
+	}
+	e.remaining -= n
+
+	if IsArchive(name) {
+		// only its files are kept
+		defer os.Remove(f.Name())
+		if depth >= e.limits.MaxDepth {
+			return fmt.Errorf("%s: archives are nested more than %d deep", name, e.limits.MaxDepth)
+		}
+		return e.expand(name, name, f, n, depth+1)
+	}
+	e.files = append(e.files, ArchiveFile{Name: name, Path: f.Name(), Size: n, Hash: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+// entryName cleans the path of an archive entry into a relative path with
+// forward slashes, or returns "" for entries that are not documents.
+func entryName(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))[1:]
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "__MACOSX" || strings.HasPrefix(segment, ".") {
+			return ""
+		}
+	}
+	return name
+}
+
+func entryPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// malformed names the nested archive that could not be read.
+func malformed(prefix string, err error) error {
+	if prefix == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", prefix, err)
+}
+
+// budgetReader fails with errArchiveTooLarge once more than n bytes have
+// been read through it.
+type budgetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, errArchiveTooLarge
+	}
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.r.Read(p)
+	if b.n -= int64(n); b.n < 0 {
+		return n, errArchiveTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildZip writes a zip with the given files, in order. Names ending in "/"
+// are directories.
+func buildZip(files ...[2]string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range files {
+		w, _ := zw.Create(f[0])
+		w.Write([]byte(f[1]))
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+// buildTarGz writes a gzipped tar with the given files, in order.
+func buildTarGz(files ...[2]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		tw.WriteHeader(&tar.Header{Name: f[0], Mode: 0o644, Size: int64(len(f[1])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(f[1]))
+	}
+	tw.WriteHeader(&tar.Header{Name: "latest", Linkname: "docs/a.txt", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+func archiveNames(files []ArchiveFile) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestExpander_Expand(t *testing.T) {
+	nested := buildTarGz([2]string{"b.md", "# B"}, [2]string{"./c/../d.txt", "D"})
+	content := buildZip(
+		[2]string{"docs/", ""},
+		[2]string{"docs/a.txt", "A"},
+		[2]string{"__MACOSX/docs/._a.txt", "junk"},
+		[2]string{"docs/.DS_Store", "junk"},
+		[2]string{`win\e.csv`, "a,b"},
+		[2]string{"more/inner.tar.gz", string(nested)},
+	)
+
+	dir := t.TempDir()
+	files, err := NewExpander(DefaultArchiveLimits, dir).Expand("dump.zip", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	expected := []string{"docs/a.txt", "win/e.csv", "more/inner.tar.gz/b.md", "more/inner.tar.gz/d.txt"}
+	if names := archiveNames(files); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected files %v, got %v", expected, names)
+	}
+	if b, _ := os.ReadFile(files[2].Path); string(b) != "# B" || files[2].Size != 3 {
+		t.Errorf("unexpected content %q of size %d", b, files[2].Size)
+	}
+	// the nested archive is not kept once its files are spooled
+	if entries, _ := os.ReadDir(dir); len(entries) != len(files) {
+		t.Errorf("expected %d spooled files, got %d", len(files), len(entries))
+	}
+}
+
+func TestExpander_Limits(t *testing.T) {
+	big := strings.Repeat("a", 1000)
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		limits   ArchiveLimits
+		err      string
+	}{
+		{"size", "a.zip", buildZip([2]string{"a.txt", big}, [2]string{"b.txt", big}),
+			ArchiveLimits{MaxSize: 1500, MaxEntries: 10}, "more than 1500 bytes"},
+		{"gzip bomb", "a.tgz", buildTarGz([2]string{"a.txt", strings.Repeat("a", 1<<20)}),
+			ArchiveLimits{MaxSize: 1 << 10, MaxEntries: 10}, "more than 1024 bytes"},
+		{"entries", "a.tar.gz", buildTarGz([2]string{"a.txt", "a"}, [2]string{"b.txt", "b"}),
+			ArchiveLimits{MaxSize: 1 << 20, MaxEntries: 1}, "more than 1 files"},
+		{"depth", "a.zip", buildZip([2]string{"b.zip", string(buildZip([2]string{"c.txt", "c"}))}),
+			ArchiveLimits{MaxSize: 1 << 20, MaxEntries: 10, MaxDepth: 0}, "nested more than 0 deep"},
+		{"empty", "a.zip", buildZip([2]string{"docs/", ""}), DefaultArchiveLimits, "no files"},
+		{"malformed", "a.zip", []byte("not a zip"), DefaultArchiveLimits, "not a valid zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := NewExpander(tt.limits, dir).Expand(tt.filename, bytes.NewReader(tt.content), int64(len(tt.content)))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("expected no spooled files left, got %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestExpander_SharedLimits(t *testing.T) {
+	content := buildZip([2]string{"a.txt", strings.Repeat("a", 1000)})
+	e := NewExpander(ArchiveLimits{MaxSize: 1500, MaxEntries: 10}, t.TempDir())
+
+	if _, err := e.Expand("a.zip", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	// each archive is within the limits, but not the two of them together
+	_, err := e.Expand("b.zip", bytes.NewReader(content), int64(len(content)))
+	if err == nil || !strings.Contains(err.Error(), "more than 1500 bytes") {
+		t.Errorf("expected the second archive to exceed the limits, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package pipeline
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultEmbeddingCacheSize is the number of vectors an EmbeddingCache keeps
+// in memory when no size is given.
+const DefaultEmbeddingCacheSize = 10000
+
+// DefaultEmbeddingCache wraps every embedder built by NewEmbedder. It is nil,
+// so nothing is cached, until RunApp configures it.
+var DefaultEmbeddingCache *EmbeddingCache
+
+// EmbeddingStore is the persistent tier of an EmbeddingCache, shared between
+// instances. GetEmbeddings leaves keys it does not hold out of its result.
+type EmbeddingStore interface {
+	GetEmbeddings(keys []string) (map[string][]float64, error)
+	PutEmbeddings(model string, vectors map[string][]float64) error
+}
+
+// EmbeddingCache remembers vectors by a hash of the normalised text they were
+// computed from, the model and its pooling, so re-uploaded content is not
+// embedded again. Lookups go to an in-memory LRU first, then to the store if
+// there is one. Store errors are logged and treated as misses. Vectors are
+// copied in and out of the LRU, so callers may modify what they get.
+type EmbeddingCache struct {
+	store EmbeddingStore
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key    string
+	vector []float64
+}
+
+// NewEmbeddingCache keeps up to size vectors in memory, or
+// DefaultEmbeddingCacheSize when size is zero. store may be nil.
+func NewEmbeddingCache(size int, store EmbeddingStore) *EmbeddingCache {
+	return &EmbeddingCache{
+		store:   store,
+		size:    cmp.Or(size, DefaultEmbeddingCacheSize),
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Wrap returns an embedder that answers from the cache and only sends texts
+// it has not seen to e. A nil cache returns e unchanged.
+func (c *EmbeddingCache) Wrap(e Embedder) Embedder {
+	if c == nil {
+		return e
+	}
+	if cached, ok := e.(*cachedEmbedder); ok {
+		e = cached.Embedder
+	}
+	return &cachedEmbedder{Embedder: e, cache: c}
+}
+
+// lookup fills vectors with the cached vector of each key and returns the
+// indexes of the keys it could not find.
+func (c *EmbeddingCache) lookup(keys []string, vectors [][]float64) []int {
+	var missing []int
+	c.mu.Lock()
+	for i, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.MoveToFront(el)
+			vectors[i] = slices.Clone(el.Value.(*cacheEntry).vector)
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(missing) == 0 || c.store == nil {
+		return missing
+	}
+	var lookup []string
+	for _, i := range missing {
+		lookup = append(lookup, keys[i])
+	}
+	stored, err := c.store.GetEmbeddings(lookup)
+	if err != nil {
+		slog.Warn("failed to read embedding cache", slog.Any("error", err))
+		return missing
+	}
+
+	still := missing[:0]
+	for _, i := range missing {
+		if v, ok := stored[keys[i]]; ok {
+			// a key asked for twice must not share the slice
+			vectors[i] = slices.Clone(v)
+			c.remember(keys[i], v)
+		} else {
+			still = append(still, i)
+		}
+	}
+	return still
+}
+
+// add caches freshly computed vectors in memory and in the store.
+func (c *EmbeddingCache) add(model string, vectors map[string][]float64) {
+	for key, v := range vectors {
+		c.remember(key, v)
+	}
+	if c.store == nil {
+		return
+	}
+	if err := c.store.PutEmbeddings(model, vectors); err != nil {
+		slog.Warn("failed to write embedding cache", slog.String("model", model), slog.Any("error", err))
+	}
+}
+
+// remember puts a vector in the LRU, evicting the least recently used one
+// when full.
+func (c *EmbeddingCache) remember(key string, vector []float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, vector: slices.Clone(vector)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// pooler is implemented by embedders whose vectors also depend on how token
+// vectors are pooled.
+type pooler interface {
+	pooling() string
+}
+
+func (e *CloudflareEmbedder) pooling() string { return cmp.Or(e.Pooling, "mean") }
+
+// cacheKey identifies the vector of text for an embedder. Texts that differ
+// only in whitespace share a key.
+func cacheKey(model, pooling, text string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", model, pooling, strings.Join(strings.Fields(text), " "))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type cachedEmbedder struct {
+	Embedder
+	cache *EmbeddingCache
+
+	// learned from cached vectors, for embedders that only learn their
+	// dimension from a response
+	seenDim atomic.Int64
+}
+
+func (e *cachedEmbedder) Dimension() int {
+	return cmp.Or(e.Embedder.Dimension(), int(e.seenDim.Load()))
+}
+
+func (e *cachedEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	model := e.Model()
+	var pooling string
+	if p, ok := e.Embedder.(pooler); ok {
+		pooling = p.pooling()
+	}
+
+	keys := make([]string, len(texts))
+	for i, text := range texts {
+		keys[i] = cacheKey(model, pooling, text)
+	}
+	vectors := make([][]float64, len(texts))
+	missing := e.cache.lookup(keys, vectors)
+	if stats, ok := ctx.Value(cacheStatsKey{}).(*CacheStats); ok {
+		stats.Hits.Add(int64(len(texts) - len(missing)))
+		stats.Misses.Add(int64(len(missing)))
+	}
+	if len(missing) == 0 {
+		if len(vectors) > 0 {
+			e.seenDim.Store(int64(len(vectors[0])))
+		}
+		return vectors, nil
+	}
+
+	// repeated texts are embedded once
+	var batch []string
+	position := map[string]int{}
+	for _, i := range missing {
+		if _, ok := position[keys[i]]; !ok {
+			position[keys[i]] = len(batch)
+			batch = append(batch, texts[i])
+		}
+	}
+	fresh, err := e.Embedder.Embed(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(fresh) != len(batch) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(fresh))
+	}
+
+	computed := make(map[string][]float64, len(batch))
+	for _, i := range missing {
+		if v, ok := computed[keys[i]]; ok {
+			// a repeated text gets its own copy
+			vectors[i] = slices.Clone(v)
+			continue
+		}
+		vectors[i] = fresh[position[keys[i]]]
+		computed[keys[i]] = vectors[i]
+	}
+	e.cache.add(model, computed)
+	return vectors, nil
+}
+
+// CacheStats counts lookups made by cached embedders on behalf of one job.
+type CacheStats struct {
+	Hits   atomic.Int64
+	Misses atomic.Int64
+}
+
+type cacheStatsKey struct{}
+
+// WithCacheStats returns a context whose embedding cache lookups are counted
+// in stats.
+func WithCacheStats(ctx context.Context, stats *CacheStats) context.Context {
+	return context.WithValue(ctx, cacheStatsKey{}, stats)
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// countingEmbedder returns {len(text)} for every text and records each call
+func countingEmbedder(calls *[][]string) mockEmbedder {
+	return mockEmbedder(func(texts []string) ([][]float64, error) {
+		*calls = append(*calls, texts)
+		out := make([][]float64, len(texts))
+		for i, text := range texts {
+			out[i] = []float64{float64(len(text))}
+		}
+		return out, nil
+	})
+}
+
+// mapStore is an in-memory EmbeddingStore
+type mapStore struct {
+	mu      sync.Mutex
+	vectors map[string][]float64
+}
+
+func (s *mapStore) GetEmbeddings(keys []string) (map[string][]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := map[string][]float64{}
+	for _, k := range keys {
+		if v, ok := s.vectors[k]; ok {
+			found[k] = v
+		}
+	}
+	return found, nil
+}
+
+func (s *mapStore) PutEmbeddings(_ string, vectors map[string][]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range vectors {
+		s.vectors[k] = v
+	}
+	return nil
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	var calls [][]string
+	e := NewEmbeddingCache(10, nil).Wrap(countingEmbedder(&calls))
+
+	stats := &CacheStats{}
+	ctx := WithCacheStats(context.Background(), stats)
+
+	got, err := e.Embed(ctx, []string{"alpha", "beta", "alpha"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, [][]float64{{5}, {4}, {5}}) {
+		t.Errorf("unexpected vectors %v", got)
+	}
+
+	// whitespace does not change the key
+	got, err = e.Embed(ctx, []string{" alpha ", "gamma", "beta"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, [][]float64{{5}, {5}, {4}}) {
+		t.Errorf("unexpected vectors %v", got)
+	}
+
+	expected := [][]string{{"alpha", "beta"}, {"gamma"}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected each new text to be embedded once.\nExpected: %v\nGot: %v", expected, calls)
+	}
+	if stats.Hits.Load() != 2 || stats.Misses.Load() != 4 {
+		t.Errorf("expected 2 hits and 4 misses, got %d and %d", stats.Hits.Load(), stats.Misses.Load())
+	}
+}
+
+func TestEmbeddingCache_CopiesVectors(t *testing.T) {
+	var calls [][]string
+	e := NewEmbeddingCache(10, nil).Wrap(countingEmbedder(&calls))
+	ctx := context.Background()
+
+	// one job normalising its vectors in place must not change another's
+	got, err := e.Embed(ctx, []string{"alpha", "alpha"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	got[0][0] = -1
+	if got[1][0] != 5 {
+		t.Errorf("repeated text shares its vector: %v", got)
+	}
+	got, err = e.Embed(ctx, []string{"alpha"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if got[0][0] != 5 {
+		t.Errorf("cached vector was modified by a caller: %v", got)
+	}
+	got[0][0] = -1
+	got, _ = e.Embed(ctx, []string{"alpha"})
+	if got[0][0] != 5 {
+		t.Errorf("cached vector was modified by a caller: %v", got)
+	}
+}
+
+func TestEmbeddingCache_Evicts(t *testing.T) {
+	var calls [][]string
+	e := NewEmbeddingCache(2, nil).Wrap(countingEmbedder(&calls))
+	ctx := context.Background()
+
+	for _, text := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := e.Embed(ctx, []string{text}); err != nil {
+			t.Fatalf("Embed failed: %v", err)
+		}
+	}
+
+	// a stays cached because it was used recently; b is evicted by c
+	expected := [][]string{{"a"}, {"b"}, {"c"}, {"b"}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("unexpected calls.\nExpected: %v\nGot: %v", expected, calls)
+	}
+}
+
+func TestEmbeddingCache_Store(t *testing.T) {
+	store := &mapStore{vectors: map[string][]float64{}}
+	ctx := context.Background()
+
+	var first [][]string
+	if _, err := NewEmbeddingCache(10, store).Wrap(countingEmbedder(&first)).Embed(ctx, []string{"shared"}); err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+
+	// another instance finds the vector in the store
+	var second [][]string
+	got, err := NewEmbeddingCache(10, store).Wrap(countingEmbedder(&second)).Embed(ctx, []string{"shared"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if len(second) != 0 || !reflect.DeepEqual(got, [][]float64{{6}}) {
+		t.Errorf("expected a hit from the store, got calls %v and vectors %v", second, got)
+	}
+}
+
+func TestEmbeddingCache_KeyedByModelAndPooling(t *testing.T) {
+	if cacheKey("m1", "", "text") == cacheKey("m2", "", "text") {
+		t.Error("expected models not to share keys")
+	}
+	mean := &CloudflareEmbedder{}
+	cls := &CloudflareEmbedder{Pooling: "cls"}
+	if cacheKey("m", mean.pooling(), "text") == cacheKey("m", cls.pooling(), "text") {
+		t.Error("expected poolings not to share keys")
+	}
+	if cacheKey("m", "", "a  b\n") != cacheKey("m", "", "a b") {
+		t.Error("expected whitespace to be normalised")
+	}
+}
+
+func TestProcessFiles_CacheStats(t *testing.T) {
+	var calls [][]string
+	embedder := NewEmbeddingCache(10, nil).Wrap(countingEmbedder(&calls))
+	docs := []Document{{ID: "d1", Filename: "handbook.txt", Text: "The handbook covers onboarding."}}
+	opts := ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder}
+
+	var got ProcessResult
+	for range 2 {
+		ProcessFiles(context.Background(), "obj", textSources(docs), opts, func(_ string, result ProcessResult) {
+			got = result
+		})
+	}
+
+	if len(calls) != 1 {
+		t.Errorf("expected the second upload to be served from the cache, got %d calls", len(calls))
+	}
+	if got.Progress.CacheHits != 1 || got.Progress.CacheMisses != 0 {
+		t.Errorf("expected 1 hit and no misses, got %+v", got.Progress)
+	}
+}
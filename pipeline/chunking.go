@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ChunkStrategy string
+
+const (
+	ChunkFixed    ChunkStrategy = "fixed"    // back-to-back windows of Size characters
+	ChunkOverlap  ChunkStrategy = "overlap"  // windows of Size characters sharing Overlap characters
+	ChunkSentence ChunkStrategy = "sentence" // whole sentences packed up to Size characters
+)
+
+// ChunkOptions controls how extracted document text is split before embedding.
+// Size and Overlap are measured in characters (runes), not bytes.
+type ChunkOptions struct {
+	Strategy ChunkStrategy
+	Size     int
+	Overlap  int
+}
+
+var DefaultChunkOptions = ChunkOptions{
+	Strategy: ChunkSentence,
+	Size:     1000,
+	Overlap:  200,
+}
+
+// sentence terminators followed by whitespace, or a blank line
+var sentenceEnd = regexp.MustCompile(`[.!?]+["')\]]*\s+|\n\s*\n`)
+
+// ParseChunkOptions builds ChunkOptions from raw request values, falling back
+// to DefaultChunkOptions for anything left empty.
+func ParseChunkOptions(strategy, size, overlap string) (ChunkOptions, error) {
+	opts := DefaultChunkOptions
+
+	if strategy != "" {
+		opts.Strategy = ChunkStrategy(strings.ToLower(strategy))
+	}
+	if size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return opts, fmt.Errorf("invalid chunk_size: %v", err)
+		}
+		opts.Size = n
+	}
+	if overlap != "" {
+		n, err := strconv.Atoi(overlap)
+		if err != nil {
+			return opts, fmt.Errorf("invalid chunk_overlap: %v", err)
+		}
+		opts.Overlap = n
+	}
+
+	return opts, opts.Validate()
+}
+
+func (o ChunkOptions) Validate() error {
+	switch o.Strategy {
+	case ChunkFixed, ChunkSentence:
+	case ChunkOverlap:
+		if o.Overlap < 0 || o.Overlap >= o.Size {
+			return fmt.Errorf("chunk overlap must be in [0, %d), got %d", o.Size, o.Overlap)
+		}
+	default:
+		return fmt.Errorf("unknown chunk strategy %q", o.Strategy)
+	}
+	if o.Size <= 0 {
+		return fmt.Errorf("chunk size must be positive, got %d", o.Size)
+	}
+	return nil
+}
+
+// ChunkText splits the text of a single document into chunks according to
+// opts. Chunks consisting only of whitespace are dropped, so chunk indexes are
+// contiguous but offsets may have gaps.
+func ChunkText(filename, text string, opts ChunkOptions) ([]Chunk, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	runes := []rune(text)
+
+	var spans [][2]int
+	switch opts.Strategy {
+	case ChunkFixed:
+		spans = windowSpans(len(runes), opts.Size, opts.Size)
+	case ChunkOverlap:
+		spans = windowSpans(len(runes), opts.Size, opts.Size-opts.Overlap)
+	case ChunkSentence:
+		spans = sentenceSpans(text, runes, opts.Size)
+	}
+
+	chunks := make([]Chunk, 0, len(spans))
+	for _, s := range spans {
+		body := string(runes[s[0]:s[1]])
+		if strings.TrimSpace(body) == "" {
+			continue
+		}
+		chunks = append(chunks, Chunk{
+			Filename: filename,
+			Index:    len(chunks),
+			Start:    s[0],
+			End:      s[1],
+			Text:     body,
+		})
+	}
+	return chunks, nil
+}
+
+func windowSpans(n, size, step int) [][2]int {
+	var spans [][2]int
+	for start := 0; start < n; start += step {
+		end := min(start+size, n)
+		spans = append(spans, [2]int{start, end})
+		if end == n {
+			break
+		}
+	}
+	return spans
+}
+
+// sentenceSpans packs consecutive sentences into spans of at most size runes.
+// A single sentence longer than size is split into fixed windows.
+func sentenceSpans(text string, runes []rune, size int) [][2]int {
+	// sentence boundaries as rune offsets, counted on from the previous one
+	var bounds []int
+	offset, prevByte := 0, 0
+	for _, m := range sentenceEnd.FindAllStringIndex(text, -1) {
+		offset += utf8.RuneCountInString(text[prevByte:m[1]])
+		prevByte = m[1]
+		bounds = append(bounds, offset)
+	}
+	if len(bounds) == 0 || bounds[len(bounds)-1] != len(runes) {
+		bounds = append(bounds, len(runes))
+	}
+
+	var spans [][2]int
+	start, prev := 0, 0
+	for _, b := range bounds {
+		if b-start <= size {
+			prev = b
+			continue
+		}
+		if prev > start {
+			spans = append(spans, [2]int{start, prev})
+			start = prev
+		}
+		if b-start > size {
+			for _, w := range windowSpans(b-start, size, size) {
+				spans = append(spans, [2]int{start + w[0], start + w[1]})
+			}
+			start = b
+		}
+		prev = b
+	}
+	if prev > start {
+		spans = append(spans, [2]int{start, prev})
+	}
+
+	return trimSpans(runes, spans)
+}
+
+// trimSpans moves span edges past leading and trailing whitespace so offsets
+// point at the sentence text itself.
+func trimSpans(runes []rune, spans [][2]int) [][2]int {
+	for i, s := range spans {
+		for s[0] < s[1] && unicode.IsSpace(runes[s[0]]) {
+			s[0]++
+		}
+		for s[1] > s[0] && unicode.IsSpace(runes[s[1]-1]) {
+			s[1]--
+		}
+		spans[i] = s
+	}
+	return spans
+}
@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChunkText_Fixed(t *testing.T) {
+	chunks, err := ChunkText("a.txt", "abcdefghij", ChunkOptions{Strategy: ChunkFixed, Size: 4})
+	if err != nil {
+		t.Fatalf("ChunkText failed: %v", err)
+	}
+
+	expected := []string{"abcd", "efgh", "ij"}
+	if len(chunks) != len(expected) {
+		t.Fatalf("expected %d chunks, got %d", len(expected), len(chunks))
+	}
+	for i, c := range chunks {
+		if c.Text != expected[i] || c.Index != i || c.Filename != "a.txt" {
+			t.Errorf("chunk %d mismatch: %+v", i, c)
+		}
+		if c.Start != i*4 {
+			t.Errorf("chunk %d: expected start %d, got %d", i, i*4, c.Start)
+		}
+	}
+}
+
+func TestChunkText_Overlap(t *testing.T) {
+	chunks, err := ChunkText("a.txt", "abcdefghij", ChunkOptions{Strategy: ChunkOverlap, Size: 4, Overlap: 2})
+	if err != nil {
+		t.Fatalf("ChunkText failed: %v", err)
+	}
+
+	expected := []string{"abcd", "cdef", "efgh", "ghij"}
+	if len(chunks) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, chunks)
+	}
+	for i, c := range chunks {
+		if c.Text != expected[i] {
+			t.Errorf("chunk %d: expected %q, got %q", i, expected[i], c.Text)
+		}
+	}
+}
+
+func TestChunkText_Sentence(t *testing.T) {
+	// multibyte runes make byte and rune offsets differ
+	text := "First séntence here. Second öne! A third? And a fourth."
+	chunks, err := ChunkText("a.txt", text, ChunkOptions{Strategy: ChunkSentence, Size: 40})
+	if err != nil {
+		t.Fatalf("ChunkText failed: %v", err)
+	}
+
+	expected := []string{"First séntence here. Second öne!", "A third? And a fourth."}
+	if len(chunks) != len(expected) {
+		t.Fatalf("expected %v, got %+v", expected, chunks)
+	}
+	for i, c := range chunks {
+		if c.Text != expected[i] {
+			t.Errorf("chunk %d: expected %q, got %q", i, expected[i], c.Text)
+		}
+		if string([]rune(text)[c.Start:c.End]) != c.Text {
+			t.Errorf("chunk %d offsets [%d:%d] do not match its text", i, c.Start, c.End)
+		}
+	}
+}
+
+func TestChunkText_LongSentenceIsSplit(t *testing.T) {
+	text := strings.Repeat("x", 25) + ". Short."
+	chunks, err := ChunkText("a.txt", text, ChunkOptions{Strategy: ChunkSentence, Size: 10})
+	if err != nil {
+		t.Fatalf("ChunkText failed: %v", err)
+	}
+	for _, c := range chunks {
+		if len([]rune(c.Text)) > 10 {
+			t.Errorf("chunk exceeds size: %q", c.Text)
+		}
+	}
+	if last := chunks[len(chunks)-1]; last.Text != "Short." {
+		t.Errorf("expected last chunk %q, got %q", "Short.", last.Text)
+	}
+}
+
+func TestChunkText_RuneOffsets(t *testing.T) {
+	chunks, err := ChunkText("a.txt", "héllo wörld", ChunkOptions{Strategy: ChunkFixed, Size: 6})
+	if err != nil {
+		t.Fatalf("ChunkText failed: %v", err)
+	}
+	if chunks[1].Start != 6 || chunks[1].Text != "wörld" {
+		t.Errorf("unexpected second chunk: %+v", chunks[1])
+	}
+}
+
+func TestParseChunkOptions(t *testing.T) {
+	opts, err := ParseChunkOptions("", "", "")
+	if err != nil || opts != DefaultChunkOptions {
+		t.Errorf("expected defaults, got %+v, err: %v", opts, err)
+	}
+
+	if _, err := ParseChunkOptions("paragraph", "", ""); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+	if _, err := ParseChunkOptions("overlap", "100", "100"); err == nil {
+		t.Error("expected error when overlap >= size")
+	}
+	if _, err := ParseChunkOptions("fixed", "abc", ""); err == nil {
+		t.Error("expected error for non-numeric size")
+	}
+}
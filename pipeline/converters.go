@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Converter turns one kind of uploaded file into plain text. A file is
+// matched to a converter by its extension, by Magic, which recognises the
+// format from the content whatever the file is called, and, for files
+// without an extension, by the MIME type sniffed from its content. The first
+// MIME type is the one recorded in Source.ContentType. When several
+// converters match equally well, the one with the highest Priority wins.
+type Converter struct {
+	Name       string                               `json:"name"`
+	Extensions []string                             `json:"extensions"` // lower case, with the dot
+	MIMETypes  []string                             `json:"mime_types"`
+	Magic      func(r io.ReaderAt, size int64) bool `json:"-"`
+	Priority   int                                  `json:"priority"`
+	// Convert extracts the text and whatever structure the format has.
+	// Long conversions stop early once ctx is cancelled.
+	Convert func(ctx context.Context, content []byte) (Extracted, error) `json:"-"`
+	// ConvertAt, if set, is Convert for files read in place, such as uploads
+	// spooled to disk, so a large file need not be loaded into memory.
+	ConvertAt func(ctx context.Context, r io.ReaderAt, size int64) (Extracted, error) `json:"-"`
+}
+
+// Extracted is the output of a Converter: the text and, for formats that
+// have them, the sections and pages it is divided into and the metadata the
+// document declares. Failed lists parts of the document that could not be
+// converted and are missing from the text.
+type Extracted struct {
+	Text        []byte
+	Sections    []Section
+	Pages       []PageStart
+	Title       string
+	Description string
+	Author      string
+	Created     time.Time
+	PageCount   int
+	Failed      []string
+}
+
+var (
+	convertersMu sync.RWMutex
+	converters   = map[string]Converter{}
+)
+
+// RegisterConverter adds c to the registry, replacing any converter of the
+// same name.
+func RegisterConverter(c Converter) {
+	if c.Name == "" || c.Convert == nil || len(c.MIMETypes) == 0 {
+		panic("pipeline: converter needs a name, a MIME type and a Convert func")
+	}
+	convertersMu.Lock()
+	defer convertersMu.Unlock()
+	converters[c.Name] = c
+}
+
+// Converters lists the registered converters, highest priority first.
+func Converters() []Converter {
+	convertersMu.RLock()
+	defer convertersMu.RUnlock()
+	list := make([]Converter, 0, len(converters))
+	for _, c := range converters {
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b Converter) int {
+		return cmp.Or(cmp.Compare(b.Priority, a.Priority), cmp.Compare(a.Name, b.Name))
+	})
+	return list
+}
+
+// DetectConverter picks the converter for an upload. In order of preference:
+// a converter whose magic bytes and extension both match, one whose magic
+// bytes match, one that claims the extension, and, only for files without an
+// extension, one that claims the sniffed MIME type. A converter chosen by
+// extension must have matching magic bytes if it declares any, and otherwise
+// content that sniffs as text, so a binary file cannot pass for text by its
+// name.
+func DetectConverter(filename string, content []byte) (Converter, error) {
+	return DetectConverterAt(filename, bytes.NewReader(content), int64(len(content)))
+}
+
+// DetectConverterAt is DetectConverter for a file of size bytes read from r,
+// such as an upload spooled to disk.
+func DetectConverterAt(filename string, r io.ReaderAt, size int64) (Converter, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	head := make([]byte, min(size, 512))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return Converter{}, fmt.Errorf("failed to read file: %v", err)
+	}
+	sniffed := http.DetectContentType(head)
+	if i := strings.Index(sniffed, ";"); i != -1 {
+		sniffed = strings.TrimSpace(sniffed[:i])
+	}
+
+	var magicExt, magic, byExt, byMIME []Converter
+	for _, c := range Converters() {
+		hasMagic := c.Magic != nil && c.Magic(r, size)
+		hasExt := ext != "" && slices.Contains(c.Extensions, ext)
+		switch {
+		case hasMagic && hasExt:
+			magicExt = append(magicExt, c)
+		case hasMagic:
+			magic = append(magic, c)
+		case hasExt:
+			byExt = append(byExt, c)
+		case ext == "" && slices.Contains(c.MIMETypes, sniffed):
+			byMIME = append(byMIME, c)
+		}
+	}
+
+	// candidates are already ordered by priority
+	switch {
+	case len(magicExt) > 0:
+		return magicExt[0], nil
+	case len(magic) > 0:
+		return magic[0], nil
+	case len(byExt) > 0:
+		c := byExt[0]
+		if c.Magic != nil {
+			return Converter{}, fmt.Errorf("content is not %s", c.Name)
+		}
+		if !strings.HasPrefix(sniffed, "text/") && !slices.Contains(c.MIMETypes, sniffed) {
+			return Converter{}, fmt.Errorf("unsupported file type %s", sniffed)
+		}
+		return c, nil
+	case len(byMIME) > 0:
+		return byMIME[0], nil
+	case ext != "":
+		return Converter{}, fmt.Errorf("unsupported file extension %s", ext)
+	default:
+		return Converter{}, fmt.Errorf("unsupported file type %s", sniffed)
+	}
+}
+
+// hasPrefix is a Magic func for formats that start with prefix.
+func hasPrefix(prefix string) func(io.ReaderAt, int64) bool {
+	return func(r io.ReaderAt, size int64) bool {
+		head := make([]byte, len(prefix))
+		if size < int64(len(prefix)) {
+			return false
+		}
+		_, err := r.ReadAt(head, 0)
+		return err == nil && string(head) == prefix
+	}
+}
+
+// converterFor returns the highest priority converter for contentType.
+func converterFor(contentType string) (Converter, bool) {
+	for _, c := range Converters() {
+		if slices.Contains(c.MIMETypes, contentType) {
+			return c, true
+		}
+	}
+	return Converter{}, false
+}
+
+// plainText embeds a file as it is.
+func plainText(_ context.Context, content []byte) (Extracted, error) {
+	return Extracted{Text: content}, nil
+}
+
+// textOnly adapts a converter of formats that have no structure.
+func textOnly(convert func([]byte) ([]byte, error)) func(context.Context, []byte) (Extracted, error) {
+	return func(_ context.Context, content []byte) (Extracted, error) {
+		text, err := convert(content)
+		return Extracted{Text: text}, err
+	}
+}
+
+// selecting adapts a converter of structured formats, passing it the paths
+// selected for the job.
+func selecting(convert func([]byte, []string) ([]byte, error)) func(context.Context, []byte) (Extracted, error) {
+	return func(ctx context.Context, content []byte) (Extracted, error) {
+		text, err := convert(content, selectorsFrom(ctx))
+		return Extracted{Text: text}, err
+	}
+}
+
+func init() {
+	RegisterConverter(Converter{
+		Name:       "pdf",
+		Extensions: []string{".pdf"},
+		MIMETypes:  []string{"application/pdf"},
+		Magic:      hasPrefix("%PDF-"),
+		Priority:   10,
+		Convert:    convertPdf,
+		ConvertAt:  convertPdfAt,
+	})
+	RegisterConverter(Converter{
+		Name:       "csv",
+		Extensions: []string{".csv"},
+		MIMETypes:  []string{"text/csv"},
+		Priority:   10,
+		Convert:    textOnly(CsvToText),
+	})
+	RegisterConverter(Converter{
+		Name:       "json",
+		Extensions: []string{".json"},
+		MIMETypes:  []string{"application/json"},
+		Priority:   10,
+		Convert:    textOnly(JsonToText),
+	})
+	RegisterConverter(Converter{
+		Name:       "markdown",
+		Extensions: []string{".md", ".markdown"},
+		MIMETypes:  []string{"text/markdown", "text/x-markdown"},
+		Priority:   10,
+		Convert:    plainText,
+	})
+	RegisterConverter(Converter{
+		Name:       "yaml",
+		Extensions: []string{".yml", ".yaml"},
+		MIMETypes:  []string{"text/x-yaml", "application/yaml"},
+		Priority:   10,
+		Convert:    selecting(YamlToText),
+	})
+	RegisterConverter(Converter{
+		Name:       "xml",
+		Extensions: []string{".xml"},
+		MIMETypes:  []string{"application/xml", "text/xml"},
+		Priority:   10,
+		Convert:    selecting(XmlToText),
+	})
+	RegisterConverter(Converter{
+		Name:       "text",
+		Extensions: []string{".txt", ".log"},
+		MIMETypes:  []string{"text/plain", "text/x-log"},
+		Priority:   0,
+		Convert:    plainText,
+	})
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDetectConverter(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+		expected string // converter name, empty for an error
+	}{
+		{"data.csv", "a,b\n1,2\n", "csv"},
+		{"DATA.JSON", `{"a": 1}`, "json"},
+		{"notes.md", "# Title", "markdown"},
+		{"config.yaml", "a: 1", "yaml"},
+		{"feed.xml", "<feed></feed>", "xml"},
+		{"notes.txt", "Plain words.", "text"},
+		{"scan", "%PDF-1.4 ...", "pdf"},
+		{"scan.txt", "%PDF-1.4 ...", "pdf"},
+		{"README", "Plain words.", "text"},
+		{"feed", "<?xml version=\"1.0\"?><feed/>", "xml"},
+		{"fake.pdf", "just text", ""},
+		{"image.png", "fake image content", ""},
+		{"notes.txt", "\x89PNG\r\n\x1a\n\x00\x00", ""},
+		{"blob", "\x00\x01\x02\x03", ""},
+	}
+	for _, tt := range tests {
+		c, err := DetectConverter(tt.filename, []byte(tt.content))
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got converter %s", tt.filename, c.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.filename, err)
+			continue
+		}
+		if c.Name != tt.expected {
+			t.Errorf("%s: expected converter %s, got %s", tt.filename, tt.expected, c.Name)
+		}
+	}
+}
+
+func TestRegisterConverter(t *testing.T) {
+	shout := Converter{
+		Name:       "shout",
+		Extensions: []string{".shout", ".txt"},
+		MIMETypes:  []string{"text/x-shout"},
+		Priority:   20,
+		Convert: func(_ context.Context, content []byte) (Extracted, error) {
+			return Extracted{Text: []byte(strings.ToUpper(string(content)))}, nil
+		},
+	}
+	RegisterConverter(shout)
+	defer func() {
+		convertersMu.Lock()
+		delete(converters, shout.Name)
+		convertersMu.Unlock()
+	}()
+
+	// a higher priority wins a shared extension
+	c, err := DetectConverter("notes.txt", []byte("quiet words"))
+	if err != nil || c.Name != "shout" {
+		t.Fatalf("expected the shout converter, got %s, %v", c.Name, err)
+	}
+	text, err := ExtractText(context.Background(), c.MIMETypes[0], []byte("quiet words"))
+	if err != nil || string(text) != "QUIET WORDS" {
+		t.Errorf("expected converted text, got %q, %v", text, err)
+	}
+	if Converters()[0].Name != "shout" {
+		t.Error("expected converters to be listed by priority")
+	}
+}
+
+func TestExtractText_CsvAndJson(t *testing.T) {
+	text, err := ExtractText(context.Background(), "text/csv", []byte("a,b\n1,2\n"))
+	if err != nil || string(text) != "a\tb\n1\t2\n" {
+		t.Errorf("expected CSV to be converted, got %q, %v", text, err)
+	}
+	text, err = ExtractText(context.Background(), "application/json", []byte(`{"a":1}`))
+	if err != nil || string(text) != "{\n  \"a\": 1\n}" {
+		t.Errorf("expected JSON to be converted, got %q, %v", text, err)
+	}
+	if _, err := ExtractText(context.Background(), "image/png", nil); err == nil {
+		t.Error("expected an error for an unsupported type")
+	}
+}
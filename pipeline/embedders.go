@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Embedder turns texts into vectors, returning one vector per input text in
+// the same order. Embed stops and returns ctx.Err() once ctx is cancelled.
+type Embedder interface {
+	// Model is the provider's name for the embedding model.
+	Model() string
+	// Dimension is the length of each vector, or 0 if not yet known.
+	Dimension() int
+	Embed(ctx context.Context, texts []string) ([][]float64, error)
+}
+
+const (
+	ProviderCloudflare = "cloudflare"
+	ProviderOpenAI     = "openai"
+	ProviderOllama     = "ollama"
+)
+
+// DefaultEmbedder is used when a job or query does not ask for a specific
+// provider. RunApp replaces it according to EMBEDDING_PROVIDER.
+var DefaultEmbedder Embedder = &CloudflareEmbedder{}
+
+// NewEmbedder builds the named provider from its environment configuration.
+// An empty name selects EMBEDDING_PROVIDER, falling back to Cloudflare.
+//
+// Environment:
+//   - cloudflare: CLOUDFLARE_ACCOUNT_ID, CLOUDFLARE_API_TOKEN, CLOUDFLARE_BATCH_SIZE,
+//     CLOUDFLARE_MAX_CONCURRENCY, CLOUDFLARE_MAX_RETRIES, CLOUDFLARE_POOLING
+//   - openai: OPENAI_BASE_URL, OPENAI_API_KEY, OPENAI_EMBEDDING_MODEL, OPENAI_EMBEDDING_DIMENSIONS
+//   - ollama: OLLAMA_HOST, OLLAMA_EMBEDDING_MODEL, OLLAMA_EMBEDDING_DIMENSIONS
+//
+// The embedder is wrapped by DefaultEmbeddingCache when one is configured.
+func NewEmbedder(provider string) (Embedder, error) {
+	e, err := newEmbedder(provider)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultEmbeddingCache.Wrap(e), nil
+}
+
+func newEmbedder(provider string) (Embedder, error) {
+	if provider == "" {
+		provider = os.Getenv("EMBEDDING_PROVIDER")
+	}
+
+	switch strings.ToLower(provider) {
+	case "", ProviderCloudflare:
+		e := &CloudflareEmbedder{
+			AccountID: os.Getenv("CLOUDFLARE_ACCOUNT_ID"),
+			APIToken:  os.Getenv("CLOUDFLARE_API_TOKEN"),
+			Pooling:   strings.ToLower(os.Getenv("CLOUDFLARE_POOLING")),
+		}
+		if e.Pooling != "" && e.Pooling != "mean" && e.Pooling != "cls" {
+			return nil, fmt.Errorf("invalid CLOUDFLARE_POOLING %q: must be mean or cls", e.Pooling)
+		}
+		var err error
+		if e.BatchSize, err = envInt("CLOUDFLARE_BATCH_SIZE"); err != nil {
+			return nil, err
+		}
+		if e.Concurrency, err = envInt("CLOUDFLARE_MAX_CONCURRENCY"); err != nil {
+			return nil, err
+		}
+		if e.MaxRetries, err = envInt("CLOUDFLARE_MAX_RETRIES"); err != nil {
+			return nil, err
+		}
+		return e, nil
+
+	case ProviderOpenAI:
+		dim, err := envInt("OPENAI_EMBEDDING_DIMENSIONS")
+		if err != nil {
+			return nil, err
+		}
+		return &OpenAIEmbedder{
+			BaseURL:   envOr("OPENAI_BASE_URL", "https://api.openai.com"),
+			APIKey:    os.Getenv("OPENAI_API_KEY"),
+			ModelName: envOr("OPENAI_EMBEDDING_MODEL", "text-embedding-3-small"),
+			Dim:       dim,
+		}, nil
+
+	case ProviderOllama:
+		dim, err := envInt("OLLAMA_EMBEDDING_DIMENSIONS")
+		if err != nil {
+			return nil, err
+		}
+		return &OllamaEmbedder{
+			BaseURL:   envOr("OLLAMA_HOST", "http://localhost:11434"),
+			ModelName: envOr("OLLAMA_EMBEDDING_MODEL", "nomic-embed-text"),
+			Dim:       dim,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown embedding provider %q", provider)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envInt(key string) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,317 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpenAIEmbedder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer key" {
+			t.Errorf("unexpected auth header %q", got)
+		}
+
+		var req OpenAIEmbeddingReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "m" || len(req.Input) != 2 {
+			t.Errorf("unexpected request: %+v", req)
+		}
+
+		// out of order on purpose
+		w.Write([]byte(`{"data":[{"embedding":[3,4],"index":1},{"embedding":[1,2],"index":0}]}`))
+	}))
+	defer server.Close()
+
+	e := &OpenAIEmbedder{BaseURL: server.URL + "/", APIKey: "key", ModelName: "m"}
+	if e.Dimension() != 0 {
+		t.Errorf("expected unknown dimension before first call, got %d", e.Dimension())
+	}
+
+	result, err := e.Embed(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if !reflect.DeepEqual(result, [][]float64{{1, 2}, {3, 4}}) {
+		t.Errorf("unexpected embeddings: %v", result)
+	}
+	if e.Dimension() != 2 {
+		t.Errorf("expected learned dimension 2, got %d", e.Dimension())
+	}
+}
+
+func TestOllamaEmbedder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/embed" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"embeddings":[[0.5,0.25,0.125]]}`))
+	}))
+	defer server.Close()
+
+	e := &OllamaEmbedder{BaseURL: server.URL, ModelName: "nomic-embed-text"}
+	result, err := e.Embed(context.Background(), []string{"a"})
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if len(result) != 1 || e.Dimension() != 3 {
+		t.Errorf("unexpected result %v, dimension %d", result, e.Dimension())
+	}
+}
+
+func TestEmbedder_ErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	e := &OllamaEmbedder{BaseURL: server.URL, ModelName: "missing"}
+	if _, err := e.Embed(context.Background(), []string{"a"}); err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
+
+func TestNewEmbedder(t *testing.T) {
+	t.Setenv("EMBEDDING_PROVIDER", "ollama")
+	t.Setenv("OLLAMA_EMBEDDING_MODEL", "all-minilm")
+
+	e, err := NewEmbedder("")
+	if err != nil {
+		t.Fatalf("NewEmbedder failed: %v", err)
+	}
+	if _, ok := e.(*OllamaEmbedder); !ok || e.Model() != "all-minilm" {
+		t.Errorf("expected ollama embedder from env, got %T %s", e, e.Model())
+	}
+
+	e, err = NewEmbedder("OpenAI")
+	if err != nil {
+		t.Fatalf("NewEmbedder failed: %v", err)
+	}
+	if _, ok := e.(*OpenAIEmbedder); !ok {
+		t.Errorf("expected explicit provider to win over env, got %T", e)
+	}
+
+	if _, err := NewEmbedder("word2vec"); err == nil {
+		t.Error("expected error for unknown provider")
+	}
+
+	t.Setenv("OLLAMA_EMBEDDING_DIMENSIONS", "lots")
+	if _, err := NewEmbedder("ollama"); err == nil {
+		t.Error("expected error for invalid dimensions")
+	}
+}
+
+func TestMain(m *testing.M) {
+	// keep retry backoff out of test run time
+	retryBaseDelay = time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestCloudflareEmbedder_Batching(t *testing.T) {
+	var calls, inFlight, peak atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		var req BGEReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Text) > 2 {
+			t.Errorf("batch larger than BatchSize: %d", len(req.Text))
+		}
+
+		res := BGERes{Success: true}
+		for _, text := range req.Text {
+			v, _ := strconv.ParseFloat(text, 64)
+			res.Result.Data = append(res.Result.Data, []float64{v})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	var texts []string
+	for i := range 7 {
+		texts = append(texts, strconv.Itoa(i))
+	}
+
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token", BatchSize: 2, Concurrency: 2}
+	result, err := e.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+
+	if calls.Load() != 4 {
+		t.Errorf("expected 4 batches, got %d", calls.Load())
+	}
+	if peak.Load() > 2 {
+		t.Errorf("expected at most 2 concurrent batches, got %d", peak.Load())
+	}
+	for i, v := range result {
+		if v[0] != float64(i) {
+			t.Fatalf("batch results out of order: %v", result)
+		}
+	}
+}
+
+func TestCloudflareEmbedder_RetriesRateLimit(t *testing.T) {
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"success":false,"errors":[{"code":3040,"message":"Capacity temporarily exceeded"}]}`))
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":{"data":[[1,2]]}}`))
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token"}
+	result, err := e.Embed(context.Background(), []string{"a"})
+	if err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if calls.Load() != 3 || len(result) != 1 {
+		t.Errorf("expected 3 attempts and 1 embedding, got %d attempts, %v", calls.Load(), result)
+	}
+}
+
+func TestCloudflareEmbedder_TypedError(t *testing.T) {
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"success":false,"errors":[{"code":5006,"message":"Error: oneOf at '/' not met"}]}`))
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token"}
+	_, err := e.Embed(context.Background(), []string{"a"})
+
+	var cfErr *CloudflareError
+	if !errors.As(err, &cfErr) {
+		t.Fatalf("expected CloudflareError, got %v", err)
+	}
+	if cfErr.StatusCode != http.StatusBadRequest || len(cfErr.Errors) != 1 || cfErr.Errors[0].Code != 5006 {
+		t.Errorf("unexpected error contents: %+v", cfErr)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 4xx not to be retried, got %d attempts", calls.Load())
+	}
+}
+
+func TestCloudflareEmbedder_GivesUp(t *testing.T) {
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token", MaxRetries: 2}
+	_, err := e.Embed(context.Background(), []string{"a"})
+
+	var cfErr *CloudflareError
+	if !errors.As(err, &cfErr) || !strings.Contains(cfErr.Error(), "upstream unavailable") {
+		t.Fatalf("expected CloudflareError with raw body, got %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 1 attempt + 2 retries, got %d", calls.Load())
+	}
+}
+
+func TestCloudflareEmbedder_RetriesOnlyTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`not json`))
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token"}
+	if _, err := e.Embed(context.Background(), []string{"a"}); err == nil {
+		t.Fatal("expected an error for an undecodable response")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected a malformed response not to be retried, got %d attempts", calls.Load())
+	}
+
+	// nothing listens on a closed server
+	server.Close()
+	e = &CloudflareEmbedder{AccountID: "id", APIToken: "token", MaxRetries: 1}
+	if _, err := e.Embed(context.Background(), []string{"a"}); !errors.Is(err, errNetwork) {
+		t.Errorf("expected a network error, got %v", err)
+	}
+}
+
+func TestCloudflareEmbedder_CapsRetryAfter(t *testing.T) {
+	original := maxRetryDelay
+	defer func() { maxRetryDelay = original }()
+	maxRetryDelay = time.Millisecond
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"success":true,"result":{"data":[[1,2]]}}`))
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e := &CloudflareEmbedder{AccountID: "id", APIToken: "token"}
+	if _, err := e.Embed(ctx, []string{"a"}); err != nil {
+		t.Fatalf("expected the retry not to wait an hour, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Errorf("expected 3s, got %v", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d < 58*time.Second || d > time.Minute {
+		t.Errorf("expected about a minute, got %v", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("expected 0 for garbage, got %v", d)
+	}
+}
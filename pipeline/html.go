@@ -0,0 +1,396 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+func init() {
+	RegisterConverter(Converter{
+		Name:       "html",
+		Extensions: []string{".html", ".htm", ".xhtml"},
+		MIMETypes:  []string{"text/html", "application/xhtml+xml"},
+		Priority:   10,
+		Convert:    HtmlToText,
+	})
+}
+
+// elements that never hold content worth embedding
+var htmlSkipped = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Template: true, atom.Nav: true, atom.Aside: true, atom.Form: true,
+	atom.Iframe: true, atom.Svg: true, atom.Button: true, atom.Select: true,
+	atom.Textarea: true, atom.Object: true, atom.Canvas: true, atom.Dialog: true,
+}
+
+// ARIA roles of page chrome
+var htmlChromeRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true,
+	"complementary": true, "search": true, "menu": true, "menubar": true,
+}
+
+// id and class names of navigation chrome in common wiki and CMS exports
+var htmlChromeNames = regexp.MustCompile(`(?i)(^|[-_\s])(nav|navbar|navigation|menu|sidebar|breadcrumbs?|footer|cookies?|toc)([-_\s]|$)`)
+
+// elements that start a new paragraph
+var htmlBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true,
+	atom.Main: true, atom.Header: true, atom.Footer: true, atom.Blockquote: true,
+	atom.Figure: true, atom.Figcaption: true, atom.Dl: true, atom.Dt: true,
+	atom.Dd: true, atom.Hr: true, atom.Address: true, atom.Details: true,
+	atom.Summary: true, atom.Caption: true,
+}
+
+// elements whose text is kept apart from its neighbours on a single line
+var htmlSeparated = map[atom.Atom]bool{
+	atom.Br: true, atom.Li: true, atom.Td: true, atom.Th: true, atom.Tr: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+var htmlSpace = regexp.MustCompile(`\s+`)
+
+// HtmlToText extracts the content of a web page. Scripts, styles, navigation
+// and other page chrome are dropped; when the page marks its content with
+// <main> or <article>, only that is kept. Headings become sections, list
+// items become "- " or numbered lines and table rows become lines of
+// tab-separated cells. The <title> and meta description are returned as the
+// document's title and description.
+func HtmlToText(ctx context.Context, content []byte) (Extracted, error) {
+	r, err := charset.NewReader(bytes.NewReader(content), "")
+	if err != nil {
+		return Extracted{}, fmt.Errorf("failed to decode HTML: %v", err)
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return Extracted{}, fmt.Errorf("failed to parse HTML: %v", err)
+	}
+
+	title, description := htmlMetadata(doc)
+	h := &htmlRenderer{ctx: ctx}
+	h.node(htmlContentRoot(doc))
+	if err := ctx.Err(); err != nil {
+		return Extracted{}, err
+	}
+	h.flush()
+
+	extracted, _ := h.out.result()
+	extracted.Title = title
+	extracted.Description = description
+	return extracted, nil
+}
+
+// htmlMetadata returns the title and description a page declares, falling
+// back to its Open Graph tags.
+func htmlMetadata(doc *html.Node) (title, description string) {
+	var ogTitle, ogDescription string
+	for n := range doc.Descendants() {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		switch n.DataAtom {
+		case atom.Title:
+			if title == "" {
+				title = htmlInlineText(n)
+			}
+		case atom.Meta:
+			value := strings.TrimSpace(htmlSpace.ReplaceAllString(htmlAttr(n, "content"), " "))
+			switch strings.ToLower(htmlAttr(n, "name") + htmlAttr(n, "property")) {
+			case "description":
+				description = value
+			case "og:title":
+				ogTitle = value
+			case "og:description":
+				ogDescription = value
+			}
+		}
+	}
+	if title == "" {
+		title = ogTitle
+	}
+	if description == "" {
+		description = ogDescription
+	}
+	return title, description
+}
+
+// htmlContentRoot picks the element holding the page's content: its main
+// element, else its only article, else its body.
+func htmlContentRoot(doc *html.Node) *html.Node {
+	var body *html.Node
+	var articles []*html.Node
+	for n := range doc.Descendants() {
+		if n.Type != html.ElementNode {
+			continue
+		}
+		switch {
+		case n.DataAtom == atom.Main || htmlAttr(n, "role") == "main":
+			return n
+		case n.DataAtom == atom.Article:
+			articles = append(articles, n)
+		case n.DataAtom == atom.Body && body == nil:
+			body = n
+		}
+	}
+	switch {
+	case len(articles) == 1:
+		return articles[0]
+	case body != nil:
+		return body
+	default:
+		return doc
+	}
+}
+
+// htmlChrome reports whether n is page chrome rather than content. Headers
+// and footers are chrome unless they belong to an article.
+func htmlChrome(n *html.Node, inArticle bool) bool {
+	if htmlSkipped[n.DataAtom] {
+		return true
+	}
+	if !inArticle && (n.DataAtom == atom.Header || n.DataAtom == atom.Footer) {
+		return true
+	}
+	if _, hidden := htmlAttrOk(n, "hidden"); hidden || htmlAttr(n, "aria-hidden") == "true" {
+		return true
+	}
+	if htmlChromeRoles[htmlAttr(n, "role")] {
+		return true
+	}
+	return htmlChromeNames.MatchString(htmlAttr(n, "id")) || htmlChromeNames.MatchString(htmlAttr(n, "class"))
+}
+
+// htmlRenderer writes the text of a page, one block at a time.
+type htmlRenderer struct {
+	ctx       context.Context
+	out       textBuilder
+	line      strings.Builder // inline text of the current block
+	pre       int             // depth of <pre> elements
+	articles  int             // depth of <article> and <main> elements
+	lists     []int           // item counters of open lists, -1 when unordered
+	listItem  string          // marker of the list item being written
+	listDepth int             // nesting of the list item being written
+}
+
+// block renders the children of n.
+func (h *htmlRenderer) block(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if h.ctx.Err() != nil {
+			return
+		}
+		h.node(c)
+	}
+}
+
+func (h *htmlRenderer) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		h.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		h.block(n)
+		return
+	}
+	if htmlChrome(n, h.articles > 0) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		h.flush()
+		if text := htmlInlineText(n); text != "" {
+			h.out.section(text)
+			h.out.WriteString(text + "\n\n")
+		}
+	case atom.Ul, atom.Ol, atom.Menu:
+		h.flush()
+		counter := -1
+		if n.DataAtom == atom.Ol {
+			counter, _ = strconv.Atoi(htmlAttr(n, "start"))
+			counter = max(counter, 1)
+		}
+		h.lists = append(h.lists, counter)
+		h.block(n)
+		h.lists = h.lists[:len(h.lists)-1]
+		if len(h.lists) == 0 {
+			h.out.WriteString("\n")
+		}
+	case atom.Li:
+		h.flush()
+		marker := "- "
+		if len(h.lists) > 0 && h.lists[len(h.lists)-1] > 0 {
+			marker = strconv.Itoa(h.lists[len(h.lists)-1]) + ". "
+			h.lists[len(h.lists)-1]++
+		}
+		outerItem, outerDepth := h.listItem, h.listDepth
+		h.listItem, h.listDepth = marker, max(len(h.lists), 1)
+		h.block(n)
+		h.flush()
+		h.listItem, h.listDepth = outerItem, outerDepth
+	case atom.Table:
+		h.flush()
+		h.table(n)
+	case atom.Br:
+		h.line.WriteString("\n")
+	case atom.Pre:
+		h.flush()
+		h.pre++
+		h.block(n)
+		h.flush()
+		h.pre--
+	case atom.Img:
+		if alt := strings.TrimSpace(htmlAttr(n, "alt")); alt != "" {
+			h.text(" " + alt + " ")
+		}
+	case atom.Article, atom.Main:
+		h.flush()
+		h.articles++
+		h.block(n)
+		h.articles--
+		h.flush()
+	default:
+		if htmlBlocks[n.DataAtom] {
+			h.flush()
+			h.block(n)
+			h.flush()
+		} else {
+			h.block(n)
+		}
+	}
+}
+
+// text adds inline text to the current block. Outside <pre>, runs of
+// whitespace collapse to a single space.
+func (h *htmlRenderer) text(s string) {
+	if h.pre > 0 {
+		h.line.WriteString(s)
+		return
+	}
+	s = htmlSpace.ReplaceAllString(s, " ")
+	if line := h.line.String(); line == "" || strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\n") {
+		s = strings.TrimLeft(s, " ")
+	}
+	h.line.WriteString(s)
+}
+
+// flush ends the current block: a paragraph, or a line of a list item.
+func (h *htmlRenderer) flush() {
+	text := h.line.String()
+	h.line.Reset()
+	if h.pre == 0 {
+		var lines []string
+		for _, l := range strings.Split(text, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		text = strings.Join(lines, "\n")
+	} else {
+		text = strings.Trim(text, "\n")
+	}
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	if len(h.lists) == 0 {
+		h.out.WriteString(text + "\n\n")
+		return
+	}
+	// the first line of an item carries its marker, the rest line up with it
+	indent := strings.Repeat("  ", h.listDepth-1)
+	prefix := indent + h.listItem
+	for i, l := range strings.Split(text, "\n") {
+		if i > 0 {
+			prefix = indent + strings.Repeat(" ", len(h.listItem))
+		}
+		h.out.WriteString(prefix + l + "\n")
+	}
+	h.listItem = strings.Repeat(" ", len(h.listItem))
+}
+
+// table writes a table as lines of tab-separated cells, its caption first.
+// Nested tables are flattened into their cell.
+func (h *htmlRenderer) table(n *html.Node) {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || htmlChrome(c, true) {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Caption:
+				if text := htmlInlineText(c); text != "" {
+					h.out.WriteString(text + "\n")
+				}
+			case atom.Tr:
+				var row []string
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+						row = append(row, htmlInlineText(cell))
+					}
+				}
+				if strings.Join(row, "") != "" {
+					rows = append(rows, row)
+				}
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	for _, row := range rows {
+		h.out.WriteString(strings.Join(row, "\t") + "\n")
+	}
+	if len(rows) > 0 {
+		h.out.WriteString("\n")
+	}
+}
+
+// htmlInlineText returns the text of n on a single line, without chrome.
+func htmlInlineText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.Type == html.TextNode:
+				b.WriteString(c.Data)
+			case c.Type != html.ElementNode:
+			case c.DataAtom == atom.Img:
+				b.WriteString(" " + htmlAttr(c, "alt") + " ")
+			case htmlChrome(c, true):
+			case htmlBlocks[c.DataAtom] || htmlSeparated[c.DataAtom]:
+				b.WriteString(" ")
+				walk(c)
+				b.WriteString(" ")
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(htmlSpace.ReplaceAllString(b.String(), " "))
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	v, _ := htmlAttrOk(n, key)
+	return v
+}
+
+func htmlAttrOk(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const wikiPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Onboarding - Team Wiki</title>
+  <meta name="description" content="How new starters
+    get set up.">
+  <style>body { color: red }</style>
+  <script>trackPageView()</script>
+</head>
+<body>
+  <header><a href="/">Team Wiki</a></header>
+  <div id="mw-navigation"><ul><li>Home</li><li>Recent changes</li></ul></div>
+  <main>
+    <h1>Onboarding</h1>
+    <p>Welcome to the <a href="/team">team</a>s wiki.
+       Read this first.</p>
+    <h2>First week</h2>
+    <ol>
+      <li>Get a laptop</li>
+      <li>Meet your buddy
+        <ul><li>Book a coffee</li></ul>
+      </li>
+    </ol>
+    <table>
+      <tr><th>Tool</th><th>Owner</th></tr>
+      <tr><td>Chat</td><td>IT</td></tr>
+    </table>
+    <pre>make setup
+  make test</pre>
+    <div class="cookie-banner">We use cookies</div>
+  </main>
+  <footer>Copyright</footer>
+</body>
+</html>`
+
+func TestHtmlToText(t *testing.T) {
+	got, err := HtmlToText(context.Background(), []byte(wikiPage))
+	if err != nil {
+		t.Fatalf("HtmlToText failed: %v", err)
+	}
+
+	expected := "Onboarding\n\n" +
+		"Welcome to the teams wiki. Read this first.\n\n" +
+		"First week\n\n" +
+		"1. Get a laptop\n" +
+		"2. Meet your buddy\n" +
+		"  - Book a coffee\n\n" +
+		"Tool\tOwner\nChat\tIT\n\n" +
+		"make setup\n  make test\n\n"
+	if string(got.Text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, got.Text)
+	}
+
+	expectedSections := []Section{{Title: "Onboarding", Start: 0}, {Title: "First week", Start: 57}}
+	if !reflect.DeepEqual(got.Sections, expectedSections) {
+		t.Errorf("unexpected sections.\nExpected: %v\nGot: %v", expectedSections, got.Sections)
+	}
+	if got.Title != "Onboarding - Team Wiki" || got.Description != "How new starters get set up." {
+		t.Errorf("unexpected metadata %q, %q", got.Title, got.Description)
+	}
+}
+
+func TestHtmlToText_WithoutMain(t *testing.T) {
+	page := `<html><head><meta property="og:title" content="Release notes"><meta charset="windows-1252"></head>
+<body><nav>Home</nav><p>Caf` + "\xe9" + ` opens</p><aside>Related</aside><div hidden>draft</div></body></html>`
+
+	got, err := HtmlToText(context.Background(), []byte(page))
+	if err != nil {
+		t.Fatalf("HtmlToText failed: %v", err)
+	}
+	if string(got.Text) != "Café opens\n\n" {
+		t.Errorf("expected only the body content, decoded, got %q", got.Text)
+	}
+	if got.Title != "Release notes" {
+		t.Errorf("expected the Open Graph title, got %q", got.Title)
+	}
+}
+
+func TestProcessFiles_DocumentMetadata(t *testing.T) {
+	sources := []Source{{ID: "d1", Filename: "onboarding.html", ContentType: "text/html", Content: []byte(wikiPage)}}
+	opts := ProcessOptions{
+		Chunking: DefaultChunkOptions,
+		Embedder: mockEmbedder(func(texts []string) ([][]float64, error) {
+			return make([][]float64, len(texts)), nil
+		}),
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	if len(got.Documents) != 1 || got.Documents[0].Title != "Onboarding - Team Wiki" || got.Documents[0].Description == "" {
+		t.Errorf("expected the page title and description on the document, got %+v", got.Documents)
+	}
+}
@@ -0,0 +1,708 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Office documents are zip archives of XML parts. Their converters read only
+// the parts that hold text, and stop once maxOfficeBytes of them have been
+// decompressed so a small upload cannot expand without bound.
+const maxOfficeBytes = 256 << 20
+
+// relationships namespace of r:id attributes
+const officeRelNS = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+
+func init() {
+	RegisterConverter(Converter{
+		Name:       "docx",
+		Extensions: []string{".docx"},
+		MIMETypes:  []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		Magic:      zipContains("word/document.xml"),
+		Priority:   10,
+		Convert:    DocxToText,
+		ConvertAt:  docxAt,
+	})
+	RegisterConverter(Converter{
+		Name:       "pptx",
+		Extensions: []string{".pptx"},
+		MIMETypes:  []string{"application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		Magic:      zipContains("ppt/presentation.xml"),
+		Priority:   10,
+		Convert:    PptxToText,
+		ConvertAt:  pptxAt,
+	})
+	RegisterConverter(Converter{
+		Name:       "xlsx",
+		Extensions: []string{".xlsx"},
+		MIMETypes:  []string{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		Magic:      zipContains("xl/workbook.xml"),
+		Priority:   10,
+		Convert:    XlsxToText,
+		ConvertAt:  xlsxAt,
+	})
+}
+
+// zipContains is a Magic func for zip archives holding the named file.
+func zipContains(name string) func(io.ReaderAt, int64) bool {
+	isZip := hasPrefix("PK\x03\x04")
+	return func(r io.ReaderAt, size int64) bool {
+		if !isZip(r, size) {
+			return false
+		}
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return false
+		}
+		for _, f := range zr.File {
+			if f.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// textBuilder collects converted text and the sections it is divided into,
+// counting characters so sections line up with chunk offsets.
+type textBuilder struct {
+	b        strings.Builder
+	runes    int
+	sections []Section
+}
+
+func (t *textBuilder) section(title string) {
+	t.sections = append(t.sections, Section{Title: title, Start: t.runes})
+}
+
+func (t *textBuilder) WriteString(s string) {
+	t.b.WriteString(s)
+	t.runes += utf8.RuneCountInString(s)
+}
+
+func (t *textBuilder) result() (Extracted, error) {
+	return Extracted{Text: []byte(t.b.String()), Sections: t.sections}, nil
+}
+
+// officePackage reads parts of an Office document within maxOfficeBytes.
+type officePackage struct {
+	zr        *zip.Reader
+	remaining int64
+}
+
+func openOffice(r io.ReaderAt, size int64) (*officePackage, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open document: %v", err)
+	}
+	return &officePackage{zr: zr, remaining: maxOfficeBytes}, nil
+}
+
+// read returns the content of the named part.
+func (p *officePackage) read(name string) ([]byte, error) {
+	f, err := p.zr.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, p.remaining+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if int64(len(data)) > p.remaining {
+		return nil, fmt.Errorf("document expands to more than %d bytes", maxOfficeBytes)
+	}
+	p.remaining -= int64(len(data))
+	return data, nil
+}
+
+// relationships maps the relationship IDs of part to their target parts and
+// types. A part without relationships has none.
+func (p *officePackage) relationships(part string) (map[string][2]string, error) {
+	dir, file := path.Split(part)
+	name := dir + "_rels/" + file + ".rels"
+	if !p.has(name) {
+		return nil, nil
+	}
+	data, err := p.read(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rels := map[string][2]string{}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return rels, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse relationships of %s: %v", part, err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "Relationship" {
+			target := attr(se, "", "Target")
+			if strings.HasPrefix(target, "/") {
+				target = strings.TrimPrefix(target, "/")
+			} else {
+				target = path.Join(dir, target)
+			}
+			rels[attr(se, "", "Id")] = [2]string{target, attr(se, "", "Type")}
+		}
+	}
+}
+
+// attr returns the value of the attribute local in namespace space; an empty
+// space matches any namespace.
+func attr(se xml.StartElement, space, local string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == local && (space == "" || a.Name.Space == space) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// DocxToText extracts the paragraphs and tables of a Word document. Each
+// heading starts a section titled with its text. Table rows become lines of
+// tab-separated cells.
+func DocxToText(ctx context.Context, content []byte) (Extracted, error) {
+	return docxAt(ctx, bytes.NewReader(content), int64(len(content)))
+}
+
+func docxAt(ctx context.Context, r io.ReaderAt, size int64) (Extracted, error) {
+	pkg, err := openOffice(r, size)
+	if err != nil {
+		return Extracted{}, err
+	}
+	data, err := pkg.read("word/document.xml")
+	if err != nil {
+		return Extracted{}, err
+	}
+
+	var (
+		out     textBuilder
+		para    strings.Builder
+		heading bool
+		tables  int // depth of nested tables
+		row     []string
+		cell    strings.Builder
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if err := ctx.Err(); err != nil {
+			return Extracted{}, err
+		}
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Extracted{}, fmt.Errorf("failed to parse document: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				para.Reset()
+				heading = false
+			case "pStyle":
+				style := strings.ToLower(attr(t, "", "val"))
+				heading = strings.HasPrefix(style, "heading") || style == "title"
+			case "outlineLvl":
+				heading = true
+			case "t":
+				var s string
+				if err := dec.DecodeElement(&s, &t); err != nil {
+					return Extracted{}, fmt.Errorf("failed to parse document: %v", err)
+				}
+				para.WriteString(s)
+			case "tab":
+				para.WriteString("\t")
+			case "br", "cr":
+				para.WriteString("\n")
+			case "tbl":
+				tables++
+			case "tr":
+				if tables == 1 {
+					row = nil
+				}
+			case "tc":
+				if tables == 1 {
+					cell.Reset()
+				}
+			}
+
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "p":
+				text := strings.TrimSpace(para.String())
+				switch {
+				case text == "":
+				case tables > 0:
+					// paragraphs of a cell, nested tables included, share a line
+					if cell.Len() > 0 {
+						cell.WriteString(" ")
+					}
+					cell.WriteString(strings.ReplaceAll(text, "\n", " "))
+				default:
+					if heading {
+						out.section(text)
+					}
+					out.WriteString(text + "\n\n")
+				}
+			case "tc":
+				if tables == 1 {
+					row = append(row, strings.ReplaceAll(cell.String(), "\t", " "))
+				}
+			case "tr":
+				if tables == 1 && slices.ContainsFunc(row, func(c string) bool { return c != "" }) {
+					out.WriteString(strings.Join(row, "\t") + "\n")
+				}
+			case "tbl":
+				tables--
+				if tables == 0 {
+					out.WriteString("\n")
+				}
+			}
+		}
+	}
+	return out.result()
+}
+
+// a shape of a slide: its placeholder type, if any, and its paragraphs
+type slideShape struct {
+	placeholder string
+	text        string
+}
+
+// PptxToText extracts the text of every slide in presentation order, then
+// its speaker notes. Each slide is a section titled "Slide N" followed by
+// the slide title, if it has one.
+func PptxToText(ctx context.Context, content []byte) (Extracted, error) {
+	return pptxAt(ctx, bytes.NewReader(content), int64(len(content)))
+}
+
+func pptxAt(ctx context.Context, r io.ReaderAt, size int64) (Extracted, error) {
+	pkg, err := openOffice(r, size)
+	if err != nil {
+		return Extracted{}, err
+	}
+	slides, err := pkg.slides()
+	if err != nil {
+		return Extracted{}, err
+	}
+
+	var out textBuilder
+	for i, slide := range slides {
+		if err := ctx.Err(); err != nil {
+			return Extracted{}, err
+		}
+		data, err := pkg.read(slide)
+		if err != nil {
+			return Extracted{}, err
+		}
+		shapes, err := slideShapes(data)
+		if err != nil {
+			return Extracted{}, fmt.Errorf("failed to parse slide %d: %v", i+1, err)
+		}
+
+		title := fmt.Sprintf("Slide %d", i+1)
+		var body []string
+		for _, s := range shapes {
+			switch s.placeholder {
+			case "title", "ctrTitle":
+				title += ": " + strings.ReplaceAll(s.text, "\n", " ")
+			case "sldNum", "dt", "ftr":
+				// slide furniture
+			default:
+				body = append(body, s.text)
+			}
+		}
+		out.section(title)
+		out.WriteString(title + "\n\n")
+		if len(body) > 0 {
+			out.WriteString(strings.Join(body, "\n\n") + "\n\n")
+		}
+
+		notes, err := pkg.slideNotes(slide)
+		if err != nil {
+			return Extracted{}, fmt.Errorf("failed to read notes of slide %d: %v", i+1, err)
+		}
+		if notes != "" {
+			out.WriteString("Notes: " + notes + "\n\n")
+		}
+	}
+	return out.result()
+}
+
+var slidePart = regexp.MustCompile(`^ppt/slides/slide(\d+)\.xml$`)
+
+// slides lists the slide parts in the order of the presentation, falling
+// back to their numbering when it has no slide list.
+func (p *officePackage) slides() ([]string, error) {
+	data, err := p.read("ppt/presentation.xml")
+	if err != nil {
+		return nil, err
+	}
+	rels, err := p.relationships("ppt/presentation.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	var slides []string
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse presentation: %v", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "sldId" {
+			if rel, ok := rels[attr(se, officeRelNS, "id")]; ok {
+				slides = append(slides, rel[0])
+			}
+		}
+	}
+	if len(slides) > 0 {
+		return slides, nil
+	}
+
+	var numbered [][2]int // index into zr.File, slide number
+	for i, f := range p.zr.File {
+		if m := slidePart.FindStringSubmatch(f.Name); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			numbered = append(numbered, [2]int{i, n})
+		}
+	}
+	slices.SortFunc(numbered, func(a, b [2]int) int { return a[1] - b[1] })
+	for _, n := range numbered {
+		slides = append(slides, p.zr.File[n[0]].Name)
+	}
+	return slides, nil
+}
+
+// slideNotes returns the speaker notes of a slide, if it has any.
+func (p *officePackage) slideNotes(slide string) (string, error) {
+	rels, err := p.relationships(slide)
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range rels {
+		if !strings.HasSuffix(rel[1], "/notesSlide") {
+			continue
+		}
+		data, err := p.read(rel[0])
+		if err != nil {
+			return "", err
+		}
+		shapes, err := slideShapes(data)
+		if err != nil {
+			return "", err
+		}
+		var notes []string
+		for _, s := range shapes {
+			if s.placeholder == "body" {
+				notes = append(notes, s.text)
+			}
+		}
+		return strings.Join(notes, "\n"), nil
+	}
+	return "", nil
+}
+
+// slideShapes returns the shapes and tables of a slide or notes page that
+// hold text.
+func slideShapes(data []byte) ([]slideShape, error) {
+	var (
+		shapes []slideShape
+		shape  *slideShape
+		paras  []string
+		para   strings.Builder
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return shapes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "sp", "graphicFrame":
+				shape = &slideShape{}
+				paras = nil
+			case "ph":
+				if shape != nil {
+					shape.placeholder = cmp.Or(attr(t, "", "type"), "body")
+				}
+			case "p":
+				para.Reset()
+			case "t":
+				var s string
+				if err := dec.DecodeElement(&s, &t); err != nil {
+					return nil, err
+				}
+				para.WriteString(s)
+			case "br":
+				para.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "p":
+				if text := strings.TrimSpace(para.String()); text != "" {
+					paras = append(paras, text)
+				}
+			case "sp", "graphicFrame":
+				if shape != nil && len(paras) > 0 {
+					shape.text = strings.Join(paras, "\n")
+					shapes = append(shapes, *shape)
+				}
+				shape = nil
+			}
+		}
+	}
+}
+
+// XlsxToText extracts every worksheet as lines of tab-separated cells, like
+// CsvToText. Each sheet is a section titled with its name. Formulas are
+// represented by their last calculated value.
+func XlsxToText(ctx context.Context, content []byte) (Extracted, error) {
+	return xlsxAt(ctx, bytes.NewReader(content), int64(len(content)))
+}
+
+func xlsxAt(ctx context.Context, r io.ReaderAt, size int64) (Extracted, error) {
+	pkg, err := openOffice(r, size)
+	if err != nil {
+		return Extracted{}, err
+	}
+	shared, err := pkg.sharedStrings()
+	if err != nil {
+		return Extracted{}, err
+	}
+	sheets, err := pkg.sheets()
+	if err != nil {
+		return Extracted{}, err
+	}
+
+	var out textBuilder
+	for _, sheet := range sheets {
+		if err := ctx.Err(); err != nil {
+			return Extracted{}, err
+		}
+		data, err := pkg.read(sheet[1])
+		if err != nil {
+			return Extracted{}, err
+		}
+		rows, err := sheetRows(data, shared)
+		if err != nil {
+			return Extracted{}, fmt.Errorf("failed to parse sheet %s: %v", sheet[0], err)
+		}
+
+		out.section(sheet[0])
+		out.WriteString("Sheet: " + sheet[0] + "\n")
+		for _, row := range rows {
+			out.WriteString(strings.Join(row, "\t") + "\n")
+		}
+		out.WriteString("\n")
+	}
+	return out.result()
+}
+
+// sheets lists the workbook's worksheets as name and part, in tab order.
+func (p *officePackage) sheets() ([][2]string, error) {
+	data, err := p.read("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+	rels, err := p.relationships("xl/workbook.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	var sheets [][2]string
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return sheets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse workbook: %v", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "sheet" {
+			rel, ok := rels[attr(se, officeRelNS, "id")]
+			if ok && strings.HasSuffix(rel[1], "/worksheet") {
+				sheets = append(sheets, [2]string{attr(se, "", "name"), rel[0]})
+			}
+		}
+	}
+}
+
+// sharedStrings reads the workbook's string table, which cells of type s
+// index into.
+func (p *officePackage) sharedStrings() ([]string, error) {
+	if !p.has("xl/sharedStrings.xml") {
+		return nil, nil
+	}
+	data, err := p.read("xl/sharedStrings.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		strs     []string
+		item     strings.Builder
+		phonetic bool // rPh runs repeat the text as a reading guide
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return strs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse shared strings: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				item.Reset()
+			case "rPh":
+				phonetic = true
+			case "t":
+				var s string
+				if err := dec.DecodeElement(&s, &t); err != nil {
+					return nil, fmt.Errorf("failed to parse shared strings: %v", err)
+				}
+				if !phonetic {
+					item.WriteString(s)
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				strs = append(strs, item.String())
+			case "rPh":
+				phonetic = false
+			}
+		}
+	}
+}
+
+func (p *officePackage) has(name string) bool {
+	for _, f := range p.zr.File {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sheetRows returns the non-empty rows of a worksheet. Cells are placed by
+// their column so gaps stay aligned; trailing empty cells are dropped.
+func sheetRows(data []byte, shared []string) ([][]string, error) {
+	var (
+		rows    [][]string
+		row     []string
+		col     int
+		typ     string
+		value   string
+		inlined strings.Builder
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				row = nil
+			case "c":
+				col = columnIndex(attr(t, "", "r"), len(row))
+				typ = attr(t, "", "t")
+				value = ""
+				inlined.Reset()
+			case "v":
+				if err := dec.DecodeElement(&value, &t); err != nil {
+					return nil, err
+				}
+			case "t":
+				// inline strings
+				var s string
+				if err := dec.DecodeElement(&s, &t); err != nil {
+					return nil, err
+				}
+				inlined.WriteString(s)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "c":
+				text := value
+				switch typ {
+				case "s":
+					if i, err := strconv.Atoi(value); err == nil && i >= 0 && i < len(shared) {
+						text = shared[i]
+					}
+				case "inlineStr":
+					text = inlined.String()
+				case "b":
+					text = map[string]string{"0": "FALSE", "1": "TRUE"}[value]
+				}
+				text = strings.Join(strings.Fields(text), " ")
+				if text == "" {
+					continue
+				}
+				for len(row) <= col {
+					row = append(row, "")
+				}
+				row[col] = text
+			case "row":
+				if len(row) > 0 {
+					rows = append(rows, row)
+				}
+			}
+		}
+	}
+}
+
+// columnIndex converts the column letters of a cell reference such as "C7"
+// to a zero-based index. Cells without a reference follow the previous one.
+func columnIndex(ref string, next int) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	if col == 0 {
+		return next
+	}
+	return col - 1
+}
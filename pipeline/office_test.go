@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+// officeZip builds an Office document from its parts
+func officeZip(t *testing.T, parts map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to build document: %v", err)
+	}
+	return buf.Bytes()
+}
+
+const docxXML = `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>Handbook</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Welcome </w:t></w:r><w:r><w:t>aboard.</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Leave</w:t></w:r></w:p>
+<w:tbl>
+<w:tr><w:tc><w:p><w:r><w:t>Type</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Days</w:t></w:r></w:p></w:tc></w:tr>
+<w:tr><w:tc><w:p><w:r><w:t>Annual</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>25</w:t></w:r></w:p></w:tc></w:tr>
+</w:tbl>
+</w:body></w:document>`
+
+func TestDocxToText(t *testing.T) {
+	doc := officeZip(t, map[string]string{"word/document.xml": docxXML})
+
+	got, err := DocxToText(context.Background(), doc)
+	if err != nil {
+		t.Fatalf("DocxToText failed: %v", err)
+	}
+
+	expected := "Handbook\n\nWelcome aboard.\n\nLeave\n\nType\tDays\nAnnual\t25\n\n"
+	if string(got.Text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, got.Text)
+	}
+	expectedSections := []Section{{Title: "Handbook", Start: 0}, {Title: "Leave", Start: 27}}
+	if !reflect.DeepEqual(got.Sections, expectedSections) {
+		t.Errorf("unexpected sections.\nExpected: %v\nGot: %v", expectedSections, got.Sections)
+	}
+}
+
+func TestPptxToText(t *testing.T) {
+	slide := func(title, body string) string {
+		return `<p:sld xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"><p:cSld><p:spTree>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="title"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>` + title + `</a:t></a:r></a:p></p:txBody></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph idx="1"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>` + body + `</a:t></a:r></a:p></p:txBody></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldNum"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>7</a:t></a:r></a:p></p:txBody></p:sp>
+</p:spTree></p:cSld></p:sld>`
+	}
+	// slide2.xml comes first in the presentation
+	doc := officeZip(t, map[string]string{
+		"ppt/presentation.xml": `<p:presentation xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<p:sldIdLst><p:sldId id="256" r:id="rId3"/><p:sldId id="257" r:id="rId2"/></p:sldIdLst></p:presentation>`,
+		"ppt/_rels/presentation.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide" Target="slides/slide1.xml"/>
+<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide" Target="slides/slide2.xml"/>
+</Relationships>`,
+		"ppt/slides/slide1.xml": slide("Roadmap", "Ship in May"),
+		"ppt/slides/slide2.xml": slide("Overview", "Why we exist"),
+		"ppt/slides/_rels/slide1.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesSlide" Target="../notesSlides/notesSlide1.xml"/>
+</Relationships>`,
+		"ppt/notesSlides/notesSlide1.xml": `<p:notes xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"><p:cSld><p:spTree>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="body" idx="1"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>Mention the beta</a:t></a:r></a:p></p:txBody></p:sp>
+</p:spTree></p:cSld></p:notes>`,
+	})
+
+	got, err := PptxToText(context.Background(), doc)
+	if err != nil {
+		t.Fatalf("PptxToText failed: %v", err)
+	}
+
+	expected := "Slide 1: Overview\n\nWhy we exist\n\n" +
+		"Slide 2: Roadmap\n\nShip in May\n\nNotes: Mention the beta\n\n"
+	if string(got.Text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, got.Text)
+	}
+	expectedSections := []Section{{Title: "Slide 1: Overview", Start: 0}, {Title: "Slide 2: Roadmap", Start: 33}}
+	if !reflect.DeepEqual(got.Sections, expectedSections) {
+		t.Errorf("unexpected sections.\nExpected: %v\nGot: %v", expectedSections, got.Sections)
+	}
+}
+
+func TestXlsxToText(t *testing.T) {
+	doc := officeZip(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Staff" sheetId="1" r:id="rId1"/><sheet name="Notes" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet2.xml"/>
+</Relationships>`,
+		"xl/sharedStrings.xml": `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>Name</t></si><si><t>Active</t></si><si><r><t>Ada </t></r><r><t>Lovelace</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="s"><v>1</v></c></row>
+<row r="2"><c r="A2" t="s"><v>2</v></c><c r="B2"><v>36</v></c><c r="C2" t="b"><v>1</v></c></row>
+</sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="B1" t="inlineStr"><is><t>Reviewed</t></is></c></row>
+</sheetData></worksheet>`,
+	})
+
+	got, err := XlsxToText(context.Background(), doc)
+	if err != nil {
+		t.Fatalf("XlsxToText failed: %v", err)
+	}
+
+	expected := "Sheet: Staff\nName\t\tActive\nAda Lovelace\t36\tTRUE\n\n" +
+		"Sheet: Notes\n\tReviewed\n\n"
+	if string(got.Text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, got.Text)
+	}
+	expectedSections := []Section{{Title: "Staff", Start: 0}, {Title: "Notes", Start: 48}}
+	if !reflect.DeepEqual(got.Sections, expectedSections) {
+		t.Errorf("unexpected sections.\nExpected: %v\nGot: %v", expectedSections, got.Sections)
+	}
+}
+
+func TestDetectConverter_Office(t *testing.T) {
+	docx := officeZip(t, map[string]string{"word/document.xml": docxXML})
+
+	c, err := DetectConverter("upload", docx)
+	if err != nil || c.Name != "docx" {
+		t.Errorf("expected docx by its content, got %q (%v)", c.Name, err)
+	}
+	// the content wins over a wrong extension
+	c, err = DetectConverter("notes.xlsx", docx)
+	if err != nil || c.Name != "docx" {
+		t.Errorf("expected docx named .xlsx to be read as docx, got %q (%v)", c.Name, err)
+	}
+	if _, err := DetectConverter("plain.docx", officeZip(t, map[string]string{"readme.txt": "hi"})); err == nil {
+		t.Error("expected a zip that is not a docx to be rejected")
+	}
+}
+
+func TestProcessFiles_Sections(t *testing.T) {
+	doc := officeZip(t, map[string]string{"word/document.xml": docxXML})
+	sources := []Source{{
+		ID:          "d1",
+		Filename:    "handbook.docx",
+		ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		Content:     doc,
+	}}
+	opts := ProcessOptions{
+		Chunking: ChunkOptions{Strategy: ChunkFixed, Size: 27},
+		Embedder: mockEmbedder(func(texts []string) ([][]float64, error) {
+			return make([][]float64, len(texts)), nil
+		}),
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	var sections []string
+	for _, e := range got.Embeddings {
+		sections = append(sections, e.Section)
+	}
+	expected := []string{"Handbook", "Leave"}
+	if !reflect.DeepEqual(sections, expected) {
+		t.Errorf("unexpected chunk sections.\nExpected: %v\nGot: %v", expected, sections)
+	}
+}
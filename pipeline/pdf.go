@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// PdfDocument is the text of a PDF page by page, with the metadata of its
+// info dictionary.
+type PdfDocument struct {
+	Title    string
+	Author   string
+	Subject  string
+	Created  time.Time // zero when the PDF does not say
+	Modified time.Time
+	NumPages int
+	Pages    []PdfPage     // pages that have text, in order
+	Skipped  []SkippedPage // pages that failed or have no text
+}
+
+// PdfPage is the text of one page. Number counts from 1.
+type PdfPage struct {
+	Number int
+	Text   string
+}
+
+// SkippedPage is a page left out of the text. Err is nil when the page
+// simply has no text, as with blank or scanned pages.
+type SkippedPage struct {
+	Number int
+	Err    error
+}
+
+// Text joins the pages with blank lines and reports the offset at which each
+// page starts.
+func (d *PdfDocument) Text() (string, []PageStart) {
+	var out textBuilder
+	starts := make([]PageStart, 0, len(d.Pages))
+	for i, p := range d.Pages {
+		if i > 0 {
+			out.WriteString("\n\n")
+		}
+		starts = append(starts, PageStart{Page: p.Number, Start: out.runes})
+		out.WriteString(p.Text)
+	}
+	return out.b.String(), starts
+}
+
+// PdfToText extracts the text of every page of a PDF and its metadata. Pages
+// that cannot be read are listed in Skipped rather than failing the whole
+// document.
+func PdfToText(content []byte) (*PdfDocument, error) {
+	return pdfAt(context.Background(), bytes.NewReader(content), int64(len(content)))
+}
+
+// pdfAt reads the PDF from r page by page, so a PDF spooled to disk is never
+// loaded whole. It checks ctx between pages since large PDFs take a while.
+func pdfAt(ctx context.Context, r io.ReaderAt, size int64) (doc *PdfDocument, err error) {
+	// the reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			doc, err = nil, fmt.Errorf("failed to read PDF: %v", r)
+		}
+	}()
+
+	pdfReader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PDF reader: %v", err)
+	}
+
+	doc = &PdfDocument{NumPages: pdfReader.NumPage()}
+	if info := pdfReader.Trailer().Key("Info"); !info.IsNull() {
+		doc.Title = pdfString(info.Key("Title"))
+		doc.Author = pdfString(info.Key("Author"))
+		doc.Subject = pdfString(info.Key("Subject"))
+		doc.Created, _ = parsePdfDate(info.Key("CreationDate").RawString())
+		doc.Modified, _ = parsePdfDate(info.Key("ModDate").RawString())
+	}
+
+	for i := 1; i <= doc.NumPages; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		text, err := pdfPageText(pdfReader.Page(i))
+		switch {
+		case err != nil:
+			slog.Error("failed to extract text from PDF page", slog.Int("page", i), slog.Any("error", err))
+			doc.Skipped = append(doc.Skipped, SkippedPage{Number: i, Err: err})
+		case strings.TrimSpace(text) == "":
+			doc.Skipped = append(doc.Skipped, SkippedPage{Number: i})
+		default:
+			doc.Pages = append(doc.Pages, PdfPage{Number: i, Text: strings.TrimSpace(text)})
+		}
+	}
+	return doc, nil
+}
+
+func pdfPageText(page pdf.Page) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	if page.V.IsNull() {
+		return "", fmt.Errorf("page is missing")
+	}
+	return page.GetPlainText(nil)
+}
+
+// pdfString decodes a text string of the info dictionary.
+func pdfString(v pdf.Value) string {
+	return strings.TrimSpace(strings.TrimRight(v.Text(), "\x00"))
+}
+
+var pdfDate = regexp.MustCompile(`^(?:D:)?(\d{4})(\d{2})?(\d{2})?(\d{2})?(\d{2})?(\d{2})?(?:([Zz])|([+-])(\d{2})'?(\d{2})?'?)?`)
+
+// parsePdfDate parses a PDF date such as D:20240131093000+01'00'. Missing
+// fields default to the start of the period and a missing zone to UTC.
+func parsePdfDate(s string) (time.Time, bool) {
+	m := pdfDate.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return time.Time{}, false
+	}
+	field := func(i, fallback int) int {
+		if m[i] == "" {
+			return fallback
+		}
+		n, _ := strconv.Atoi(m[i])
+		return n
+	}
+	loc := time.UTC
+	if m[8] != "" {
+		offset := field(9, 0)*3600 + field(10, 0)*60
+		if m[8] == "-" {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	t := time.Date(field(1, 0), time.Month(field(2, 1)), field(3, 1), field(4, 0), field(5, 0), field(6, 0), 0, loc)
+	return t, true
+}
+
+// convertPdf is the registered converter for PDFs. Pages that fail are
+// reported as failures of the document.
+func convertPdf(ctx context.Context, content []byte) (Extracted, error) {
+	return convertPdfAt(ctx, bytes.NewReader(content), int64(len(content)))
+}
+
+func convertPdfAt(ctx context.Context, r io.ReaderAt, size int64) (Extracted, error) {
+	doc, err := pdfAt(ctx, r, size)
+	if err != nil {
+		return Extracted{}, err
+	}
+	text, pages := doc.Text()
+	extracted := Extracted{
+		Text:        []byte(text),
+		Pages:       pages,
+		Title:       doc.Title,
+		Description: doc.Subject,
+		Author:      doc.Author,
+		Created:     doc.Created,
+		PageCount:   doc.NumPages,
+	}
+	var empty []int
+	for _, p := range doc.Skipped {
+		if p.Err != nil {
+			extracted.Failed = append(extracted.Failed, fmt.Sprintf("page %d: %v", p.Number, p.Err))
+		} else {
+			empty = append(empty, p.Number)
+		}
+	}
+	if len(empty) > 0 {
+		slog.Info("PDF pages without text", slog.Any("pages", empty))
+	}
+	return extracted, nil
+}
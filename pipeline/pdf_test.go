@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// buildPdf writes a PDF with one page per entry of pages and the given info
+// dictionary entries. An empty page has no text; a page of "!" has contents
+// that are not a stream.
+func buildPdf(info string, pages ...string) []byte {
+	var objects []string
+	kids := ""
+	for i, text := range pages {
+		pageObj, contentObj := 4+2*i, 5+2*i
+		kids += fmt.Sprintf("%d 0 R ", pageObj)
+		objects = append(objects, fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", contentObj))
+		switch text {
+		case "!":
+			objects = append(objects, "42")
+		default:
+			stream := ""
+			if text != "" {
+				stream = fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+			}
+			objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream))
+		}
+	}
+	objects = append([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}, objects...)
+	infoObj := len(objects) + 1
+	objects = append(objects, "<< "+info+" >>")
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, infoObj, xref)
+	return b.Bytes()
+}
+
+func TestPdfToText_Pages(t *testing.T) {
+	content := buildPdf("/Title (Quarterly report) /Author (Finance) /CreationDate (D:20240131093000+01'00')",
+		"Revenue grew.", "", "!", "Costs fell.")
+
+	doc, err := PdfToText(content)
+	if err != nil {
+		t.Fatalf("PdfToText failed: %v", err)
+	}
+
+	if doc.Title != "Quarterly report" || doc.Author != "Finance" || doc.NumPages != 4 {
+		t.Errorf("unexpected metadata %+v", doc)
+	}
+	if created := time.Date(2024, 1, 31, 8, 30, 0, 0, time.UTC); !doc.Created.Equal(created) {
+		t.Errorf("expected creation date %v, got %v", created, doc.Created)
+	}
+
+	expected := []PdfPage{{Number: 1, Text: "Revenue grew."}, {Number: 4, Text: "Costs fell."}}
+	if !reflect.DeepEqual(doc.Pages, expected) {
+		t.Errorf("unexpected pages.\nExpected: %+v\nGot: %+v", expected, doc.Pages)
+	}
+	if len(doc.Skipped) != 2 || doc.Skipped[0].Number != 2 || doc.Skipped[0].Err != nil ||
+		doc.Skipped[1].Number != 3 || doc.Skipped[1].Err == nil {
+		t.Errorf("expected page 2 empty and page 3 failed, got %+v", doc.Skipped)
+	}
+
+	text, starts := doc.Text()
+	if text != "Revenue grew.\n\nCosts fell." {
+		t.Errorf("unexpected text %q", text)
+	}
+	if expected := []PageStart{{Page: 1, Start: 0}, {Page: 4, Start: 15}}; !reflect.DeepEqual(starts, expected) {
+		t.Errorf("expected page starts %v, got %v", expected, starts)
+	}
+}
+
+func TestParsePdfDate(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected time.Time
+	}{
+		{"D:20240131093000Z", time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC)},
+		{"D:20240131093000-05'30'", time.Date(2024, 1, 31, 15, 0, 0, 0, time.UTC)},
+		{"D:2024", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"20240131", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, ok := parsePdfDate(tt.in)
+		if !ok || !got.Equal(tt.expected) {
+			t.Errorf("parsePdfDate(%q) = %v, %v; expected %v", tt.in, got, ok, tt.expected)
+		}
+	}
+	if _, ok := parsePdfDate("yesterday"); ok {
+		t.Error("expected an invalid date to be rejected")
+	}
+}
+
+func TestProcessFiles_PdfPages(t *testing.T) {
+	content := buildPdf("/Title (Report)", "Revenue grew.", "!", "Costs fell.")
+	sources := []Source{{ID: "d1", Filename: "report.pdf", ContentType: "application/pdf", Content: content}}
+	opts := ProcessOptions{
+		Chunking: ChunkOptions{Strategy: ChunkFixed, Size: 15},
+		Embedder: mockEmbedder(func(texts []string) ([][]float64, error) {
+			return make([][]float64, len(texts)), nil
+		}),
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	var pages []int
+	for _, e := range got.Embeddings {
+		pages = append(pages, e.Page)
+	}
+	if expected := []int{1, 3}; !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected chunks to cite pages %v, got %v", expected, pages)
+	}
+	if len(got.Documents) != 1 || got.Documents[0].Title != "Report" || got.Documents[0].Pages != 3 {
+		t.Errorf("expected the document metadata, got %+v", got.Documents)
+	}
+	if len(got.Failures) != 1 || got.Failures[0].Stage != StageExtract || got.Failures[0].File != "report.pdf" {
+		t.Errorf("expected the unreadable page as a failure, got %+v", got.Failures)
+	}
+}
@@ -1,13 +1,18 @@
 package pipeline
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // ------------------------------------
@@ -16,38 +21,56 @@ import (
 // ------------------------------------
 // ------------------------------------
 
-// mock EmbeddingsAPI override
+// mock Embedder override
+type mockEmbedder func(texts []string) ([][]float64, error)
+
+func (m mockEmbedder) Model() string  { return "mock" }
+func (m mockEmbedder) Dimension() int { return 3 }
+func (m mockEmbedder) Embed(_ context.Context, texts []string) ([][]float64, error) {
+	return m(texts)
+}
+
 func mockEmbeddingsAPI(texts []string) ([][]float64, error) {
-	return [][]float64{
+	vectors := [][]float64{
 		{0.1, 0.2, 0.3},
 		{0.4, 0.5, 0.6},
-	}, nil
+	}
+	return vectors[:len(texts)], nil
+}
+
+// textSources wraps already extracted documents as plain text uploads
+func textSources(docs []Document) []Source {
+	sources := make([]Source, len(docs))
+	for i, d := range docs {
+		sources[i] = Source{ID: d.ID, Filename: d.Filename, ContentType: "text/plain", Content: []byte(d.Text)}
+	}
+	return sources
 }
 
 // mock ResultWriter to capture results
 type captureResult struct {
 	objectID   string
-	embeddings [][]float64
-	triples    []string
+	embeddings []Embedding
+	triples    []Triple
 }
 
 func TestProcessFiles(t *testing.T) {
 	// override API
-	original := EmbeddingFn
-	defer func() { EmbeddingFn = original }()
-	EmbeddingFn = mockEmbeddingsAPI
+	original := DefaultEmbedder
+	defer func() { DefaultEmbedder = original }()
+	DefaultEmbedder = mockEmbedder(mockEmbeddingsAPI)
 
-	memFiles := map[string][]byte{
-		"file1.txt": []byte("Hello, this is test 1.\nIt's a file."),
-		"file2.txt": []byte("Second file's content."),
+	docs := []Document{
+		{ID: "d1", Filename: "file1.txt", Text: "Hello, this is test 1.\nIt's a file."},
+		{ID: "d2", Filename: "file2.txt", Text: "Second file's content."},
 	}
 
 	var captured captureResult
-	writeBack := func(object_id string, embeddings [][]float64, triples []string) {
-		captured = captureResult{object_id, embeddings, triples}
+	writeBack := func(object_id string, result ProcessResult) {
+		captured = captureResult{object_id, result.Embeddings, result.Triples}
 	}
 
-	ProcessFiles("obj123", memFiles, writeBack)
+	ProcessFiles(context.Background(), "obj123", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions}, writeBack)
 
 	if captured.objectID != "obj123" {
 		t.Errorf("Expected object ID 'obj123', got '%s'", captured.objectID)
@@ -57,8 +80,19 @@ func TestProcessFiles(t *testing.T) {
 		{0.1, 0.2, 0.3},
 		{0.4, 0.5, 0.6},
 	}
-	if !reflect.DeepEqual(captured.embeddings, expectedEmbeddings) {
-		t.Errorf("Embeddings mismatch.\nExpected: %v\nGot: %v", expectedEmbeddings, captured.embeddings)
+	if len(captured.embeddings) != len(docs) {
+		t.Fatalf("Expected one embedding per file, got: %v", captured.embeddings)
+	}
+	for i, e := range captured.embeddings {
+		if !reflect.DeepEqual(e.Vector, expectedEmbeddings[i]) {
+			t.Errorf("Embedding %d mismatch.\nExpected: %v\nGot: %v", i, expectedEmbeddings[i], e.Vector)
+		}
+		if e.DocumentID != docs[i].ID || e.Filename != docs[i].Filename || e.Text != docs[i].Text {
+			t.Errorf("embedding %d not paired with document %d: %+v", i, i, e.Chunk)
+		}
+		if e.Index != 0 || e.Start != 0 || e.End != len(docs[i].Text) {
+			t.Errorf("unexpected chunk provenance: %+v", e.Chunk)
+		}
 	}
 
 	if len(captured.triples) != 0 {
@@ -66,6 +100,187 @@ func TestProcessFiles(t *testing.T) {
 	}
 }
 
+func TestProcessFiles_PartialFailure(t *testing.T) {
+	// fail any request that contains the poisoned file
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		out := make([][]float64, len(texts))
+		for i, text := range texts {
+			if strings.Contains(text, "poison") {
+				return nil, fmt.Errorf("upstream rejected input")
+			}
+			out[i] = []float64{1}
+		}
+		return out, nil
+	})
+
+	docs := []Document{
+		{ID: "d1", Filename: "good.txt", Text: "Healthy content here."},
+		{ID: "d2", Filename: "bad.txt", Text: "Contains poison text."},
+		{ID: "d3", Filename: "empty.txt", Text: "   "},
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder}, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	if got.Err != nil {
+		t.Fatalf("expected a partial result, got error %v", got.Err)
+	}
+	if len(got.Embeddings) != 1 || got.Embeddings[0].DocumentID != "d1" {
+		t.Fatalf("expected only good.txt to be embedded, got %+v", got.Embeddings)
+	}
+
+	expected := []StageError{
+		{Stage: StageEmbed, File: "bad.txt", Message: "upstream rejected input"},
+		{Stage: StageChunk, File: "empty.txt", Message: "no text to embed"},
+	}
+	if !reflect.DeepEqual(got.Failures, expected) {
+		t.Errorf("unexpected failures.\nExpected: %+v\nGot: %+v", expected, got.Failures)
+	}
+}
+
+func TestProcessFiles_AllFailed(t *testing.T) {
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		return nil, fmt.Errorf("service unavailable")
+	})
+
+	docs := []Document{{ID: "d1", Filename: "a.txt", Text: "Some text."}}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder}, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	var stageErr *StageError
+	if !errors.As(got.Err, &stageErr) {
+		t.Fatalf("expected a StageError, got %v", got.Err)
+	}
+	if stageErr.Stage != StageEmbed || stageErr.File != "a.txt" || stageErr.Message != "service unavailable" {
+		t.Errorf("unexpected error: %+v", stageErr)
+	}
+	if len(got.Embeddings) != 0 {
+		t.Errorf("expected no embeddings, got %d", len(got.Embeddings))
+	}
+}
+
+func TestProcessFiles_DeterministicOrder(t *testing.T) {
+	// echo each text's length back so vectors can be matched to their input
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		out := make([][]float64, len(texts))
+		for i, text := range texts {
+			out[i] = []float64{float64(len(text))}
+		}
+		return out, nil
+	})
+
+	var docs []Document
+	for i := range 20 {
+		docs = append(docs, Document{
+			ID:       fmt.Sprintf("d%d", i),
+			Filename: fmt.Sprintf("file%d.txt", i),
+			Text:     strings.Repeat("word ", i+1),
+		})
+	}
+
+	for range 5 {
+		var got []Embedding
+		ProcessFiles(context.Background(), "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder}, func(_ string, result ProcessResult) {
+			got = result.Embeddings
+		})
+
+		if len(got) != len(docs) {
+			t.Fatalf("expected %d embeddings, got %d", len(docs), len(got))
+		}
+		for i, e := range got {
+			if e.DocumentID != docs[i].ID {
+				t.Fatalf("embedding %d belongs to %s, expected %s", i, e.DocumentID, docs[i].ID)
+			}
+			if e.Vector[0] != float64(len(cleanText(e.Text))) {
+				t.Fatalf("embedding %d vector does not match its text", i)
+			}
+		}
+	}
+}
+
+func TestProcessFiles_LargeDocumentFailure(t *testing.T) {
+	// the poisoned sentence lands in the second batch of big.txt
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		if len(texts) > embedBatchChunks {
+			t.Errorf("expected batches of at most %d chunks, got %d", embedBatchChunks, len(texts))
+		}
+		for _, text := range texts {
+			if strings.Contains(strings.ToLower(text), "poison") {
+				return nil, fmt.Errorf("upstream rejected input")
+			}
+		}
+		return make([][]float64, len(texts)), nil
+	})
+
+	docs := []Document{
+		{ID: "d1", Filename: "big.txt", Text: strings.Repeat("Sentence here. ", 700) + "Poison. " + strings.Repeat("Sentence here. ", 400)},
+		{ID: "d2", Filename: "small.txt", Text: "Short."},
+	}
+	opts := ProcessOptions{Chunking: ChunkOptions{Strategy: ChunkSentence, Size: 15}, Embedder: embedder}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", textSources(docs), opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	for _, e := range got.Embeddings {
+		if e.DocumentID != "d2" {
+			t.Fatalf("expected big.txt to be left out entirely, got chunk %d of it", e.Index)
+		}
+	}
+	if len(got.Embeddings) == 0 {
+		t.Error("expected small.txt to be embedded")
+	}
+	expected := []StageError{{Stage: StageEmbed, File: "big.txt", Message: "upstream rejected input"}}
+	if !reflect.DeepEqual(got.Failures, expected) {
+		t.Errorf("unexpected failures.\nExpected: %+v\nGot: %+v", expected, got.Failures)
+	}
+}
+
+func TestProcessFiles_SpooledSource(t *testing.T) {
+	dir := t.TempDir()
+	pdfPath, textPath := dir+"/report", dir+"/notes"
+	content := buildPdf("/Title (Report)", "Revenue grew.")
+	if err := os.WriteFile(pdfPath, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(textPath, []byte("Plain notes."), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []Source{
+		{ID: "d1", Filename: "report.pdf", ContentType: "application/pdf", Path: pdfPath, Size: int64(len(content))},
+		{ID: "d2", Filename: "notes.txt", ContentType: "text/plain", Path: textPath, Size: 12},
+		{ID: "d3", Filename: "gone.txt", ContentType: "text/plain", Path: dir + "/gone", Size: 5},
+	}
+	opts := ProcessOptions{
+		Chunking: DefaultChunkOptions,
+		Embedder: mockEmbedder(func(texts []string) ([][]float64, error) {
+			return make([][]float64, len(texts)), nil
+		}),
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	if len(got.Documents) != 2 || got.Documents[0].Text != "Revenue grew." || got.Documents[1].Text != "Plain notes." {
+		t.Errorf("expected both spooled files to be extracted, got %+v", got.Documents)
+	}
+	if got.Progress.BytesTotal != int64(len(content))+17 {
+		t.Errorf("expected progress to count spooled bytes, got %d", got.Progress.BytesTotal)
+	}
+	if len(got.Failures) != 1 || got.Failures[0].File != "gone.txt" {
+		t.Errorf("expected the missing spool file to fail extraction, got %+v", got.Failures)
+	}
+}
+
 // ------------------------------------
 // ------------------------------------
 // ------- Testing CSV => Text --------
@@ -125,12 +340,12 @@ func TestCsvToText_UnevenRows(t *testing.T) {
 func TestPdfToText(t *testing.T) {
 	pdfData, err := os.ReadFile("../test-data/week9.pdf")
 
-	text, err := PdfToText(pdfData)
+	doc, err := PdfToText(pdfData)
 	if err != nil {
 		t.Fatalf("PdfToText failed: %v", err)
 	}
 
-	result := string(text)
+	result, _ := doc.Text()
 	expectedSubstring := "departments given"
 
 	if !strings.Contains(result, expectedSubstring) {
@@ -150,6 +365,31 @@ func TestPdfToText_InvalidPDF(t *testing.T) {
 	}
 }
 
+func TestProcessFiles_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the job is cancelled while its chunks are being embedded
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		cancel()
+		return mockEmbeddingsAPI(texts)
+	})
+
+	docs := []Document{{ID: "d1", Filename: "a.txt", Text: "Some text."}}
+
+	var got ProcessResult
+	ProcessFiles(ctx, "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder}, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	if !errors.Is(got.Err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", got.Err)
+	}
+	if len(got.Documents) != 0 || len(got.Embeddings) != 0 {
+		t.Errorf("expected partial results to be discarded, got %d documents and %d embeddings", len(got.Documents), len(got.Embeddings))
+	}
+}
+
 // --------------------------------
 // --------------------------------
 // --- Testing Backend API res ----
@@ -182,7 +422,7 @@ func TestEmbeddingsAPI(t *testing.T) {
 
 	EmbeddingsAPIURL = server.URL + "/%s"
 
-	result, err := EmbeddingsAPI([]string{"hello", "world"})
+	result, err := (&CloudflareEmbedder{}).Embed(context.Background(), []string{"hello", "world"})
 	if err != nil {
 		t.Fatalf("EmbeddingsAPI failed: %v", err)
 	}
@@ -200,7 +440,7 @@ func TestEmbeddingsAPI_MissingEnvVars(t *testing.T) {
 	os.Unsetenv("CLOUDFLARE_ACCOUNT_ID")
 	os.Unsetenv("CLOUDFLARE_API_TOKEN")
 
-	_, err := EmbeddingsAPI([]string{"test"})
+	_, err := (&CloudflareEmbedder{}).Embed(context.Background(), []string{"test"})
 	if err == nil || !strings.Contains(err.Error(), "missing CLOUDFLARE_ACC") {
 		t.Errorf("Expected error for missing env vars, got: %v", err)
 	}
@@ -216,7 +456,7 @@ func TestEmbeddingsAPI_BadJSONResponse(t *testing.T) {
 
 	EmbeddingsAPIURL = server.URL + "/%s"
 
-	_, err := EmbeddingsAPI([]string{"x"})
+	_, err := (&CloudflareEmbedder{}).Embed(context.Background(), []string{"x"})
 	if err == nil {
 		t.Fatal("Expected JSON decode error, got nil")
 	}
@@ -228,12 +468,32 @@ func TestEmbeddingsAPI_RequestError(t *testing.T) {
 	// Point to an invalid server (e.g., closed port)
 	EmbeddingsAPIURL = "http://localhost:12345/%s"
 
-	_, err := EmbeddingsAPI([]string{"fail"})
+	_, err := (&CloudflareEmbedder{}).Embed(context.Background(), []string{"fail"})
 	if err == nil {
 		t.Fatal("Expected request error, got nil")
 	}
 }
 
+func TestEmbeddingsAPI_Cancelled(t *testing.T) {
+	os.Setenv("CLOUDFLARE_ACCOUNT_ID", "id")
+	os.Setenv("CLOUDFLARE_API_TOKEN", "token")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request sent for a cancelled context")
+	}))
+	defer server.Close()
+
+	EmbeddingsAPIURL = server.URL + "/%s"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := (&CloudflareEmbedder{}).Embed(ctx, []string{"x"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
 // ------------------------------
 // ------------------------------
 // ---- Testing JSON => Text ----
@@ -264,3 +524,43 @@ func TestJsonToText_Empty(t *testing.T) {
 		t.Errorf("expected empty result, got: %s", string(result))
 	}
 }
+
+// concurrencyProbe records how many Extract calls overlap
+type concurrencyProbe struct {
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (p *concurrencyProbe) Extract(_ context.Context, c Chunk) ([]Triple, error) {
+	p.mu.Lock()
+	p.active++
+	p.maxActive = max(p.maxActive, p.active)
+	p.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	return nil, nil
+}
+
+func TestProcessFiles_Concurrency(t *testing.T) {
+	var docs []Document
+	for i := range 8 {
+		docs = append(docs, Document{ID: fmt.Sprintf("d%d", i), Filename: "f.txt", Text: "Some text."})
+	}
+
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		return make([][]float64, len(texts)), nil
+	})
+
+	probe := &concurrencyProbe{}
+	opts := ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder, Extractor: probe, Concurrency: 2}
+	ProcessFiles(context.Background(), "obj", textSources(docs), opts, func(string, ProcessResult) {})
+
+	if probe.maxActive > 2 {
+		t.Errorf("expected at most 2 files in flight, got %d", probe.maxActive)
+	}
+}
@@ -2,87 +2,437 @@ package pipeline
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"regexp"
+	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/bbalet/stopwords"
-	"github.com/ledongthuc/pdf"
 )
 
-var EmbeddingFn = EmbeddingsAPI
+var cleanRe = regexp.MustCompile(`['\n]`)
+
+// ProcessFiles extracts text from every source, chunks and embeds it,
+// extracts triples from every chunk when an extractor is configured, then
+// hands the results to writeBack. Documents and embeddings are returned in
+// upload order, then chunk order, regardless of which goroutine finished
+// first.
+//
+// A file that fails a stage is reported in ProcessResult.Failures and left
+// out of the embeddings; the other files are still processed. Err is only
+// set when no file produced an embedding.
+//
+// Once ctx is cancelled no new file or embedding batch is started, requests
+// in flight are aborted and writeBack receives only Progress and an Err that
+// wraps ctx.Err(); whatever was produced so far is discarded.
+func ProcessFiles(ctx context.Context, object_id string, sources []Source, opts ProcessOptions, writeBack ResultWriter) {
+	embedder := opts.Embedder
+	if embedder == nil {
+		embedder = DefaultEmbedder
+	}
+
+	progress := newProgressTracker(object_id, sources, opts.Progress)
 
-func ProcessFiles(object_id string, memFiles map[string][]byte, writeBack ResultWriter) {
 	var wg = sync.WaitGroup{}
-	var trips []string
-	var corpusCleaned []string
-	var mutex = sync.Mutex{}
+	sem := make(chan struct{}, cmp.Or(opts.Concurrency, runtime.NumCPU()))
 
-	for fname, content := range memFiles {
+	// one slot per document so concurrent extraction keeps upload order
+	docs := make([]*Document, len(sources))
+	docChunks := make([][]Chunk, len(sources))
+	docCleaned := make([][]string, len(sources))
+	docTriples := make([][]Triple, len(sources))
+	docFailures := make([][]StageError, len(sources))
+
+	for i, src := range sources {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
 		wg.Add(1)
-		go func(fname string, data []byte) {
+		go func(i int, src Source) {
 			defer wg.Done()
+			defer func() { <-sem }()
 
-			re := regexp.MustCompile(`['\n]`)
-			raw := string(data)
+			extracted, err := extractSource(withSelectors(ctx, opts.Select), src)
+			progress.update(func(p *Progress) {
+				p.FilesExtracted++
+				p.BytesExtracted += src.Len()
+			})
+			if err != nil {
+				slog.Error("file processing error", slog.String("filename", src.Filename), slog.Any("error", err))
+				docFailures[i] = append(docFailures[i], StageError{Stage: StageExtract, File: src.Filename, Message: err.Error()})
+				progress.update(func(p *Progress) { p.FilesChunked++ })
+				return
+			}
+			doc := Document{
+				ID:          src.ID,
+				Filename:    src.Filename,
+				Hash:        src.Hash,
+				Title:       extracted.Title,
+				Description: extracted.Description,
+				Author:      extracted.Author,
+				Created:     extracted.Created,
+				Pages:       extracted.PageCount,
+				Text:        string(extracted.Text),
+			}
+			docs[i] = &doc
+			slog.Info("processed file", slog.String("filename", src.Filename), slog.Int64("bytes", src.Len()))
 
-			// removing ' (apostrophe) and '\n'
-			cleaned := re.ReplaceAllString(raw, "")
-			corpus := stopwords.CleanString(cleaned, "en", true)
-			slog.Debug("cleaned corpus", slog.String("filename", fname), slog.String("corpus", corpus))
+			// parts of the file that could not be converted, such as unreadable
+			// PDF pages, leave the rest of it usable
+			var failures []StageError
+			for _, msg := range extracted.Failed {
+				slog.Error("file partly extracted", slog.String("filename", src.Filename), slog.String("error", msg))
+				failures = append(failures, StageError{Stage: StageExtract, File: src.Filename, Message: msg})
+			}
 
-			mutex.Lock()
-			corpusCleaned = append(corpusCleaned, corpus)
-			mutex.Unlock()
-		}(fname, content)
+			docChunks[i], docCleaned[i], docTriples[i], docFailures[i] = chunkDocument(ctx, doc, extracted.Sections, extracted.Pages, opts)
+			docFailures[i] = append(failures, docFailures[i]...)
+			progress.update(func(p *Progress) {
+				p.FilesChunked++
+				p.ChunksCreated += len(docChunks[i])
+			})
+		}(i, src)
 	}
 	wg.Wait()
-	slog.Info("processed job", slog.String("object_id", object_id), slog.Int("file_count", len(memFiles)))
 
-	slog.Info("created tokens, sending to embedding API", slog.String("object_id", object_id))
+	if ctx.Err() != nil {
+		cancelled(ctx, object_id, progress, writeBack)
+		return
+	}
 
-  embeddings, err := EmbeddingFn(corpusCleaned)
+	var chunkCount int
+	for i := range sources {
+		chunkCount += len(docChunks[i])
+	}
+	slog.Info("processed job", slog.String("object_id", object_id), slog.Int("file_count", len(sources)), slog.Int("chunk_count", chunkCount))
 
-	if err != nil {
-		slog.Error("embedding API call failed", slog.String("object_id", object_id), slog.Any("error", err))
-	} else {
-		slog.Info("received embeddings", slog.String("object_id", object_id), slog.Int("count", len(embeddings)), slog.Int("embedding_size", len(embeddings[0])))
+	slog.Info("created tokens, sending to embedding API", slog.String("object_id", object_id), slog.String("model", embedder.Model()))
+
+	embeddings := embedDocuments(ctx, object_id, embedder, sources, docChunks, docCleaned, docFailures, progress)
+	if ctx.Err() != nil {
+		cancelled(ctx, object_id, progress, writeBack)
+		return
+	}
+
+	var result ProcessResult
+	result.Embeddings = embeddings
+	result.Progress = progress.flush()
+	for i := range sources {
+		if docs[i] != nil {
+			result.Documents = append(result.Documents, *docs[i])
+		}
+		result.Triples = append(result.Triples, docTriples[i]...)
+		result.Failures = append(result.Failures, docFailures[i]...)
+	}
+
+	if len(embeddings) == 0 {
+		if len(result.Failures) > 0 {
+			first := result.Failures[0]
+			result.Err = &first
+		} else {
+			result.Err = &StageError{Stage: StageEmbed, Message: "no embeddings produced"}
+		}
+		slog.Error("job produced no embeddings", slog.String("object_id", object_id), slog.Any("error", result.Err))
+	} else if len(embeddings[0].Vector) > 0 {
+		slog.Info("received embeddings", slog.String("object_id", object_id), slog.Int("count", len(embeddings)), slog.Int("embedding_size", len(embeddings[0].Vector)))
 	}
 
-	writeBack(object_id, embeddings, trips)
+	writeBack(object_id, result)
 }
 
-func PdfToText(content []byte) ([]byte, error) {
-	reader := bytes.NewReader(content)
-	pdfReader, err := pdf.NewReader(reader, int64(len(content)))
+// cancelled reports a job that was stopped through its context.
+func cancelled(ctx context.Context, object_id string, progress *progressTracker, writeBack ResultWriter) {
+	slog.Info("job cancelled", slog.String("object_id", object_id))
+	writeBack(object_id, ProcessResult{
+		Progress: progress.flush(),
+		Err:      fmt.Errorf("job cancelled: %w", ctx.Err()),
+	})
+}
+
+// chunkDocument splits doc into chunks, labels each with the section and
+// page it starts in, cleans it for embedding and extracts its triples.
+// Chunks that are empty after cleaning are dropped.
+func chunkDocument(ctx context.Context, doc Document, sections []Section, pages []PageStart, opts ProcessOptions) ([]Chunk, []string, []Triple, []StageError) {
+	var (
+		chunks   []Chunk
+		cleaned  []string
+		triples  []Triple
+		failures []StageError
+	)
+
+	fileChunks, err := ChunkText(doc.Filename, doc.Text, opts.Chunking)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create PDF reader: %v", err)
+		slog.Error("failed to chunk file", slog.String("filename", doc.Filename), slog.Any("error", err))
+		return nil, nil, nil, []StageError{{Stage: StageChunk, File: doc.Filename, Message: err.Error()}}
 	}
 
-	var builder strings.Builder
-	numPages := pdfReader.NumPage()
-
-	for i := 1; i <= numPages; i++ {
-		page := pdfReader.Page(i)
-		if page.V.IsNull() { // make sure the page exists
+	var (
+		extractErr   error
+		failedChunks int
+	)
+	for _, c := range fileChunks {
+		corpus := cleanText(c.Text)
+		if corpus == "" {
 			continue
 		}
+		c.DocumentID = doc.ID
+		c.Section = sectionAt(sections, c.Start)
+		c.Page = pageAt(pages, c.Start)
+		chunks = append(chunks, c)
+		cleaned = append(cleaned, corpus)
 
-		texts, err := page.GetPlainText(nil)
+		if opts.Extractor == nil {
+			continue
+		}
+		// triples come from the raw chunk text, stopwords carry the predicates
+		t, err := opts.Extractor.Extract(ctx, c)
 		if err != nil {
-			slog.Error("failed to extract text from PDF page", slog.Int("page", i), slog.Any("error", err))
+			slog.Error("failed to extract triples", slog.String("filename", doc.Filename), slog.Int("chunk", c.Index), slog.Any("error", err))
+			extractErr = cmp.Or(extractErr, err)
+			failedChunks++
 			continue
 		}
+		triples = append(triples, t...)
+	}
+
+	if len(chunks) == 0 {
+		failures = append(failures, StageError{Stage: StageChunk, File: doc.Filename, Message: "no text to embed"})
+	}
+	if extractErr != nil {
+		failures = append(failures, StageError{
+			Stage:   StageTriples,
+			File:    doc.Filename,
+			Message: fmt.Sprintf("%d of %d chunks failed: %v", failedChunks, len(chunks), extractErr),
+		})
+	}
+	slog.Debug("chunked file", slog.String("filename", doc.Filename), slog.Int("chunks", len(chunks)), slog.Int("triples", len(triples)))
+
+	return chunks, cleaned, triples, failures
+}
+
+// documents are embedded in batches of about this many chunks so progress can
+// be reported while a large job runs; the embedder may split them further
+const embedBatchChunks = 500
+
+// embedSpan is the chunks from..to of document doc.
+type embedSpan struct {
+	doc, from, to int
+}
+
+// embedDocuments embeds the chunks of the documents in batches of
+// embedBatchChunks so the embedder can send them together. Small documents
+// share a batch; a large one is spread over several, so a document of any
+// size is embedded a batch at a time. If a batch fails and holds several
+// documents, each of them is retried on its own so one bad file does not
+// sink the rest; documents that still fail are recorded in docFailures and
+// left out entirely. Embedding cache hits and misses are added to the
+// progress.
+func embedDocuments(ctx context.Context, object_id string, embedder Embedder, sources []Source, docChunks [][]Chunk, docCleaned [][]string, docFailures [][]StageError, progress *progressTracker) []Embedding {
+	stats := &CacheStats{}
+	ctx = WithCacheStats(ctx, stats)
+
+	var batches [][]embedSpan
+	var size int
+	for i := range sources {
+		for from := 0; from < len(docChunks[i]); {
+			if len(batches) == 0 || size >= embedBatchChunks {
+				batches = append(batches, nil)
+				size = 0
+			}
+			to := min(from+embedBatchChunks-size, len(docChunks[i]))
+			batches[len(batches)-1] = append(batches[len(batches)-1], embedSpan{doc: i, from: from, to: to})
+			size += to - from
+			from = to
+		}
+	}
+	progress.update(func(p *Progress) { p.BatchesTotal = len(batches) })
 
-		builder.WriteString(texts)
+	failed := make([]bool, len(sources))
+	fail := func(i int, err error) {
+		slog.Error("failed to embed file", slog.String("filename", sources[i].Filename), slog.Any("error", err))
+		if !failed[i] {
+			failed[i] = true
+			docFailures[i] = append(docFailures[i], StageError{Stage: StageEmbed, File: sources[i].Filename, Message: err.Error()})
+		}
 	}
 
-	result := builder.String()
-	return []byte(result), nil
+	docEmbeddings := make([][]Embedding, len(sources))
+	for _, batch := range batches {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var (
+			chunks []Chunk
+			texts  []string
+		)
+		for _, s := range batch {
+			chunks = append(chunks, docChunks[s.doc][s.from:s.to]...)
+			texts = append(texts, docCleaned[s.doc][s.from:s.to]...)
+		}
+
+		embs, err := embedChunks(ctx, embedder, chunks, texts)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			for _, s := range batch {
+				n := s.to - s.from
+				docEmbeddings[s.doc] = append(docEmbeddings[s.doc], embs[:n]...)
+				embs = embs[n:]
+			}
+		} else {
+			slog.Error("embedding API call failed", slog.String("object_id", object_id), slog.Any("error", err))
+
+			if len(batch) == 1 {
+				fail(batch[0].doc, err)
+			} else {
+				slog.Warn("retrying embeddings per file", slog.String("object_id", object_id), slog.Int("file_count", len(batch)))
+				for _, s := range batch {
+					embs, err := embedChunks(ctx, embedder, docChunks[s.doc][s.from:s.to], docCleaned[s.doc][s.from:s.to])
+					if err != nil {
+						fail(s.doc, err)
+						continue
+					}
+					docEmbeddings[s.doc] = append(docEmbeddings[s.doc], embs...)
+				}
+			}
+		}
+
+		progress.update(func(p *Progress) {
+			p.BatchesEmbedded++
+			p.ChunksEmbedded += len(chunks)
+			p.CacheHits = int(stats.Hits.Load())
+			p.CacheMisses = int(stats.Misses.Load())
+		})
+	}
+
+	// a document is embedded whole or not at all
+	var embeddings []Embedding
+	for i, embs := range docEmbeddings {
+		if !failed[i] {
+			embeddings = append(embeddings, embs...)
+		}
+	}
+	return embeddings
+}
+
+func embedChunks(ctx context.Context, embedder Embedder, chunks []Chunk, texts []string) ([]Embedding, error) {
+	vectors, err := embedder.Embed(ctx, texts)
+	if err == nil && len(vectors) != len(chunks) {
+		err = fmt.Errorf("expected %d embeddings, got %d", len(chunks), len(vectors))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := make([]Embedding, len(chunks))
+	for i, c := range chunks {
+		embeddings[i] = Embedding{Chunk: c, Vector: vectors[i]}
+	}
+	return embeddings, nil
+}
+
+// sectionAt returns the title of the section that offset falls in.
+func sectionAt(sections []Section, offset int) string {
+	title := ""
+	for _, s := range sections {
+		if s.Start > offset {
+			break
+		}
+		title = s.Title
+	}
+	return title
+}
+
+// pageAt returns the number of the page that offset falls in, or 0 for
+// documents without pages.
+func pageAt(pages []PageStart, offset int) int {
+	page := 0
+	for _, p := range pages {
+		if p.Start > offset {
+			break
+		}
+		page = p.Page
+	}
+	return page
+}
+
+// cleanText removes apostrophes, newlines and English stopwords before the
+// text is sent for embedding.
+func cleanText(raw string) string {
+	cleaned := cleanRe.ReplaceAllString(raw, "")
+	return strings.TrimSpace(stopwords.CleanString(cleaned, "en", true))
+}
+
+// ExtractText converts an uploaded file to plain text with the registered
+// converter for its content type. Long extractions stop early once ctx is
+// cancelled.
+func ExtractText(ctx context.Context, contentType string, content []byte) ([]byte, error) {
+	extracted, err := Extract(ctx, contentType, content)
+	return extracted.Text, err
+}
+
+// extractSource converts src. A spooled upload is read in place when its
+// converter can, and loaded into memory otherwise.
+func extractSource(ctx context.Context, src Source) (Extracted, error) {
+	if src.Path == "" {
+		return Extract(ctx, src.ContentType, src.Content)
+	}
+	if err := ctx.Err(); err != nil {
+		return Extracted{}, err
+	}
+
+	c, ok := converterFor(src.ContentType)
+	if !ok {
+		return Extracted{}, fmt.Errorf("unsupported file type %q", src.ContentType)
+	}
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return Extracted{}, fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer f.Close()
+
+	if c.ConvertAt != nil {
+		return c.ConvertAt(ctx, f, src.Size)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return Extracted{}, fmt.Errorf("failed to read upload: %v", err)
+	}
+	return c.Convert(ctx, content)
+}
+
+// Extract is ExtractText that also returns the structure of the document,
+// for formats that have one.
+func Extract(ctx context.Context, contentType string, content []byte) (Extracted, error) {
+	if err := ctx.Err(); err != nil {
+		return Extracted{}, err
+	}
+
+	c, ok := converterFor(contentType)
+	if !ok {
+		return Extracted{}, fmt.Errorf("unsupported file type %q", contentType)
+	}
+	return c.Convert(ctx, content)
+}
+
+// SupportedContentType reports whether ExtractText can handle contentType.
+func SupportedContentType(contentType string) bool {
+	_, ok := converterFor(contentType)
+	return ok
 }
 
 func JsonToText(content []byte) ([]byte, error) {
@@ -0,0 +1,146 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress is a snapshot of a running ProcessFiles call. Counters include
+// work that failed, so they always reach their totals. ChunksCreated and
+// BatchesTotal are only final once Stage reaches StageEmbed. CacheHits and
+// CacheMisses count chunks found in and missing from the embedding cache.
+type Progress struct {
+	Stage           string `json:"stage"`
+	FilesTotal      int    `json:"files_total"`
+	FilesExtracted  int    `json:"files_extracted"`
+	FilesChunked    int    `json:"files_chunked"`
+	BytesTotal      int64  `json:"bytes_total"`
+	BytesExtracted  int64  `json:"bytes_extracted"`
+	ChunksCreated   int    `json:"chunks_created"`
+	ChunksEmbedded  int    `json:"chunks_embedded"`
+	BatchesTotal    int    `json:"batches_total"`
+	BatchesEmbedded int    `json:"batches_embedded"`
+	CacheHits       int    `json:"cache_hits"`
+	CacheMisses     int    `json:"cache_misses"`
+}
+
+// ProgressFunc receives progress snapshots of a job: whenever its stage
+// changes, when it has moved on by progressStep or progressInterval has
+// passed since the last one, and once more with the final counts. Calls for
+// one job never overlap and never go back to an older snapshot.
+type ProgressFunc func(object_id string, p Progress)
+
+// how often a job's progress is reported, at most, outside stage changes
+const (
+	progressStep     = 0.01
+	progressInterval = time.Second
+)
+
+// share of the total work attributed to each stage; embedding dominates the
+// runtime of most jobs since it waits on a remote model
+const (
+	extractWeight = 0.2
+	chunkWeight   = 0.2
+	embedWeight   = 0.6
+)
+
+// Fraction estimates how much of the job is done, between 0 and 1.
+func (p Progress) Fraction() float64 {
+	var f float64
+	if p.BytesTotal > 0 {
+		f += extractWeight * float64(p.BytesExtracted) / float64(p.BytesTotal)
+	} else if p.FilesTotal > 0 {
+		f += extractWeight * float64(p.FilesExtracted) / float64(p.FilesTotal)
+	}
+	if p.FilesTotal > 0 {
+		f += chunkWeight * float64(p.FilesChunked) / float64(p.FilesTotal)
+	}
+	if p.Stage == StageEmbed && p.ChunksCreated > 0 {
+		f += embedWeight * float64(p.ChunksEmbedded) / float64(p.ChunksCreated)
+	}
+	return min(f, 1)
+}
+
+// progressTracker serialises progress updates from the per-file goroutines
+// and derives the current stage from the counters. Snapshots are reported
+// outside its lock, so workers do not wait on a slow ProgressFunc to count
+// their work.
+type progressTracker struct {
+	mu        sync.Mutex
+	object_id string
+	progress  Progress
+	seq       int // snapshots taken
+	last      Progress
+	lastAt    time.Time
+	report    ProgressFunc
+
+	reportMu sync.Mutex
+	reported int // seq of the last snapshot reported
+}
+
+func newProgressTracker(object_id string, sources []Source, report ProgressFunc) *progressTracker {
+	t := &progressTracker{object_id: object_id, report: report}
+	t.progress.FilesTotal = len(sources)
+	for _, src := range sources {
+		t.progress.BytesTotal += src.Len()
+	}
+	t.progress.Stage = StageExtract
+	return t
+}
+
+func (t *progressTracker) update(fn func(p *Progress)) {
+	t.mu.Lock()
+	fn(&t.progress)
+	switch p := &t.progress; {
+	case p.FilesExtracted < p.FilesTotal:
+		p.Stage = StageExtract
+	case p.FilesChunked < p.FilesTotal:
+		p.Stage = StageChunk
+	default:
+		p.Stage = StageEmbed
+	}
+	t.seq++
+	p, seq := t.progress, t.seq
+	now := time.Now()
+	stageChanged := p.Stage != t.last.Stage
+	due := stageChanged || p.Fraction()-t.last.Fraction() >= progressStep || now.Sub(t.lastAt) >= progressInterval
+	if due {
+		t.last, t.lastAt = p, now
+	}
+	t.mu.Unlock()
+
+	if due {
+		// a snapshot held back while another is being reported is covered
+		// by a later one; stage changes are not
+		t.send(seq, p, stageChanged)
+	}
+}
+
+// flush reports the current snapshot unless it already was, and returns it.
+func (t *progressTracker) flush() Progress {
+	t.mu.Lock()
+	p, seq := t.progress, t.seq
+	t.last, t.lastAt = p, time.Now()
+	t.mu.Unlock()
+
+	t.send(seq, p, true)
+	return p
+}
+
+func (t *progressTracker) send(seq int, p Progress, wait bool) {
+	if t.report == nil {
+		return
+	}
+	if wait {
+		t.reportMu.Lock()
+	} else if !t.reportMu.TryLock() {
+		return
+	}
+	defer t.reportMu.Unlock()
+	if seq <= t.reported {
+		// a newer snapshot went out already
+		return
+	}
+	t.reported = seq
+	t.report(t.object_id, p)
+}
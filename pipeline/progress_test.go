@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProcessFiles_Progress(t *testing.T) {
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		out := make([][]float64, len(texts))
+		for i := range texts {
+			out[i] = []float64{1}
+		}
+		return out, nil
+	})
+
+	// enough chunks for more than one embedding batch
+	sources := []Source{
+		{ID: "d1", Filename: "big.txt", ContentType: "text/plain", Content: []byte(strings.Repeat("Sentence here. ", 600))},
+		{ID: "d2", Filename: "small.txt", ContentType: "text/plain", Content: []byte("Just one sentence.")},
+		{ID: "d3", Filename: "bad.json", ContentType: "application/json", Content: []byte("{not json")},
+	}
+	opts := ProcessOptions{Chunking: ChunkOptions{Strategy: ChunkSentence, Size: 10}, Embedder: embedder}
+
+	var events []Progress
+	opts.Progress = func(object_id string, p Progress) {
+		if object_id != "obj" {
+			t.Errorf("unexpected object id %q", object_id)
+		}
+		events = append(events, p)
+	}
+
+	var result ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, r ProcessResult) { result = r })
+
+	if len(events) == 0 {
+		t.Fatal("expected progress events")
+	}
+
+	prev := 0.0
+	for i, p := range events {
+		if f := p.Fraction(); f < prev {
+			t.Errorf("progress went backwards at event %d: %f < %f", i, f, prev)
+		} else {
+			prev = f
+		}
+	}
+
+	last := events[len(events)-1]
+	if last.Stage != StageEmbed {
+		t.Errorf("expected final stage %q, got %q", StageEmbed, last.Stage)
+	}
+	if last.FilesExtracted != 3 || last.FilesChunked != 3 || last.BytesExtracted != last.BytesTotal {
+		t.Errorf("expected every file to be counted, got %+v", last)
+	}
+	// the 1201 chunks of big.txt are spread over three batches, the last
+	// shared with small.txt
+	if last.BatchesTotal != 3 || last.BatchesEmbedded != 3 {
+		t.Errorf("expected three embedding batches, got %+v", last)
+	}
+	if last.ChunksEmbedded != last.ChunksCreated || last.ChunksCreated != len(result.Embeddings) {
+		t.Errorf("expected all %d chunks embedded, got %+v", len(result.Embeddings), last)
+	}
+	if last.Fraction() != 1 {
+		t.Errorf("expected a finished job to be at 100%%, got %f", last.Fraction())
+	}
+
+	if len(result.Documents) != 2 {
+		t.Errorf("expected the unreadable file to be left out of documents, got %d", len(result.Documents))
+	}
+	if len(result.Failures) != 1 || result.Failures[0].Stage != StageExtract || result.Failures[0].File != "bad.json" {
+		t.Errorf("expected an extract failure for bad.json, got %+v", result.Failures)
+	}
+}
+
+func TestProgressTracker_Throttles(t *testing.T) {
+	sources := make([]Source, 1000)
+	var events []Progress
+	tracker := newProgressTracker("obj", sources, func(_ string, p Progress) { events = append(events, p) })
+
+	for range len(sources) {
+		tracker.update(func(p *Progress) { p.FilesExtracted++ })
+	}
+	// extraction is a fifth of the job, so a report per 1% is 20 of them
+	// plus the move to chunking
+	if len(events) > 25 {
+		t.Errorf("expected progress to be throttled, got %d reports for %d updates", len(events), len(sources))
+	}
+	if last := events[len(events)-1]; last.Stage != StageChunk {
+		t.Errorf("expected the stage change to be reported, got %+v", last)
+	}
+
+	tracker.update(func(p *Progress) { p.FilesChunked++ })
+	n := len(events)
+	tracker.flush()
+	if len(events) != n+1 || events[n].FilesChunked != 1 {
+		t.Errorf("expected flush to report the final snapshot, got %+v", events[n:])
+	}
+	tracker.flush()
+	if len(events) != n+1 {
+		t.Errorf("expected a snapshot to be reported once, got %d reports", len(events)-n)
+	}
+}
+
+func TestProgress_Fraction(t *testing.T) {
+	tests := []struct {
+		p    Progress
+		want float64
+	}{
+		{Progress{}, 0},
+		{Progress{Stage: StageExtract, FilesTotal: 2, BytesTotal: 100, BytesExtracted: 50, FilesExtracted: 1}, 0.1},
+		{Progress{Stage: StageChunk, FilesTotal: 2, FilesExtracted: 2, FilesChunked: 1}, 0.3},
+		{Progress{Stage: StageEmbed, FilesTotal: 1, FilesExtracted: 1, FilesChunked: 1, ChunksCreated: 4, ChunksEmbedded: 2}, 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", tt.p), func(t *testing.T) {
+			if got := tt.p.Fraction(); got < tt.want-1e-9 || got > tt.want+1e-9 {
+				t.Errorf("expected %f, got %f", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExtractText_Unsupported(t *testing.T) {
+	if SupportedContentType("image/png") {
+		t.Error("expected image/png to be unsupported")
+	}
+	if _, err := ExtractText(context.Background(), "image/png", []byte{0x89}); err == nil {
+		t.Error("expected error for unsupported content type")
+	}
+	if !SupportedContentType("text/xml") {
+		t.Error("expected text/xml to be supported")
+	}
+}
@@ -0,0 +1,311 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"gopkg.in/yaml.v3"
+)
+
+// MaxSelectors is the most paths a job may select.
+const MaxSelectors = 50
+
+// structured documents stop expanding (YAML aliases) past this many nodes
+const maxStructuredValues = 1_000_000
+
+var selectorSegment = regexp.MustCompile(`^@?[^\s.@\[\]]+$`)
+
+// ParseSelectors builds the list of element and key paths to keep from raw
+// request values. Each value may hold several comma-separated paths. A path
+// is a dot-separated list of names, with "@" before an XML attribute, and
+// selects every element or key whose path ends with those names: "description"
+// selects all description elements, "item.description" only those of an
+// item, and "item.@id" the id attributes of items.
+func ParseSelectors(values []string) ([]string, error) {
+	var selectors []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			for _, segment := range strings.Split(s, ".") {
+				if !selectorSegment.MatchString(segment) {
+					return nil, fmt.Errorf("invalid path %q", s)
+				}
+			}
+			selectors = append(selectors, s)
+		}
+	}
+	if len(selectors) > MaxSelectors {
+		return nil, fmt.Errorf("at most %d paths may be selected, got %d", MaxSelectors, len(selectors))
+	}
+	return selectors, nil
+}
+
+type selectorsKey struct{}
+
+// withSelectors passes the paths selected for a job to the converters of
+// structured formats.
+func withSelectors(ctx context.Context, selectors []string) context.Context {
+	if len(selectors) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, selectorsKey{}, selectors)
+}
+
+func selectorsFrom(ctx context.Context) []string {
+	selectors, _ := ctx.Value(selectorsKey{}).([]string)
+	return selectors
+}
+
+// flattener writes the values of a structured document as "path: value"
+// lines. Paths join names with dots and index repeated elements, such as
+// items[1].name. When selectors are given, only the values in selected
+// subtrees are written.
+type flattener struct {
+	b         strings.Builder
+	selectors [][]string
+	values    int
+	matched   bool
+	expanding map[*yaml.Node]bool // aliased YAML nodes being written
+}
+
+func newFlattener(selectors []string) *flattener {
+	f := &flattener{}
+	for _, s := range selectors {
+		f.selectors = append(f.selectors, strings.Split(s, "."))
+	}
+	return f
+}
+
+// selected reports whether a node whose path has the given names is, or is
+// inside, a selected subtree.
+func (f *flattener) selected(names []string, inside bool) bool {
+	if inside || len(f.selectors) == 0 {
+		return true
+	}
+	for _, s := range f.selectors {
+		if len(s) <= len(names) && slices.Equal(s, names[len(names)-len(s):]) {
+			f.matched = true
+			return true
+		}
+	}
+	return false
+}
+
+// visit counts the nodes of a document, which YAML aliases can multiply.
+func (f *flattener) visit() error {
+	if f.values++; f.values > maxStructuredValues {
+		return fmt.Errorf("document has more than %d nodes", maxStructuredValues)
+	}
+	return nil
+}
+
+func (f *flattener) value(path, value string) {
+	value = strings.Join(strings.Fields(value), " ")
+	if value == "" {
+		return
+	}
+	if path != "" {
+		f.b.WriteString(path + ": ")
+	}
+	f.b.WriteString(value + "\n")
+}
+
+// text returns the flattened document, or an error when selectors were given
+// and none of them matched.
+func (f *flattener) text() ([]byte, error) {
+	if len(f.selectors) > 0 && !f.matched {
+		return nil, errors.New("no elements or keys match the selected paths")
+	}
+	return []byte(f.b.String()), nil
+}
+
+// extend returns names followed by name, leaving names as it is for its
+// other children.
+func extend(names []string, name string) []string {
+	return append(names[:len(names):len(names)], name)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// xmlElement is an element of a parsed XML document.
+type xmlElement struct {
+	name     string
+	attrs    []xml.Attr
+	text     strings.Builder
+	children []*xmlElement
+}
+
+// XmlToText flattens an XML document into "path: value" lines, one for each
+// attribute and for the text of each element, so markup does not end up in
+// the embedding. With selectors, only the selected elements and attributes,
+// and everything inside them, are kept; see ParseSelectors.
+func XmlToText(content []byte, selectors []string) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	dec.CharsetReader = charset.NewReaderLabel
+
+	var root *xmlElement
+	var open []*xmlElement
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse XML: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			el := &xmlElement{name: t.Name.Local, attrs: t.Attr}
+			if len(open) > 0 {
+				parent := open[len(open)-1]
+				parent.children = append(parent.children, el)
+				// keep words on either side of a child element apart
+				parent.text.WriteString(" ")
+			} else if root == nil {
+				root = el
+			}
+			open = append(open, el)
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(open) > 0 {
+				open[len(open)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("failed to parse XML: no root element")
+	}
+
+	f := newFlattener(selectors)
+	if err := f.xmlElement(root, root.name, []string{root.name}, false); err != nil {
+		return nil, err
+	}
+	return f.text()
+}
+
+func (f *flattener) xmlElement(el *xmlElement, path string, names []string, inside bool) error {
+	if err := f.visit(); err != nil {
+		return err
+	}
+	inside = f.selected(names, inside)
+	for _, a := range el.attrs {
+		if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+			continue
+		}
+		name := "@" + a.Name.Local
+		if f.selected(extend(names, name), inside) {
+			f.value(joinPath(path, name), a.Value)
+		}
+	}
+	if inside {
+		f.value(path, el.text.String())
+	}
+
+	counts := map[string]int{}
+	for _, c := range el.children {
+		counts[c.name]++
+	}
+	seen := map[string]int{}
+	for _, c := range el.children {
+		segment := c.name
+		if counts[c.name] > 1 {
+			segment += "[" + strconv.Itoa(seen[c.name]) + "]"
+			seen[c.name]++
+		}
+		if err := f.xmlElement(c, joinPath(path, segment), extend(names, c.name), inside); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// YamlToText flattens a YAML document, or a stream of them, into
+// "path: value" lines, one for each scalar. Aliases and merge keys are
+// expanded. With selectors, only the selected keys, and everything under
+// them, are kept; see ParseSelectors.
+func YamlToText(content []byte, selectors []string) ([]byte, error) {
+	f := newFlattener(selectors)
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc yaml.Node
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse YAML: %v", err)
+		}
+		if err := f.yamlNode(&doc, "", nil, false); err != nil {
+			return nil, err
+		}
+	}
+	return f.text()
+}
+
+func (f *flattener) yamlNode(n *yaml.Node, path string, names []string, inside bool) error {
+	if err := f.visit(); err != nil {
+		return err
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := f.yamlNode(c, path, names, inside); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Tag == "!!merge" {
+				// merged keys belong to this mapping
+				if err := f.yamlNode(n.Content[i+1], path, names, inside); err != nil {
+					return err
+				}
+				continue
+			}
+			child := extend(names, key.Value)
+			if err := f.yamlNode(n.Content[i+1], joinPath(path, key.Value), child, f.selected(child, inside)); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if err := f.yamlNode(c, path+"["+strconv.Itoa(i)+"]", names, inside); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		if f.expanding[n.Alias] {
+			return fmt.Errorf("alias %s refers to itself", n.Value)
+		}
+		if f.expanding == nil {
+			f.expanding = map[*yaml.Node]bool{}
+		}
+		f.expanding[n.Alias] = true
+		defer delete(f.expanding, n.Alias)
+		return f.yamlNode(n.Alias, path, names, inside)
+	case yaml.ScalarNode:
+		if (inside || len(f.selectors) == 0) && n.Tag != "!!null" {
+			f.value(path, n.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const catalogXML = `<?xml version="1.0"?>
+<catalog xmlns="urn:example">
+  <title>Spring   range</title>
+  <item id="1"><name>Widget</name><description>Small and <b>cheap</b>.</description></item>
+  <item id="2"><name>Gadget</name><description>Large.</description></item>
+</catalog>`
+
+func TestXmlToText(t *testing.T) {
+	text, err := XmlToText([]byte(catalogXML), nil)
+	if err != nil {
+		t.Fatalf("XmlToText failed: %v", err)
+	}
+
+	expected := "catalog.title: Spring range\n" +
+		"catalog.item[0].@id: 1\n" +
+		"catalog.item[0].name: Widget\n" +
+		"catalog.item[0].description: Small and .\n" +
+		"catalog.item[0].description.b: cheap\n" +
+		"catalog.item[1].@id: 2\n" +
+		"catalog.item[1].name: Gadget\n" +
+		"catalog.item[1].description: Large.\n"
+	if string(text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, text)
+	}
+}
+
+func TestXmlToText_Select(t *testing.T) {
+	text, err := XmlToText([]byte(catalogXML), []string{"item.description", "@id"})
+	if err != nil {
+		t.Fatalf("XmlToText failed: %v", err)
+	}
+
+	expected := "catalog.item[0].@id: 1\n" +
+		"catalog.item[0].description: Small and .\n" +
+		"catalog.item[0].description.b: cheap\n" +
+		"catalog.item[1].@id: 2\n" +
+		"catalog.item[1].description: Large.\n"
+	if string(text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, text)
+	}
+
+	if _, err := XmlToText([]byte(catalogXML), []string{"price"}); err == nil {
+		t.Error("expected an error when nothing is selected")
+	}
+}
+
+const configYAML = `service: api
+owners:
+  - name: Ada
+    role: lead
+  - name: Grace
+defaults: &defaults
+  timeout: 30s
+  retries: null
+staging:
+  <<: *defaults
+---
+service: worker
+`
+
+func TestYamlToText(t *testing.T) {
+	text, err := YamlToText([]byte(configYAML), nil)
+	if err != nil {
+		t.Fatalf("YamlToText failed: %v", err)
+	}
+
+	expected := "service: api\n" +
+		"owners[0].name: Ada\n" +
+		"owners[0].role: lead\n" +
+		"owners[1].name: Grace\n" +
+		"defaults.timeout: 30s\n" +
+		"staging.timeout: 30s\n" +
+		"service: worker\n"
+	if string(text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, text)
+	}
+}
+
+func TestYamlToText_Select(t *testing.T) {
+	text, err := YamlToText([]byte(configYAML), []string{"owners.name", "service"})
+	if err != nil {
+		t.Fatalf("YamlToText failed: %v", err)
+	}
+
+	expected := "service: api\nowners[0].name: Ada\nowners[1].name: Grace\nservice: worker\n"
+	if string(text) != expected {
+		t.Errorf("unexpected text.\nExpected: %q\nGot: %q", expected, text)
+	}
+}
+
+func TestYamlToText_AliasBomb(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("a0: &a0 [x, x, x, x, x, x, x, x, x, x]\n")
+	for i := 1; i < 9; i++ {
+		b.WriteString("a" + string(rune('0'+i)) + ": &a" + string(rune('0'+i)) + " [")
+		for j := range 10 {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("*a" + string(rune('0'+i-1)))
+		}
+		b.WriteString("]\n")
+	}
+
+	// not even a selection that skips every value may expand it
+	if _, err := YamlToText([]byte(b.String()), []string{"missing"}); err == nil {
+		t.Error("expected an error for a document that expands to a billion values")
+	}
+}
+
+func TestParseSelectors(t *testing.T) {
+	got, err := ParseSelectors([]string{"description, item.@id", "", "name"})
+	if err != nil {
+		t.Fatalf("ParseSelectors failed: %v", err)
+	}
+	if expected := []string{"description", "item.@id", "name"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	for _, bad := range []string{"item..name", "item name", "items[0]", "item@id"} {
+		if _, err := ParseSelectors([]string{bad}); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestProcessFiles_Select(t *testing.T) {
+	sources := []Source{
+		{ID: "d1", Filename: "catalog.xml", ContentType: "application/xml", Content: []byte(catalogXML)},
+		{ID: "d2", Filename: "notes.txt", ContentType: "text/plain", Content: []byte("Plain text is not filtered.")},
+	}
+	opts := ProcessOptions{
+		Chunking: DefaultChunkOptions,
+		Select:   []string{"name"},
+		Embedder: mockEmbedder(func(texts []string) ([][]float64, error) {
+			return make([][]float64, len(texts)), nil
+		}),
+	}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", sources, opts, func(_ string, result ProcessResult) {
+		got = result
+	})
+
+	if len(got.Documents) != 2 {
+		t.Fatalf("expected both documents, got %+v", got.Documents)
+	}
+	if expected := "catalog.item[0].name: Widget\ncatalog.item[1].name: Gadget\n"; got.Documents[0].Text != expected {
+		t.Errorf("expected only names from the XML, got %q", got.Documents[0].Text)
+	}
+	if got.Documents[1].Text != "Plain text is not filtered." {
+		t.Errorf("expected the text file unchanged, got %q", got.Documents[1].Text)
+	}
+}
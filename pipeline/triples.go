@@ -0,0 +1,270 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// TripleExtractor pulls subject–predicate–object triples out of a chunk.
+// Returned triples must carry the chunk's provenance.
+type TripleExtractor interface {
+	Extract(ctx context.Context, chunk Chunk) ([]Triple, error)
+}
+
+const (
+	ExtractorNone  = "none"
+	ExtractorRules = "rules"
+	ExtractorLLM   = "llm"
+)
+
+// DefaultExtractor is used when a job does not ask for a specific extractor.
+// RunApp replaces it according to TRIPLE_EXTRACTOR.
+var DefaultExtractor TripleExtractor = RuleExtractor{}
+
+// NewExtractor builds the named extractor. An empty name selects
+// TRIPLE_EXTRACTOR, falling back to the rule-based extractor. "none" returns
+// a nil extractor, which disables triple extraction.
+//
+// Environment for "llm":
+//   - TRIPLE_LLM_PROVIDER: cloudflare (default) or openai
+//   - TRIPLE_LLM_MODEL: model name, provider specific default
+//   - cloudflare: CLOUDFLARE_ACCOUNT_ID, CLOUDFLARE_API_TOKEN
+//   - openai: OPENAI_BASE_URL, OPENAI_API_KEY
+func NewExtractor(name string) (TripleExtractor, error) {
+	if name == "" {
+		name = os.Getenv("TRIPLE_EXTRACTOR")
+	}
+
+	switch strings.ToLower(name) {
+	case "", ExtractorRules:
+		return RuleExtractor{}, nil
+	case ExtractorNone:
+		return nil, nil
+	case ExtractorLLM:
+		switch provider := strings.ToLower(os.Getenv("TRIPLE_LLM_PROVIDER")); provider {
+		case "", ProviderCloudflare:
+			return LLMExtractor{Provider: &CloudflareLLM{
+				AccountID: os.Getenv("CLOUDFLARE_ACCOUNT_ID"),
+				APIToken:  os.Getenv("CLOUDFLARE_API_TOKEN"),
+				ModelName: envOr("TRIPLE_LLM_MODEL", "@cf/meta/llama-3.1-8b-instruct"),
+			}}, nil
+		case ProviderOpenAI:
+			return LLMExtractor{Provider: &OpenAIChat{
+				BaseURL:   envOr("OPENAI_BASE_URL", "https://api.openai.com"),
+				APIKey:    os.Getenv("OPENAI_API_KEY"),
+				ModelName: envOr("TRIPLE_LLM_MODEL", "gpt-4o-mini"),
+			}}, nil
+		default:
+			return nil, fmt.Errorf("unknown triple LLM provider %q", provider)
+		}
+	default:
+		return nil, fmt.Errorf("unknown triple extractor %q", name)
+	}
+}
+
+// RuleExtractor is a dependency-free extractor that looks for a known
+// relation verb in each sentence and takes the noun phrase before it as the
+// subject and the phrase after it as the object. It favours precision over
+// recall: sentences without a recognised verb produce nothing.
+type RuleExtractor struct{}
+
+var relationVerbs = map[string]bool{
+	"is": true, "are": true, "was": true, "were": true,
+	"has": true, "have": true, "had": true,
+	"contains": true, "contain": true, "includes": true, "include": true,
+	"uses": true, "use": true, "used": true, "provides": true, "provide": true,
+	"supports": true, "support": true, "requires": true, "require": true,
+	"produces": true, "produce": true, "creates": true, "create": true, "created": true,
+	"owns": true, "own": true, "consists": true, "comprises": true,
+	"stores": true, "store": true, "returns": true, "return": true,
+	"describes": true, "defines": true, "becomes": true, "became": true,
+	"means": true, "causes": true, "caused": true, "enables": true, "allows": true,
+	"wrote": true, "founded": true, "developed": true, "invented": true, "discovered": true,
+}
+
+var relationPreps = map[string]bool{
+	"of": true, "in": true, "on": true, "at": true, "by": true, "to": true,
+	"with": true, "for": true, "from": true, "as": true, "into": true,
+}
+
+var negations = map[string]bool{"not": true, "never": true, "no": true}
+
+var determiners = map[string]bool{
+	"the": true, "a": true, "an": true, "this": true, "that": true,
+	"these": true, "those": true, "its": true, "their": true,
+}
+
+// words that start a new clause and therefore end an object phrase
+var clauseStarters = map[string]bool{
+	"which": true, "that": true, "who": true, "whom": true, "because": true,
+	"but": true, "while": true, "when": true, "where": true, "although": true,
+}
+
+const (
+	maxSubjectWords = 5
+	maxObjectWords  = 8
+)
+
+func (RuleExtractor) Extract(_ context.Context, c Chunk) ([]Triple, error) {
+	var triples []Triple
+	seen := map[[3]string]bool{}
+
+	for _, sentence := range sentenceEnd.Split(c.Text, -1) {
+		t, ok := ruleTriple(sentence)
+		if !ok {
+			continue
+		}
+		key := [3]string{strings.ToLower(t.Subject), strings.ToLower(t.Predicate), strings.ToLower(t.Object)}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		triples = append(triples, withProvenance(t, c))
+	}
+	return triples, nil
+}
+
+// ruleTriple extracts at most one triple from a sentence, anchored on the
+// first relation verb that has both a subject and an object.
+func ruleTriple(sentence string) (Triple, bool) {
+	words := strings.Fields(sentence)
+
+	for v := 1; v < len(words); v++ {
+		if !relationVerbs[normWord(words[v])] || endsClause(words[v-1]) {
+			continue
+		}
+
+		// subject: walk back to the start of the clause
+		s := v
+		for s > 0 && v-s < maxSubjectWords && !endsClause(words[s-1]) {
+			s--
+		}
+		subject := phrase(words[s:v])
+
+		// predicate: verb, optional negation, optional "participle preposition"
+		// ("was founded by"), or a bare preposition ("consists of")
+		p := v + 1
+		if p < len(words) && !endsClause(words[p-1]) && negations[normWord(words[p])] {
+			p++
+		}
+		if p+1 < len(words) && !endsClause(words[p-1]) && !endsClause(words[p]) &&
+			strings.HasSuffix(normWord(words[p]), "ed") && relationPreps[normWord(words[p+1])] {
+			p += 2
+		} else if p < len(words) && !endsClause(words[p-1]) && relationPreps[normWord(words[p])] {
+			p++
+		}
+		if endsClause(words[p-1]) {
+			// "X is, ..." has no object in this clause
+			continue
+		}
+		predicate := strings.ToLower(strings.Join(trimAll(words[v:p]), " "))
+
+		// object: up to the end of the clause
+		o := p
+		for o < len(words) && o-p < maxObjectWords && !clauseStarters[normWord(words[o])] {
+			o++
+			if endsClause(words[o-1]) {
+				break
+			}
+		}
+		object := phrase(words[p:o])
+
+		if subject == "" || object == "" {
+			continue
+		}
+		return Triple{Subject: subject, Predicate: predicate, Object: object}, true
+	}
+	return Triple{}, false
+}
+
+// phrase joins words after dropping leading determiners and surrounding punctuation
+func phrase(words []string) string {
+	words = trimAll(words)
+	for len(words) > 0 && determiners[strings.ToLower(words[0])] {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+func trimAll(words []string) []string {
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = trimWord(w); w != "" {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+func trimWord(w string) string {
+	return strings.TrimFunc(w, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func normWord(w string) string {
+	return strings.ToLower(trimWord(w))
+}
+
+func endsClause(w string) bool {
+	return strings.HasSuffix(w, ",") || strings.HasSuffix(w, ";") || strings.HasSuffix(w, ":") ||
+		strings.HasSuffix(w, ")") || strings.HasSuffix(w, "(")
+}
+
+func withProvenance(t Triple, c Chunk) Triple {
+	t.DocumentID = c.DocumentID
+	t.Filename = c.Filename
+	t.ChunkIndex = c.Index
+	return t
+}
+
+// LLMProvider completes a single prompt with a language model.
+type LLMProvider interface {
+	Complete(ctx context.Context, prompt string) (string, error)
+}
+
+// LLMExtractor asks a language model for triples and parses its JSON answer.
+type LLMExtractor struct {
+	Provider LLMProvider
+}
+
+const triplePrompt = `Extract factual subject-predicate-object triples from the text below.
+Answer with only a JSON array of objects with the string fields "subject", "predicate" and "object".
+Answer with [] if there are none.
+
+Text:
+%s`
+
+func (x LLMExtractor) Extract(ctx context.Context, c Chunk) ([]Triple, error) {
+	answer, err := x.Provider.Complete(ctx, fmt.Sprintf(triplePrompt, c.Text))
+	if err != nil {
+		return nil, fmt.Errorf("triple extraction failed: %w", err)
+	}
+
+	// models like to wrap JSON in prose or code fences
+	start, end := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("no JSON array in model answer: %q", answer)
+	}
+
+	var raw []Triple
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("invalid triples in model answer: %v", err)
+	}
+
+	triples := make([]Triple, 0, len(raw))
+	for _, t := range raw {
+		t.Subject = strings.TrimSpace(t.Subject)
+		t.Predicate = strings.TrimSpace(t.Predicate)
+		t.Object = strings.TrimSpace(t.Object)
+		if t.Subject == "" || t.Predicate == "" || t.Object == "" {
+			continue
+		}
+		triples = append(triples, withProvenance(t, c))
+	}
+	return triples, nil
+}
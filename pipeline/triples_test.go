@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRuleExtractor(t *testing.T) {
+	chunk := Chunk{
+		DocumentID: "d1",
+		Filename:   "facts.txt",
+		Index:      3,
+		Text: "The Earth is a planet. Go was designed at Google, which is in California. " +
+			"Water consists of hydrogen and oxygen. Hello there. The Earth is a planet.",
+	}
+
+	triples, err := RuleExtractor{}.Extract(context.Background(), chunk)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := []Triple{
+		{Subject: "Earth", Predicate: "is", Object: "planet"},
+		{Subject: "Go", Predicate: "was designed at", Object: "Google"},
+		{Subject: "Water", Predicate: "consists of", Object: "hydrogen and oxygen"},
+	}
+	if len(triples) != len(expected) {
+		t.Fatalf("expected %d triples, got %+v", len(expected), triples)
+	}
+	for i, tr := range triples {
+		e := expected[i]
+		if tr.Subject != e.Subject || tr.Predicate != e.Predicate || tr.Object != e.Object {
+			t.Errorf("triple %d: expected %+v, got %+v", i, e, tr)
+		}
+		if tr.DocumentID != "d1" || tr.Filename != "facts.txt" || tr.ChunkIndex != 3 {
+			t.Errorf("triple %d missing chunk provenance: %+v", i, tr)
+		}
+	}
+}
+
+func TestRuleExtractor_Negation(t *testing.T) {
+	triples, _ := RuleExtractor{}.Extract(context.Background(), Chunk{Text: "Pluto is not a planet."})
+	if len(triples) != 1 || triples[0].Predicate != "is not" || triples[0].Object != "planet" {
+		t.Errorf("unexpected triples: %+v", triples)
+	}
+}
+
+type fakeLLM struct {
+	answer string
+	err    error
+}
+
+func (f fakeLLM) Complete(_ context.Context, prompt string) (string, error) { return f.answer, f.err }
+
+func TestLLMExtractor(t *testing.T) {
+	x := LLMExtractor{Provider: fakeLLM{answer: "Sure! ```json\n" +
+		`[{"subject":"Earth","predicate":"orbits","object":"Sun"},{"subject":"","predicate":"is","object":"x"}]` +
+		"\n```"}}
+
+	triples, err := x.Extract(context.Background(), Chunk{DocumentID: "d1", Filename: "a.txt", Index: 1})
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := []Triple{{Subject: "Earth", Predicate: "orbits", Object: "Sun", DocumentID: "d1", Filename: "a.txt", ChunkIndex: 1}}
+	if !reflect.DeepEqual(triples, expected) {
+		t.Errorf("expected %+v, got %+v", expected, triples)
+	}
+}
+
+func TestLLMExtractor_Errors(t *testing.T) {
+	if _, err := (LLMExtractor{Provider: fakeLLM{err: fmt.Errorf("boom")}}).Extract(context.Background(), Chunk{}); err == nil {
+		t.Error("expected provider error to be returned")
+	}
+	if _, err := (LLMExtractor{Provider: fakeLLM{answer: "I cannot help"}}).Extract(context.Background(), Chunk{}); err == nil {
+		t.Error("expected error for answer without JSON")
+	}
+}
+
+func TestNewExtractor(t *testing.T) {
+	if x, err := NewExtractor(""); err != nil || x != (RuleExtractor{}) {
+		t.Errorf("expected rule extractor by default, got %T, err: %v", x, err)
+	}
+	if x, err := NewExtractor("none"); err != nil || x != nil {
+		t.Errorf("expected nil extractor for none, got %T, err: %v", x, err)
+	}
+
+	t.Setenv("TRIPLE_LLM_PROVIDER", "openai")
+	x, err := NewExtractor("llm")
+	if err != nil {
+		t.Fatalf("NewExtractor failed: %v", err)
+	}
+	if llm, ok := x.(LLMExtractor); !ok {
+		t.Errorf("expected LLM extractor, got %T", x)
+	} else if _, ok := llm.Provider.(*OpenAIChat); !ok {
+		t.Errorf("expected OpenAI chat provider, got %T", llm.Provider)
+	}
+
+	if _, err := NewExtractor("spacy"); err == nil {
+		t.Error("expected error for unknown extractor")
+	}
+}
+
+func TestProcessFiles_Triples(t *testing.T) {
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		out := make([][]float64, len(texts))
+		for i := range texts {
+			out[i] = []float64{1}
+		}
+		return out, nil
+	})
+
+	docs := []Document{{ID: "d1", Filename: "a.txt", Text: "The Earth is a planet."}}
+
+	var got []Triple
+	ProcessFiles(context.Background(), "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder, Extractor: RuleExtractor{}},
+		func(_ string, result ProcessResult) { got = result.Triples })
+
+	if len(got) != 1 || got[0].Subject != "Earth" || got[0].DocumentID != "d1" {
+		t.Errorf("expected triple linked to d1, got %+v", got)
+	}
+}
+
+func TestProcessFiles_TripleFailureIsPartial(t *testing.T) {
+	embedder := mockEmbedder(func(texts []string) ([][]float64, error) {
+		out := make([][]float64, len(texts))
+		for i := range texts {
+			out[i] = []float64{1}
+		}
+		return out, nil
+	})
+
+	docs := []Document{{ID: "d1", Filename: "a.txt", Text: "The Earth is a planet."}}
+	extractor := LLMExtractor{Provider: fakeLLM{err: fmt.Errorf("model overloaded")}}
+
+	var got ProcessResult
+	ProcessFiles(context.Background(), "obj", textSources(docs), ProcessOptions{Chunking: DefaultChunkOptions, Embedder: embedder, Extractor: extractor},
+		func(_ string, result ProcessResult) { got = result })
+
+	if got.Err != nil || len(got.Embeddings) != 1 {
+		t.Fatalf("expected embeddings despite extraction failure, got %+v", got)
+	}
+	if len(got.Failures) != 1 || got.Failures[0].Stage != StageTriples || got.Failures[0].File != "a.txt" {
+		t.Errorf("expected a triples failure for a.txt, got %+v", got.Failures)
+	}
+}
@@ -1,7 +1,152 @@
 package pipeline
 
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
 // call back for the embedding data recived to be written to the handler package
-type ResultWriter func(object_id string, embeddings [][]float64, triples []string)
+type ResultWriter func(object_id string, result ProcessResult)
+
+// ProcessResult is everything a ProcessFiles run produced. Documents holds
+// every source whose text could be extracted, in upload order. Failures lists
+// files that were skipped or only partly processed; the rest of the job is
+// still usable. Progress is the final progress snapshot. Err is set when the
+// job produced nothing at all.
+type ProcessResult struct {
+	Documents  []Document
+	Embeddings []Embedding
+	Triples    []Triple
+	Failures   []StageError
+	Progress   Progress
+	Err        error
+}
+
+// Pipeline stages reported in StageError.
+const (
+	StageExtract = "extract"
+	StageChunk   = "chunk"
+	StageTriples = "triples"
+	StageEmbed   = "embed"
+)
+
+// StageError reports a failure in one pipeline stage. File is empty when the
+// failure is not tied to a single file.
+type StageError struct {
+	Stage   string `json:"stage"`
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *StageError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Stage, e.File, e.Message)
+}
+
+// Source is one uploaded file before text extraction. ContentType is the
+// detected MIME type without parameters. The file is held in Content or,
+// when it was too large to keep in memory, spooled to disk at Path, which
+// holds Size bytes. Hash identifies the content, so an unchanged re-upload
+// can be recognised; it is carried over to the Document.
+type Source struct {
+	ID          string
+	Filename    string
+	ContentType string
+	Content     []byte
+	Path        string
+	Size        int64
+	Hash        string
+}
+
+// Len is the size of the file in bytes.
+func (s Source) Len() int64 {
+	if s.Path != "" {
+		return s.Size
+	}
+	return int64(len(s.Content))
+}
+
+// Document is one uploaded file after text extraction. ID is unique within
+// the job and links every chunk and embedding back to its source. Title,
+// Description, Author and Created are set for formats that declare them,
+// such as HTML and PDF; Pages for formats that have pages.
+type Document struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	Hash        string    `json:"hash,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Author      string    `json:"author,omitempty"`
+	Created     time.Time `json:"created,omitzero"`
+	Pages       int       `json:"pages,omitempty"`
+	Text        string    `json:"text"`
+}
+
+// ProcessOptions configures a single ProcessFiles run.
+type ProcessOptions struct {
+	Chunking  ChunkOptions
+	Embedder  Embedder        // nil means DefaultEmbedder
+	Extractor TripleExtractor // nil disables triple extraction
+	Progress  ProgressFunc    // nil disables progress reporting
+
+	// element and key paths kept by the XML and YAML converters, as parsed
+	// by ParseSelectors; empty keeps everything
+	Select []string
+
+	// files extracted and chunked at once; zero means runtime.NumCPU()
+	Concurrency int
+}
+
+// Section is a titled part of an extracted document, such as a heading, a
+// slide or a sheet. Start is the character offset in the text where it
+// begins; it runs until the next section.
+type Section struct {
+	Title string `json:"title"`
+	Start int    `json:"start"`
+}
+
+// PageStart is the character offset in the extracted text at which a page
+// begins. Page counts from 1.
+type PageStart struct {
+	Page  int `json:"page"`
+	Start int `json:"start"`
+}
+
+// Chunk is a piece of a source document that is embedded on its own.
+// Start and End are character offsets into the extracted text of Filename.
+// Section is the title of the section the chunk starts in, and Page the
+// number of the page, for formats that have them.
+type Chunk struct {
+	DocumentID string `json:"document_id"`
+	Filename   string `json:"filename"`
+	Index      int    `json:"chunk_index"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Section    string `json:"section,omitempty"`
+	Page       int    `json:"page,omitempty"`
+	Text       string `json:"text"`
+}
+
+// Embedding is the vector for a single chunk, carried together with the
+// chunk's provenance so the pairing can't drift.
+type Embedding struct {
+	Chunk
+	Vector []float64 `json:"vector"`
+}
+
+// Triple is a subject–predicate–object fact extracted from a chunk.
+type Triple struct {
+	Subject    string `json:"subject"`
+	Predicate  string `json:"predicate"`
+	Object     string `json:"object"`
+	DocumentID string `json:"document_id"`
+	Filename   string `json:"filename"`
+	ChunkIndex int    `json:"chunk_index"`
+}
 
 type BGEReq struct {
 	Text    []string `json:"text"`
@@ -12,4 +157,85 @@ type BGERes struct {
 	Result struct {
 		Data [][]float64 `json:"data"`
 	} `json:"result"`
+	Success bool                 `json:"success"`
+	Errors  []CloudflareAPIError `json:"errors,omitempty"`
+}
+
+// CloudflareAPIError is one entry of the "errors" array in a Cloudflare API
+// response envelope.
+type CloudflareAPIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// CloudflareError is returned when Workers AI answers with a non-2xx status or
+// a non-empty errors array. Body holds the raw response when it was not a
+// Cloudflare envelope.
+type CloudflareError struct {
+	StatusCode int
+	Errors     []CloudflareAPIError
+	Body       string
+}
+
+func (e *CloudflareError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, ce := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%d: %s", ce.Code, ce.Message))
+	}
+	if len(msgs) == 0 && e.Body != "" {
+		msgs = append(msgs, e.Body)
+	}
+	return fmt.Sprintf("cloudflare API error (status %d): %s", e.StatusCode, strings.Join(msgs, "; "))
+}
+
+// Retryable reports whether the request may succeed if sent again.
+func (e *CloudflareError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+type OpenAIEmbeddingReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type OpenAIEmbeddingRes struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+}
+
+type OllamaEmbedReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type OllamaEmbedRes struct {
+	Embeddings [][]float64 `json:"embeddings"`
+}
+
+type LLMMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type CloudflareLLMReq struct {
+	Messages []LLMMessage `json:"messages"`
+}
+
+type CloudflareLLMRes struct {
+	Result struct {
+		Response string `json:"response"`
+	} `json:"result"`
+}
+
+type OpenAIChatReq struct {
+	Model    string       `json:"model"`
+	Messages []LLMMessage `json:"messages"`
+}
+
+type OpenAIChatRes struct {
+	Choices []struct {
+		Message LLMMessage `json:"message"`
+	} `json:"choices"`
 }